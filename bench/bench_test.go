@@ -0,0 +1,201 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"m3u-stream-merger/handlers"
+	"m3u-stream-merger/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchChannels  = 50
+	benchReadBytes = 1024 * 1024
+)
+
+var (
+	setupOnce   sync.Once
+	proxyServer *httptest.Server
+	tsStreams   []string
+	hlsStreams  []string
+	httpClient  = &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: 1000},
+	}
+)
+
+func setup(b *testing.B) {
+	setupOnce.Do(func() {
+		log.SetOutput(io.Discard)
+
+		upstream := NewUpstream(benchChannels)
+		os.Setenv("M3U_URL_1", upstream.PlaylistURL())
+		os.Setenv("M3U_MAX_CONCURRENCY_1", "100000")
+
+		if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+			b.Fatalf("Downloader returned error: %v", err)
+		}
+
+		cm := store.NewConcurrencyManager()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/p/", func(w http.ResponseWriter, r *http.Request) {
+			handlers.StreamHandler(w, r, cm)
+		})
+		proxyServer = httptest.NewServer(mux)
+
+		for _, stream := range store.GetStreams() {
+			streamUrl := store.GenerateStreamURL(proxyServer.URL, stream)
+			if stream.Group == "HLS" {
+				hlsStreams = append(hlsStreams, streamUrl)
+			} else {
+				tsStreams = append(tsStreams, streamUrl)
+			}
+		}
+	})
+
+	if len(tsStreams) == 0 || len(hlsStreams) == 0 {
+		b.Fatal("no streams parsed from the synthetic upstream")
+	}
+}
+
+// fetch reads up to limit bytes from url and returns the time to first byte.
+func fetch(url string, limit int64) (time.Duration, int64, error) {
+	start := time.Now()
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, 32*1024)
+	n, err := resp.Body.Read(buf)
+	ttfb := time.Since(start)
+	if err != nil && err != io.EOF {
+		return ttfb, int64(n), err
+	}
+
+	rest, err := io.Copy(io.Discard, io.LimitReader(resp.Body, limit-int64(n)))
+	if err != nil {
+		return ttfb, int64(n) + rest, err
+	}
+
+	return ttfb, int64(n) + rest, nil
+}
+
+// runClients fetches every url concurrently, b.N times, and reports the
+// throughput and average time to first byte.
+func runClients(b *testing.B, urls []string, limit int64) {
+	b.ReportAllocs()
+
+	var mu sync.Mutex
+	var totalTtfb time.Duration
+	var totalBytes int64
+	var requests int
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, url := range urls {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+
+				ttfb, n, err := fetch(url, limit)
+				if err != nil {
+					b.Errorf("Error fetching %s: %v", url, err)
+					return
+				}
+
+				mu.Lock()
+				totalTtfb += ttfb
+				totalBytes += n
+				requests++
+				mu.Unlock()
+			}(url)
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	if requests > 0 {
+		b.ReportMetric(float64(totalTtfb.Microseconds())/1000/float64(requests), "ttfb-ms")
+		b.ReportMetric(float64(totalBytes)/1024/1024/b.Elapsed().Seconds(), "MiB/s")
+	}
+}
+
+func BenchmarkTSClientsOnOneChannel(b *testing.B) {
+	setup(b)
+
+	for _, clients := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			urls := make([]string, clients)
+			for i := range urls {
+				urls[i] = tsStreams[0]
+			}
+			runClients(b, urls, benchReadBytes)
+		})
+	}
+}
+
+// BenchmarkTSClientWriteBatching compares flushing every chunk to the clients
+// with batching them (CLIENT_WRITE_BATCH_KB) under fan-out.
+func BenchmarkTSClientWriteBatching(b *testing.B) {
+	setup(b)
+
+	for _, batchKb := range []string{"0", "64"} {
+		b.Run("batch_kb="+batchKb, func(b *testing.B) {
+			b.Setenv("CLIENT_WRITE_BATCH_KB", batchKb)
+
+			urls := make([]string, 50)
+			for i := range urls {
+				urls[i] = tsStreams[0]
+			}
+			runClients(b, urls, benchReadBytes)
+		})
+	}
+}
+
+func BenchmarkTSChannelsWithOneClient(b *testing.B) {
+	setup(b)
+
+	for _, channels := range []int{1, 10, benchChannels} {
+		b.Run(fmt.Sprintf("channels=%d", channels), func(b *testing.B) {
+			runClients(b, tsStreams[:channels], benchReadBytes)
+		})
+	}
+}
+
+func BenchmarkHLSPlaylist(b *testing.B) {
+	setup(b)
+
+	for _, clients := range []int{1, 10, 50} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			urls := make([]string, clients)
+			for i := range urls {
+				urls[i] = hlsStreams[i%len(hlsStreams)]
+			}
+
+			// Playlists are small, the limit only bounds a misbehaving proxy.
+			runClients(b, urls, 64*1024)
+		})
+	}
+}
+
+func BenchmarkPlaylistGeneration(b *testing.B) {
+	setup(b)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		content := store.RevalidatingGetM3U(httptest.NewRequest("GET", "/playlist.m3u", nil), true)
+		if !strings.HasPrefix(content, "#EXTM3U") {
+			b.Fatal("invalid playlist generated")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+const tsPacketSize = 188
+
+// Upstream is a synthetic IPTV provider serving a playlist with TS and HLS
+// variants of every channel. TS streams never end on their own; they are
+// written as fast as the client reads until the request is cancelled.
+type Upstream struct {
+	*httptest.Server
+	Channels int
+}
+
+func NewUpstream(channels int) *Upstream {
+	upstream := &Upstream{Channels: channels}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u", upstream.playlistHandler)
+	mux.HandleFunc("/live/ts/", upstream.tsHandler)
+	mux.HandleFunc("/live/hls/", upstream.hlsHandler)
+
+	upstream.Server = httptest.NewServer(mux)
+	return upstream
+}
+
+// PlaylistURL returns the URL to be used as M3U_URL_X.
+func (u *Upstream) PlaylistURL() string {
+	return u.URL + "/playlist.m3u"
+}
+
+func (u *Upstream) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	for i := 0; i < u.Channels; i++ {
+		fmt.Fprintf(&playlist, "#EXTINF:-1 tvg-id=\"ts%d\" group-title=\"TS\",TS Channel %d\n%s/live/ts/%d.ts\n", i, i, u.URL, i)
+		fmt.Fprintf(&playlist, "#EXTINF:-1 tvg-id=\"hls%d\" group-title=\"HLS\",HLS Channel %d\n%s/live/hls/%d.m3u8\n", i, i, u.URL, i)
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	_, _ = w.Write([]byte(playlist.String()))
+}
+
+func (u *Upstream) tsHandler(w http.ResponseWriter, r *http.Request) {
+	chunk := make([]byte, tsPacketSize*7)
+	for i := 0; i < len(chunk); i += tsPacketSize {
+		chunk[i] = 0x47
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func (u *Upstream) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ".ts") {
+		w.Header().Set("Content-Type", "video/mp2t")
+		_, _ = w.Write(make([]byte, tsPacketSize*100))
+		return
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n")
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(&playlist, "#EXTINF:2.000,\nseg%d.ts\n", i)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	_, _ = w.Write([]byte(playlist.String()))
+}
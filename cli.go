@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/updater"
+	"m3u-stream-merger/utils"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// command is a subcommand of the binary, e.g. `m3u-proxy sync`.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "[--check-config]", "run the proxy (default)", serve},
+		{"sync", "[-o file] [-base-url url]", "fetch the sources once and write the merged playlist", syncCommand},
+		{"validate", "<file|url|->", "parse a playlist and report its problems", validateCommand},
+		{"probe", "[-seconds n] <channel>", "run the load balancer for a channel once and print the result", probeCommand},
+		{"help", "", "show this help", func([]string) int {
+			printUsage(os.Stdout)
+			return 0
+		}},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-9s %-28s %s\n", cmd.name, cmd.args, cmd.summary)
+	}
+}
+
+// runCommand runs the command named by the first argument, or serve if the
+// first argument is a flag or missing, and returns the exit code.
+func runCommand(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	printUsage(os.Stderr)
+	return 2
+}
+
+// commandContext returns a context cancelled on SIGINT or SIGTERM, so a
+// command can be interrupted without leaving partial files behind.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// loadEnv reads the source configuration, reporting its errors. It returns
+// false if there are any.
+func loadEnv() bool {
+	envErrs := utils.LoadSourceEnv()
+	for _, err := range envErrs {
+		fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+	}
+	return len(envErrs) == 0
+}
+
+// syncCommand fetches the sources once, like a scheduled sync, and writes the
+// merged playlist to a file or stdout.
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	output := flags.String("o", "", "write the playlist to this file instead of stdout")
+	baseURL := flags.String("base-url", "", "base URL of the stream URLs (default PUBLIC_URL or BASE_URL)")
+	_ = flags.Parse(args)
+
+	if !loadEnv() {
+		return 1
+	}
+	if *baseURL == "" {
+		*baseURL = utils.DetermineBaseURL(nil)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	run := updater.SyncOnce(ctx)
+	for _, err := range run.Errors {
+		fmt.Fprintf(os.Stderr, "[ERROR] %s\n", err)
+	}
+	if run.Status == store.SyncCancelled || run.Status == store.SyncSkipped {
+		fmt.Fprintf(os.Stderr, "Sync %s.\n", run.Status)
+		return 1
+	}
+
+	if err := store.RegenerateM3U(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] building the playlist: %v\n", err)
+		return 1
+	}
+	playlist, err := store.OpenCachedM3U()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] opening the playlist: %v\n", err)
+		return 1
+	}
+	defer playlist.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			return 1
+		}
+	}
+	_, err = io.Copy(out, store.ResolveBaseURL(playlist.Reader(), *baseURL))
+	if *output != "" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[ERROR] writing the playlist: %v\n", err)
+		return 1
+	}
+
+	channels, _ := store.ChannelCount()
+	fmt.Fprintf(os.Stderr, "Synced %d channels from %d sources in %.1fs.\n", channels, len(run.Sources), time.Since(run.Start).Seconds())
+	if run.Status != store.SyncCompleted {
+		return 1
+	}
+	return 0
+}
+
+// validateCommand lints a playlist file, URL or stdin (-) and prints its
+// problems by line. It fails if there is any error.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: validate <file|url|->")
+		return 2
+	}
+
+	source := flags.Arg(0)
+	var input io.Reader
+	switch {
+	case source == "-":
+		input = os.Stdin
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		resp, err := utils.CustomHttpRequest("GET", source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %s\n", utils.RedactURLs(err.Error()))
+			return 1
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			fmt.Fprintf(os.Stderr, "[ERROR] status %d\n", resp.StatusCode)
+			return 1
+		}
+		input = resp.Body
+	default:
+		file, err := os.Open(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR] %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	entries, issues := updater.LintPlaylist(input)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("%d entries, %d issues.\n", entries, len(issues))
+	if updater.HasConfigErrors(issues) {
+		return 1
+	}
+	return 0
+}
+
+// probeCommand runs the load balancer for a channel of the last sync like
+// for a client, reads the stream for a few seconds and prints the upstreams
+// tried as JSON. It fails if the channel could not be streamed.
+func probeCommand(args []string) int {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	seconds := flags.Int("seconds", 5, "how long to read the stream")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 || *seconds <= 0 {
+		fmt.Fprintln(os.Stderr, "Usage: probe [-seconds n] <channel>")
+		return 2
+	}
+
+	if !loadEnv() {
+		return 1
+	}
+
+	channel := flags.Arg(0)
+	info, err := store.GetStreamBySlug(channel)
+	if err != nil || len(info.URLs) == 0 {
+		var ok bool
+		if info, ok = store.GetStreamByTitle(channel); !ok {
+			fmt.Fprintf(os.Stderr, "[ERROR] channel %s not found, run the sync command first\n", channel)
+			return 1
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	stream := &proxy.StreamInstance{Info: info, Cm: store.NewConcurrencyManager()}
+	session := store.Session{ID: "probe", CreatedAt: time.Now()}
+	report := stream.SelfTest(ctx, &session, time.Duration(*seconds)*time.Second)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -4,12 +4,11 @@ go 1.23.0
 
 require (
 	github.com/edsrzf/mmap-go v1.2.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/goccy/go-json v0.10.4
 	github.com/klauspost/compress v1.17.11
 	github.com/robfig/cron/v3 v3.0.1
+	go.etcd.io/bbolt v1.3.11
 )
 
-require (
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-)
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checkAdmin restricts an endpoint to clients sending ADMIN_TOKEN as bearer
+// token. Such endpoints are unavailable until ADMIN_TOKEN is set. It returns
+// true if the response has been written.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	if token == "" {
+		http.Error(w, "Set ADMIN_TOKEN to enable this endpoint", http.StatusForbidden)
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	given, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(given)), []byte(token)) != 1 {
+		utils.SafeLogf("Unauthorized request from %s for %s\n", r.RemoteAddr, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="m3u-stream-merger-proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func CatchupHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
+	utils.SafeLogf("Received catchup request from %s for URL: %s\n", r.RemoteAddr, r.URL.Path)
+
+	if handleCORS(w, r) || checkReferer(w, r) {
+		return
+	}
+
+	streamUrl := strings.Split(r.PathValue("slug"), ".")[0]
+
+	utc, err := strconv.ParseInt(r.URL.Query().Get("utc"), 10, 64)
+	if err != nil {
+		streamError(w, http.StatusBadRequest, "invalid or missing utc parameter")
+		return
+	}
+	start := time.Unix(utc, 0)
+
+	duration := time.Since(start)
+	if durationSecond, err := strconv.ParseInt(r.URL.Query().Get("duration"), 10, 64); err == nil && durationSecond > 0 {
+		duration = time.Duration(durationSecond) * time.Second
+	}
+
+	stream, err := proxy.NewStreamInstance(streamUrl, cm)
+	if err != nil {
+		utils.SafeLogf("Error retrieving stream for slug %s: %v\n", streamUrl, err)
+		streamError(w, http.StatusNotFound, "unknown stream")
+		return
+	}
+
+	catchup, err := stream.CatchupInstance(start, duration)
+	if err != nil {
+		utils.SafeLogf("Error building catchup stream for slug %s: %v\n", streamUrl, err)
+		streamError(w, http.StatusNotFound, "no source of the stream supports catchup")
+		return
+	}
+
+	proxyStream(w, r, catchup, streamUrl)
+}
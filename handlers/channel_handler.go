@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/goccy/go-json"
+)
+
+type channelSourceRequest struct {
+	Source string `json:"source"`
+}
+
+func decodeChannelSourceRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req channelSourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+
+	if !slices.Contains(utils.GetM3UIndexes(), req.Source) {
+		http.Error(w, "Unknown source: "+req.Source, http.StatusBadRequest)
+		return "", false
+	}
+
+	return req.Source, true
+}
+
+func writeChannelPin(w http.ResponseWriter, title string) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(store.GetChannelPin(title))
+}
+
+func ChannelPinSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	title := r.PathValue("id")
+
+	source := ""
+	if r.Method != http.MethodDelete {
+		var ok bool
+		source, ok = decodeChannelSourceRequest(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	if err := store.PinChannelSource(title, source); err != nil {
+		utils.SafeLogf("Error saving channel pin for %s: %v\n", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SafeLogf("Channel %s pinned to source: %s\n", title, source)
+	writeChannelPin(w, title)
+}
+
+func ChannelPreferSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	title := r.PathValue("id")
+
+	source := ""
+	if r.Method != http.MethodDelete {
+		var ok bool
+		source, ok = decodeChannelSourceRequest(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	if err := store.PreferChannelSource(title, source); err != nil {
+		utils.SafeLogf("Error saving channel preference for %s: %v\n", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SafeLogf("Channel %s preferred source set to: %s\n", title, source)
+	writeChannelPin(w, title)
+}
+
+// ChannelQualityHandler returns the qualities recorded for the source entries
+// of the channel by QUALITY_PROBE, or forgets them on DELETE.
+func ChannelQualityHandler(w http.ResponseWriter, r *http.Request) {
+	title := r.PathValue("id")
+
+	if r.Method == http.MethodDelete {
+		if checkAdmin(w, r) {
+			return
+		}
+		if err := proxy.ForgetChannelQuality(title); err != nil {
+			utils.SafeLogf("Error forgetting the quality of %s: %v\n", title, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		utils.SafeLogf("Forgot the recorded quality of channel %s\n", title)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(store.GetChannelQuality(title))
+}
+
+func ChannelExcludeSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	title := r.PathValue("id")
+
+	source, ok := decodeChannelSourceRequest(w, r)
+	if !ok {
+		return
+	}
+
+	exclude := r.Method != http.MethodDelete
+	if err := store.ExcludeChannelSource(title, source, exclude); err != nil {
+		utils.SafeLogf("Error saving channel exclusion for %s: %v\n", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SafeLogf("Channel %s exclusion of source %s set to %t\n", title, source, exclude)
+	writeChannelPin(w, title)
+}
+
+// pageParams returns the offset and limit query parameters of a listing,
+// answering with 400 if they are invalid.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	query := r.URL.Query()
+
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if query.Has("offset") && (err != nil || offset < 0) {
+		http.Error(w, "Invalid offset: "+query.Get("offset"), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if query.Has("limit") && (err != nil || limit < 0) {
+		http.Error(w, "Invalid limit: "+query.Get("limit"), http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	return offset, limit, true
+}
+
+func ChannelsQueryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	offset, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	channels, err := store.QueryChannels(store.ChannelQuery{
+		Title:  query.Get("title"),
+		TvgID:  query.Get("tvg-id"),
+		Group:  query.Get("group"),
+		Source: query.Get("source"),
+		Offset: offset,
+		Limit:  limit,
+	})
+	if err != nil {
+		utils.SafeLogf("Error querying channels: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(channels)
+}
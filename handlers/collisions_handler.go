@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+
+	"github.com/goccy/go-json"
+)
+
+func SlugCollisionsHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(store.GetSlugCollisions())
+	if err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
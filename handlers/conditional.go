@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkNotModified sets the ETag and Last-Modified headers and replies with
+// 304 Not Modified if the client already has this version. It returns true if
+// the response has been written.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+				notModified = true
+				break
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modTime.Truncate(time.Second).After(t) {
+			notModified = true
+		}
+	}
+
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+var contentVersions = struct {
+	sync.Mutex
+	versions map[string]contentVersion
+}{versions: make(map[string]contentVersion)}
+
+type contentVersion struct {
+	etag    string
+	modTime time.Time
+}
+
+// contentETag returns the ETag of a generated response body and the time that
+// version of the body was first served, for endpoints without a backing file.
+func contentETag(name string, content []byte) (string, time.Time) {
+	hash := fnv.New64a()
+	_, _ = hash.Write(content)
+	etag := fmt.Sprintf("\"%x-%x\"", hash.Sum64(), len(content))
+
+	contentVersions.Lock()
+	defer contentVersions.Unlock()
+
+	version, ok := contentVersions.versions[name]
+	if !ok || version.etag != etag {
+		version = contentVersion{etag: etag, modTime: time.Now()}
+		contentVersions.versions[name] = version
+	}
+
+	return version.etag, version.modTime
+}
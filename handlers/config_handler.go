@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"m3u-stream-merger/updater"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+
+	"github.com/goccy/go-json"
+)
+
+type configValidation struct {
+	Valid  bool                  `json:"valid"`
+	Issues []updater.ConfigIssue `json:"issues"`
+}
+
+func ConfigValidateHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if checkAdmin(w, r) {
+		return
+	}
+
+	// Fetching every source is opt-in.
+	issues := updater.ValidateConfig(r.URL.Query().Get("probe") == "true")
+	if issues == nil {
+		issues = []updater.ConfigIssue{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(configValidation{
+		Valid:  !updater.HasConfigErrors(issues),
+		Issues: issues,
+	})
+	if err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
+
+// ConfigHandler returns the effective configuration, with secrets redacted,
+// for bug reports.
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if checkAdmin(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(updater.GetEffectiveConfig())
+	if err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
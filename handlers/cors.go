@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"m3u-stream-merger/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// envList returns the comma-separated values of an env, or fallback if it is
+// not set.
+func envList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return fallback
+	}
+
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// matchHostPattern reports whether value matches one of the patterns, which
+// may use * wildcards (e.g. https://*.example.com).
+func matchHostPattern(patterns []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+		if pattern == "*" || pattern == value {
+			return true
+		}
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCORS sets the CORS headers of the response following the
+// CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS envs
+// and answers preflight requests. It returns true if the response has been
+// written.
+func handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origins := envList("CORS_ALLOWED_ORIGINS", []string{"*"})
+	origin := r.Header.Get("Origin")
+
+	allowed := false
+	switch {
+	case len(origins) == 1 && origins[0] == "*":
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		allowed = true
+	case origin != "" && matchHostPattern(origins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		allowed = true
+	default:
+		w.Header().Add("Vary", "Origin")
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	if !allowed {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return true
+	}
+
+	methods := envList("CORS_ALLOWED_METHODS", []string{"GET", "HEAD", "OPTIONS"})
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	headers := envList("CORS_ALLOWED_HEADERS", nil)
+	if headers == nil {
+		// Without a configured list, the headers the client asks for are
+		// allowed.
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+	} else {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkReferer rejects stream requests embedded by sites missing from
+// STREAM_ALLOWED_REFERERS. Requests without a Referer or Origin, as sent by
+// IPTV players, are always allowed. It returns true if the response has been
+// written.
+func checkReferer(w http.ResponseWriter, r *http.Request) bool {
+	hosts := envList("STREAM_ALLOWED_REFERERS", nil)
+	if len(hosts) == 0 {
+		return false
+	}
+
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		referer = r.Header.Get("Origin")
+	}
+	if referer == "" {
+		return false
+	}
+
+	u, err := url.Parse(referer)
+	if err == nil && u.Hostname() != "" && matchHostPattern(hosts, u.Hostname()) {
+		return false
+	}
+
+	utils.SafeLogf("Rejected stream request from %s with referer %s\n", r.RemoteAddr, referer)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// regeneratePlaylist adds (or drops) the custom channels to the playlist in
+// the background.
+func regeneratePlaylist() {
+	go func() {
+		if err := store.RegenerateM3U(context.Background()); err != nil {
+			utils.SafeLogf("Error regenerating playlist: %v\n", err)
+		}
+	}()
+}
+
+// checkStreamURL returns an error if value is not a URL the proxy may stream
+// from when added through the API. The host has to be listed in
+// API_ALLOWED_STREAM_HOSTS if set. Otherwise any host is allowed but the
+// loopback and link-local ones (e.g. cloud metadata endpoints), so the API
+// can't be used to reach services of the proxy host.
+func checkStreamURL(value string) error {
+	streamURL, err := url.Parse(value)
+	if err != nil || (streamURL.Scheme != "http" && streamURL.Scheme != "https") || streamURL.Hostname() == "" {
+		return fmt.Errorf("not an http(s) URL")
+	}
+	host := streamURL.Hostname()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("can't resolve %s", host)
+	}
+
+	if allowed := envList("API_ALLOWED_STREAM_HOSTS", nil); len(allowed) > 0 {
+		for _, entry := range allowed {
+			if strings.EqualFold(entry, host) || hostAddrsIn(addrs, entry) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not in API_ALLOWED_STREAM_HOSTS", host)
+	}
+
+	for _, addr := range addrs {
+		ip := addr.IP
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+			return fmt.Errorf("%s is a loopback or link-local address", host)
+		}
+	}
+	return nil
+}
+
+// hostAddrsIn reports whether all the addresses of a host are the address or
+// in the CIDR range entry.
+func hostAddrsIn(addrs []net.IPAddr, entry string) bool {
+	for _, addr := range addrs {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if !network.Contains(addr.IP) {
+				return false
+			}
+		} else if entryAddr := net.ParseIP(entry); entryAddr == nil || !entryAddr.Equal(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// CustomChannelAddHandler injects a channel (title, group, url and logo) into
+// the playlist without a source file for it, e.g. a local camera. It persists
+// across restarts and syncs.
+func CustomChannelAddHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	var channel store.CustomChannel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	channel.Title = strings.TrimSpace(channel.Title)
+	channel.Group = strings.TrimSpace(channel.Group)
+	channel.URL = strings.TrimSpace(channel.URL)
+	channel.LogoURL = strings.TrimSpace(channel.LogoURL)
+	if channel.Title == "" {
+		http.Error(w, "Missing title", http.StatusBadRequest)
+		return
+	}
+	if err := checkStreamURL(channel.URL); err != nil {
+		http.Error(w, "Invalid url: "+channel.URL+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.AddCustomChannel(channel); err != nil {
+		utils.SafeLogf("Error saving custom channel %s: %v\n", channel.Title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SafeLogf("Custom channel %s added\n", channel.Title)
+	regeneratePlaylist()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(channel)
+}
+
+// CustomChannelRemoveHandler drops a channel injected with
+// CustomChannelAddHandler.
+func CustomChannelRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	title := r.PathValue("id")
+
+	removed, err := store.RemoveCustomChannel(title)
+	if err != nil {
+		utils.SafeLogf("Error removing custom channel %s: %v\n", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.NotFound(w, r)
+		return
+	}
+
+	utils.SafeLogf("Custom channel %s removed\n", title)
+	regeneratePlaylist()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+
+	"github.com/goccy/go-json"
+)
+
+// GroupsHandler lists the groups of the playlist with their number of
+// channels, so clients can browse a large playlist a group at a time with
+// /playlist.m3u?group=.
+func GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if handleCORS(w, r) {
+		return
+	}
+
+	playlist, err := store.OpenCachedM3U()
+	if err != nil {
+		utils.SafeLogf("Error opening playlist: %v\n", err)
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer playlist.Close()
+
+	groups, err := playlist.Groups()
+	if err != nil {
+		utils.SafeLogf("Error listing playlist groups: %v\n", err)
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
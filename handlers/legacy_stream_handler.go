@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// LegacyStreamHandler serves the /stream/{id}.{ext} URLs of older versions,
+// which clients configured before upgrading may still use. Following
+// LEGACY_STREAM_PATHS, they are redirected to the current /p/ URL of the
+// stream ("redirect", the default), served as if requested from it
+// ("rewrite") or not served at all ("off").
+func LegacyStreamHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("LEGACY_STREAM_PATHS")))
+	switch mode {
+	case "off", "false":
+		http.NotFound(w, r)
+		return
+	case "rewrite":
+		StreamHandler(w, r, cm)
+		return
+	}
+
+	if handleCORS(w, r) || checkReferer(w, r) {
+		return
+	}
+
+	id := strings.Split(path.Base(r.URL.Path), ".")[0]
+	stream, err := store.GetStreamBySlug(id)
+	if err != nil || len(stream.URLs) == 0 {
+		utils.SafeLogf("Unknown legacy stream requested by %s: %s\n", r.RemoteAddr, r.URL.Path)
+		streamError(w, http.StatusNotFound, "unknown stream")
+		return
+	}
+
+	target := store.GenerateStreamURL(utils.DetermineBaseURL(r), stream)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+
+	"github.com/goccy/go-json"
+)
+
+// VODHandler lists the movies and series of the provider playlists, so
+// frontends can render a library instead of the flat playlist.
+func VODHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	mediaType := query.Get("type")
+	if mediaType != "" && mediaType != store.MediaMovie && mediaType != store.MediaSeries {
+		http.Error(w, "Invalid type: "+mediaType, http.StatusBadRequest)
+		return
+	}
+	offset, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := store.QueryLibrary(store.LibraryQuery{
+		Type:   mediaType,
+		Group:  query.Get("group"),
+		Title:  query.Get("title"),
+		Offset: offset,
+		Limit:  limit,
+	}, utils.DetermineBaseURL(r))
+	if err != nil {
+		utils.SafeLogf("Error querying the VOD library: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(items)
+}
+
+// SeriesEpisodesHandler lists the episodes of a series of the VOD library.
+func SeriesEpisodesHandler(w http.ResponseWriter, r *http.Request) {
+	episodes, ok, err := store.SeriesEpisodes(r.PathValue("id"), utils.DetermineBaseURL(r))
+	if err != nil {
+		utils.SafeLogf("Error reading the episodes of series %s: %v\n", r.PathValue("id"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(episodes)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+)
+
+func LineupM3UHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	w.Header().Set("Content-Type", "text/plain")
+	if handleCORS(w, r) || checkPlaylistRateLimit(w, r) {
+		return
+	}
+
+	baseURL := utils.DetermineBaseURL(r)
+	content := []byte(store.GenerateLineupM3U(baseURL))
+
+	etag, modTime := contentETag("lineup.m3u|"+baseURL, content)
+	if checkNotModified(w, r, etag, modTime) {
+		return
+	}
+
+	_, err := w.Write(content)
+	if err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+		}
+	}
+}
+
+func XMLTVHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	w.Header().Set("Content-Type", "application/xml")
+	if handleCORS(w, r) {
+		return
+	}
+
+	var content bytes.Buffer
+	if err := store.GenerateXMLTV(&content); err != nil {
+		utils.SafeLogf("Error generating XMLTV: %v\n", err)
+		http.Error(w, "XMLTV not available", http.StatusInternalServerError)
+		return
+	}
+
+	etag, modTime := contentETag("xmltv.xml", content.Bytes())
+	if checkNotModified(w, r, etag, modTime) {
+		return
+	}
+
+	_, err := w.Write(content.Bytes())
+	if err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// LocalPlaylistHandler serves the local playlist as it is stored, with the
+// stream URLs of its entries.
+func LocalPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if handleCORS(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	file, err := os.Open(store.LocalPlaylistPath)
+	if errors.Is(err, os.ErrNotExist) {
+		http.ServeContent(w, r, "local.m3u", time.Time{}, bytes.NewReader([]byte("#EXTM3U\n")))
+		return
+	}
+	if err != nil {
+		utils.SafeLogf("Error opening the local playlist: %v\n", err)
+		http.Error(w, "Local playlist not available", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		utils.SafeLogf("Error opening the local playlist: %v\n", err)
+		http.Error(w, "Local playlist not available", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, "local.m3u", info.ModTime(), file)
+}
+
+// LocalEntryAddHandler appends an entry (title, group, url, logo and tvg_id)
+// to the local playlist.
+func LocalEntryAddHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	var entry store.LocalEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, field := range []*string{&entry.Title, &entry.Group, &entry.URL, &entry.LogoURL, &entry.TvgID} {
+		*field = strings.TrimSpace(*field)
+		if strings.ContainsAny(*field, "\r\n") {
+			http.Error(w, "Invalid line break in: "+*field, http.StatusBadRequest)
+			return
+		}
+	}
+	if entry.Title == "" {
+		http.Error(w, "Missing title", http.StatusBadRequest)
+		return
+	}
+	if err := checkStreamURL(entry.URL); err != nil {
+		http.Error(w, "Invalid url: "+entry.URL+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.AddLocalEntry(entry); err != nil {
+		utils.SafeLogf("Error adding %s to the local playlist: %v\n", entry.Title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	utils.SafeLogf("Added %s to the local playlist\n", entry.Title)
+	regeneratePlaylist()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// LocalEntryRemoveHandler drops the entries of a channel from the local
+// playlist.
+func LocalEntryRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	title := r.PathValue("title")
+
+	removed, err := store.RemoveLocalEntries(title)
+	if err != nil {
+		utils.SafeLogf("Error removing %s from the local playlist: %v\n", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if removed == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	utils.SafeLogf("Removed %d entries of %s from the local playlist\n", removed, title)
+	regeneratePlaylist()
+
+	w.WriteHeader(http.StatusNoContent)
+}
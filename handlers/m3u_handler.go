@@ -1,20 +1,188 @@
 package handlers
 
 import (
+	"fmt"
+	"hash/fnv"
+	"io"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/utils"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
 )
 
 func M3UHandler(w http.ResponseWriter, r *http.Request) {
 	debug := os.Getenv("DEBUG") == "true"
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if handleCORS(w, r) || checkPlaylistRateLimit(w, r) {
+		return
+	}
+
+	// Frontends asking for JSON get the progress of the first sync instead of
+	// waiting for the playlist to be generated.
+	if acceptsJSON(r) && !store.HasCachedM3U() {
+		if progress, ok := store.GetSyncProgress(); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(progress)
+			return
+		}
+	}
+
+	playlist, err := store.OpenCachedM3U()
+	if err != nil {
+		utils.SafeLogf("Error opening playlist: %v\n", err)
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+	defer playlist.Close()
+
+	// ?offset= and ?limit= serve a page of the playlist, for clients that
+	// can't handle the whole of a large playlist.
+	offset, limit, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	paged := r.URL.Query().Has("offset") || r.URL.Query().Has("limit")
+
+	// ?sources=1,3 generates a playlist restricted to the given sources,
+	// bypassing the cached playlist.
+	if r.URL.Query().Has("sources") {
+		if paged {
+			http.Error(w, "offset and limit are not supported with sources", http.StatusBadRequest)
+			return
+		}
+		sourcesM3UHandler(w, r)
+		return
+	}
+
+	// ?variants=all lists the quality variants of the channels as their own
+	// entries, bypassing the cached playlist.
+	if r.URL.Query().Get("variants") == "all" {
+		if paged {
+			http.Error(w, "offset and limit are not supported with variants", http.StatusBadRequest)
+			return
+		}
+		variantsM3UHandler(w, r)
+		return
+	}
+
+	// The cached playlist holds relative proxy URLs, the base URL of the
+	// request is inserted while serving it.
+	baseURL := utils.DetermineBaseURL(r)
+
+	content := playlist.Reader()
+	groups := r.URL.Query()["group"]
+	switch {
+	case paged:
+		var total int
+		content, total, err = playlist.PageReader(groups, offset, limit)
+		if err == nil {
+			w.Header().Set("X-Total-Count", strconv.Itoa(total))
+			w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
+		}
+	case len(groups) > 0:
+		content, err = playlist.GroupReader(groups)
+	}
+	if err != nil {
+		utils.SafeLogf("Error filtering playlist: %v\n", err)
+		http.Error(w, "Playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(baseURL))
+	for _, group := range groups {
+		_, _ = hash.Write([]byte("\n" + group))
+	}
+	if paged {
+		_, _ = fmt.Fprintf(hash, "\n%d-%d", offset, limit)
+	}
+	etag := fmt.Sprintf("%s-%x\"", strings.TrimSuffix(playlist.ETag(), "\""), hash.Sum32())
+
+	if checkNotModified(w, r, etag, playlist.ModTime) {
+		return
+	}
+	if size, ok := playlist.ResolvedSize(baseURL); ok && len(groups) == 0 && !paged {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	_, err = io.Copy(w, store.ResolveBaseURL(content, baseURL))
+	if err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+		}
+	}
+}
+
+// acceptsJSON reports whether the Accept header of the request lists JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(value, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "application/json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func variantsM3UHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if os.Getenv("QUALITY_VARIANTS") != "true" {
+		http.Error(w, "QUALITY_VARIANTS is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	baseURL := utils.DetermineBaseURL(r)
+	content := []byte(store.GenerateVariantsM3U(baseURL, r.URL.Query()["group"]))
+
+	etag, modTime := contentETag("playlist.m3u|variants|"+baseURL+"|"+strings.Join(r.URL.Query()["group"], ","), content)
+	if checkNotModified(w, r, etag, modTime) {
+		return
+	}
+
+	_, err := w.Write(content)
+	if err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+		}
+	}
+}
+
+func sourcesM3UHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	sources := store.ParseSources(r.URL.Query().Get("sources"))
+	if len(sources) == 0 {
+		http.Error(w, "No source given", http.StatusBadRequest)
+		return
+	}
+	for _, index := range sources {
+		if !slices.Contains(utils.GetM3UIndexes(), index) {
+			http.Error(w, "Unknown source: "+index, http.StatusBadRequest)
+			return
+		}
+	}
+
+	baseURL := utils.DetermineBaseURL(r)
+	content := []byte(store.GenerateSourcesM3U(baseURL, sources, r.URL.Query()["group"]))
+
+	etag, modTime := contentETag("playlist.m3u|"+baseURL+"|"+strings.Join(sources, ",")+"|"+strings.Join(r.URL.Query()["group"], ","), content)
+	if checkNotModified(w, r, etag, modTime) {
+		return
+	}
 
-	content := store.RevalidatingGetM3U(r, false)
-	_, err := w.Write([]byte(content))
+	_, err := w.Write(content)
 	if err != nil {
 		if debug {
 			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
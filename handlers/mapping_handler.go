@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/goccy/go-json"
+)
+
+func MappingExportHandler(w http.ResponseWriter, r *http.Request) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if checkAdmin(w, r) {
+		return
+	}
+
+	mappings, err := store.ExportChannelMappings()
+	if err != nil {
+		utils.SafeLogf("Error exporting channel mapping: %v\n", err)
+		http.Error(w, "Error reading channels", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"mapping.csv\"")
+		err = store.WriteChannelMappingsCSV(w, mappings)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(mappings)
+	}
+
+	if err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
+
+func MappingImportHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	var mappings []store.ChannelMapping
+	var err error
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		mappings, err = store.ReadChannelMappingsCSV(r.Body)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&mappings)
+	}
+	if err != nil {
+		http.Error(w, "Invalid mapping: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := store.ImportChannelMappings(mappings); err != nil {
+		utils.SafeLogf("Error importing channel mapping: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	utils.SafeLogf("Imported %d channel mapping entries. Changes will apply on the next sync.\n", len(mappings))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"m3u-stream-merger/utils"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// playlistBucket is the token bucket of a client of the playlist.
+type playlistBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var playlistBuckets = struct {
+	sync.Mutex
+	clients   map[string]*playlistBucket
+	lastPrune time.Time
+}{clients: make(map[string]*playlistBucket)}
+
+// playlistRateLimit returns the playlist requests per minute allowed per
+// client (PLAYLIST_RATE_LIMIT) and how many may be made at once
+// (PLAYLIST_RATE_BURST). The limit is 0 if it is disabled.
+func playlistRateLimit() (float64, float64) {
+	limit, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv("PLAYLIST_RATE_LIMIT")), 64)
+	if err != nil || limit <= 0 {
+		return 0, 0
+	}
+
+	burst, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv("PLAYLIST_RATE_BURST")), 64)
+	if err != nil || burst < 1 {
+		burst = math.Max(1, math.Ceil(limit))
+	}
+	return limit, burst
+}
+
+// isRateLimitExempt reports whether ip is in PLAYLIST_RATE_LIMIT_EXEMPT, a
+// comma-separated list of addresses and CIDR ranges.
+func isRateLimitExempt(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, exempt := range envList("PLAYLIST_RATE_LIMIT_EXEMPT", nil) {
+		if _, network, err := net.ParseCIDR(exempt); err == nil {
+			if addr != nil && network.Contains(addr) {
+				return true
+			}
+		} else if exemptAddr := net.ParseIP(exempt); exemptAddr != nil && exemptAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlaylistRateLimit answers 429 to clients requesting the playlist more
+// often than PLAYLIST_RATE_LIMIT allows, as some players request it every
+// few seconds. It returns true if the response has been written.
+func checkPlaylistRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	limit, burst := playlistRateLimit()
+	if limit == 0 {
+		return false
+	}
+
+	ip := utils.ClientIP(r)
+	if isRateLimitExempt(ip) {
+		return false
+	}
+
+	perSecond := limit / 60
+	now := time.Now()
+
+	playlistBuckets.Lock()
+	defer playlistBuckets.Unlock()
+
+	// Buckets refilled since are the same as new ones.
+	if now.Sub(playlistBuckets.lastPrune) > time.Minute {
+		for client, bucket := range playlistBuckets.clients {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond >= burst {
+				delete(playlistBuckets.clients, client)
+			}
+		}
+		playlistBuckets.lastPrune = now
+	}
+
+	bucket, ok := playlistBuckets.clients[ip]
+	if !ok {
+		bucket = &playlistBucket{tokens: burst, last: now}
+		playlistBuckets.clients[ip] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return false
+	}
+
+	retryAfter := math.Ceil((1 - bucket.tokens) / perSecond)
+	utils.SafeLogf("Rate limited playlist request from %s\n", ip)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return true
+}
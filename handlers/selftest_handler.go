@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	defaultSelfTestSeconds = 5
+	maxSelfTestSeconds     = 30
+)
+
+// SelfTestHandler runs a full proxy round trip for the channel given by its
+// stream ID (as in its /p/ URL) or title, and returns the timings of every
+// upstream tried, like a client playing it for a few seconds would see them.
+func SelfTestHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if handleCORS(w, r) {
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	info, err := store.GetStreamBySlug(channel)
+	if err != nil || len(info.URLs) == 0 {
+		var ok bool
+		if info, ok = store.GetStreamByTitle(channel); !ok {
+			streamError(w, http.StatusNotFound, "unknown stream")
+			return
+		}
+	}
+
+	seconds, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = defaultSelfTestSeconds
+	}
+	seconds = min(seconds, maxSelfTestSeconds)
+
+	// A session of its own, so the sources tried by the player of the
+	// client are tried again.
+	stream := &proxy.StreamInstance{Info: info, Cm: cm}
+	session := store.Session{ID: "selftest", CreatedAt: time.Now()}
+
+	utils.SafeLogf("Running self-test of %s for %s\n", info.Title, r.RemoteAddr)
+	report := stream.SelfTest(r.Context(), &session, time.Duration(seconds)*time.Second)
+	utils.SafeLogf("Self-test of %s finished: ok=%t source=%s error=%q\n", info.Title, report.OK, report.Source, report.Error)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(report); err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"os"
+)
+
+// SnapshotHandler returns a JPEG frame of the channel with the given title,
+// e.g. for dashboards to show thumbnails and check a channel has picture.
+func SnapshotHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	if handleCORS(w, r) {
+		return
+	}
+
+	title := r.PathValue("id")
+	info, ok := store.GetStreamByTitle(title)
+	if !ok {
+		streamError(w, http.StatusNotFound, "unknown stream")
+		return
+	}
+
+	stream := &proxy.StreamInstance{Info: info, Cm: cm}
+	session := store.GetOrCreateSession(r)
+
+	utils.SafeLogf("Taking snapshot of %s for %s\n", title, r.RemoteAddr)
+	frame, err := stream.Snapshot(r.Context(), &session)
+	switch {
+	case errors.Is(err, proxy.ErrFFmpegUnavailable):
+		utils.SafeLogf("Error taking snapshot of %s: %v\n", title, err)
+		streamError(w, http.StatusNotImplemented, "ffmpeg is not available")
+		return
+	case errors.Is(err, proxy.ErrNoPicture):
+		utils.SafeLogf("Error taking snapshot of %s: %v\n", title, err)
+		streamError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		utils.SafeLogf("Error taking snapshot of %s: %v\n", title, err)
+		streamStatusError(w, proxy.LoadBalancerStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(frame); err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error writing http response: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"slices"
+
+	"github.com/goccy/go-json"
+)
+
+type sourceState struct {
+	Source   string `json:"source"`
+	Disabled bool   `json:"disabled"`
+}
+
+// SourceDisableHandler puts a source in maintenance mode (POST) or takes it
+// out of it (DELETE).
+func SourceDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	source := r.PathValue("idx")
+	if !slices.Contains(utils.GetM3UIndexes(), source) {
+		http.Error(w, "Unknown source: "+source, http.StatusNotFound)
+		return
+	}
+
+	disabled := r.Method != http.MethodDelete
+	if err := store.SetSourceDisabled(source, disabled); err != nil {
+		utils.SafeLogf("Error saving disabled state of M3U_%s: %v\n", source, err)
+		if errors.Is(err, store.ErrSourceDisabledByConfig) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	utils.SafeLogf("Source M3U_%s disabled set to %t\n", source, disabled)
+
+	// Channels only available from the source are dropped from (or restored
+	// to) the playlist.
+	go func() {
+		if err := store.RegenerateM3U(context.Background()); err != nil {
+			utils.SafeLogf("Error regenerating playlist: %v\n", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sourceState{Source: source, Disabled: store.IsSourceDisabled(source)})
+}
+
+type sourceConcurrency struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+// SourceConcurrencyResetHandler resets the concurrency count of a source to
+// the streams actually open from it, e.g. when a drifted count blocks a slot.
+func SourceConcurrencyResetHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
+	if checkAdmin(w, r) {
+		return
+	}
+
+	source := r.PathValue("idx")
+	if !slices.Contains(utils.GetM3UIndexes(), source) {
+		http.Error(w, "Unknown source: "+source, http.StatusNotFound)
+		return
+	}
+
+	before := cm.GetCount(source)
+	count := cm.Reset(source, proxy.OpenStreams())
+	utils.SafeLogf("Concurrency count of M3U_%s reset from %d to %d\n", source, before, count)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sourceConcurrency{Source: source, Count: count})
+}
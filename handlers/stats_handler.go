@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"m3u-stream-merger/proxy"
+	"net/http"
+
+	"github.com/goccy/go-json"
+)
+
+func BufferStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(proxy.Buffers.Stats())
+}
+
+func SourceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(proxy.Sources.Stats())
+}
+
+func RunningStreamsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(proxy.RunningStreams())
+}
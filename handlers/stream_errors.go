@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"encoding/json"
+	"m3u-stream-merger/proxy"
+	"net/http"
+	"strconv"
+)
+
+// streamRetryAfter is the Retry-After sent when every source of a stream is
+// at its concurrency limit.
+const streamRetryAfter = 10
+
+type streamErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// streamError replies to a stream request that failed before any of the
+// stream was sent, with a small JSON body describing the failure.
+func streamError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(streamErrorResponse{Error: message, Status: status})
+}
+
+// streamStatusError replies to a stream request that ended with status before
+// any of the stream was sent.
+func streamStatusError(w http.ResponseWriter, status proxy.StreamStatus) {
+	if status.Code == proxy.StatusConcurrencyLimited {
+		w.Header().Set("Retry-After", strconv.Itoa(streamRetryAfter))
+	}
+	message := status.Error()
+	if status.Err != nil {
+		message = status.Err.Error()
+	}
+	streamError(w, status.HTTPStatus(), message)
+}
@@ -2,43 +2,133 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"m3u-stream-merger/proxy"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/utils"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 )
 
 func StreamHandler(w http.ResponseWriter, r *http.Request, cm *store.ConcurrencyManager) {
-	debug := os.Getenv("DEBUG") == "true"
-
-	ctx := r.Context()
+	utils.SafeLogf("Received request %s from %s for URL: %s\n", utils.RequestID(r.Context()), r.RemoteAddr, r.URL.Path)
 
-	utils.SafeLogf("Received request from %s for URL: %s\n", r.RemoteAddr, r.URL.Path)
+	if handleCORS(w, r) || checkReferer(w, r) {
+		return
+	}
 
 	streamUrl := strings.Split(path.Base(r.URL.Path), ".")[0]
 	if streamUrl == "" {
 		utils.SafeLogf("Invalid m3uID for request from %s: %s\n", r.RemoteAddr, r.URL.Path)
-		http.NotFound(w, r)
+		streamError(w, http.StatusNotFound, "unknown stream")
 		return
 	}
 
 	stream, err := proxy.NewStreamInstance(strings.TrimPrefix(streamUrl, "/"), cm)
 	if err != nil {
 		utils.SafeLogf("Error retrieving stream for slug %s: %v\n", streamUrl, err)
-		http.NotFound(w, r)
+		streamError(w, http.StatusNotFound, "unknown stream")
 		return
 	}
 
+	proxyStream(w, r, stream, streamUrl)
+}
+
+// maxStreamRequestBody is the largest client request body passed on to the
+// upstream, e.g. for the session setup of some players.
+const maxStreamRequestBody = 1 << 20
+
+// proxyStream load balances the stream instance and proxies it to the
+// client, failing over to the other URLs until the stream ends.
+func proxyStream(w http.ResponseWriter, r *http.Request, stream *proxy.StreamInstance, streamUrl string) {
+	debug := os.Getenv("DEBUG") == "true"
+
+	ctx := r.Context()
+
+	var err error
 	var selectedIndex string
 	var selectedSubIndex string
 	var selectedUrl string
 
+	// ?source=2 forces a source and ?prefer=2 (or ?prefer=backup) tries it
+	// first, e.g. to troubleshoot a provider without changing the config.
+	stream.Source = r.URL.Query().Get("source")
+	stream.Prefer = r.URL.Query().Get("prefer")
+	if _, ok := stream.Info.URLs[stream.Source]; stream.Source != "" && !ok {
+		utils.SafeLogf("Source %s requested by %s is not available for %s\n", stream.Source, r.RemoteAddr, stream.Info.Title)
+		streamError(w, http.StatusNotFound, "source "+stream.Source+" is not available for this stream")
+		return
+	}
+	// The pins and exclusions of the channel still apply to a forced source.
+	if stream.Source != "" && !store.GetChannelPin(stream.Info.Title).IsSourceAllowed(stream.Source) {
+		utils.SafeLogf("Source %s requested by %s is excluded for %s\n", stream.Source, r.RemoteAddr, stream.Info.Title)
+		streamError(w, http.StatusForbidden, "source "+stream.Source+" is excluded for this stream")
+		return
+	}
+
+	// ?sources=1,3, set on the stream URLs of /playlist.m3u?sources=1,3,
+	// only balances across the given sources.
+	if r.URL.Query().Has("sources") {
+		urls := make(map[string]map[string]string)
+		for _, index := range store.ParseSources(r.URL.Query().Get("sources")) {
+			if innerMap, ok := stream.Info.URLs[index]; ok {
+				urls[index] = innerMap
+			}
+		}
+		if len(urls) == 0 {
+			utils.SafeLogf("None of the sources requested by %s is available for %s\n", r.RemoteAddr, stream.Info.Title)
+			streamError(w, http.StatusNotFound, "none of the requested sources is available for this stream")
+			return
+		}
+		stream.Info.URLs = urls
+	}
+
+	// ?quality=hd, set on the stream URLs of /playlist.m3u?variants=all,
+	// only balances across the entries of a quality variant.
+	if quality := r.URL.Query().Get("quality"); quality != "" {
+		urls := store.VariantURLs(stream.Info, quality)
+		if len(urls) == 0 {
+			utils.SafeLogf("Quality %s requested by %s is not available for %s\n", quality, r.RemoteAddr, stream.Info.Title)
+			streamError(w, http.StatusNotFound, "quality "+quality+" is not available for this stream")
+			return
+		}
+		stream.Info.URLs = urls
+	}
+
+	if err := stream.SetClientRequest(r, maxStreamRequestBody); err != nil {
+		utils.SafeLogf("Error reading request body from %s: %v\n", r.RemoteAddr, err)
+		if errors.Is(err, proxy.ErrRequestBodyTooLarge) {
+			streamError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		} else {
+			streamError(w, http.StatusBadRequest, "invalid request body")
+		}
+		return
+	}
+
 	session := store.GetOrCreateSession(r)
 	firstWrite := true
 
+	// ?profile=<name> passes the stream through a transcode profile of
+	// ffmpeg, e.g. ?profile=audio (or ?audio_only=1) for listening to a
+	// channel over mobile data. The stream is written to out.
+	profile := r.URL.Query().Get("profile")
+	if isTrueParam(r.URL.Query().Get("audio_only")) {
+		profile = "audio"
+	}
+	var transcodeArgs []string
+	if r.Method == http.MethodGet && profile != "" && !strings.EqualFold(profile, "passthrough") {
+		var ok bool
+		if transcodeArgs, ok = proxy.TranscodeProfile(profile); !ok {
+			streamError(w, http.StatusBadRequest, "unknown transcode profile: "+profile)
+			return
+		}
+	}
+	var out http.ResponseWriter = w
+	var progress *progressWriter
+
 	var resp *http.Response
 	defer func() {
 		if resp != nil && resp.Body != nil {
@@ -46,24 +136,105 @@ func StreamHandler(w http.ResponseWriter, r *http.Request, cm *store.Concurrency
 		}
 	}()
 
+	// An upstream ending the stream is reconnected to before failing over,
+	// e.g. for providers ending streams on token refreshes.
+	maxReconnects, err := strconv.Atoi(strings.TrimSpace(os.Getenv("STREAM_RECONNECT_ATTEMPTS")))
+	if err != nil || maxReconnects < 0 {
+		maxReconnects = 1
+	}
+	reconnects := 0
+	var reconnected *http.Response
+
+	// A client re-attaching after a network blip with the session token of
+	// its previous response goes straight back to the source it was
+	// streamed from, at the live edge, without probing the sources again.
+	resumeToken := r.Header.Get("X-Stream-Session")
+	if resumeToken == "" {
+		resumeToken = r.URL.Query().Get("session")
+	}
+	if index, subIndex, ok := store.ResumeSource(resumeToken, stream.Info.Title); ok {
+		if stream.Cm.CheckStreamConcurrency(index, stream.Info.Group) {
+			utils.SafeLogf("Concurrency limit reached for M3U_%s, not resuming session of %s\n", index, r.RemoteAddr)
+		} else if resumed, err := stream.Reconnect(r.Method, index, subIndex); err != nil {
+			utils.SafeLogf("Error resuming session of %s on M3U_%s|%s: %v\n", r.RemoteAddr, index, subIndex, err)
+		} else {
+			utils.SafeLogf("Resuming session of %s on M3U_%s|%s\n", r.RemoteAddr, index, subIndex)
+			reconnected = resumed
+			selectedIndex, selectedSubIndex = index, subIndex
+			selectedUrl = stream.Info.URLs[index][subIndex]
+		}
+	} else {
+		resumeToken = store.NewResumeToken()
+	}
+	defer store.ReleaseResumeToken(resumeToken)
+
 	for {
-		resp, selectedUrl, selectedIndex, selectedSubIndex, err = stream.LoadBalancer(ctx, &session, r.Method)
-		if err != nil {
-			utils.SafeLogf("Error reloading stream for %s: %v\n", streamUrl, err)
-			return
+		if reconnected != nil {
+			resp, reconnected = reconnected, nil
+		} else {
+			previous := resp
+			resp, selectedUrl, selectedIndex, selectedSubIndex, err = stream.LoadBalancer(ctx, &session, r.Method)
+			if err != nil {
+				utils.SafeLogf("Error reloading stream for %s: %v\n", streamUrl, err)
+				// Once the stream started, the client can only be sent the
+				// configured end of the stream before being disconnected.
+				switch {
+				case ctx.Err() != nil:
+				case firstWrite:
+					streamStatusError(w, proxy.LoadBalancerStatus(err))
+				case previous != nil:
+					proxy.EndFailedStream(out, previous)
+				}
+				return
+			}
+			reconnects = 0
+		}
+
+		resumable := r.Method == http.MethodGet && resumeToken != "" && !utils.EOFIsExpected(resp)
+		if resumable {
+			store.AttachResumeToken(resumeToken, stream.Info.Title, selectedIndex, selectedSubIndex)
 		}
 
 		// HTTP header initialization
 		if firstWrite {
-			for k, v := range resp.Header {
-				if strings.ToLower(k) == "content-length" {
-					continue
+			if r.Method == http.MethodGet {
+				store.RecordChannelOpen(stream.Info.Title, session.ID)
+			}
+
+			proxy.CopyResponseHeaders(w.Header(), resp.Header)
+
+			// HLS playlists are passed through, their segments are fetched
+			// by the client itself.
+			if transcodeArgs != nil && !utils.EOFIsExpected(resp) {
+				transcoder, err := proxy.NewTranscodeWriter(ctx, w, transcodeArgs)
+				if err != nil {
+					utils.SafeLogf("Error starting transcoding for %s: %v\n", r.RemoteAddr, err)
+					streamError(w, http.StatusNotImplemented, "transcoding is not available")
+					return
 				}
+				defer transcoder.Close()
+				out = transcoder
 
-				for _, val := range v {
-					w.Header().Set(k, val)
+				w.Header().Set("Content-Type", proxy.TranscodeContentType(transcodeArgs))
+				for _, key := range []string{"Accept-Ranges", "Content-Disposition", "ETag", "Last-Modified"} {
+					w.Header().Del(key)
 				}
 			}
+
+			// Movies and episodes record how far the client got, so players
+			// can resume them later.
+			if r.Method == http.MethodGet && transcodeArgs == nil && !utils.EOFIsExpected(resp) && store.StreamMediaType(stream.Info) != store.MediaLive {
+				offset, length := responseRange(resp)
+				progress = &progressWriter{ResponseWriter: out, length: length}
+				progress.offset.Store(offset)
+				out = progress
+				defer progress.record(vodUser(r), stream.Info.Title)
+			}
+
+			if resumable {
+				w.Header().Set("X-Stream-Session", resumeToken)
+				w.Header().Set("Access-Control-Expose-Headers", "X-Stream-Session")
+			}
 			w.WriteHeader(resp.StatusCode)
 
 			if debug {
@@ -72,33 +243,65 @@ func StreamHandler(w http.ResponseWriter, r *http.Request, cm *store.Concurrency
 			firstWrite = false
 		}
 
-		exitStatus := make(chan int)
+		exitStatus := make(chan proxy.StreamStatus)
 
 		utils.SafeLogf("Proxying %s to %s\n", r.RemoteAddr, selectedUrl)
 		proxyCtx, proxyCtxCancel := context.WithCancel(ctx)
 		defer proxyCtxCancel()
 
-		go stream.ProxyStream(proxyCtx, selectedIndex, selectedSubIndex, resp, r, w, exitStatus)
+		go stream.ProxyStream(proxyCtx, selectedIndex, selectedSubIndex, resp, r, out, exitStatus)
 
 		select {
 		case <-ctx.Done():
 			utils.SafeLogf("Client has closed the stream: %s\n", r.RemoteAddr)
 			return
-		case streamExitCode := <-exitStatus:
-			utils.SafeLogf("Exit code %d received from %s\n", streamExitCode, selectedUrl)
+		case status := <-exitStatus:
+			logStreamStatus(status, selectedUrl)
 
-			if streamExitCode == 2 && utils.EOFIsExpected(resp) {
+			switch {
+			case status.Code == proxy.StatusEOF && utils.EOFIsExpected(resp):
 				utils.SafeLogf("Successfully proxied playlist: %s\n", r.RemoteAddr)
 				return
-			} else if streamExitCode == 1 || streamExitCode == 2 {
+			case status.Retryable():
+				proxyCtxCancel()
+
+				// The rest of a movie is requested from where the client
+				// got to instead of sending it from the start again.
+				if progress != nil {
+					if resume := progress.resumeRange(r); resume != "" {
+						stream.Header.Set("Range", resume)
+					}
+				}
+
+				if status.Code == proxy.StatusEOF && reconnects < maxReconnects {
+					reconnects++
+					resp.Body.Close()
+
+					utils.SafeLogf("Reconnecting to %s (%d/%d)...\n", selectedUrl, reconnects, maxReconnects)
+					reconnected, err = stream.Reconnect(r.Method, selectedIndex, selectedSubIndex)
+					if err == nil {
+						continue
+					}
+					utils.SafeLogf("Error reconnecting to %s: %v\n", selectedUrl, err)
+				}
+
 				// Retry on server-side connection errors
-				session.SetTestedIndexes(append(session.TestedIndexes, selectedIndex+"|"+selectedSubIndex))
+				session.SetTestedIndexes(append(session.TestedIndexes, store.SameURLEntries(stream.Info, selectedIndex, selectedSubIndex)...))
 				utils.SafeLogf("Retrying other servers...\n")
-				proxyCtxCancel()
-			} else if streamExitCode == 4 {
+			case status.Code == proxy.StatusCompleted:
+				utils.SafeLogf("Successfully proxied stream: %s\n", r.RemoteAddr)
+				return
+			case status.Code == proxy.StatusM3U8Parsed:
 				utils.SafeLogf("Finished handling %s request: %s\n", r.Method, r.RemoteAddr)
 				return
-			} else {
+			case status.Code == proxy.StatusPanic:
+				// Already logged with its stack trace. The client is
+				// disconnected as the state of the stream is unknown.
+				return
+			case status.Code == proxy.StatusClientStalled:
+				utils.SafeLogf("Client stopped accepting data, disconnecting: %s\n", r.RemoteAddr)
+				return
+			default:
 				// Consider client-side connection errors as complete closure
 				utils.SafeLogf("Unable to write to client. Assuming stream has been closed: %s\n", r.RemoteAddr)
 				return
@@ -106,3 +309,27 @@ func StreamHandler(w http.ResponseWriter, r *http.Request, cm *store.Concurrency
 		}
 	}
 }
+
+// logStreamStatus logs how proxying from an upstream ended, following the
+// severity of the status.
+func logStreamStatus(status proxy.StreamStatus, url string) {
+	switch status.Severity() {
+	case proxy.SeverityDebug:
+		if os.Getenv("DEBUG") == "true" {
+			utils.SafeLogf("[DEBUG] Stream from %s ended: %v\n", url, status)
+		}
+	case proxy.SeverityError:
+		utils.SafeLogf("Error streaming from %s: %v\n", url, status)
+	default:
+		utils.SafeLogf("Stream from %s ended: %v\n", url, status)
+	}
+}
+
+// isTrueParam reports whether a flag query parameter is set, e.g. ?flag=1.
+func isTrueParam(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"fmt"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// vodUser returns who the progress of a movie or episode is recorded for:
+// the user query parameter of the request, or else the address of the
+// client.
+func vodUser(r *http.Request) string {
+	if user := strings.TrimSpace(r.URL.Query().Get("user")); user != "" {
+		return user
+	}
+	return utils.ClientIP(r)
+}
+
+// responseRange returns the offset of the first byte of the upstream
+// response in the file and the size of the file, 0 if it is unknown.
+func responseRange(resp *http.Response) (int64, int64) {
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, max(resp.ContentLength, 0)
+	}
+
+	// bytes 100-199/1000, the size may be *.
+	spec, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return 0, 0
+	}
+	byteRange, size, _ := strings.Cut(spec, "/")
+	first, _, _ := strings.Cut(byteRange, "-")
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return 0, 0
+	}
+	length, _ := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	return start, length
+}
+
+// progressWriter counts the bytes of a movie or episode written to the
+// client, starting at offset in the file.
+type progressWriter struct {
+	http.ResponseWriter
+	offset atomic.Int64
+	length int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.ResponseWriter.Write(p)
+	pw.offset.Add(int64(n))
+	return n, err
+}
+
+func (pw *progressWriter) Flush() {
+	_ = pw.FlushError()
+}
+
+func (pw *progressWriter) FlushError() error {
+	return http.NewResponseController(pw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (pw *progressWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// resumeRange returns the Range header requesting the rest of the file from
+// where the client got to, for a reconnect or failover. It is empty if the
+// client requested a bounded range, which is requested again as is.
+func (pw *progressWriter) resumeRange(r *http.Request) string {
+	requested := r.Header.Get("Range")
+	if requested != "" && (!strings.HasPrefix(requested, "bytes=") || !strings.HasSuffix(requested, "-") || strings.Contains(requested, ",")) {
+		return ""
+	}
+	return fmt.Sprintf("bytes=%d-", pw.offset.Load())
+}
+
+// record persists how far the user got into the movie or episode.
+func (pw *progressWriter) record(user string, title string) {
+	progress := store.VODProgress{Offset: pw.offset.Load(), Length: pw.length, UpdatedAt: time.Now()}
+	if err := store.RecordVODProgress(user, title, progress); err != nil {
+		utils.SafeLogf("Error saving the progress of %s in %s: %v\n", user, title, err)
+	}
+}
+
+// VODProgressHandler returns how far a user got into the movie or episode
+// given by its stream ID or title, to resume it from there with a Range
+// request, or forgets it on DELETE. The user is the user query parameter,
+// or else the address of the client.
+func VODProgressHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	info, err := store.GetStreamBySlug(id)
+	if err != nil || len(info.URLs) == 0 {
+		var ok bool
+		if info, ok = store.GetStreamByTitle(id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	user := vodUser(r)
+
+	if r.Method == http.MethodDelete {
+		if err := store.ForgetVODProgress(user, info.Title); err != nil {
+			utils.SafeLogf("Error forgetting the progress of %s in %s: %v\n", user, info.Title, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	progress, ok := store.GetVODProgress(user, info.Title)
+	if !ok {
+		http.Error(w, "No progress recorded", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(progress)
+}
@@ -0,0 +1,2095 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/handlers"
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/updater"
+	"m3u-stream-merger/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setup points M3U_URL_1, M3U_URL_2, ... to the providers and syncs them.
+func setup(t *testing.T, providers ...*Provider) {
+	t.Helper()
+
+	for i, provider := range providers {
+		t.Cleanup(provider.Close)
+		index := string(rune('1' + i))
+		t.Setenv("M3U_URL_"+index, provider.PlaylistURL())
+	}
+	t.Setenv("STREAM_TIMEOUT", "0")
+	t.Setenv("MAX_RETRIES", "1")
+	t.Setenv("PROBE_CACHE_TTL", "0")
+	// Also drops the source indexes cached by the previous tests.
+	utils.LoadSourceEnv()
+	store.ClearSessionStore()
+
+	for i := range providers {
+		if err := store.DownloadM3USource(context.Background(), string(rune('1'+i))); err != nil {
+			t.Fatalf("Downloader returned error: %v", err)
+		}
+	}
+	// Like the sync on boot, as the playlists are served from the stored
+	// channels.
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+}
+
+// request requests the channel with the given title from the proxy, always
+// as the same client within a test, and returns the response once the proxy
+// ended it. The request can be changed with the opts.
+func request(t *testing.T, title string, opts ...func(*http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	for _, stream := range store.GetStreams() {
+		if stream.Title != title {
+			continue
+		}
+
+		req := httptest.NewRequest("GET", store.GenerateStreamURL("", stream), nil)
+		req.Header.Set("User-Agent", fmt.Sprintf("%s-%p", t.Name(), t))
+		for _, opt := range opts {
+			opt(req)
+		}
+		w := httptest.NewRecorder()
+		handlers.StreamHandler(w, req, store.NewConcurrencyManager())
+		return w
+	}
+
+	t.Fatalf("Channel %s not found", title)
+	return nil
+}
+
+// playlistURLs requests the playlist from the proxy and returns the URLs of
+// its channels by title.
+func playlistURLs(t *testing.T, target string) map[string]string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handlers.M3UHandler(w, httptest.NewRequest("GET", target, nil))
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	urls := make(map[string]string)
+	lines := strings.Split(w.Body.String(), "\n")
+	for i, line := range lines {
+		if _, title, ok := strings.Cut(line, ","); ok && strings.HasPrefix(line, "#EXTINF") && i+1 < len(lines) {
+			urls[title] = lines[i+1]
+		}
+	}
+	return urls
+}
+
+// assertFailover checks that output is the first Packets packets of from
+// followed by packets of to only.
+func assertFailover(t *testing.T, output []byte, from *Provider, to *Provider) {
+	t.Helper()
+
+	first := bytes.Repeat(from.Packet(), from.Packets)
+	if !bytes.HasPrefix(output, first) {
+		t.Fatalf("Expected the stream to start with the %d packets of the first provider", from.Packets)
+	}
+
+	rest := output[len(first):]
+	if len(rest) == 0 || len(rest)%tsPacketSize != 0 {
+		t.Fatalf("Expected whole packets of the second provider after the failover, got %d bytes", len(rest))
+	}
+	if !bytes.Equal(rest, bytes.Repeat(to.Packet(), len(rest)/tsPacketSize)) {
+		t.Fatal("Expected only packets of the second provider after the failover")
+	}
+}
+
+func TestMidStreamNotFound(t *testing.T) {
+	first := NewProvider(NotFoundMidStream, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+
+	w := request(t, "Live")
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	assertFailover(t, w.Body.Bytes(), first, second)
+	if first.Requests("/live/1.ts") != 2 {
+		t.Errorf("Expected one reconnect to the first provider, got %d requests", first.Requests("/live/1.ts"))
+	}
+}
+
+func TestStalledUpstream(t *testing.T) {
+	first := NewProvider(Stall, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_IDLE_TIMEOUT", "1")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	w := request(t, "Live")
+	assertFailover(t, w.Body.Bytes(), first, second)
+	if len(w.Body.Bytes()) != 2*first.Packets*tsPacketSize {
+		t.Errorf("Expected the whole stream of the second provider, got %d bytes", len(w.Body.Bytes()))
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	first := NewProvider(TokenExpiry, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+
+	playlist := request(t, "HLS").Body.String()
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:100\n") || !strings.Contains(playlist, first.URL+"/hls/seg100.ts") {
+		t.Fatalf("Expected the playlist of the first provider, got:\n%s", playlist)
+	}
+
+	// The token of the first provider expired, the client refreshing the
+	// playlist gets the one of the second provider without a jump back.
+	w := request(t, "HLS")
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	playlist = w.Body.String()
+	if !strings.Contains(playlist, second.URL+"/hls/seg100.ts") {
+		t.Fatalf("Expected the playlist of the second provider, got:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:103\n") || !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("Expected the media sequence to continue after a discontinuity, got:\n%s", playlist)
+	}
+}
+
+func TestPlaylistReset(t *testing.T) {
+	provider := NewProvider(PlaylistReset, 0x01)
+	setup(t, provider)
+
+	playlist := request(t, "HLS").Body.String()
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:100\n") {
+		t.Fatalf("Expected media sequence 100, got:\n%s", playlist)
+	}
+
+	// The provider restarted its media sequence at 0, which the client
+	// would take for old segments.
+	playlist = request(t, "HLS").Body.String()
+	if !strings.Contains(playlist, provider.URL+"/hls/seg0.ts") {
+		t.Fatalf("Expected the reset playlist, got:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:103\n") || !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("Expected the media sequence to continue after a discontinuity, got:\n%s", playlist)
+	}
+
+	// The timestamps of the segments are passed through, after the
+	// discontinuity.
+	pdt := "#EXT-X-PROGRAM-DATE-TIME:" + provider.SegmentTime(0).Format(time.RFC3339Nano) + "\n"
+	if !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n"+pdt+"#EXTINF:2.000,\n"+provider.URL+"/hls/seg0.ts") {
+		t.Errorf("Expected the program date time of the first segment after the discontinuity, got:\n%s", playlist)
+	}
+}
+
+func TestMovie(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_TIMEOUT", "3")
+
+	w := request(t, "Movie")
+	if w.Code != 200 {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	output, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("Error reading movie: %v", err)
+	}
+
+	// A movie sent completely is not restarted or continued from another
+	// provider.
+	if !bytes.Equal(output, first.Movie()) {
+		t.Errorf("Expected the %d bytes of the movie, got %d bytes", len(first.Movie()), len(output))
+	}
+	if first.Requests("/movie/1.mp4") != 1 || second.Requests("/movie/1.mp4") != 0 {
+		t.Errorf("Expected a single request for the movie, got %d and %d", first.Requests("/movie/1.mp4"), second.Requests("/movie/1.mp4"))
+	}
+}
+
+func TestInjectedFaults(t *testing.T) {
+	first := NewProvider(Stall, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	// Requests of channels other than the selected ones are left alone.
+	t.Setenv("CHAOS_CHANNELS", "movie")
+	t.Setenv("CHAOS_FAILURE_RATE", "1")
+	if w := request(t, "HLS"); w.Code != 200 {
+		t.Fatalf("Expected status 200 for a channel without faults, got %d", w.Code)
+	}
+
+	t.Setenv("CHAOS_CHANNELS", "hls")
+	if w := request(t, "HLS"); w.Code != 502 {
+		t.Fatalf("Expected status 502 with every request failing, got %d", w.Code)
+	}
+
+	// The stalled stream is reset, which fails over to the second provider.
+	t.Setenv("CHAOS_CHANNELS", "Live")
+	t.Setenv("CHAOS_FAILURE_RATE", "0")
+	t.Setenv("CHAOS_RESET_AFTER_SECONDS", "1")
+	assertFailover(t, request(t, "Live").Body.Bytes(), first, second)
+}
+
+func TestSessionResumption(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	w := request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "source=2"
+	})
+	token := w.Header().Get("X-Stream-Session")
+	if token == "" {
+		t.Fatal("Expected a session token")
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), second.Packet()) {
+		t.Fatal("Expected the stream to start from the second provider")
+	}
+
+	// Re-attaching with the token goes back to the second provider instead
+	// of the first one the load balancer would try, and only fails over to
+	// it once the stream ends.
+	w = request(t, "Live", func(r *http.Request) {
+		r.Header.Set("X-Stream-Session", token)
+	})
+	assertFailover(t, w.Body.Bytes(), second, first)
+	if w.Header().Get("X-Stream-Session") != token {
+		t.Errorf("Expected the session token to be kept, got %q", w.Header().Get("X-Stream-Session"))
+	}
+
+	// Tokens of other channels are ignored.
+	w = request(t, "Movie", func(r *http.Request) {
+		r.Header.Set("X-Stream-Session", token)
+	})
+	if w.Header().Get("X-Stream-Session") == token {
+		t.Error("Expected the token not to be reused for another channel")
+	}
+}
+
+func TestDuplicateSourceURLs(t *testing.T) {
+	// Both sources list the same URLs, like two resellers of a provider.
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	// The URL is not requested again from the second source on failover.
+	out := request(t, "Live").Body.Bytes()
+	if !bytes.Equal(out, bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Errorf("Expected the stream once, got %d bytes", len(out))
+	}
+	if n := provider.Requests("/live/1.ts"); n != 1 {
+		t.Errorf("Expected a single request of the URL, got %d", n)
+	}
+
+	// The entries of the second source are kept.
+	w := request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "source=2"
+	})
+	if w.Code != 200 || !bytes.HasPrefix(w.Body.Bytes(), provider.Packet()) {
+		t.Errorf("Expected the stream from the second source, got status %d", w.Code)
+	}
+}
+
+func TestProbeCache(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("PROBE_MODE", "head")
+	t.Setenv("PROBE_CACHE_TTL", "10")
+
+	request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "source=2"
+	})
+	if second.Requests("/live/1.ts") != 2 {
+		t.Fatalf("Expected a HEAD probe and a GET, got %d requests", second.Requests("/live/1.ts"))
+	}
+
+	// The channel was just opened from the second provider, which is tried
+	// first without probing it again.
+	w := request(t, "Live")
+	assertFailover(t, w.Body.Bytes(), second, first)
+	if second.Requests("/live/1.ts") != 3 {
+		t.Errorf("Expected a single GET without HEAD probe, got %d requests", second.Requests("/live/1.ts")-2)
+	}
+}
+
+func TestSourceMaintenance(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("ADMIN_TOKEN", "admin")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sources/{idx}/disable", handlers.SourceDisableHandler)
+	setDisabled := func(disabled bool) {
+		method := "POST"
+		if !disabled {
+			method = "DELETE"
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/sources/1/disable", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	setDisabled(true)
+	t.Cleanup(func() { setDisabled(false) })
+
+	// The first provider is skipped while it is disabled.
+	output := request(t, "Live").Body.Bytes()
+	if !bytes.Equal(output, bytes.Repeat(second.Packet(), second.Packets)) {
+		t.Errorf("Expected only the stream of the second provider, got %d bytes", len(output))
+	}
+	if first.Requests("/live/1.ts") != 0 {
+		t.Errorf("Expected no request to the disabled provider, got %d", first.Requests("/live/1.ts"))
+	}
+
+	setDisabled(false)
+	assertFailover(t, request(t, "Live").Body.Bytes(), first, second)
+}
+
+func TestSourceStatistics(t *testing.T) {
+	first := NewProvider(NotFoundMidStream, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+
+	stats := func() map[string]proxy.SourceStats {
+		stats := make(map[string]proxy.SourceStats)
+		for _, stat := range proxy.Sources.Stats() {
+			stats[stat.Source] = stat
+		}
+		return stats
+	}
+
+	// The counters are shared with the other tests.
+	before := stats()
+	assertFailover(t, request(t, "Live").Body.Bytes(), first, second)
+	after := stats()
+
+	if got := after["1"].Outcomes["200"] - before["1"].Outcomes["200"]; got != 1 {
+		t.Errorf("Expected one 200 of the first provider, got %d", got)
+	}
+	if got := after["1"].Outcomes["404"] - before["1"].Outcomes["404"]; got != 1 {
+		t.Errorf("Expected one 404 of the first provider, got %d", got)
+	}
+	if got := after["1"].Failures - before["1"].Failures; got != 1 {
+		t.Errorf("Expected one failure of the first provider, got %d", got)
+	}
+	if got := after["1"].BytesServed - before["1"].BytesServed; got != int64(first.Packets*tsPacketSize) {
+		t.Errorf("Expected %d bytes served from the first provider, got %d", first.Packets*tsPacketSize, got)
+	}
+	if got := after["2"].Successes - before["2"].Successes; got != int64(second.Requests("/live/1.ts")) {
+		t.Errorf("Expected %d successes of the second provider, got %d", second.Requests("/live/1.ts"), got)
+	}
+	if after["2"].BytesServed <= before["2"].BytesServed {
+		t.Error("Expected bytes served from the second provider")
+	}
+	if after["1"].ExclusiveStreams != 0 || after["2"].ExclusiveStreams != 0 {
+		t.Errorf("Expected no channel exclusive to a provider, got %d and %d", after["1"].ExclusiveStreams, after["2"].ExclusiveStreams)
+	}
+}
+
+func TestSourcesPlaylist(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	streamURL := playlistURLs(t, "/playlist.m3u?sources=2")["Live"]
+	if !strings.HasSuffix(streamURL, "?sources=2") {
+		t.Fatalf("Expected the stream URL of Live to be restricted to the second source, got %q", streamURL)
+	}
+
+	req := httptest.NewRequest("GET", streamURL, nil)
+	req.Header.Set("User-Agent", fmt.Sprintf("%s-%p", t.Name(), t))
+	w := httptest.NewRecorder()
+	handlers.StreamHandler(w, req, store.NewConcurrencyManager())
+
+	if !bytes.Equal(w.Body.Bytes(), bytes.Repeat(second.Packet(), second.Packets)) {
+		t.Errorf("Expected only the stream of the second provider, got %d bytes", w.Body.Len())
+	}
+	if first.Requests("/live/1.ts") != 0 {
+		t.Errorf("Expected no request to the first provider, got %d", first.Requests("/live/1.ts"))
+	}
+
+	w = httptest.NewRecorder()
+	handlers.M3UHandler(w, httptest.NewRequest("GET", "/playlist.m3u?sources=9", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for an unknown source, got %d", w.Code)
+	}
+}
+
+func TestDirectURLs(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	// The playlist is regenerated once the envs are restored.
+	t.Cleanup(func() { _ = store.RegenerateM3U(context.Background()) })
+	setup(t, provider)
+	t.Setenv("PLAYLIST_URL_MODE", "direct")
+	t.Setenv("DIRECT_URL_GROUPS", "Movies")
+
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("RegenerateM3U returned error: %v", err)
+	}
+
+	urls := playlistURLs(t, "/playlist.m3u")
+	if urls["Movie"] != provider.URL+"/movie/1.mp4" {
+		t.Errorf("Expected the upstream URL for Movie, got %q", urls["Movie"])
+	}
+	if !strings.Contains(urls["Live"], "/p/") {
+		t.Errorf("Expected a proxy URL for Live, got %q", urls["Live"])
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	// Fills the channel database the channels are looked up in.
+	store.GetStreams()
+
+	// Stands in for ffmpeg, answering with the size of the stream input.
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\nwc -c\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/streams/{id}/snapshot.jpg", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SnapshotHandler(w, r, store.NewConcurrencyManager())
+	})
+	snapshot := func(title string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/streams/"+title+"/snapshot.jpg", nil))
+		return w
+	}
+
+	t.Setenv("FFMPEG_PATH", filepath.Join(t.TempDir(), "missing"))
+	if w := snapshot("Live"); w.Code != 501 {
+		t.Errorf("Expected status 501 without ffmpeg, got %d", w.Code)
+	}
+
+	t.Setenv("FFMPEG_PATH", ffmpeg)
+	if w := snapshot("Unknown"); w.Code != 404 {
+		t.Errorf("Expected status 404 for an unknown channel, got %d", w.Code)
+	}
+
+	w := snapshot("Live")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected a JPEG, got status %d: %s", w.Code, w.Body.String())
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != strconv.Itoa(provider.Packets*tsPacketSize) {
+		t.Errorf("Expected the stream to be piped to ffmpeg, got %s bytes", got)
+	}
+}
+
+func TestTranscodeProfiles(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+
+	// Stands in for ffmpeg, recording its arguments and passing the stream
+	// through.
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/args\nexec cat\n", dir)
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FFMPEG_PATH", ffmpeg)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	w := request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "audio_only=1"
+	})
+	if w.Code != 200 || w.Header().Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("Expected an MPEG-TS stream, got status %d and %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Errorf("Expected the stream to go through ffmpeg, got %d bytes", w.Body.Len())
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatalf("Expected ffmpeg to be started: %v", err)
+	}
+	if !strings.Contains(string(args), "-map 0:a") {
+		t.Errorf("Expected ffmpeg to only keep the audio, got arguments %s", args)
+	}
+
+	t.Setenv("TRANSCODE_PROFILE_MOBILE", "-c:v libx264 -b:v 800k -f matroska")
+	w = request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "profile=mobile"
+	})
+	if w.Code != 200 || w.Header().Get("Content-Type") != "video/x-matroska" {
+		t.Fatalf("Expected a Matroska stream, got status %d and %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if args, _ := os.ReadFile(filepath.Join(dir, "args")); !strings.Contains(string(args), "-b:v 800k -f matroska pipe:1") {
+		t.Errorf("Expected the arguments of the profile, got %s", args)
+	}
+
+	w = request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "profile=unknown"
+	})
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for an unknown profile, got %d", w.Code)
+	}
+}
+
+func TestSnapshotOfRunningStream(t *testing.T) {
+	provider := NewProvider(Endless, 0x01)
+	setup(t, provider)
+
+	// Stands in for ffmpeg, answering with the first packets of the stream.
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\nhead -c 1880\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FFMPEG_PATH", ffmpeg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request(t, "Live", func(r *http.Request) {
+			*r = *r.WithContext(ctx)
+		})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for provider.Requests("/live/1.ts") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/streams/{id}/snapshot.jpg", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SnapshotHandler(w, r, store.NewConcurrencyManager())
+	})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/streams/Live/snapshot.jpg", nil))
+
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), bytes.Repeat(provider.Packet(), 10)) {
+		t.Fatalf("Expected the packets of the running stream, got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+	if provider.Requests("/live/1.ts") != 1 {
+		t.Errorf("Expected the running stream to be tapped without another request, got %d requests", provider.Requests("/live/1.ts"))
+	}
+}
+
+func TestRunningStreams(t *testing.T) {
+	provider := NewProvider(Endless, 0x01)
+	setup(t, provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request(t, "Live", func(r *http.Request) {
+			*r = *r.WithContext(ctx)
+		})
+	}()
+
+	var streams []proxy.RunningStream
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		streams = proxy.RunningStreams()
+		if len(streams) == 1 && streams[0].BytesServed > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("Expected one running stream, got %d", len(streams))
+	}
+	if streams[0].Title != "Live" || streams[0].Source != "1|0" || streams[0].State != "streaming" || streams[0].BytesServed == 0 {
+		t.Errorf("Unexpected running stream: %+v", streams[0])
+	}
+
+	cancel()
+	<-done
+	// The stream ends right after the handler returned.
+	deadline = time.Now().Add(5 * time.Second)
+	for len(proxy.RunningStreams()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if streams := proxy.RunningStreams(); len(streams) != 0 {
+		t.Errorf("Expected the stream to be unregistered once its client left, got %+v", streams)
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	first := NewProvider(Stall, 0x01)
+	second := NewProvider(Endless, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_IDLE_TIMEOUT", "1")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		request(t, "Live", func(r *http.Request) {
+			*r = *r.WithContext(ctx)
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The metrics of the stream are kept across the failover.
+	var streams []proxy.RunningStream
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		streams = proxy.RunningStreams()
+		if len(streams) == 1 && streams[0].Source == "2|0" && streams[0].Metrics.BitrateKbps > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("Expected one running stream, got %d", len(streams))
+	}
+	metrics := streams[0].Metrics
+	if streams[0].Source != "2|0" || metrics.Failovers != 1 || metrics.Stalls != 1 || metrics.BitrateKbps <= 0 {
+		t.Errorf("Expected a stalled source and a failover in the metrics, got %+v", streams[0])
+	}
+}
+
+func TestStreamFailureMode(t *testing.T) {
+	slatePacket := NewProvider(Healthy, 0x02).Packet()
+	slate := filepath.Join(t.TempDir(), "slate.ts")
+	if err := os.WriteFile(slate, bytes.Repeat(slatePacket, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OFFLINE_SLATE_PATH", slate)
+
+	// Streams the channel of a provider failing after the first response,
+	// returning the data sent after the stream.
+	failedStream := func(mode string) []byte {
+		t.Helper()
+
+		provider := NewProvider(NotFoundMidStream, 0x01)
+		setup(t, provider)
+		t.Setenv("STREAM_FAILURE_MODE", mode)
+
+		served := bytes.Repeat(provider.Packet(), provider.Packets)
+		w := request(t, "Live")
+		if !bytes.HasPrefix(w.Body.Bytes(), served) {
+			t.Fatalf("Expected the stream before its end, got %d bytes", w.Body.Len())
+		}
+		return w.Body.Bytes()[len(served):]
+	}
+
+	if end := failedStream(""); len(end) != 0 {
+		t.Errorf("Expected the connection to be closed after the stream, got %d bytes", len(end))
+	}
+
+	padding := failedStream("endlist,padding")
+	if len(padding) == 0 || len(padding)%tsPacketSize != 0 {
+		t.Fatalf("Expected null packets after the stream, got %d bytes", len(padding))
+	}
+	for i := 0; i < len(padding); i += tsPacketSize {
+		if padding[i] != 0x47 || padding[i+1] != 0x1F || padding[i+2] != 0xFF {
+			t.Fatalf("Expected null packets, got packet %x at %d", padding[i:i+4], i)
+		}
+	}
+
+	if end := failedStream("slate,padding"); !bytes.Equal(end, bytes.Repeat(slatePacket, 10)) {
+		t.Errorf("Expected the slate after the stream, got %d bytes", len(end))
+	}
+}
+
+func TestEncryptedArtifacts(t *testing.T) {
+	t.Setenv("DATA_ENCRYPTION_KEY", "correct horse battery staple")
+	t.Setenv("PLAYLIST_URL_MODE", "direct")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("RegenerateM3U returned error: %v", err)
+	}
+
+	for _, path := range []string{utils.GetM3UFilePathByIndex("1"), "/m3u-proxy/data/cache.m3u"} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(content, []byte("EXTINF")) || bytes.Contains(content, []byte(provider.URL)) {
+			t.Errorf("Expected %s to be encrypted", path)
+		}
+	}
+
+	if urls := playlistURLs(t, "/playlist.m3u"); urls["Live"] != provider.URL+"/live/1.ts?token=valid" {
+		t.Errorf("Expected the decrypted playlist, got %v", urls)
+	}
+	if w := request(t, "Live"); !bytes.Equal(w.Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Errorf("Expected the stream from the decrypted channel, got %d bytes", w.Body.Len())
+	}
+
+	// Playlists written in clear are still read once the encryption is
+	// disabled again.
+	t.Setenv("DATA_ENCRYPTION_KEY", "")
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("RegenerateM3U returned error: %v", err)
+	}
+	if urls := playlistURLs(t, "/playlist.m3u"); urls["Live"] != provider.URL+"/live/1.ts?token=valid" {
+		t.Errorf("Expected the playlist in clear, got %v", urls)
+	}
+}
+
+func TestPlaylistRateLimit(t *testing.T) {
+	setup(t, NewProvider(Healthy, 0x01))
+	t.Setenv("PLAYLIST_RATE_LIMIT", "2")
+	t.Setenv("PLAYLIST_RATE_BURST", "2")
+	t.Setenv("PLAYLIST_RATE_LIMIT_EXEMPT", "10.0.0.0/8")
+
+	playlist := func(remoteAddr string, forwardedFor ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/playlist.m3u", nil)
+		r.RemoteAddr = remoteAddr
+		for _, value := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		w := httptest.NewRecorder()
+		handlers.M3UHandler(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := playlist("192.0.2.10:1234"); w.Code != 200 {
+			t.Fatalf("Expected request %d within the burst to succeed, got %d", i+1, w.Code)
+		}
+	}
+	w := playlist("192.0.2.10:4321")
+	if w.Code != 429 {
+		t.Fatalf("Expected status 429 once the burst is used, got %d", w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 30 {
+		t.Errorf("Expected a Retry-After of at most 30 seconds, got %q", w.Header().Get("Retry-After"))
+	}
+
+	if w := playlist("192.0.2.11:1234"); w.Code != 200 {
+		t.Errorf("Expected other clients not to be limited, got %d", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if w := playlist("10.1.2.3:1234"); w.Code != 200 {
+			t.Fatalf("Expected exempt clients not to be limited, got %d", w.Code)
+		}
+	}
+
+	// X-Forwarded-For is only used from a trusted proxy, and only for the
+	// address the proxy added.
+	if w := playlist("192.0.2.10:1234", "192.0.2.20"); w.Code != 429 {
+		t.Errorf("Expected X-Forwarded-For of a client to be ignored, got %d", w.Code)
+	}
+	t.Setenv("TRUSTED_PROXIES", "198.51.100.1")
+	if w := playlist("198.51.100.1:1234", "203.0.113.5, 192.0.2.10"); w.Code != 429 {
+		t.Errorf("Expected the client behind the proxy to be limited, got %d", w.Code)
+	}
+	if w := playlist("198.51.100.1:1234", "192.0.2.10", "192.0.2.21"); w.Code != 200 {
+		t.Errorf("Expected other clients behind the proxy not to be limited, got %d", w.Code)
+	}
+}
+
+func TestShortStreamIDs(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	slugURL := playlistURLs(t, "/playlist.m3u?sources=1")["Live"]
+
+	t.Setenv("SHORT_STREAM_IDS", "true")
+	streamURL := playlistURLs(t, "/playlist.m3u?sources=1")["Live"]
+	if id := strings.Split(path.Base(streamURL), ".")[0]; len(id) > 12 {
+		t.Fatalf("Expected a short stream ID, got %s", streamURL)
+	}
+	if again := playlistURLs(t, "/playlist.m3u?sources=1")["Live"]; again != streamURL {
+		t.Errorf("Expected the same short ID on every playlist, got %s and %s", streamURL, again)
+	}
+
+	for _, target := range []string{streamURL, slugURL} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("User-Agent", fmt.Sprintf("%s-%p", t.Name(), t))
+		w := httptest.NewRecorder()
+		handlers.StreamHandler(w, req, store.NewConcurrencyManager())
+
+		if !bytes.Equal(w.Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+			t.Errorf("Expected the stream for %s, got status %d and %d bytes", target, w.Code, w.Body.Len())
+		}
+	}
+}
+
+func TestLegacyStreamPaths(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	streamURL := playlistURLs(t, "/playlist.m3u?sources=1")["Live"]
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.Split(path.Base(u.Path), ".")[0]
+
+	legacy := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/stream/"+id+".mp4?sources=1", nil)
+		req.Header.Set("User-Agent", fmt.Sprintf("%s-%p", t.Name(), t))
+		w := httptest.NewRecorder()
+		handlers.LegacyStreamHandler(w, req, store.NewConcurrencyManager())
+		return w
+	}
+
+	w := legacy()
+	if w.Code != 301 || !strings.HasSuffix(w.Header().Get("Location"), u.Path+"?sources=1") {
+		t.Errorf("Expected a redirect to %s, got status %d and %s", u.Path, w.Code, w.Header().Get("Location"))
+	}
+
+	t.Setenv("LEGACY_STREAM_PATHS", "rewrite")
+	if w := legacy(); !bytes.Equal(w.Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Errorf("Expected the stream, got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	t.Setenv("LEGACY_STREAM_PATHS", "off")
+	if w := legacy(); w.Code != 404 {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestStreamURLExtension(t *testing.T) {
+	setup(t, NewProvider(Healthy, 0x01))
+
+	extensions := func() (string, string) {
+		urls := playlistURLs(t, "/playlist.m3u?sources=1")
+		u, err := url.Parse(urls["Live"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		movie, err := url.Parse(urls["Movie"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path.Ext(u.Path), path.Ext(movie.Path)
+	}
+
+	if live, movie := extensions(); live != ".ts" || movie != ".mp4" {
+		t.Errorf("Expected the extensions of the sources, got %q and %q", live, movie)
+	}
+
+	t.Setenv("STREAM_URL_EXTENSION", "none")
+	t.Setenv("STREAM_URL_EXTENSION_GROUPS", "Movies=ts")
+	if live, movie := extensions(); live != "" || movie != ".ts" {
+		t.Errorf("Expected no extension for Live and .ts for Movie, got %q and %q", live, movie)
+	}
+}
+
+func TestGroupConcurrency(t *testing.T) {
+	provider := NewProvider(Endless, 0x01)
+	setup(t, provider)
+	t.Setenv("M3U_MAX_CONCURRENCY_DEFAULT", "5")
+	t.Setenv("GROUP_MAX_CONCURRENCY_1", "^Li.e$=>1")
+
+	// The streams share the concurrency manager, as they do in the server.
+	cm := store.NewConcurrencyManager()
+	urls := playlistURLs(t, "/playlist.m3u?sources=1")
+	stream := func(ctx context.Context, title string, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", urls[title], nil).WithContext(ctx)
+		req.Header.Set("User-Agent", client)
+		w := httptest.NewRecorder()
+		handlers.StreamHandler(w, req, cm)
+		return w
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream(ctx, "Live", "first")
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.RunningStreams()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := stream(context.Background(), "Live", "second"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the group limit to be reached, got status %d", w.Code)
+	}
+	if w := stream(context.Background(), "Movie", "second"); w.Code != 200 {
+		t.Errorf("Expected other groups to be limited by the source only, got status %d", w.Code)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestConcurrencyReconciliation(t *testing.T) {
+	setup(t, NewProvider(Endless, 0x01))
+	cm := store.NewConcurrencyManager()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("GET", playlistURLs(t, "/playlist.m3u?sources=1")["Live"], nil).WithContext(ctx)
+		handlers.StreamHandler(httptest.NewRecorder(), req, cm)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.OpenStreams()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Increments of streams that crashed without decrementing.
+	cm.UpdateStreamConcurrency("1", "Live", true)
+	cm.UpdateStreamConcurrency("1", "Live", true)
+
+	if corrected := cm.Reconcile(proxy.OpenStreams()); len(corrected) != 0 || cm.GetCount("1") != 3 {
+		t.Errorf("Expected a first drift to be left alone, got %v and count %d", corrected, cm.GetCount("1"))
+	}
+	if corrected := cm.Reconcile(proxy.OpenStreams()); len(corrected) != 1 || cm.GetCount("1") != 1 {
+		t.Errorf("Expected the drift to be corrected to the running stream, got %v and count %d", corrected, cm.GetCount("1"))
+	}
+
+	cm.UpdateConcurrency("1", true)
+	t.Setenv("ADMIN_TOKEN", "admin")
+	req := httptest.NewRequest("DELETE", "/api/sources/1/concurrency", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	req.SetPathValue("idx", "1")
+	w := httptest.NewRecorder()
+	handlers.SourceConcurrencyResetHandler(w, req, cm)
+	if w.Code != 200 || cm.GetCount("1") != 1 {
+		t.Errorf("Expected the count to be reset to the running stream, got status %d and count %d", w.Code, cm.GetCount("1"))
+	}
+
+	cancel()
+	<-done
+	// The stream is released by its proxy goroutine, which may still be
+	// running once the handler returned.
+	deadline = time.Now().Add(time.Second)
+	for cm.GetCount("1") != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cm.GetCount("1") != 0 {
+		t.Errorf("Expected no count once the stream ended, got %d", cm.GetCount("1"))
+	}
+}
+
+// TestAdminRoutes checks that the routes changing the channels or the
+// sources, or exposing the sources, are refused without ADMIN_TOKEN.
+func TestAdminRoutes(t *testing.T) {
+	provider := NewProvider(Healthy, 'a')
+	setup(t, provider)
+	cm := store.NewConcurrencyManager()
+
+	routes := []struct {
+		pattern string
+		target  string
+		handler http.HandlerFunc
+	}{
+		{"GET /api/config/validate", "/api/config/validate", handlers.ConfigValidateHandler},
+		{"POST /api/channels", "/api/channels", handlers.CustomChannelAddHandler},
+		{"DELETE /api/channels/{id}", "/api/channels/Live", handlers.CustomChannelRemoveHandler},
+		{"POST /api/local/entries", "/api/local/entries", handlers.LocalEntryAddHandler},
+		{"DELETE /api/local/entries/{title}", "/api/local/entries/Live", handlers.LocalEntryRemoveHandler},
+		{"GET /api/mapping", "/api/mapping", handlers.MappingExportHandler},
+		{"POST /api/mapping", "/api/mapping", handlers.MappingImportHandler},
+		{"POST /api/channels/{id}/pin-source", "/api/channels/Live/pin-source", handlers.ChannelPinSourceHandler},
+		{"DELETE /api/channels/{id}/pin-source", "/api/channels/Live/pin-source", handlers.ChannelPinSourceHandler},
+		{"POST /api/channels/{id}/exclude-source", "/api/channels/Live/exclude-source", handlers.ChannelExcludeSourceHandler},
+		{"DELETE /api/channels/{id}/exclude-source", "/api/channels/Live/exclude-source", handlers.ChannelExcludeSourceHandler},
+		{"POST /api/channels/{id}/prefer-source", "/api/channels/Live/prefer-source", handlers.ChannelPreferSourceHandler},
+		{"DELETE /api/channels/{id}/prefer-source", "/api/channels/Live/prefer-source", handlers.ChannelPreferSourceHandler},
+		{"POST /api/sources/{idx}/disable", "/api/sources/1/disable", handlers.SourceDisableHandler},
+		{"DELETE /api/sources/{idx}/disable", "/api/sources/1/disable", handlers.SourceDisableHandler},
+		{"DELETE /api/channels/{id}/quality", "/api/channels/Live/quality", handlers.ChannelQualityHandler},
+		{"DELETE /api/sources/{idx}/concurrency", "/api/sources/1/concurrency", func(w http.ResponseWriter, r *http.Request) {
+			handlers.SourceConcurrencyResetHandler(w, r, cm)
+		}},
+	}
+
+	for _, route := range routes {
+		mux := http.NewServeMux()
+		mux.HandleFunc(route.pattern, route.handler)
+		method, _, _ := strings.Cut(route.pattern, " ")
+		send := func(token string) int {
+			req := httptest.NewRequest(method, route.target, strings.NewReader(`{}`))
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		t.Setenv("ADMIN_TOKEN", "")
+		if code := send("admin"); code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 without ADMIN_TOKEN, got %d", route.pattern, code)
+		}
+		t.Setenv("ADMIN_TOKEN", "admin")
+		if code := send(""); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 without a token, got %d", route.pattern, code)
+		}
+		if code := send("wrong"); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401 with a wrong token, got %d", route.pattern, code)
+		}
+	}
+}
+
+func TestRedisMigration(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	// Data of a Redis-backed version, which numbered the sources from 0.
+	redis, err := NewRedis(map[string]any{
+		"stream:news":       map[string]string{"title": "News", "tvg_id": "news", "group_name": "Old", "logo_url": provider.URL + "/news.png"},
+		"stream:news:url:0": provider.URL + "/live/1.ts",
+		"stream:kids":       map[string]string{"title": "Kids"},
+		"stream:kids:urls":  map[string]string{"0": provider.URL + "/live/1.ts"},
+		"stream:incomplete": map[string]string{"title": "Incomplete"},
+		"m3u_0_concurrency": "2",
+		"streams_sorted":    "ignored",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(redis.Close)
+	t.Setenv("REDIS_ADDR", redis.Addr())
+
+	store.ClearCache()
+	t.Cleanup(store.ClearCache)
+	if err := store.MigrateRedis(context.Background()); err != nil {
+		t.Fatalf("Error migrating: %v", err)
+	}
+
+	news, ok := store.GetStreamByTitle("News")
+	if !ok || news.TvgID != "news" || news.Group != "Old" || news.URLs["1"]["0"] != provider.URL+"/live/1.ts" {
+		t.Fatalf("Expected the channel to be imported for M3U_URL_1, got %+v", news)
+	}
+
+	// Served without a sync.
+	urls := playlistURLs(t, "/playlist.m3u")
+	if len(urls) != 2 || urls["News"] == "" || urls["Kids"] == "" {
+		t.Fatalf("Expected the imported channels in the playlist, got %v", urls)
+	}
+	w := httptest.NewRecorder()
+	handlers.StreamHandler(w, httptest.NewRequest("GET", urls["Kids"], nil), store.NewConcurrencyManager())
+	if !bytes.HasPrefix(w.Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Error("Expected the imported channel to be streamed")
+	}
+
+	// The first sync replaces the imported channels, which are not imported
+	// again.
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	redis.Close()
+	if err := store.MigrateRedis(context.Background()); err != nil {
+		t.Errorf("Expected no migration once synced, got %v", err)
+	}
+	if _, ok := playlistURLs(t, "/playlist.m3u")["News"]; ok {
+		t.Error("Expected the imported channels to be replaced by the sync")
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	provider := NewProvider(Healthy, 'a')
+	setup(t, provider)
+	t.Setenv("M3U_MAX_CONCURRENCY_DEFAULT", "3")
+	t.Setenv("M3U_QUERY_PARAMS_1", "password=secret")
+	t.Setenv("ADMIN_TOKEN", "")
+
+	get := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handlers.ConfigHandler(w, req)
+		if w.Code == http.StatusOK && strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("Expected secrets to be redacted, got %s", w.Body.String())
+		}
+		return w.Code
+	}
+	if code := get(""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without ADMIN_TOKEN, got %d", code)
+	}
+	t.Setenv("ADMIN_TOKEN", "admin")
+	if code := get("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", code)
+	}
+	if code := get("admin"); code != http.StatusOK {
+		t.Errorf("Expected 200 with the token, got %d", code)
+	}
+
+	config := updater.GetEffectiveConfig()
+	for _, setting := range config.Settings {
+		switch setting.Key {
+		case "PORT":
+			if setting.Set || setting.Value != "8080" {
+				t.Errorf("Expected the default PORT, got %+v", setting)
+			}
+		case "ADMIN_TOKEN":
+			if !setting.Set || setting.Value == "admin" {
+				t.Errorf("Expected ADMIN_TOKEN to be redacted, got %+v", setting)
+			}
+		}
+	}
+
+	if len(config.Sources) != 1 {
+		t.Fatalf("Expected 1 source, got %+v", config.Sources)
+	}
+	source := config.Sources[0]
+	if source.MaxConcurrency != 3 || strings.Contains(source.URL, "playlist.m3u") || !strings.HasPrefix(source.URL, "http://127.0.0.1:") {
+		t.Errorf("Expected the source with its default concurrency and redacted URL, got %+v", source)
+	}
+	if len(source.Overrides) != 1 || source.Overrides[0].Key != "M3U_QUERY_PARAMS_1" {
+		t.Errorf("Expected the query params override of the source, got %+v", source.Overrides)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	expired := NewProvider(TokenExpiry, 0x01)
+	setup(t, expired, NewProvider(Endless, 0x02))
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "0")
+	store.GetStreams()
+
+	// Uses up the only request the first provider serves.
+	if resp, err := http.Get(expired.URL + "/live/1.ts"); err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	selftest := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlers.SelfTestHandler(w, httptest.NewRequest("GET", "/api/selftest?"+query, nil), store.NewConcurrencyManager())
+		return w
+	}
+
+	if w := selftest("channel=Unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown channel, got %d", w.Code)
+	}
+
+	w := selftest("channel=Live&seconds=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report proxy.SelfTestReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	if !report.OK || report.Source != "2|0" || report.Playlist {
+		t.Errorf("Expected the stream to be read from the second source, got %+v", report)
+	}
+	if len(report.Attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %+v", report.Attempts)
+	}
+	if failed := report.Attempts[0]; failed.Source != "1|0" || failed.Status != http.StatusForbidden || failed.Error == "" || failed.Bytes != 0 {
+		t.Errorf("Expected the failed attempt of the first source, got %+v", failed)
+	}
+	if streamed := report.Attempts[1]; streamed.Bytes == 0 || streamed.ThroughputKbps <= 0 || strings.Contains(w.Body.String(), "127.0.0.1") {
+		t.Errorf("Expected the data of the second source without its URL, got %+v", streamed)
+	}
+}
+
+// goneClientRecorder is the response of a client whose connection broke
+// without the request being canceled, e.g. behind a buffering reverse proxy.
+type goneClientRecorder struct {
+	*httptest.ResponseRecorder
+	gone atomic.Bool
+}
+
+func (r *goneClientRecorder) FlushError() error {
+	if r.gone.Load() {
+		return errors.New("connection reset by peer")
+	}
+	r.ResponseRecorder.Flush()
+	return nil
+}
+
+func TestPostPassthrough(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	post := func(req *http.Request) {
+		req.Method = "POST"
+		req.Body = io.NopCloser(strings.NewReader(`{"session": "setup"}`))
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// The response is not a playlist and is passed on as it is.
+	w := request(t, "Live", post)
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), bytes.Repeat(first.Packet(), first.Packets)) {
+		t.Fatalf("Expected the response of the first provider as it is, got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+
+	// A failed POST is not sent again to the other sources.
+	first.Close()
+	if w := request(t, "Live", post); w.Code == 200 {
+		t.Errorf("Expected the POST to fail with its source, got status %d", w.Code)
+	}
+	if n := second.Requests("/live/1.ts"); n != 0 {
+		t.Errorf("Expected the POST not to be retried on the second provider, got %d requests", n)
+	}
+}
+
+func TestQuietUpstreamKeepsClient(t *testing.T) {
+	first := NewProvider(Pause, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_TIMEOUT", "1")
+	t.Setenv("CLIENT_PROBE_INTERVAL", "1")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	// The probes of the client during the pause must not count as a
+	// timeout of the upstream.
+	out := request(t, "Live").Body.Bytes()
+	if !bytes.HasPrefix(out, bytes.Repeat(first.Packet(), first.Packets)) {
+		t.Fatalf("Expected the whole response of the first provider despite its pause, got %d bytes", len(out))
+	}
+}
+
+func TestDeadClientDetection(t *testing.T) {
+	setup(t, NewProvider(Stall, 0x01))
+	t.Setenv("CLIENT_PROBE_INTERVAL", "1")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	var stream store.StreamInfo
+	for _, s := range store.GetStreams() {
+		if s.Title == "Live" {
+			stream = s
+		}
+	}
+
+	cm := store.NewConcurrencyManager()
+	w := &goneClientRecorder{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handlers.StreamHandler(w, httptest.NewRequest("GET", store.GenerateStreamURL("", stream), nil), cm)
+	}()
+
+	// The upstream stalls after its first data, the client goes away then.
+	time.Sleep(500 * time.Millisecond)
+	if cm.GetCount("1") != 1 {
+		t.Fatalf("Expected the stream to hold a slot of the source, got %d", cm.GetCount("1"))
+	}
+	w.gone.Store(true)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the dead client to be disconnected")
+	}
+	if cm.GetCount("1") != 0 {
+		t.Errorf("Expected the slot of the source to be freed, got %d", cm.GetCount("1"))
+	}
+}
+
+func TestUserAgentPool(t *testing.T) {
+	userAgents := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.UserAgent()
+	}))
+	defer server.Close()
+
+	userAgent := func(ctx context.Context, index string, headers http.Header) string {
+		resp, err := utils.SourceHttpRequestContext(ctx, index, http.MethodGet, server.URL, headers)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return <-userAgents
+	}
+
+	t.Setenv("USER_AGENT", "Default")
+	t.Setenv("USER_AGENT_POOL", "A | B")
+	t.Setenv("M3U_USER_AGENT_POOL_2", "C")
+
+	first := userAgent(context.Background(), "1", nil)
+	second := userAgent(context.Background(), "1", nil)
+	if first == second || (first != "A" && first != "B") || (second != "A" && second != "B") {
+		t.Errorf("Expected requests without session to rotate through the pool, got %s and %s", first, second)
+	}
+
+	ctx := utils.WithUserAgentSession(context.Background(), "client")
+	sticky := userAgent(ctx, "1", nil)
+	for range 3 {
+		if got := userAgent(ctx, "1", nil); got != sticky {
+			t.Errorf("Expected the session to keep %s, got %s", sticky, got)
+		}
+	}
+
+	if got := userAgent(ctx, "2", nil); got != "C" {
+		t.Errorf("Expected the pool of the source, got %s", got)
+	}
+	if got := userAgent(ctx, "1", http.Header{"User-Agent": {"Directive"}}); got != "Directive" {
+		t.Errorf("Expected the User-Agent of the playlist to take precedence, got %s", got)
+	}
+
+	t.Setenv("USER_AGENT_POOL", "")
+	if got := userAgent(ctx, "1", nil); got != "Default" {
+		t.Errorf("Expected USER_AGENT without pool, got %s", got)
+	}
+}
+
+func TestCoalescedProbes(t *testing.T) {
+	first := NewProvider(NotFoundMidStream, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("M3U_MAX_CONCURRENCY_DEFAULT", "100")
+	// Keeps the first run in flight while the others start.
+	t.Setenv("CHAOS_CHANNELS", "Live")
+	t.Setenv("CHAOS_LATENCY_MS", "200")
+
+	// The channel of the first provider went offline.
+	if resp, err := http.Get(first.URL + "/live/1.ts"); err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	store.GetStreams()
+	info, _ := store.GetStreamByTitle("Live")
+
+	const clients = 20
+	cm := store.NewConcurrencyManager()
+	var wg sync.WaitGroup
+	sources := make(chan string, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream := &proxy.StreamInstance{Info: info, Cm: cm}
+			session := store.Session{ID: strconv.Itoa(i)}
+			resp, _, index, _, err := stream.LoadBalancer(context.Background(), &session, http.MethodGet)
+			if err != nil {
+				t.Errorf("Load balancer failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+			sources <- index
+		}()
+	}
+	wg.Wait()
+	close(sources)
+
+	for index := range sources {
+		if index != "2" {
+			t.Errorf("Expected every client to get the second source, got %s", index)
+		}
+	}
+	if n := first.Requests("/live/1.ts"); n != 2 {
+		t.Errorf("Expected the offline source to be probed once, got %d requests", n-1)
+	}
+	if n := second.Requests("/live/1.ts"); n != clients {
+		t.Errorf("Expected one request per client to the second source, got %d", n)
+	}
+}
+
+func TestConcurrentFirstRequests(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	t.Setenv("M3U_MAX_CONCURRENCY_DEFAULT", "1000")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	var target string
+	for _, stream := range store.GetStreams() {
+		if stream.Title == "Live" {
+			target = store.GenerateStreamURL("", stream)
+		}
+	}
+
+	const clients = 100
+	cm := store.NewConcurrencyManager()
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", target, nil)
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+			w := httptest.NewRecorder()
+			handlers.StreamHandler(w, req, cm)
+			if w.Code != http.StatusOK || w.Body.Len() != provider.Packets*tsPacketSize {
+				t.Errorf("Expected the whole stream, got status %d with %d bytes", w.Code, w.Body.Len())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count := cm.GetCount("1"); count != 0 {
+		t.Errorf("Expected every concurrency slot to be released, got %d", count)
+	}
+	if running := proxy.RunningStreams(); len(running) != 0 {
+		t.Errorf("Expected no running stream left, got %d", len(running))
+	}
+	if n := provider.Requests("/live/1.ts"); n != clients {
+		t.Errorf("Expected one upstream request per client, got %d", n)
+	}
+}
+
+func TestPreferredSource(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("ADMIN_TOKEN", "admin")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/channels/{id}/prefer-source", handlers.ChannelPreferSourceHandler)
+	setPreferred := func(source string) {
+		method, body := "POST", `{"source": "`+source+`"}`
+		if source == "" {
+			method, body = "DELETE", ""
+		}
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/channels/Live/prefer-source", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	setPreferred("2")
+	t.Cleanup(func() { setPreferred("") })
+	if pin := store.GetChannelPin("Live"); pin.PreferredSource != "2" || pin.PinnedSource != "" {
+		t.Fatalf("Expected the second source to be preferred, got %+v", pin)
+	}
+
+	// The preferred source is tried first, the other one is still used once
+	// it ended.
+	assertFailover(t, request(t, "Live").Body.Bytes(), second, first)
+
+	// The prefer query parameter takes precedence.
+	assertFailover(t, request(t, "Live", func(r *http.Request) {
+		r.URL.RawQuery = "prefer=1"
+	}).Body.Bytes(), first, second)
+
+	setPreferred("")
+	assertFailover(t, request(t, "Live").Body.Bytes(), first, second)
+}
+
+func TestSourceQueryPins(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+
+	forceSecond := func(r *http.Request) {
+		r.URL.RawQuery = "source=2"
+	}
+
+	if err := store.ExcludeChannelSource("Live", "2", true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.ExcludeChannelSource("Live", "2", false) })
+	if w := request(t, "Live", forceSecond); w.Code != 403 {
+		t.Fatalf("Expected status 403 for an excluded source, got %d", w.Code)
+	}
+	if n := second.Requests("/live/1.ts"); n != 0 {
+		t.Errorf("Expected no request to the excluded source, got %d", n)
+	}
+
+	if err := store.ExcludeChannelSource("Live", "2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PinChannelSource("Live", "1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.PinChannelSource("Live", "") })
+	if w := request(t, "Live", forceSecond); w.Code != 403 {
+		t.Fatalf("Expected status 403 for a source other than the pinned one, got %d", w.Code)
+	}
+
+	if err := store.PinChannelSource("Live", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if w := request(t, "Live", forceSecond); w.Code != 200 || !bytes.HasPrefix(w.Body.Bytes(), second.Packet()) {
+		t.Errorf("Expected the stream from the pinned source, got status %d", w.Code)
+	}
+}
+
+func TestQualityProbe(t *testing.T) {
+	first := NewProvider(Healthy, 0x01)
+	second := NewProvider(Healthy, 0x02)
+	setup(t, first, second)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("QUALITY_PROBE", "true")
+	t.Setenv("QUALITY_PROBE_SECONDS", "1")
+	store.GetStreams()
+
+	// Stands in for ffprobe, answering that the stream of the second
+	// provider is the one in full HD.
+	ffprobe := filepath.Join(t.TempDir(), "ffprobe")
+	script := "#!/bin/sh\nmarker=$(od -An -tx1 -j1 -N1 | tr -d ' \\n')\nheight=720\n[ \"$marker\" = \"02\" ] && height=1080\necho \"{\\\"streams\\\": [{\\\"width\\\": 1280, \\\"height\\\": $height}]}\"\n"
+	if err := os.WriteFile(ffprobe, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FFPROBE_PATH", ffprobe)
+	t.Setenv("ADMIN_TOKEN", "admin")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/channels/{id}/quality", handlers.ChannelQualityHandler)
+	quality := func(method string) map[string]store.SourceQuality {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/channels/Live/quality", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, req)
+		var qualities map[string]store.SourceQuality
+		if err := json.Unmarshal(w.Body.Bytes(), &qualities); w.Code != 200 || err != nil {
+			t.Fatalf("Expected the qualities, got status %d: %s", w.Code, w.Body.String())
+		}
+		return qualities
+	}
+	t.Cleanup(func() { quality("DELETE") })
+
+	proxy.PreresolveChannels(context.Background(), []string{"Live"})
+	qualities := quality("GET")
+	if len(qualities) != 2 || qualities["2|0"].Height != 1080 || qualities["1|0"].Height != 720 || qualities["1|0"].BitrateKbps == 0 {
+		t.Fatalf("Expected the quality of both sources to be recorded, got %+v", qualities)
+	}
+
+	// The full HD source is tried first.
+	assertFailover(t, request(t, "Live").Body.Bytes(), second, first)
+
+	if qualities := quality("DELETE"); len(qualities) != 0 {
+		t.Fatalf("Expected the qualities to be forgotten, got %+v", qualities)
+	}
+	assertFailover(t, request(t, "Live").Body.Bytes(), first, second)
+}
+
+func TestVODLibrary(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+
+	playlist := filepath.Join(t.TempDir(), "series.m3u")
+	content := "#EXTM3U\n" +
+		"#EXTINF:-1 group-title=\"Drama\",The Show S01 E02\nhttp://provider.invalid/series/user/pass/2.mkv\n" +
+		"#EXTINF:-1 group-title=\"Drama\" tvg-logo=\"http://provider.invalid/show.png\",The Show S01 E01\nhttp://provider.invalid/series/user/pass/1.mkv\n" +
+		"#EXTINF:-1 group-title=\"TV Shows\",The Show - 2x01\nhttp://provider.invalid/show/3.mkv\n" +
+		"#EXTINF:-1 group-title=\"VOD | Action\",Another Movie\nhttp://provider.invalid/vod/4.mkv\n"
+	if err := os.WriteFile(playlist, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("M3U_URL_2", "file://"+playlist)
+	utils.LoadSourceEnv()
+	if err := store.DownloadM3USource(context.Background(), "2"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+	store.GetStreams()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/vod", handlers.VODHandler)
+	mux.HandleFunc("/api/series/{id}/episodes", handlers.SeriesEpisodesHandler)
+	get := func(target string, v any) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+		}
+		return w.Code
+	}
+
+	var items []store.LibraryItem
+	get("/api/vod", &items)
+	if len(items) != 3 {
+		t.Fatalf("Expected the series and two movies, got %+v", items)
+	}
+
+	var movies []store.LibraryItem
+	get("/api/vod?type=movie", &movies)
+	if len(movies) != 2 || movies[0].Title != "Another Movie" || movies[1].Title != "Movie" || !strings.Contains(movies[0].URL, "/p/") {
+		t.Errorf("Expected both movies with their stream URLs, got %+v", movies)
+	}
+
+	var series []store.LibraryItem
+	get("/api/vod?type=series&title=show", &series)
+	if len(series) != 1 || series[0].Title != "The Show" || series[0].Seasons != 2 || series[0].Episodes != 3 || series[0].LogoURL == "" {
+		t.Fatalf("Expected the episodes to be gathered into one series, got %+v", series)
+	}
+
+	var episodes []store.Episode
+	if code := get("/api/series/"+series[0].ID+"/episodes", &episodes); code != 200 {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if len(episodes) != 3 || episodes[0].Title != "The Show S01 E01" || episodes[1].Episode != 2 || episodes[2].Season != 2 {
+		t.Errorf("Expected the episodes by season and episode number, got %+v", episodes)
+	}
+
+	if code := get("/api/series/unknown/episodes", &episodes); code != 404 {
+		t.Errorf("Expected status 404 for an unknown series, got %d", code)
+	}
+	if code := get("/api/vod?type=live", &items); code != 400 {
+		t.Errorf("Expected status 400 for an invalid type, got %d", code)
+	}
+}
+
+func TestVODProgress(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	movie := provider.Movie()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/vod/{id}/progress", handlers.VODProgressHandler)
+	progress := func(method string) (int, store.VODProgress) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, "/api/vod/Movie/progress?user=alice", nil))
+		var progress store.VODProgress
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+				t.Fatalf("Invalid response: %v", err)
+			}
+		}
+		return w.Code, progress
+	}
+	t.Cleanup(func() { progress("DELETE") })
+
+	seek := func(byteRange string) *httptest.ResponseRecorder {
+		return request(t, "Movie", func(r *http.Request) {
+			r.URL.RawQuery = "user=alice"
+			r.Header.Set("Range", byteRange)
+		})
+	}
+
+	// Seeking is passed on to the provider.
+	w := seek("bytes=100-")
+	if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), movie[100:]) {
+		t.Fatalf("Expected the movie from byte 100, got status %d and %d bytes", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Range") != fmt.Sprintf("bytes 100-%d/%d", len(movie)-1, len(movie)) {
+		t.Errorf("Expected the Content-Range of the provider, got %q", w.Header().Get("Content-Range"))
+	}
+	if code, got := progress("GET"); code != 200 || got.Offset != int64(len(movie)) || got.Length != int64(len(movie)) {
+		t.Errorf("Expected the movie to be watched to the end, got status %d and %+v", code, got)
+	}
+
+	seek("bytes=0-9")
+	if code, got := progress("GET"); code != 200 || got.Offset != 10 {
+		t.Errorf("Expected the progress to be the end of the last range, got status %d and %+v", code, got)
+	}
+
+	if code, _ := progress("DELETE"); code != 204 {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	if code, _ := progress("GET"); code != 404 {
+		t.Errorf("Expected no progress once forgotten, got status %d", code)
+	}
+}
+
+func TestPlaylistPages(t *testing.T) {
+	setup(t, NewProvider(Healthy, 0x01))
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Error generating the playlist: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handlers.GroupsHandler(w, httptest.NewRequest("GET", "/api/groups", nil))
+	var groups []store.PlaylistGroup
+	if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil || w.Code != 200 {
+		t.Fatalf("Expected the groups, got status %d: %s", w.Code, w.Body.String())
+	}
+	if len(groups) != 2 || groups[0] != (store.PlaylistGroup{Name: "Live", Channels: 2}) || groups[1] != (store.PlaylistGroup{Name: "Movies", Channels: 1}) {
+		t.Errorf("Expected the groups in playlist order with their channels, got %+v", groups)
+	}
+
+	page := func(target string) (map[string]string, string) {
+		w := httptest.NewRecorder()
+		handlers.M3UHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "#EXTM3U\n") {
+			t.Fatalf("Expected a playlist, got status %d: %s", w.Code, w.Body.String())
+		}
+		return playlistURLs(t, target), w.Header().Get("X-Total-Count")
+	}
+
+	all, _ := page("/playlist.m3u")
+	first, total := page("/playlist.m3u?limit=2")
+	rest, _ := page("/playlist.m3u?offset=2")
+	if len(first) != 2 || len(rest) != 1 || total != "3" {
+		t.Fatalf("Expected pages of 2 and 1 of the 3 channels, got %v and %v of %s", first, rest, total)
+	}
+	for title, url := range rest {
+		if _, ok := first[title]; ok || all[title] != url {
+			t.Errorf("Expected %s to only be on the second page with the same URL", title)
+		}
+	}
+
+	live, total := page("/playlist.m3u?group=Live&offset=1&limit=5")
+	if len(live) != 1 || total != "2" {
+		t.Errorf("Expected the second channel of the group, got %v of %s", live, total)
+	}
+
+	w = httptest.NewRecorder()
+	handlers.M3UHandler(w, httptest.NewRequest("GET", "/playlist.m3u?sources=1&limit=1", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for a page of a sources playlist, got %d", w.Code)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	setup(t, NewProvider(Healthy, 0x01))
+
+	playlist := func() string {
+		req := httptest.NewRequest("GET", "/playlist.m3u", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "tv.example.com")
+		w := httptest.NewRecorder()
+		handlers.M3UHandler(w, req)
+		return w.Body.String()
+	}
+
+	if out := playlist(); strings.Contains(out, "tv.example.com") || !strings.Contains(out, "http://example.com/") {
+		t.Errorf("Expected the forwarded headers of a client to be ignored, got %s", out)
+	}
+
+	// httptest requests come from 192.0.2.1.
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	if out := playlist(); !strings.Contains(out, "https://tv.example.com/") {
+		t.Errorf("Expected the forwarded headers of a trusted proxy to be used, got %s", out)
+	}
+}
+
+func TestCustomChannels(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	camera := NewProvider(Healthy, 0x02)
+	t.Cleanup(camera.Close)
+	setup(t, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("ADMIN_TOKEN", "admin")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/channels", handlers.CustomChannelAddHandler)
+	mux.HandleFunc("DELETE /api/channels/{id}", handlers.CustomChannelRemoveHandler)
+	send := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// The camera is on the loopback address, refused unless allowed.
+	for _, body := range []string{
+		`{"title": "Door Camera", "url": "` + camera.URL + `/live/1.ts"}`,
+		`{"title": "Door Camera", "url": "http://169.254.169.254/latest/meta-data/"}`,
+	} {
+		if w := send("POST", "/api/channels", body); w.Code != 400 {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+	t.Setenv("API_ALLOWED_STREAM_HOSTS", "127.0.0.1")
+
+	for _, body := range []string{
+		`{"url": "` + camera.URL + `/live/1.ts"}`,
+		`{"title": "Door Camera", "url": "ftp://camera/1.ts"}`,
+		`{"title": "Door Camera", "url": "http://169.254.169.254/latest/meta-data/"}`,
+		`{"title": "Door Camera"`,
+	} {
+		if w := send("POST", "/api/channels", body); w.Code != 400 {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+
+	w := send("POST", "/api/channels", `{"title": "Door Camera", "group": "Home", "url": "`+camera.URL+`/live/1.ts", "logo": "`+camera.URL+`/logo.png"}`)
+	if w.Code != 201 {
+		t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	t.Cleanup(func() { _, _ = store.RemoveCustomChannel("Door Camera") })
+
+	// Injected channels are merged into the playlist by the syncs.
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Error generating the playlist: %v", err)
+	}
+	urls := playlistURLs(t, "/playlist.m3u?group=Home")
+	if len(urls) != 1 || urls["Door Camera"] == "" {
+		t.Fatalf("Expected the injected channel in its group, got %v", urls)
+	}
+	if _, ok := playlistURLs(t, "/playlist.m3u")["Live"]; !ok {
+		t.Error("Expected the channels of the sources to be kept")
+	}
+
+	out := request(t, "Door Camera").Body.Bytes()
+	if !bytes.HasPrefix(out, bytes.Repeat(camera.Packet(), camera.Packets)) {
+		t.Error("Expected the injected channel to be streamed from its URL")
+	}
+
+	if w := send("DELETE", "/api/channels/Door%20Camera", ""); w.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+	if w := send("DELETE", "/api/channels/Door%20Camera", ""); w.Code != 404 {
+		t.Errorf("Expected status 404 for a removed channel, got %d", w.Code)
+	}
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Error generating the playlist: %v", err)
+	}
+	if _, ok := playlistURLs(t, "/playlist.m3u")["Door Camera"]; ok {
+		t.Error("Expected the removed channel to be dropped from the playlist")
+	}
+}
+
+func TestLocalPlaylist(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	local := NewProvider(Healthy, 0x02)
+	t.Cleanup(local.Close)
+	setup(t, provider)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("API_ALLOWED_STREAM_HOSTS", "127.0.0.1")
+	t.Setenv("ADMIN_TOKEN", "admin")
+
+	// Edited by hand before, the comments are kept by the API.
+	if err := os.MkdirAll(filepath.Dir(store.LocalPlaylistPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.LocalPlaylistPath, []byte("#EXTM3U\n# Living room\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(store.LocalPlaylistPath) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/local.m3u", handlers.LocalPlaylistHandler)
+	mux.HandleFunc("POST /api/local/entries", handlers.LocalEntryAddHandler)
+	mux.HandleFunc("DELETE /api/local/entries/{title}", handlers.LocalEntryRemoveHandler)
+	send := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, body := range []string{
+		`{"title": "Live", "url": "` + local.URL + `/live/1.ts", "group": "Live\n#EXTINF:-1,Other"}`,
+		`{"title": "Live", "url": "/live/1.ts"}`,
+	} {
+		if w := send("POST", "/api/local/entries", body); w.Code != 400 {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+	for _, body := range []string{
+		`{"title": "Live", "group": "Live", "url": "` + local.URL + `/live/1.ts"}`,
+		`{"title": "Kids \"TV\"", "group": "Family", "url": "` + local.URL + `/live/1.ts", "tvg_id": "kids"}`,
+	} {
+		if w := send("POST", "/api/local/entries", body); w.Code != 201 {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := send("GET", "/local.m3u", "")
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "#EXTM3U\n# Living room\n#EXTINF:-1 tvg-name=\"Live\" group-title=\"Live\",Live\n"+local.URL+"/live/1.ts\n") {
+		t.Fatalf("Expected the local playlist with the entries appended, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Error generating the playlist: %v", err)
+	}
+	urls := playlistURLs(t, "/playlist.m3u")
+	if urls["Kids \"TV\""] == "" || urls["Live"] == "" || urls["Movie"] == "" {
+		t.Fatalf("Expected the local playlist to be merged with the sources, got %v", urls)
+	}
+
+	// The local playlist is tried first, the source once it ended.
+	assertFailover(t, request(t, "Live").Body.Bytes(), local, provider)
+
+	if w := send("DELETE", "/api/local/entries/Live", ""); w.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", w.Code)
+	}
+	if w := send("DELETE", "/api/local/entries/Live", ""); w.Code != 404 {
+		t.Errorf("Expected status 404 for a removed entry, got %d", w.Code)
+	}
+	w = send("GET", "/local.m3u", "")
+	if strings.Contains(w.Body.String(), "/live/1.ts\n#") || !strings.Contains(w.Body.String(), "# Living room\n#EXTINF:-1 tvg-id=\"kids\"") {
+		t.Errorf("Expected only the entry of the channel to be removed, got %s", w.Body.String())
+	}
+
+	if !bytes.HasPrefix(request(t, "Live").Body.Bytes(), bytes.Repeat(provider.Packet(), provider.Packets)) {
+		t.Error("Expected the channel to be streamed from the source once removed from the local playlist")
+	}
+}
+
+func TestQualityOrder(t *testing.T) {
+	sd := NewProvider(Healthy, 0x01)
+	hd := NewProvider(Healthy, 0x02)
+	t.Cleanup(sd.Close)
+	t.Cleanup(hd.Close)
+	setup(t)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("TITLE_SUBSTR_FILTER", " (SD|HD)$")
+
+	// Both variants are merged into the News channel of the same source.
+	playlist := "#EXTM3U\n#EXTINF:-1,News SD\n" + sd.URL + "/live/1.ts\n#EXTINF:-1,News HD\n" + hd.URL + "/live/1.ts\n"
+	if err := os.MkdirAll(filepath.Dir(store.LocalPlaylistPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.LocalPlaylistPath, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(store.LocalPlaylistPath) })
+
+	// The entries are tried in playlist order by default.
+	assertFailover(t, request(t, "News").Body.Bytes(), sd, hd)
+
+	t.Setenv("QUALITY_ORDER", "(?i)\\bfhd\\b,(?i)\\bhd\\b")
+	assertFailover(t, request(t, "News", func(r *http.Request) {
+		r.Header.Set("User-Agent", "quality-order")
+	}).Body.Bytes(), hd, sd)
+}
+
+func TestQualityVariants(t *testing.T) {
+	sd := NewProvider(Healthy, 0x01)
+	hd := NewProvider(Healthy, 0x02)
+	t.Cleanup(sd.Close)
+	t.Cleanup(hd.Close)
+	setup(t)
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("QUALITY_VARIANTS", "true")
+
+	playlist := "#EXTM3U\n#EXTINF:-1,News SD\n" + sd.URL + "/live/1.ts\n#EXTINF:-1,News (HD)\n" + hd.URL + "/live/1.ts\n"
+	if err := os.MkdirAll(filepath.Dir(store.LocalPlaylistPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(store.LocalPlaylistPath, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(store.LocalPlaylistPath) })
+
+	if err := store.RegenerateM3U(context.Background()); err != nil {
+		t.Fatalf("Error generating the playlist: %v", err)
+	}
+	urls := playlistURLs(t, "/playlist.m3u")
+	if urls["News"] == "" || urls["News SD"] != "" || urls["News (HD)"] != "" {
+		t.Fatalf("Expected the variants to be merged into News, got %v", urls)
+	}
+
+	variantURLs := playlistURLs(t, "/playlist.m3u?variants=all")
+	if !strings.HasSuffix(variantURLs["News HD"], "?quality=hd") || !strings.HasSuffix(variantURLs["News SD"], "?quality=sd") || variantURLs["News"] != "" {
+		t.Fatalf("Expected an entry per variant, got %v", variantURLs)
+	}
+
+	quality := func(variant string) func(*http.Request) {
+		return func(r *http.Request) {
+			r.URL.RawQuery = "quality=" + variant
+		}
+	}
+	if output := request(t, "News", quality("hd")).Body.Bytes(); !bytes.Equal(output, bytes.Repeat(hd.Packet(), hd.Packets)) {
+		t.Errorf("Expected only the HD variant to be streamed, got %d bytes", len(output))
+	}
+	if w := request(t, "News", quality("4k")); w.Code != 404 {
+		t.Errorf("Expected status 404 for a missing variant, got %d", w.Code)
+	}
+	// Without a variant, the channel fails over across all of them.
+	assertFailover(t, request(t, "News").Body.Bytes(), sd, hd)
+}
+
+func TestSyncOnce(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+
+	run := updater.SyncOnce(context.Background())
+	if run.Status != store.SyncCompleted || !slices.Equal(run.Sources, []string{"1"}) || len(run.Errors) > 0 {
+		t.Fatalf("Expected a completed sync of the source, got %+v", run)
+	}
+	if history := store.GetSyncHistory(); len(history) == 0 || !history[0].Start.Equal(run.Start) {
+		t.Error("Expected the sync to be recorded in the history")
+	}
+}
+
+func TestPlaylistSyncProgress(t *testing.T) {
+	provider := NewProvider(Healthy, 0x01)
+	setup(t, provider)
+	store.ClearCache()
+
+	// A second source whose playlist is only served once released, keeping
+	// the first sync underway.
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		provider.playlistHandler(w, r)
+	}))
+	t.Cleanup(slow.Close)
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	t.Setenv("M3U_URL_2", slow.URL+"/playlist.m3u")
+	utils.LoadSourceEnv()
+
+	done := make(chan store.SyncRun, 1)
+	go func() { done <- updater.SyncOnce(context.Background()) }()
+
+	progress := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/playlist.m3u", nil)
+		req.Header.Set("Accept", "text/html, application/json;q=0.9")
+		w := httptest.NewRecorder()
+		handlers.M3UHandler(w, req)
+		return w
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if status, ok := store.GetSyncProgress(); ok && status.SourcesDone == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the first source to be fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := progress()
+	var status store.SyncProgress
+	if err := json.Unmarshal(w.Body.Bytes(), &status); w.Code != 202 || err != nil {
+		t.Fatalf("Expected the progress of the sync, got status %d: %s", w.Code, w.Body.String())
+	}
+	if status.Phase != store.SyncPhaseFetching || status.SourcesDone != 1 || status.SourcesTotal != 2 || status.StartedAt.IsZero() {
+		t.Errorf("Expected one of the two sources fetched, got %+v", status)
+	}
+
+	unblock()
+	if run := <-done; run.Status != store.SyncCompleted {
+		t.Fatalf("Expected the sync to complete, got %+v", run)
+	}
+	if _, ok := store.GetSyncProgress(); ok {
+		t.Error("Expected no sync to be running anymore")
+	}
+
+	// Once the sync is over, the playlist is generated as usual.
+	if w := progress(); w.Code != 200 || !strings.Contains(w.Body.String(), "#EXTINF") {
+		t.Errorf("Expected the playlist, got status %d", w.Code)
+	}
+}
@@ -0,0 +1,222 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tsPacketSize = 188
+
+// Failure is a scripted failure mode of a Provider.
+type Failure int
+
+const (
+	// Healthy serves every request.
+	Healthy Failure = iota
+	// NotFoundMidStream ends the first TS response early and answers 404 to
+	// the following requests, like a channel going offline.
+	NotFoundMidStream
+	// Stall stops sending the first TS response without closing the
+	// connection.
+	Stall
+	// TokenExpiry answers 403 to every request after the first one, like a
+	// provider whose stream token expired.
+	TokenExpiry
+	// PlaylistReset restarts the HLS media sequence at 0 after the first
+	// playlist, like a provider restarting its packager.
+	PlaylistReset
+	// Endless keeps sending the TS response until the client disconnects,
+	// like a live channel that never fails.
+	Endless
+	// Pause stops sending the first TS response for a few seconds after its
+	// first chunk, like a live channel with a quiet period.
+	Pause
+)
+
+// Provider is a synthetic IPTV provider serving a live TS channel, a live HLS
+// channel and a VOD movie, with a scripted failure mode. The channel titles
+// are the same for every provider so they are merged by the proxy.
+type Provider struct {
+	*httptest.Server
+	Failure Failure
+	// Marker fills the payload of everything the provider sends, to tell the
+	// providers apart in the output.
+	Marker byte
+	// Packets is the number of TS packets of a live TS response.
+	Packets int
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func NewProvider(failure Failure, marker byte) *Provider {
+	provider := &Provider{
+		Failure:  failure,
+		Marker:   marker,
+		Packets:  100,
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/playlist.m3u", provider.playlistHandler)
+	mux.HandleFunc("/live/", provider.tsHandler)
+	mux.HandleFunc("/hls/", provider.hlsHandler)
+	mux.HandleFunc("/movie/", provider.movieHandler)
+
+	provider.Server = httptest.NewServer(mux)
+	return provider
+}
+
+// PlaylistURL returns the URL to be used as M3U_URL_X.
+func (p *Provider) PlaylistURL() string {
+	return p.URL + "/playlist.m3u"
+}
+
+// Requests returns how many requests were made for path.
+func (p *Provider) Requests(path string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.requests[path]
+}
+
+// Movie returns the content of the VOD movie.
+func (p *Provider) Movie() []byte {
+	return bytes.Repeat([]byte{p.Marker}, 256*1024)
+}
+
+// Packet returns a TS packet of the live channel.
+func (p *Provider) Packet() []byte {
+	packet := bytes.Repeat([]byte{p.Marker}, tsPacketSize)
+	packet[0] = 0x47
+	return packet
+}
+
+// request counts a request and returns its number for the path, starting
+// at 1.
+func (p *Provider) request(r *http.Request) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requests[r.URL.Path]++
+	return p.requests[r.URL.Path]
+}
+
+func (p *Provider) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&playlist, "#EXTINF:-1 tvg-id=\"live\" group-title=\"Live\",Live\n%s/live/1.ts?token=valid\n", p.URL)
+	fmt.Fprintf(&playlist, "#EXTINF:-1 tvg-id=\"hls\" group-title=\"Live\",HLS\n%s/hls/1.m3u8?token=valid\n", p.URL)
+	fmt.Fprintf(&playlist, "#EXTINF:-1 tvg-id=\"movie\" group-title=\"Movies\",Movie\n%s/movie/1.mp4\n", p.URL)
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	_, _ = w.Write([]byte(playlist.String()))
+}
+
+func (p *Provider) tsHandler(w http.ResponseWriter, r *http.Request) {
+	n := p.request(r)
+
+	switch {
+	case p.Failure == NotFoundMidStream && n > 1:
+		http.NotFound(w, r)
+		return
+	case p.Failure == TokenExpiry && n > 1:
+		http.Error(w, "token expired", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	flusher, _ := w.(http.Flusher)
+
+	// Chunks not aligned to packets, as delivered by most providers
+	content := bytes.Repeat(p.Packet(), p.Packets)
+	for start := 0; start < len(content); start += 1000 {
+		if _, err := w.Write(content[start:min(start+1000, len(content))]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if p.Failure == Pause && n == 1 && start == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(2500 * time.Millisecond):
+			}
+		}
+	}
+
+	if p.Failure == Endless {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := w.Write(content[:10*tsPacketSize]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	if p.Failure == Stall && n == 1 {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func (p *Provider) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ".ts") {
+		w.Header().Set("Content-Type", "video/mp2t")
+		_, _ = w.Write(bytes.Repeat(p.Packet(), 100))
+		return
+	}
+
+	n := p.request(r)
+	if p.Failure == TokenExpiry && n > 1 {
+		http.Error(w, "token expired", http.StatusForbidden)
+		return
+	}
+
+	// The playlist advances by one segment per request.
+	mediaSeq := 100 + n - 1
+	if p.Failure == PlaylistReset && n > 1 {
+		mediaSeq = n - 2
+	}
+
+	var playlist strings.Builder
+	fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&playlist, "#EXT-X-PROGRAM-DATE-TIME:%s\n", p.SegmentTime(mediaSeq+i).Format(time.RFC3339Nano))
+		fmt.Fprintf(&playlist, "#EXTINF:2.000,\nseg%d.ts\n", mediaSeq+i)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	_, _ = w.Write([]byte(playlist.String()))
+}
+
+// SegmentTime returns the EXT-X-PROGRAM-DATE-TIME of the HLS segment with
+// the given media sequence number.
+func (p *Provider) SegmentTime(mediaSeq int) time.Time {
+	return time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(mediaSeq) * 2 * time.Second)
+}
+
+func (p *Provider) movieHandler(w http.ResponseWriter, r *http.Request) {
+	p.request(r)
+
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, "1.mp4", time.Time{}, bytes.NewReader(p.Movie()))
+}
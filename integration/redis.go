@@ -0,0 +1,130 @@
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Redis is a fake Redis server holding the data of the Redis-backed versions
+// of the proxy. Values are strings or hashes (map[string]string).
+type Redis struct {
+	listener net.Listener
+	data     map[string]any
+}
+
+func NewRedis(data map[string]any) (*Redis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	redis := &Redis{listener: listener, data: data}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+	return redis, nil
+}
+
+func (r *Redis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *Redis) Close() {
+	_ = r.listener.Close()
+}
+
+func (r *Redis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		var reply strings.Builder
+		switch strings.ToUpper(args[0]) {
+		case "AUTH", "SELECT", "PING":
+			reply.WriteString("+OK\r\n")
+		case "SCAN":
+			// Every key is returned in a single page.
+			var keys []string
+			for key := range r.data {
+				if matched, _ := path.Match(args[3], key); matched {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(&reply, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+			for _, key := range keys {
+				writeBulk(&reply, key)
+			}
+		case "GET":
+			value, ok := r.data[args[1]].(string)
+			if !ok {
+				reply.WriteString("$-1\r\n")
+				break
+			}
+			writeBulk(&reply, value)
+		case "HGETALL":
+			hash, _ := r.data[args[1]].(map[string]string)
+			fmt.Fprintf(&reply, "*%d\r\n", len(hash)*2)
+			for field, value := range hash {
+				writeBulk(&reply, field)
+				writeBulk(&reply, value)
+			}
+		default:
+			fmt.Fprintf(&reply, "-ERR unknown command '%s'\r\n", args[0])
+		}
+
+		if _, err := io.WriteString(conn, reply.String()); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid command: %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeBulk(w *strings.Builder, value string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+}
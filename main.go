@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"m3u-stream-merger/handlers"
+	"m3u-stream-merger/proxy"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/updater"
 	"m3u-stream-merger/utils"
@@ -13,11 +15,49 @@ import (
 )
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// serve runs the proxy: the HTTP server and the scheduled syncs.
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	checkConfig := flags.Bool("check-config", false, "validate the configuration and sources, then exit")
+	_ = flags.Parse(args)
+
+	envErrs := utils.LoadSourceEnv()
+
+	if *checkConfig {
+		for _, err := range envErrs {
+			fmt.Printf("[ERROR] %v\n", err)
+		}
+		issues := updater.ValidateConfig(true)
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if len(envErrs) > 0 || updater.HasConfigErrors(issues) {
+			return 1
+		}
+		fmt.Println("Configuration is valid.")
+		return 0
+	}
+
+	for _, err := range envErrs {
+		utils.SafeLogf("Configuration [ERROR] %v\n", err)
+	}
+	for _, issue := range updater.ValidateConfig(false) {
+		utils.SafeLogf("Configuration %s\n", issue)
+	}
+	// Fails before the first sync, which may take a while.
+	if _, err := utils.ListenAddr(); err != nil {
+		utils.SafeLogFatalf("Invalid listen address: %v", err)
+	}
+
 	// Context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	cm := store.NewConcurrencyManager()
+	go proxy.ReconcileConcurrency(ctx, cm)
 
 	utils.SafeLogln("Starting updater...")
 	_, err := updater.Initialize(ctx)
@@ -39,16 +79,132 @@ func main() {
 	http.HandleFunc("/playlist.m3u", func(w http.ResponseWriter, r *http.Request) {
 		handlers.M3UHandler(w, r)
 	})
+	http.HandleFunc("/lineup.m3u", func(w http.ResponseWriter, r *http.Request) {
+		handlers.LineupM3UHandler(w, r)
+	})
+	http.HandleFunc("/local.m3u", func(w http.ResponseWriter, r *http.Request) {
+		handlers.LocalPlaylistHandler(w, r)
+	})
+	http.HandleFunc("/xmltv.xml", func(w http.ResponseWriter, r *http.Request) {
+		handlers.XMLTVHandler(w, r)
+	})
 	http.HandleFunc("/p/", func(w http.ResponseWriter, r *http.Request) {
 		handlers.StreamHandler(w, r, cm)
 	})
+	http.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
+		handlers.LegacyStreamHandler(w, r, cm)
+	})
+	http.HandleFunc("/c/{slug}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.CatchupHandler(w, r, cm)
+	})
+	http.HandleFunc("GET /api/streams/{id}/snapshot.jpg", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SnapshotHandler(w, r, cm)
+	})
+	http.HandleFunc("GET /api/mapping", func(w http.ResponseWriter, r *http.Request) {
+		handlers.MappingExportHandler(w, r)
+	})
+	http.HandleFunc("POST /api/mapping", func(w http.ResponseWriter, r *http.Request) {
+		handlers.MappingImportHandler(w, r)
+	})
+	http.HandleFunc("POST /api/channels/{id}/pin-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelPinSourceHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{id}/pin-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelPinSourceHandler(w, r)
+	})
+	http.HandleFunc("POST /api/channels/{id}/prefer-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelPreferSourceHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{id}/prefer-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelPreferSourceHandler(w, r)
+	})
+	http.HandleFunc("GET /api/channels/{id}/quality", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelQualityHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{id}/quality", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelQualityHandler(w, r)
+	})
+	http.HandleFunc("POST /api/channels/{id}/exclude-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelExcludeSourceHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{id}/exclude-source", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelExcludeSourceHandler(w, r)
+	})
+	http.HandleFunc("POST /api/sources/{idx}/disable", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SourceDisableHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/sources/{idx}/disable", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SourceDisableHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/sources/{idx}/concurrency", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SourceConcurrencyResetHandler(w, r, cm)
+	})
+	http.HandleFunc("GET /api/stats/buffers", func(w http.ResponseWriter, r *http.Request) {
+		handlers.BufferStatsHandler(w, r)
+	})
+	http.HandleFunc("GET /api/stats/sources", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SourceStatsHandler(w, r)
+	})
+	http.HandleFunc("GET /api/stats/streams", func(w http.ResponseWriter, r *http.Request) {
+		handlers.RunningStreamsHandler(w, r)
+	})
+	http.HandleFunc("GET /api/selftest", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SelfTestHandler(w, r, cm)
+	})
+	http.HandleFunc("GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ConfigHandler(w, r)
+	})
+	http.HandleFunc("GET /api/config/validate", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ConfigValidateHandler(w, r)
+	})
+	http.HandleFunc("GET /api/sync/history", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SyncHistoryHandler(w, r)
+	})
+	http.HandleFunc("GET /api/channels", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ChannelsQueryHandler(w, r)
+	})
+	http.HandleFunc("POST /api/channels", func(w http.ResponseWriter, r *http.Request) {
+		handlers.CustomChannelAddHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/channels/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.CustomChannelRemoveHandler(w, r)
+	})
+	http.HandleFunc("POST /api/local/entries", func(w http.ResponseWriter, r *http.Request) {
+		handlers.LocalEntryAddHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/local/entries/{title}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.LocalEntryRemoveHandler(w, r)
+	})
+	http.HandleFunc("GET /api/groups", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GroupsHandler(w, r)
+	})
+	http.HandleFunc("GET /api/vod", func(w http.ResponseWriter, r *http.Request) {
+		handlers.VODHandler(w, r)
+	})
+	http.HandleFunc("GET /api/vod/{id}/progress", func(w http.ResponseWriter, r *http.Request) {
+		handlers.VODProgressHandler(w, r)
+	})
+	http.HandleFunc("DELETE /api/vod/{id}/progress", func(w http.ResponseWriter, r *http.Request) {
+		handlers.VODProgressHandler(w, r)
+	})
+	http.HandleFunc("GET /api/series/{id}/episodes", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SeriesEpisodesHandler(w, r)
+	})
+	http.HandleFunc("GET /api/channels/collisions", func(w http.ResponseWriter, r *http.Request) {
+		handlers.SlugCollisionsHandler(w, r)
+	})
 
 	// Start the server
-	utils.SafeLogln(fmt.Sprintf("Server is running on port %s...", os.Getenv("PORT")))
+	listener, listenDesc, err := utils.Listen()
+	if err != nil {
+		utils.SafeLogFatalf("Error starting server: %v", err)
+	}
+	utils.SafeLogln(fmt.Sprintf("Server is running on %s...", listenDesc))
 	utils.SafeLogln("Playlist Endpoint is running (`/playlist.m3u`)")
 	utils.SafeLogln("Stream Endpoint is running (`/p/{originalBasePath}/{streamID}.{fileExt}`)")
-	err = http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), nil)
+	err = http.Serve(listener, utils.RecoverPanics(utils.StripPathPrefix(http.DefaultServeMux)))
 	if err != nil {
 		utils.SafeLogFatalf("HTTP server error: %v", err)
 	}
+	return 0
 }
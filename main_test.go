@@ -0,0 +1,44 @@
+package main
+
+import (
+	"m3u-stream-merger/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	playlist := filepath.Join(t.TempDir(), "playlist.m3u")
+	if err := os.WriteFile(playlist, []byte("#EXTM3U\n#EXTINF:-1,Live\nhttp://provider.invalid/live/1.ts\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notPlaylist := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(notPlaylist, []byte("<html></html>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want int
+	}{
+		{"valid", map[string]string{"M3U_URL_1": "file://" + playlist}, 0},
+		{"not a playlist", map[string]string{"M3U_URL_1": "file://" + notPlaylist}, 1},
+		{"missing file", map[string]string{"M3U_URL_1": "file://" + playlist + ".missing"}, 1},
+		{"bad cron", map[string]string{"M3U_URL_1": "file://" + playlist, "SYNC_CRON": "not a cron"}, 1},
+		{"only warnings", map[string]string{"M3U_URL_1": "file://" + playlist, "M3U_URL_3": "file://" + playlist}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			t.Cleanup(func() { utils.LoadSourceEnv() })
+
+			if got := serve([]string{"--check-config"}); got != tt.want {
+				t.Errorf("serve --check-config returned %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"m3u-stream-merger/store"
+)
+
+// balancerFlight is a load balancer run other runs for the same channel wait
+// for, e.g. when the clients of a channel whose upstream died all reconnect
+// at once. They then start from the source entry it found instead of probing
+// every source in parallel.
+type balancerFlight struct {
+	done chan struct{}
+
+	index    string
+	subIndex string
+	err      error
+}
+
+var balancerFlights = struct {
+	sync.Mutex
+	flights map[string]*balancerFlight
+}{flights: make(map[string]*balancerFlight)}
+
+// flightKey returns the key of the load balancer runs that may share their
+// result: GETs of the same channel among the same source entries, e.g. not
+// of two quality variants.
+func (instance *StreamInstance) flightKey() string {
+	entries := make([]string, 0, len(instance.Info.URLs))
+	for index, innerMap := range instance.Info.URLs {
+		for subIndex := range innerMap {
+			entries = append(entries, index+"|"+subIndex)
+		}
+	}
+	slices.Sort(entries)
+	return strings.Join([]string{instance.Info.Title, instance.Source, instance.Prefer, strings.Join(entries, ",")}, "|")
+}
+
+// joinBalancerFlight returns the run in flight for key, or registers a new
+// one if there is none. leader reports whether the caller has to run the
+// load balancer and finish the flight.
+func joinBalancerFlight(key string) (flight *balancerFlight, leader bool) {
+	balancerFlights.Lock()
+	defer balancerFlights.Unlock()
+
+	if flight, ok := balancerFlights.flights[key]; ok {
+		return flight, false
+	}
+	flight = &balancerFlight{done: make(chan struct{})}
+	balancerFlights.flights[key] = flight
+	return flight, true
+}
+
+func (flight *balancerFlight) finish(key string, index string, subIndex string, err error) {
+	balancerFlights.Lock()
+	delete(balancerFlights.flights, key)
+	balancerFlights.Unlock()
+
+	flight.index, flight.subIndex, flight.err = index, subIndex, err
+	close(flight.done)
+}
+
+// LoadBalancer returns the response of the first source entry of the stream
+// that could be fetched. Concurrent GETs of a channel share one probe round:
+// the first one probes the sources, the others wait for it and then fetch
+// the source entry it found, or fail like it if no source is available.
+func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store.Session, method string) (*http.Response, string, string, string, error) {
+	if method != http.MethodGet {
+		return instance.loadBalance(ctx, session, method, nil)
+	}
+
+	key := instance.flightKey()
+	flight, leader := joinBalancerFlight(key)
+	if leader {
+		resp, url, index, subIndex, err := instance.loadBalance(ctx, session, method, nil)
+		flight.finish(key, index, subIndex, err)
+		return resp, url, index, subIndex, err
+	}
+
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, "", "", "", fmt.Errorf("Cancelling load balancer.")
+	}
+
+	switch {
+	case flight.err == nil:
+		return instance.loadBalance(ctx, session, method, flight)
+	case errors.Is(flight.err, ErrUpstreamFailed), errors.Is(flight.err, ErrConcurrencyExhausted):
+		return nil, "", "", "", flight.err
+	}
+	// The first run was canceled by its client.
+	return instance.loadBalance(ctx, session, method, nil)
+}
+
+// jitter returns a random duration between half and all of d, so the
+// retries of clients failing at the same time spread out.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// BufferBudget keeps track of the memory held by stream buffers across all
+// active streams and enforces the BUFFER_MAX_TOTAL_MB cap.
+type BufferBudget struct {
+	mu      sync.Mutex
+	used    int64
+	active  int
+	refused int64
+}
+
+type BufferStats struct {
+	UsedBytes int64 `json:"used_bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Active    int   `json:"active_buffers"`
+	Refused   int64 `json:"refused_count"`
+}
+
+var Buffers = &BufferBudget{}
+
+func bufferMaxTotalBytes() int64 {
+	maxMb, err := strconv.ParseInt(os.Getenv("BUFFER_MAX_TOTAL_MB"), 10, 64)
+	if err != nil || maxMb <= 0 {
+		return 0
+	}
+
+	return maxMb * 1024 * 1024
+}
+
+// Acquire reserves size bytes from the budget. It returns false if the
+// reservation would exceed the cap.
+func (b *BufferBudget) Acquire(size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if maxBytes := bufferMaxTotalBytes(); maxBytes > 0 && b.used+size > maxBytes {
+		b.refused++
+		return false
+	}
+
+	b.used += size
+	b.active++
+	return true
+}
+
+func (b *BufferBudget) Release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= size
+	b.active--
+}
+
+// getBuffer returns a buffer of size bytes, charging its capacity to the
+// budget as pooled buffers are larger than requested. It returns false if
+// that would exceed the cap.
+func (b *BufferBudget) getBuffer(size int) ([]byte, bool) {
+	if !b.Acquire(int64(bufferCapacity(size))) {
+		return nil, false
+	}
+	return getBuffer(size), true
+}
+
+// releaseBuffer returns the capacity of a buffer from getBuffer to the
+// budget. The buffer itself is recycled with putBuffer.
+func (b *BufferBudget) releaseBuffer(buf []byte) {
+	b.Release(int64(cap(buf)))
+}
+
+func (b *BufferBudget) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BufferStats{
+		UsedBytes: b.used,
+		MaxBytes:  bufferMaxTotalBytes(),
+		Active:    b.active,
+		Refused:   b.refused,
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import "testing"
+
+func TestBufferBudget(t *testing.T) {
+	t.Setenv("BUFFER_POOL_MAX_MB", "4")
+	t.Setenv("BUFFER_MAX_TOTAL_MB", "")
+
+	const mb = 1024 * 1024
+
+	tests := []struct {
+		name    string
+		size    int
+		charged int64
+	}{
+		{"class size", 1 * mb, 1 * mb},
+		{"rounded up to its class", 2 * mb, 4 * mb},
+		{"larger than the pooled classes", 5 * mb, 5 * mb},
+		{"larger than every class", 65 * mb, 65 * mb},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := &BufferBudget{}
+
+			// Twice, so the second buffer may come from the pool.
+			for i := 0; i < 2; i++ {
+				buf, ok := budget.getBuffer(tt.size)
+				if !ok {
+					t.Fatal("Expected the buffer without a cap")
+				}
+				if len(buf) != tt.size {
+					t.Errorf("Expected a buffer of %d bytes, got %d", tt.size, len(buf))
+				}
+				if stats := budget.Stats(); stats.UsedBytes != int64(cap(buf)) || stats.UsedBytes != tt.charged || stats.Active != 1 {
+					t.Errorf("Expected %d bytes (the capacity) charged to 1 buffer, got %+v for a capacity of %d", tt.charged, stats, cap(buf))
+				}
+
+				budget.releaseBuffer(buf)
+				putBuffer(buf)
+				if stats := budget.Stats(); stats.UsedBytes != 0 || stats.Active != 0 {
+					t.Errorf("Expected the budget to be balanced after the release, got %+v", stats)
+				}
+			}
+		})
+	}
+
+	t.Run("cap counts the capacity", func(t *testing.T) {
+		t.Setenv("BUFFER_MAX_TOTAL_MB", "5")
+		budget := &BufferBudget{}
+
+		// 2 MB are charged as 4 MB, leaving room for 1 MB only.
+		first, ok := budget.getBuffer(2 * mb)
+		if !ok {
+			t.Fatal("Expected the first buffer to fit")
+		}
+		if _, ok := budget.getBuffer(2 * mb); ok {
+			t.Fatal("Expected the second buffer to be refused")
+		}
+		second, ok := budget.getBuffer(1 * mb)
+		if !ok {
+			t.Fatal("Expected a 1 MB buffer to fit")
+		}
+
+		budget.releaseBuffer(first)
+		budget.releaseBuffer(second)
+		putBuffer(first)
+		putBuffer(second)
+		if stats := budget.Stats(); stats.UsedBytes != 0 || stats.Active != 0 || stats.Refused != 1 {
+			t.Errorf("Expected a balanced budget with 1 refusal, got %+v", stats)
+		}
+	})
+}
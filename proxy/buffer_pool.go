@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// bufferClasses are the buffer sizes that are recycled between streams.
+// Requests are rounded up to the nearest class so that a pool never holds
+// buffers larger than its class.
+var bufferClasses = []int{
+	1024,
+	64 * 1024,
+	1024 * 1024,
+	4 * 1024 * 1024,
+	16 * 1024 * 1024,
+	64 * 1024 * 1024,
+}
+
+var bufferPools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(bufferClasses))
+	for i, size := range bufferClasses {
+		pools[i] = &sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+	}
+	return pools
+}()
+
+// bufferPoolMaxRetained returns the largest buffer size that is kept in the
+// pools after use. Larger buffers are left to the garbage collector.
+func bufferPoolMaxRetained() int {
+	maxMb, err := strconv.Atoi(os.Getenv("BUFFER_POOL_MAX_MB"))
+	if err != nil || maxMb < 0 {
+		maxMb = 4
+	}
+
+	return maxMb * 1024 * 1024
+}
+
+func bufferClass(size int) int {
+	for i, classSize := range bufferClasses {
+		if size <= classSize {
+			return i
+		}
+	}
+	return -1
+}
+
+// bufferCapacity returns the capacity of the buffers getBuffer returns for
+// size: the size of its class if it is pooled.
+func bufferCapacity(size int) int {
+	class := bufferClass(size)
+	if class < 0 || bufferClasses[class] > bufferPoolMaxRetained() {
+		return size
+	}
+	return bufferClasses[class]
+}
+
+func getBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 || bufferClasses[class] > bufferPoolMaxRetained() {
+		return make([]byte, size)
+	}
+
+	buf := bufferPools[class].Get().(*[]byte)
+	return (*buf)[:size]
+}
+
+func putBuffer(buf []byte) {
+	class := bufferClass(cap(buf))
+	if class < 0 || bufferClasses[class] != cap(buf) || cap(buf) > bufferPoolMaxRetained() {
+		return
+	}
+
+	buf = buf[:cap(buf)]
+	bufferPools[class].Put(&buf)
+}
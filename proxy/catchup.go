@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// CatchupInstance returns a copy of the stream instance whose URLs point to
+// the archive of the program starting at start. Source entries without
+// catchup support are left out.
+func (instance *StreamInstance) CatchupInstance(start time.Time, duration time.Duration) (*StreamInstance, error) {
+	info := instance.Info
+	info.URLs = make(map[string]map[string]string)
+
+	for m3uIndex, innerMap := range instance.Info.URLs {
+		for subIndex := range innerMap {
+			catchupUrl, ok := instance.Info.CatchupURL(m3uIndex, subIndex, start, duration)
+			if !ok {
+				continue
+			}
+
+			if _, exists := info.URLs[m3uIndex]; !exists {
+				info.URLs[m3uIndex] = make(map[string]string)
+			}
+			info.URLs[m3uIndex][subIndex] = catchupUrl
+		}
+	}
+
+	if len(info.URLs) == 0 {
+		return nil, fmt.Errorf("no source of %s supports catchup", info.Title)
+	}
+
+	return &StreamInstance{
+		Info:   info,
+		Cm:     instance.Cm,
+		Source: instance.Source,
+		Prefer: instance.Prefer,
+		Query:  instance.Query,
+		Header: instance.Header,
+		Body:   instance.Body,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"m3u-stream-merger/utils"
+)
+
+// chaosChannel reports whether faults are injected for the channel title.
+// Fault injection simulates a misbehaving upstream for the channels listed in
+// CHAOS_CHANNELS, so operators can check their failover configuration before
+// a real outage. It is disabled unless CHAOS_CHANNELS is set.
+func chaosChannel(title string) bool {
+	title = strings.ToLower(title)
+	for _, pattern := range strings.Split(os.Getenv("CHAOS_CHANNELS"), ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if pattern == "*" || pattern == title {
+			return true
+		}
+		if matched, err := path.Match(pattern, title); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// injectRequestFault delays an upstream request by CHAOS_LATENCY_MS and fails
+// it with a probability of CHAOS_FAILURE_RATE.
+func injectRequestFault(title string, url string) error {
+	if !chaosChannel(title) {
+		return nil
+	}
+
+	if ms, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CHAOS_LATENCY_MS"))); err == nil && ms > 0 {
+		utils.SafeLogf("[CHAOS] Delaying request by %dms: %s\n", ms, url)
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+	}
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv("CHAOS_FAILURE_RATE")), 64)
+	if err == nil && rate > 0 && rand.Float64() < rate {
+		utils.SafeLogf("[CHAOS] Failing request: %s\n", url)
+		return fmt.Errorf("upstream returned 503 Service Unavailable (injected fault)")
+	}
+
+	return nil
+}
+
+// injectResetFault resets the connection of an upstream stream after
+// CHAOS_RESET_AFTER_SECONDS.
+func injectResetFault(title string, resp *http.Response) {
+	if !chaosChannel(title) {
+		return
+	}
+
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CHAOS_RESET_AFTER_SECONDS")))
+	if err != nil || seconds <= 0 {
+		return
+	}
+
+	after := time.Duration(seconds) * time.Second
+	body := &resetBody{ReadCloser: resp.Body}
+	body.timer = time.AfterFunc(after, func() {
+		utils.SafeLogf("[CHAOS] Resetting connection after %s: %s\n", after, resp.Request.URL)
+		body.reset.Store(true)
+		_ = body.ReadCloser.Close()
+	})
+	resp.Body = body
+}
+
+// resetBody is a response body whose connection was reset once reset is set.
+// Closing the underlying body unblocks a pending read.
+type resetBody struct {
+	io.ReadCloser
+	timer *time.Timer
+	reset atomic.Bool
+}
+
+func (b *resetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.reset.Load() {
+		return n, fmt.Errorf("injected fault: %w", syscall.ECONNRESET)
+	}
+	return n, err
+}
+
+func (b *resetBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker skips upstream URLs that failed CIRCUIT_BREAKER_THRESHOLD
+// times in a row for CIRCUIT_BREAKER_COOLDOWN seconds. Once the cooldown is
+// over, a single trial request is let through (half-open) and its outcome
+// either closes the circuit or opens it for another cooldown.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+var Circuits = &CircuitBreaker{circuits: make(map[string]*circuit)}
+
+func circuitBreakerThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_THRESHOLD"))
+	if err != nil || threshold < 0 {
+		return 5
+	}
+	return threshold
+}
+
+func circuitBreakerCooldown() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_COOLDOWN"))
+	if err != nil || seconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Allow reports whether a request to url may be attempted.
+func (cb *CircuitBreaker) Allow(url string) bool {
+	if circuitBreakerThreshold() == 0 {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c, ok := cb.circuits[url]
+	if !ok || c.openedAt.IsZero() {
+		return true
+	}
+
+	if c.trial || time.Since(c.openedAt) < circuitBreakerCooldown() {
+		return false
+	}
+
+	c.trial = true
+	return true
+}
+
+// Success closes the circuit of url.
+func (cb *CircuitBreaker) Success(url string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	delete(cb.circuits, url)
+}
+
+// Failure records a failed request to url, opening its circuit once the
+// threshold is reached or if it was the half-open trial.
+func (cb *CircuitBreaker) Failure(url string) {
+	threshold := circuitBreakerThreshold()
+	if threshold == 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c, ok := cb.circuits[url]
+	if !ok {
+		c = &circuit{}
+		cb.circuits[url] = c
+	}
+
+	c.failures++
+	if c.trial || c.failures >= threshold {
+		c.openedAt = time.Now()
+		c.trial = false
+	}
+}
+
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "2")
+	t.Setenv("CIRCUIT_BREAKER_COOLDOWN", "30")
+
+	const url = "http://upstream/live/1.ts"
+
+	// The steps are applied in order. "allow" checks Allow against allowed,
+	// "wait" moves the opening of the circuit back by the given duration.
+	type step struct {
+		op      string
+		allowed bool
+		wait    time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"closed below the threshold", []step{
+			{op: "fail"}, {op: "allow", allowed: true},
+		}},
+		{"opens at the threshold", []step{
+			{op: "fail"}, {op: "fail"}, {op: "allow", allowed: false},
+		}},
+		{"success resets the failures", []step{
+			{op: "fail"}, {op: "success"}, {op: "fail"}, {op: "allow", allowed: true},
+		}},
+		{"stays open during the cooldown", []step{
+			{op: "fail"}, {op: "fail"}, {op: "wait", wait: 29 * time.Second}, {op: "allow", allowed: false},
+		}},
+		{"half-open lets a single trial through", []step{
+			{op: "fail"}, {op: "fail"}, {op: "wait", wait: 31 * time.Second},
+			{op: "allow", allowed: true}, {op: "allow", allowed: false},
+		}},
+		{"successful trial closes", []step{
+			{op: "fail"}, {op: "fail"}, {op: "wait", wait: 31 * time.Second},
+			{op: "allow", allowed: true}, {op: "success"},
+			{op: "allow", allowed: true}, {op: "fail"}, {op: "allow", allowed: true},
+		}},
+		{"failed trial opens for another cooldown", []step{
+			{op: "fail"}, {op: "fail"}, {op: "wait", wait: 31 * time.Second},
+			{op: "allow", allowed: true}, {op: "fail"}, {op: "allow", allowed: false},
+			{op: "wait", wait: 29 * time.Second}, {op: "allow", allowed: false},
+			{op: "wait", wait: 2 * time.Second}, {op: "allow", allowed: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &CircuitBreaker{circuits: make(map[string]*circuit)}
+			for i, s := range tt.steps {
+				switch s.op {
+				case "allow":
+					if got := cb.Allow(url); got != s.allowed {
+						t.Fatalf("step %d: Allow() = %v, want %v", i, got, s.allowed)
+					}
+				case "fail":
+					cb.Failure(url)
+				case "success":
+					cb.Success(url)
+				case "wait":
+					cb.circuits[url].openedAt = cb.circuits[url].openedAt.Add(-s.wait)
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "0")
+
+		cb := &CircuitBreaker{circuits: make(map[string]*circuit)}
+		for i := 0; i < 10; i++ {
+			cb.Failure(url)
+		}
+		if !cb.Allow(url) {
+			t.Error("Expected requests to be allowed with a threshold of 0")
+		}
+	})
+}
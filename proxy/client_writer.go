@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientWriter writes upstream chunks to the client. The default
+// implementation writes and flushes every chunk as soon as it is read.
+// CLIENT_WRITE_BATCH_KB switches to a batching implementation that coalesces
+// consecutive chunks into a single write.
+type clientWriter interface {
+	// WriteChunk writes p to the client. more reports whether the upstream
+	// read filled the whole buffer, i.e. more data is likely immediately
+	// available.
+	WriteChunk(p []byte, more bool) error
+	// Flush sends any pending data to the client.
+	Flush() error
+}
+
+// deadlineWriter fails a write the client does not accept within timeout, so
+// a client with a stalled connection does not hold the stream forever.
+type deadlineWriter struct {
+	clientWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// withWriteDeadline applies CLIENT_WRITE_TIMEOUT to the writes of cw.
+func withWriteDeadline(cw clientWriter, w http.ResponseWriter) clientWriter {
+	timeoutSecond, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CLIENT_WRITE_TIMEOUT")))
+	if err != nil || timeoutSecond < 0 {
+		timeoutSecond = 30
+	}
+	if timeoutSecond == 0 {
+		return cw
+	}
+
+	return &deadlineWriter{
+		clientWriter: cw,
+		rc:           http.NewResponseController(w),
+		timeout:      time.Duration(timeoutSecond) * time.Second,
+	}
+}
+
+func (dw *deadlineWriter) WriteChunk(p []byte, more bool) error {
+	return dw.withDeadline(func() error {
+		return dw.clientWriter.WriteChunk(p, more)
+	})
+}
+
+func (dw *deadlineWriter) Flush() error {
+	return dw.withDeadline(dw.clientWriter.Flush)
+}
+
+func (dw *deadlineWriter) withDeadline(write func() error) error {
+	// Writers not supporting deadlines are written to without one.
+	if err := dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout)); err != nil {
+		return write()
+	}
+
+	if err := write(); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errClientStalled
+		}
+		return err
+	}
+
+	// The deadline must not expire while waiting for the next upstream read.
+	_ = dw.rc.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+var errClientStalled = errors.New("client did not accept data within CLIENT_WRITE_TIMEOUT")
+
+// maxStartupBuffer bounds the data held back by startupWriter.
+const maxStartupBuffer = 32 * 1024 * 1024
+
+// startupWriter holds back the first data of a stream for a delay and then
+// sends it at once, so players start with a filled buffer on sources with
+// bursty delivery.
+type startupWriter struct {
+	clientWriter
+	delay   time.Duration
+	started time.Time
+	held    []byte
+	holding bool
+}
+
+// startupDelay returns the M3U_STARTUP_BUFFER_SECONDS_X (or
+// STARTUP_BUFFER_SECONDS) of a source.
+func startupDelay(m3uIndex string) time.Duration {
+	value := os.Getenv("M3U_STARTUP_BUFFER_SECONDS_" + m3uIndex)
+	if strings.TrimSpace(value) == "" {
+		value = os.Getenv("STARTUP_BUFFER_SECONDS")
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// withStartupDelay holds back the first delay of data written to cw.
+func withStartupDelay(cw clientWriter, delay time.Duration) clientWriter {
+	if delay <= 0 {
+		return cw
+	}
+	return &startupWriter{clientWriter: cw, delay: delay, holding: true}
+}
+
+func (sw *startupWriter) WriteChunk(p []byte, more bool) error {
+	if !sw.holding {
+		return sw.clientWriter.WriteChunk(p, more)
+	}
+
+	if sw.started.IsZero() {
+		sw.started = time.Now()
+	}
+	sw.held = append(sw.held, p...)
+
+	if time.Since(sw.started) < sw.delay && len(sw.held) < maxStartupBuffer {
+		return nil
+	}
+	return sw.release()
+}
+
+func (sw *startupWriter) Flush() error {
+	// The stream ending before the delay still gets its data out.
+	if sw.holding && len(sw.held) > 0 {
+		if err := sw.release(); err != nil {
+			return err
+		}
+	}
+	return sw.clientWriter.Flush()
+}
+
+func (sw *startupWriter) release() error {
+	held := sw.held
+	sw.held = nil
+	sw.holding = false
+	return sw.clientWriter.WriteChunk(held, false)
+}
+
+const tsPacketSize = 188
+
+// tsAlignWriter only writes whole MPEG-TS packets. A packet cut off by an
+// upstream failing mid-packet is dropped with the writer, instead of being
+// followed by the packets of the next source, which makes players lose sync
+// (and often the audio) after a failover.
+type tsAlignWriter struct {
+	clientWriter
+	detected bool
+	ts       bool
+	pending  []byte
+}
+
+func withTSAlignment(cw clientWriter) clientWriter {
+	return &tsAlignWriter{clientWriter: cw}
+}
+
+// isTS reports whether p looks like the start of an MPEG-TS stream.
+func isTS(p []byte) bool {
+	if len(p) == 0 || p[0] != 0x47 {
+		return false
+	}
+	return len(p) <= tsPacketSize || p[tsPacketSize] == 0x47
+}
+
+func (tw *tsAlignWriter) WriteChunk(p []byte, more bool) error {
+	if !tw.detected {
+		tw.detected = true
+		tw.ts = isTS(p)
+	}
+	if !tw.ts {
+		return tw.clientWriter.WriteChunk(p, more)
+	}
+
+	data := p
+	if len(tw.pending) > 0 {
+		tw.pending = append(tw.pending, p...)
+		data = tw.pending
+	}
+
+	n := len(data) - len(data)%tsPacketSize
+	var err error
+	if n > 0 {
+		err = tw.clientWriter.WriteChunk(data[:n], more)
+	}
+
+	// The read buffer is reused for the next read so the rest is copied.
+	tw.pending = append(tw.pending[:0], data[n:]...)
+	return err
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type flushingWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw *flushingWriter) WriteChunk(p []byte, more bool) error {
+	if _, err := fw.w.Write(p); err != nil {
+		return err
+	}
+
+	return fw.Flush()
+}
+
+func (fw *flushingWriter) Flush() error {
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// batchingWriter queues chunks while the upstream keeps filling the read
+// buffer and writes them out with a single write and flush, cutting the
+// number of write syscalls per client under high fan-out.
+type batchingWriter struct {
+	w       http.ResponseWriter
+	buf     []byte
+	maxSize int
+}
+
+// newClientWriter returns a batchingWriter if CLIENT_WRITE_BATCH_KB is set,
+// else a writer flushing every chunk.
+func newClientWriter(w http.ResponseWriter) clientWriter {
+	batchKb, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CLIENT_WRITE_BATCH_KB")))
+	if err != nil || batchKb <= 0 {
+		return &flushingWriter{w: w}
+	}
+
+	return &batchingWriter{w: w, maxSize: batchKb * 1024}
+}
+
+func (bw *batchingWriter) WriteChunk(p []byte, more bool) error {
+	// The read buffer is reused for the next read so the chunk has to be
+	// copied while it is queued.
+	bw.buf = append(bw.buf, p...)
+
+	if more && len(bw.buf) < bw.maxSize {
+		return nil
+	}
+
+	return bw.Flush()
+}
+
+func (bw *batchingWriter) Flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+
+	_, err := bw.w.Write(bw.buf)
+	bw.buf = bw.buf[:0]
+	if err != nil {
+		return err
+	}
+
+	if flusher, ok := bw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingRecorder counts the writes to the response.
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (cr *countingRecorder) Write(p []byte) (int, error) {
+	cr.writes++
+	return cr.ResponseRecorder.Write(p)
+}
+
+func TestBatchingWriter(t *testing.T) {
+	t.Setenv("CLIENT_WRITE_BATCH_KB", "4")
+
+	w := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cw := newClientWriter(w)
+	if _, ok := cw.(*batchingWriter); !ok {
+		t.Fatalf("Expected a batchingWriter, got %T", cw)
+	}
+
+	chunk := bytes.Repeat([]byte{0x47}, 1024)
+	var want []byte
+	for i := 0; i < 10; i++ {
+		// The buffer is reused by the next read, as in ProxyStream.
+		chunk[1] = byte(i)
+		want = append(want, chunk...)
+		if err := cw.WriteChunk(chunk, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.writes != 2 {
+		t.Errorf("Expected full batches to be written, got %d writes", w.writes)
+	}
+
+	// A short read sends the rest right away.
+	if err := cw.WriteChunk(chunk[:100], false); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, chunk[:100]...)
+	if w.writes != 3 || !bytes.Equal(w.Body.Bytes(), want) {
+		t.Errorf("Expected the chunks in order in 3 writes, got %d writes and %d bytes", w.writes, w.Body.Len())
+	}
+
+	t.Setenv("CLIENT_WRITE_BATCH_KB", "0")
+	if _, ok := newClientWriter(w).(*flushingWriter); !ok {
+		t.Error("Expected batching to be disabled by default")
+	}
+}
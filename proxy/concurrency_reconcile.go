@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"m3u-stream-merger/store"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backgroundStreams are the streams opened for snapshots and self-tests,
+// which hold a concurrency slot without being running streams.
+var backgroundStreams = struct {
+	sync.Mutex
+	streams map[*store.OpenStream]struct{}
+}{streams: make(map[*store.OpenStream]struct{})}
+
+// registerBackgroundStream registers a stream opened for a snapshot or a
+// self-test until the returned function is called.
+func registerBackgroundStream(stream store.OpenStream) func() {
+	backgroundStreams.Lock()
+	defer backgroundStreams.Unlock()
+
+	backgroundStreams.streams[&stream] = struct{}{}
+	return func() {
+		backgroundStreams.Lock()
+		defer backgroundStreams.Unlock()
+
+		delete(backgroundStreams.streams, &stream)
+	}
+}
+
+// OpenStreams returns the streams holding a concurrency slot: the running
+// streams and the streams opened for snapshots.
+func OpenStreams() []store.OpenStream {
+	open := []store.OpenStream{}
+
+	runningStreams.Lock()
+	for _, tees := range runningStreams.tees {
+		for _, tee := range tees {
+			m3uIndex, _, _ := strings.Cut(tee.source, "|")
+			open = append(open, store.OpenStream{M3UIndex: m3uIndex, Group: tee.group})
+		}
+	}
+	runningStreams.Unlock()
+
+	backgroundStreams.Lock()
+	for stream := range backgroundStreams.streams {
+		open = append(open, *stream)
+	}
+	backgroundStreams.Unlock()
+
+	return open
+}
+
+// concurrencyReconcileInterval returns the interval of the concurrency
+// reconciliation (CONCURRENCY_RECONCILE_INTERVAL), 0 if it is disabled.
+func concurrencyReconcileInterval() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CONCURRENCY_RECONCILE_INTERVAL")))
+	if err != nil || seconds < 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ReconcileConcurrency periodically corrects the concurrency counts of cm
+// that drifted from the open streams, until ctx is done.
+func ReconcileConcurrency(ctx context.Context, cm *store.ConcurrencyManager) {
+	interval := concurrencyReconcileInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cm.Reconcile(OpenStreams())
+		}
+	}
+}
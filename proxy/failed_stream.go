@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"m3u-stream-merger/utils"
+)
+
+// nullPacketBurst is the number of MPEG-TS null packets sent to a client
+// whose stream failed, about a second of a typical SD stream.
+const nullPacketBurst = 700
+
+// streamFailureModes returns the STREAM_FAILURE_MODE values: how a stream is
+// ended once every source failed after its headers were sent.
+func streamFailureModes() []string {
+	modes := []string{}
+	for _, mode := range strings.Split(os.Getenv("STREAM_FAILURE_MODE"), ",") {
+		if mode = strings.ToLower(strings.TrimSpace(mode)); mode != "" {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// isTSResponse reports whether resp is an MPEG-TS stream.
+func isTSResponse(resp *http.Response) bool {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	if strings.Contains(contentType, "mp2t") {
+		return true
+	}
+	return resp.Request != nil && strings.ToLower(filepath.Ext(resp.Request.URL.Path)) == ".ts"
+}
+
+// nullPacket returns an MPEG-TS null packet (PID 0x1FFF).
+func nullPacket() []byte {
+	packet := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+	packet[0], packet[1], packet[2], packet[3] = 0x47, 0x1F, 0xFF, 0x10
+	return packet
+}
+
+// EndFailedStream writes the end of a stream to the client once every source
+// failed after the headers were sent, instead of only closing the
+// connection. resp is the last upstream response of the stream. Following
+// STREAM_FAILURE_MODE, HLS playlists get an EXT-X-ENDLIST ("endlist") and
+// MPEG-TS streams get OFFLINE_SLATE_PATH ("slate") or a burst of null
+// packets ("padding").
+func EndFailedStream(w io.Writer, resp *http.Response) {
+	modes := streamFailureModes()
+
+	var err error
+	switch {
+	case utils.EOFIsExpected(resp):
+		if slices.Contains(modes, "endlist") {
+			_, err = io.WriteString(w, "\n#EXT-X-ENDLIST\n")
+		}
+	case !isTSResponse(resp):
+		return
+	case slices.Contains(modes, "slate") && strings.TrimSpace(os.Getenv("OFFLINE_SLATE_PATH")) != "":
+		var slate *os.File
+		slate, err = os.Open(strings.TrimSpace(os.Getenv("OFFLINE_SLATE_PATH")))
+		if err == nil {
+			_, err = io.Copy(w, slate)
+			slate.Close()
+		}
+	case slices.Contains(modes, "padding"):
+		_, err = w.Write(bytes.Repeat(nullPacket(), nullPacketBurst))
+	default:
+		return
+	}
+
+	if err != nil {
+		utils.SafeLogf("Error ending failed stream: %v\n", err)
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsStateTTL is how long the playlist state of a client is kept after its
+// last playlist request.
+const hlsStateTTL = 5 * time.Minute
+
+// hlsPlaylistState tracks the media playlists of one channel served to one
+// client, so a switch to another upstream can be announced to it.
+type hlsPlaylistState struct {
+	// source is the m3uIndex|subIndex the last playlist was fetched from.
+	source string
+	// offset is added to the media sequence numbers of source.
+	offset int64
+	// nextSeq is the media sequence number following the last segment served
+	// and lastSeq the media sequence number of the last playlist served.
+	nextSeq int64
+	lastSeq int64
+	// switchSeq is the media sequence number of the first segment after the
+	// last switch and discontinuities the number of switches.
+	switchSeq       int64
+	discontinuities int64
+	lastSeen        time.Time
+}
+
+var hlsStates = struct {
+	sync.Mutex
+	states map[string]*hlsPlaylistState
+}{states: make(map[string]*hlsPlaylistState)}
+
+// continuousHLSPlaylist rewrites the lines of a media playlist fetched from
+// source so the media sequence keeps increasing across upstream switches, and
+// inserts an EXT-X-DISCONTINUITY before the first segment of the new upstream.
+// An upstream restarting its media sequence is handled like a switch. Master
+// playlists are returned unchanged.
+func continuousHLSPlaylist(key string, source string, lines []string) []string {
+	mediaSeq, discontinuitySeq := int64(0), int64(0)
+	segments := int64(0)
+	firstSegment := -1
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			mediaSeq, _ = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:")), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			discontinuitySeq, _ = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:")), 10, 64)
+		case strings.HasPrefix(line, "#EXTINF:"):
+			segments++
+			if firstSegment < 0 {
+				firstSegment = i
+			}
+		}
+	}
+	if segments == 0 {
+		return lines
+	}
+
+	// The tags preceding the EXTINF of the first segment, e.g. its
+	// EXT-X-PROGRAM-DATE-TIME, stay after the inserted tags so players align
+	// the segments of the new upstream by its own timestamps.
+	for firstSegment > 0 && isHLSSegmentTag(lines[firstSegment-1]) {
+		firstSegment--
+	}
+
+	hlsStates.Lock()
+	now := time.Now()
+	for k, state := range hlsStates.states {
+		if now.Sub(state.lastSeen) > hlsStateTTL {
+			delete(hlsStates.states, k)
+		}
+	}
+
+	state, ok := hlsStates.states[key]
+	if !ok {
+		state = &hlsPlaylistState{source: source, switchSeq: -1}
+		hlsStates.states[key] = state
+	} else if state.source != source || mediaSeq+state.offset+segments <= state.lastSeq {
+		// Either another upstream, or a playlist ending before the last one
+		// served started as the upstream restarted its media sequence.
+		state.source = source
+		state.offset = state.nextSeq - mediaSeq
+		state.switchSeq = state.nextSeq
+		state.discontinuities++
+	}
+	state.lastSeen = now
+
+	outSeq := mediaSeq + state.offset
+	state.nextSeq = max(state.nextSeq, outSeq+segments)
+	state.lastSeq = outSeq
+
+	// The discontinuity is announced as long as the first segment after the
+	// switch is the first one of the playlist. Afterwards it is counted in
+	// the discontinuity sequence.
+	inject := state.discontinuities > 0 && outSeq == state.switchSeq
+	discontinuities := state.discontinuities
+	if inject {
+		discontinuities--
+	}
+	offset := state.offset
+	hlsStates.Unlock()
+
+	if offset == 0 && discontinuities == 0 && !inject {
+		return lines
+	}
+
+	out := make([]string, 0, len(lines)+3)
+	headerDone := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") || strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:") {
+			continue
+		}
+
+		if i == firstSegment {
+			if !headerDone {
+				out = append(out, hlsSequenceTags(outSeq, discontinuitySeq+discontinuities)...)
+				headerDone = true
+			}
+			if inject {
+				out = append(out, "#EXT-X-DISCONTINUITY")
+			}
+		}
+
+		out = append(out, line)
+
+		if i == 0 && strings.HasPrefix(line, "#EXTM3U") {
+			out = append(out, hlsSequenceTags(outSeq, discontinuitySeq+discontinuities)...)
+			headerDone = true
+		}
+	}
+
+	return out
+}
+
+func hlsSequenceTags(mediaSeq int64, discontinuitySeq int64) []string {
+	tags := []string{fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", mediaSeq)}
+	if discontinuitySeq > 0 {
+		tags = append(tags, fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d", discontinuitySeq))
+	}
+	return tags
+}
+
+// hlsSegmentTags are the tags applying to the next media segment only, which
+// may precede its EXTINF.
+var hlsSegmentTags = []string{
+	"#EXT-X-PROGRAM-DATE-TIME:",
+	"#EXT-X-BYTERANGE:",
+	"#EXT-X-DATERANGE:",
+	"#EXT-X-BITRATE:",
+	"#EXT-X-GAP",
+}
+
+func isHLSSegmentTag(line string) bool {
+	for _, tag := range hlsSegmentTags {
+		if strings.HasPrefix(line, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mediaPlaylist returns the lines of a media playlist of the segments of
+// prefix starting at seq.
+func mediaPlaylist(seq int64, prefix string, segments int) []string {
+	lines := []string{"#EXTM3U", "#EXT-X-VERSION:3", "#EXT-X-TARGETDURATION:6", fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", seq)}
+	for i := int64(0); i < int64(segments); i++ {
+		lines = append(lines, "#EXTINF:6.0,", fmt.Sprintf("%s%d.ts", prefix, seq+i))
+	}
+	return lines
+}
+
+func TestContinuousHLSPlaylist(t *testing.T) {
+	key := t.Name()
+	t.Cleanup(func() {
+		hlsStates.Lock()
+		delete(hlsStates.states, key)
+		hlsStates.Unlock()
+	})
+
+	// withPDT adds an EXT-X-PROGRAM-DATE-TIME to the first segment.
+	withPDT := func(lines []string) []string {
+		i := slices.IndexFunc(lines, func(line string) bool { return strings.HasPrefix(line, "#EXTINF:") })
+		return slices.Insert(slices.Clone(lines), i, "#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z")
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		lines  []string
+		want   []string
+	}{
+		{
+			name:   "first upstream is unchanged",
+			source: "1|0",
+			lines:  mediaPlaylist(100, "a", 3),
+			want:   mediaPlaylist(100, "a", 3),
+		},
+		{
+			name:   "same upstream is unchanged",
+			source: "1|0",
+			lines:  mediaPlaylist(101, "a", 3),
+			want:   mediaPlaylist(101, "a", 3),
+		},
+		{
+			name:   "switch continues the sequence with a discontinuity",
+			source: "2|0",
+			lines:  withPDT(mediaPlaylist(5, "b", 3)),
+			want: []string{
+				"#EXTM3U", "#EXT-X-MEDIA-SEQUENCE:104", "#EXT-X-VERSION:3", "#EXT-X-TARGETDURATION:6",
+				"#EXT-X-DISCONTINUITY", "#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z",
+				"#EXTINF:6.0,", "b5.ts", "#EXTINF:6.0,", "b6.ts", "#EXTINF:6.0,", "b7.ts",
+			},
+		},
+		{
+			name:   "discontinuity is counted once it scrolled out",
+			source: "2|0",
+			lines:  mediaPlaylist(6, "b", 3),
+			want: []string{
+				"#EXTM3U", "#EXT-X-MEDIA-SEQUENCE:105", "#EXT-X-DISCONTINUITY-SEQUENCE:1", "#EXT-X-VERSION:3", "#EXT-X-TARGETDURATION:6",
+				"#EXTINF:6.0,", "b6.ts", "#EXTINF:6.0,", "b7.ts", "#EXTINF:6.0,", "b8.ts",
+			},
+		},
+		{
+			name:   "restarted media sequence is a switch",
+			source: "2|0",
+			lines:  mediaPlaylist(0, "b", 2),
+			want: []string{
+				"#EXTM3U", "#EXT-X-MEDIA-SEQUENCE:108", "#EXT-X-DISCONTINUITY-SEQUENCE:1", "#EXT-X-VERSION:3", "#EXT-X-TARGETDURATION:6",
+				"#EXT-X-DISCONTINUITY", "#EXTINF:6.0,", "b0.ts", "#EXTINF:6.0,", "b1.ts",
+			},
+		},
+		{
+			name:   "master playlist is unchanged",
+			source: "3|0",
+			lines:  []string{"#EXTM3U", "#EXT-X-STREAM-INF:BANDWIDTH=1280000", "low.m3u8"},
+			want:   []string{"#EXTM3U", "#EXT-X-STREAM-INF:BANDWIDTH=1280000", "low.m3u8"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := continuousHLSPlaylist(key, tt.source, tt.lines)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
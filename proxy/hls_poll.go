@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPolledPlaylistSize bounds the media playlists kept for revalidation.
+	maxPolledPlaylistSize = 4 * 1024 * 1024
+	// polledPlaylistTTL is how long a media playlist is kept after its last
+	// request.
+	polledPlaylistTTL = time.Minute
+	// minPollInterval is the first backoff step once a media playlist stops
+	// advancing.
+	minPollInterval = 500 * time.Millisecond
+)
+
+// polledPlaylist is the last version of an upstream HLS media playlist, used
+// to revalidate it with a conditional request and to answer polls without
+// one while it does not advance.
+type polledPlaylist struct {
+	body         []byte
+	header       http.Header
+	request      *http.Request
+	etag         string
+	lastModified string
+	mediaSeq     int64
+	target       time.Duration
+	fetchedAt    time.Time
+	lastUsed     time.Time
+	// interval is how long the playlist is served without asking the
+	// upstream. It grows while the media sequence does not advance.
+	interval time.Duration
+}
+
+var polledPlaylists = struct {
+	sync.Mutex
+	playlists map[string]*polledPlaylist
+}{playlists: make(map[string]*polledPlaylist)}
+
+func pollBackoffEnabled() bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("HLS_POLL_BACKOFF"))) != "false"
+}
+
+// response returns a response serving the stored playlist.
+func (p *polledPlaylist) response() *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        p.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(p.body)),
+		ContentLength: int64(len(p.body)),
+		Request:       p.request,
+	}
+}
+
+// backoff doubles the poll interval, up to half the target duration as
+// clients reload an unchanged playlist at that pace anyway.
+func (p *polledPlaylist) backoff() {
+	if !pollBackoffEnabled() || p.target <= 0 {
+		p.interval = 0
+		return
+	}
+	p.interval = min(max(p.interval*2, minPollInterval), p.target/2)
+}
+
+// cachedHLSPlaylist returns the stored media playlist of url if the upstream
+// is backed off from.
+func cachedHLSPlaylist(url string) (*http.Response, bool) {
+	polledPlaylists.Lock()
+	defer polledPlaylists.Unlock()
+
+	p, ok := polledPlaylists.playlists[url]
+	if !ok || p.interval <= 0 || time.Since(p.fetchedAt) >= p.interval {
+		return nil, false
+	}
+
+	p.lastUsed = time.Now()
+	return p.response(), true
+}
+
+// conditionalHLSHeaders adds the validators of the stored media playlist of
+// url to the upstream request headers.
+func conditionalHLSHeaders(url string, headers http.Header) {
+	polledPlaylists.Lock()
+	defer polledPlaylists.Unlock()
+
+	p, ok := polledPlaylists.playlists[url]
+	if !ok {
+		return
+	}
+
+	if p.etag != "" {
+		headers.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		headers.Set("If-Modified-Since", p.lastModified)
+	}
+}
+
+// revalidatedHLSPlaylist returns the stored media playlist of url after the
+// upstream answered 304 Not Modified.
+func revalidatedHLSPlaylist(url string) (*http.Response, bool) {
+	polledPlaylists.Lock()
+	defer polledPlaylists.Unlock()
+
+	p, ok := polledPlaylists.playlists[url]
+	if !ok {
+		return nil, false
+	}
+
+	p.fetchedAt = time.Now()
+	p.lastUsed = p.fetchedAt
+	p.backoff()
+	return p.response(), true
+}
+
+// storeHLSPlaylist keeps the media playlist of resp for the next polls of url
+// and returns a response to serve it from. Master playlists are not stored.
+func storeHLSPlaylist(url string, resp *http.Response) (*http.Response, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolledPlaylistSize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxPolledPlaylistSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	mediaSeq, target, ok := parseMediaPlaylist(body)
+	if !ok {
+		return resp, nil
+	}
+
+	now := time.Now()
+	polledPlaylists.Lock()
+	defer polledPlaylists.Unlock()
+
+	for k, p := range polledPlaylists.playlists {
+		if now.Sub(p.lastUsed) > polledPlaylistTTL {
+			delete(polledPlaylists.playlists, k)
+		}
+	}
+
+	p := &polledPlaylist{
+		body:         body,
+		header:       resp.Header.Clone(),
+		request:      &http.Request{Method: http.MethodGet, URL: resp.Request.URL},
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		mediaSeq:     mediaSeq,
+		target:       target,
+		fetchedAt:    now,
+		lastUsed:     now,
+	}
+	if previous, ok := polledPlaylists.playlists[url]; ok && previous.mediaSeq == mediaSeq {
+		p.interval = previous.interval
+		p.backoff()
+	}
+	polledPlaylists.playlists[url] = p
+
+	return resp, nil
+}
+
+// parseMediaPlaylist returns the media sequence and target duration of an
+// HLS media playlist.
+func parseMediaPlaylist(body []byte) (int64, time.Duration, bool) {
+	var mediaSeq int64
+	var target time.Duration
+	media := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			mediaSeq, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if seconds, err := strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64); err == nil {
+				target = time.Duration(seconds * float64(time.Second))
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			media = true
+		case line == "#EXT-X-ENDLIST":
+			// A finished playlist does not change anymore, nothing to poll.
+			return 0, 0, false
+		}
+	}
+
+	return mediaSeq, target, media
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// playlistResponse returns an upstream response of a media playlist of 3
+// segments starting at seq, with a target duration of 6 seconds.
+func playlistResponse(t *testing.T, rawURL string, seq int64, etag string) *http.Response {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Join(mediaPlaylist(seq, "seg", 3), "\n") + "\n"
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Etag": {etag}, "Content-Type": {"application/vnd.apple.mpegurl"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    &http.Request{Method: http.MethodGet, URL: u},
+	}
+}
+
+func storePlaylist(t *testing.T, rawURL string, seq int64, etag string) {
+	resp, err := storeHLSPlaylist(rawURL, playlistResponse(t, rawURL, seq, etag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "#EXT-X-MEDIA-SEQUENCE:") {
+		t.Fatalf("Expected the playlist to be served, got %q", body)
+	}
+}
+
+func pollInterval(rawURL string) time.Duration {
+	polledPlaylists.Lock()
+	defer polledPlaylists.Unlock()
+
+	if p, ok := polledPlaylists.playlists[rawURL]; ok {
+		return p.interval
+	}
+	return -1
+}
+
+func TestHLSPolling(t *testing.T) {
+	const playlistURL = "http://upstream/live/index.m3u8"
+	t.Cleanup(func() {
+		polledPlaylists.Lock()
+		delete(polledPlaylists.playlists, playlistURL)
+		polledPlaylists.Unlock()
+	})
+
+	t.Run("backs off while the playlist does not advance", func(t *testing.T) {
+		t.Setenv("HLS_POLL_BACKOFF", "true")
+
+		storePlaylist(t, playlistURL, 10, `"a"`)
+		if got := pollInterval(playlistURL); got != 0 {
+			t.Fatalf("Expected no backoff for a new playlist, got %v", got)
+		}
+		if _, ok := cachedHLSPlaylist(playlistURL); ok {
+			t.Fatal("Expected the upstream to be polled for a new playlist")
+		}
+
+		// The interval doubles up to half the target duration.
+		for _, want := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+			storePlaylist(t, playlistURL, 10, `"a"`)
+			if got := pollInterval(playlistURL); got != want {
+				t.Fatalf("Expected a poll interval of %v, got %v", want, got)
+			}
+		}
+
+		resp, ok := cachedHLSPlaylist(playlistURL)
+		if !ok {
+			t.Fatal("Expected the stored playlist to be served while backed off")
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "#EXT-X-MEDIA-SEQUENCE:10") || resp.Header.Get("ETag") != `"a"` {
+			t.Errorf("Expected the stored playlist, got %q with headers %v", body, resp.Header)
+		}
+
+		// The playlist advancing resets the backoff.
+		storePlaylist(t, playlistURL, 11, `"b"`)
+		if got := pollInterval(playlistURL); got != 0 {
+			t.Errorf("Expected the backoff to be reset, got %v", got)
+		}
+	})
+
+	t.Run("revalidates with the stored validators", func(t *testing.T) {
+		t.Setenv("HLS_POLL_BACKOFF", "true")
+
+		storePlaylist(t, playlistURL, 20, `"c"`)
+
+		headers := http.Header{}
+		conditionalHLSHeaders(playlistURL, headers)
+		if headers.Get("If-None-Match") != `"c"` {
+			t.Errorf("Expected If-None-Match to be set, got %v", headers)
+		}
+
+		// A 304 serves the stored playlist and counts as not advancing.
+		resp, ok := revalidatedHLSPlaylist(playlistURL)
+		if !ok {
+			t.Fatal("Expected the stored playlist after a 304")
+		}
+		if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "#EXT-X-MEDIA-SEQUENCE:20") {
+			t.Errorf("Expected the stored playlist, got %q", body)
+		}
+		if got := pollInterval(playlistURL); got != minPollInterval {
+			t.Errorf("Expected a poll interval of %v, got %v", minPollInterval, got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("HLS_POLL_BACKOFF", "false")
+
+		storePlaylist(t, playlistURL, 30, `"d"`)
+		storePlaylist(t, playlistURL, 30, `"d"`)
+		if got := pollInterval(playlistURL); got != 0 {
+			t.Errorf("Expected no backoff, got %v", got)
+		}
+		if _, ok := cachedHLSPlaylist(playlistURL); ok {
+			t.Error("Expected every poll to reach the upstream")
+		}
+	})
+
+	t.Run("finished playlists are not stored", func(t *testing.T) {
+		const vodURL = "http://upstream/vod/index.m3u8"
+
+		resp := playlistResponse(t, vodURL, 0, `"e"`)
+		resp.Body = io.NopCloser(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg0.ts\n#EXT-X-ENDLIST\n"))
+		if _, err := storeHLSPlaylist(vodURL, resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := pollInterval(vodURL); got != -1 {
+			t.Errorf("Expected the VOD playlist not to be stored, got an interval of %v", got)
+		}
+	})
+}
@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/utils"
 	"net/http"
+	"net/url"
 	"os"
 	"slices"
 	"sort"
@@ -14,9 +17,98 @@ import (
 	"time"
 )
 
+var (
+	ErrRequestBodyTooLarge = errors.New("request body too large")
+
+	// ErrConcurrencyExhausted is returned by the load balancer if every
+	// source was skipped for being at its concurrency limit.
+	ErrConcurrencyExhausted = errors.New("all sources are at their concurrency limit")
+	// ErrUpstreamFailed is returned by the load balancer if no source could
+	// be fetched.
+	ErrUpstreamFailed = errors.New("exhausted all streams")
+)
+
 type StreamInstance struct {
 	Info store.StreamInfo
 	Cm   *store.ConcurrencyManager
+
+	// Source restricts the load balancer to a single M3U source and Prefer
+	// tries a source ("backup" for anything but the usual first choice)
+	// before the others. Both are set from the client request and neither
+	// overrides the pins and exclusions of the channel.
+	Source string
+	Prefer string
+
+	// Query is the query of the client request, for the parameters forwarded
+	// to the upstream URLs.
+	Query url.Values
+
+	// Header and Body are passed on to the upstream requests, so non-GET
+	// requests of players (e.g. a POST for session setup) reach the source.
+	Header http.Header
+	Body   []byte
+
+	// streaming is set once the stream has been sent to the client from a
+	// source.
+	streaming bool
+
+	// metrics records the data sent to the client across the sources.
+	metrics *streamMetrics
+
+	// client identifies the client of the stream, which keeps the same
+	// User-Agent of the pools for all its upstream requests.
+	client string
+
+	// trace is called with every upstream request of the load balancer, for
+	// the self-test.
+	trace func(UpstreamAttempt)
+}
+
+// passthroughRequestHeaders are the client request headers passed on to the
+// upstream. Anything identifying the client or the proxy itself is left out.
+var passthroughRequestHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Content-Type",
+}
+
+// vodRequestHeaders are also passed on for movies and episodes, so players
+// can seek in them.
+var vodRequestHeaders = []string{
+	"Range",
+	"If-Range",
+}
+
+// SetClientRequest passes the method dependent parts of the client request
+// on to the upstream requests. The body is read up to maxBody bytes.
+func (instance *StreamInstance) SetClientRequest(r *http.Request, maxBody int64) error {
+	instance.Query = r.URL.Query()
+	instance.client = utils.GenerateFingerprint(r)
+
+	instance.Header = http.Header{}
+	passthrough := passthroughRequestHeaders
+	if store.StreamMediaType(instance.Info) != store.MediaLive {
+		passthrough = append(passthrough, vodRequestHeaders...)
+	}
+	for _, key := range passthrough {
+		if values := r.Header.Values(key); len(values) > 0 {
+			instance.Header[key] = values
+		}
+	}
+
+	if r.Body == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxBody {
+		return ErrRequestBodyTooLarge
+	}
+	instance.Body = body
+	return nil
 }
 
 func NewStreamInstance(streamUrl string, cm *store.ConcurrencyManager) (*StreamInstance, error) {
@@ -31,14 +123,13 @@ func NewStreamInstance(streamUrl string, cm *store.ConcurrencyManager) (*StreamI
 	}, nil
 }
 
-func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store.Session, method string) (*http.Response, string, string, string, error) {
+// loadBalance tries the source entries of the stream in order until one can
+// be fetched, starting with the one found by shared if not nil.
+func (instance *StreamInstance) loadBalance(ctx context.Context, session *store.Session, method string, shared *balancerFlight) (*http.Response, string, string, string, error) {
 	debug := os.Getenv("DEBUG") == "true"
 
-	m3uIndexes := utils.GetM3UIndexes()
-
-	sort.Slice(m3uIndexes, func(i, j int) bool {
-		return instance.Cm.ConcurrencyPriorityValue(m3uIndexes[i]) > instance.Cm.ConcurrencyPriorityValue(m3uIndexes[j])
-	})
+	pin := store.GetChannelPin(instance.Info.Title)
+	m3uIndexes := instance.sourceOrder(pin)
 
 	maxLapsString := os.Getenv("MAX_RETRIES")
 	maxLaps, err := strconv.Atoi(strings.TrimSpace(maxLapsString))
@@ -48,11 +139,45 @@ func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store
 
 	lap := 0
 
+	// Requests other than GET and HEAD (e.g. a POST for the session setup of
+	// a player) may not be safe to repeat, so they are sent to the first
+	// source entry tried only.
+	once := method != http.MethodGet && method != http.MethodHead
+
+	// Whether a source was skipped for its concurrency limit, and whether one
+	// was requested (or skipped for failing).
+	limited, attempted := false, false
+
 	// Backoff settings
 	initialBackoff := 200 * time.Millisecond
 	maxBackoff := 2 * time.Second
 	currentBackoff := initialBackoff
 
+	// The source entry found by a concurrent run, or the one the channel was
+	// opened from moments ago, is tried first, e.g. for a second client
+	// joining or a quick channel flip back, instead of going through the
+	// sources in order again.
+	if index, subIndex, url, ok := instance.cachedSource(session, m3uIndexes, pin, shared); ok {
+		attempted = true
+
+		resp, err := instance.fetchSource(method, index, subIndex, url)
+		if err == nil {
+			Circuits.Success(url)
+			storeProbe(instance.Info.Title, index, subIndex)
+			if debug {
+				utils.SafeLogf("[DEBUG] Reused recently opened stream from %s\n", url)
+			}
+			return resp, url, index, subIndex, nil
+		}
+		Circuits.Failure(url)
+		forgetProbe(instance.Info.Title, index, subIndex)
+		utils.SafeLogf("Error fetching stream: %s\n", err.Error())
+		if once {
+			return nil, "", "", "", ErrUpstreamFailed
+		}
+		session.SetTestedIndexes(append(session.TestedIndexes, store.SameURLEntries(instance.Info, index, subIndex)...))
+	}
+
 	for lap < maxLaps || maxLaps == 0 {
 		if debug {
 			utils.SafeLogf("[DEBUG] Stream attempt %d out of %d\n", lap+1, maxLaps)
@@ -63,35 +188,68 @@ func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store
 			return nil, "", "", "", fmt.Errorf("Cancelling load balancer.")
 		default:
 			for _, index := range m3uIndexes {
+				if store.IsSourceDisabled(index) {
+					if debug {
+						utils.SafeLogf("[DEBUG] Skipping M3U_%s: source is disabled\n", index)
+					}
+					continue
+				}
+
+				if !pin.IsSourceAllowed(index) {
+					if debug {
+						utils.SafeLogf("[DEBUG] Skipping M3U_%s: excluded by channel pin\n", index)
+					}
+					continue
+				}
+
 				innerMap, ok := instance.Info.URLs[index]
 				if !ok {
 					utils.SafeLogf("Channel not found from M3U_%s: %s\n", index, instance.Info.Title)
 					continue
 				}
 
-				for subIndex, url := range innerMap {
+				// Variants of the channel in the source, e.g. HD and SD, are
+				// tried in QUALITY_ORDER.
+				for _, subIndex := range store.SubIndexOrder(instance.Info, index) {
+					url := innerMap[subIndex]
 					if slices.Contains(session.TestedIndexes, index+"|"+subIndex) {
 						utils.SafeLogf("Skipping M3U_%s|%s: marked as previous stream\n", index, subIndex)
 						continue
 					}
 
-					if instance.Cm.CheckConcurrency(index) {
+					if instance.Cm.CheckStreamConcurrency(index, instance.Info.Group) {
 						utils.SafeLogf("Concurrency limit reached for M3U_%s: %s\n", index, url)
+						limited = true
+						continue
+					}
+
+					attempted = true
+
+					if !Circuits.Allow(url) {
+						utils.SafeLogf("Skipping M3U_%s|%s: circuit open after repeated failures\n", index, subIndex)
 						continue
 					}
 
-					resp, err := utils.CustomHttpRequest(method, url)
+					resp, err := instance.fetchSource(method, index, subIndex, url)
 					if err == nil {
+						Circuits.Success(url)
+						storeProbe(instance.Info.Title, index, subIndex)
 						if debug {
 							utils.SafeLogf("[DEBUG] Successfully fetched stream from %s\n", url)
 						}
 						return resp, url, index, subIndex, nil
 					}
+					Circuits.Failure(url)
+					forgetProbe(instance.Info.Title, index, subIndex)
 					utils.SafeLogf("Error fetching stream: %s\n", err.Error())
 					if debug {
 						utils.SafeLogf("[DEBUG] Error fetching stream from %s: %s\n", url, err.Error())
 					}
-					session.SetTestedIndexes(append(session.TestedIndexes, index+"|"+subIndex))
+					if once {
+						return nil, "", "", "", ErrUpstreamFailed
+					}
+					// Other sources listing the same URL are skipped too.
+					session.SetTestedIndexes(append(session.TestedIndexes, store.SameURLEntries(instance.Info, index, subIndex)...))
 				}
 			}
 
@@ -103,7 +261,7 @@ func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store
 		}
 
 		select {
-		case <-time.After(currentBackoff):
+		case <-time.After(jitter(currentBackoff)):
 			currentBackoff *= 2
 			if currentBackoff > maxBackoff {
 				currentBackoff = maxBackoff
@@ -114,5 +272,112 @@ func (instance *StreamInstance) LoadBalancer(ctx context.Context, session *store
 		lap++
 	}
 
-	return nil, "", "", "", fmt.Errorf("Error fetching stream. Exhausted all streams.")
+	if limited && !attempted {
+		return nil, "", "", "", ErrConcurrencyExhausted
+	}
+	return nil, "", "", "", ErrUpstreamFailed
+}
+
+// Reconnect requests the source entry a stream was proxied from again, e.g.
+// after the upstream ended the response for a token refresh.
+func (instance *StreamInstance) Reconnect(method string, m3uIndex string, subIndex string) (*http.Response, error) {
+	url, ok := instance.Info.URLs[m3uIndex][subIndex]
+	if !ok {
+		return nil, fmt.Errorf("M3U_%s|%s is not a source of %s", m3uIndex, subIndex, instance.Info.Title)
+	}
+
+	if store.IsSourceDisabled(m3uIndex) {
+		return nil, fmt.Errorf("M3U_%s is disabled", m3uIndex)
+	}
+
+	if !Circuits.Allow(url) {
+		return nil, fmt.Errorf("circuit open after repeated failures")
+	}
+
+	resp, err := instance.fetchSource(method, m3uIndex, subIndex, url)
+	if err != nil {
+		Circuits.Failure(url)
+		forgetProbe(instance.Info.Title, m3uIndex, subIndex)
+		return nil, err
+	}
+	Circuits.Success(url)
+	storeProbe(instance.Info.Title, m3uIndex, subIndex)
+
+	return resp, nil
+}
+
+// cachedSource returns the source entry found by shared, or else the one the
+// channel was opened from within PROBE_CACHE_TTL, if it may be used for this
+// request.
+func (instance *StreamInstance) cachedSource(session *store.Session, m3uIndexes []string, pin store.ChannelPin, shared *balancerFlight) (string, string, string, bool) {
+	index, subIndex, ok := cachedProbe(instance.Info.Title)
+	if shared != nil {
+		index, subIndex, ok = shared.index, shared.subIndex, true
+	}
+	if !ok || instance.Prefer != "" || !slices.Contains(m3uIndexes, index) || store.IsSourceDisabled(index) {
+		return "", "", "", false
+	}
+	if !pin.IsSourceAllowed(index) {
+		return "", "", "", false
+	}
+	// The preferred source is probed again rather than reusing a fallback.
+	if shared == nil && instance.Source == "" && pin.PreferredSource != "" && index != pin.PreferredSource {
+		return "", "", "", false
+	}
+	if slices.Contains(session.TestedIndexes, index+"|"+subIndex) || instance.Cm.CheckStreamConcurrency(index, instance.Info.Group) {
+		return "", "", "", false
+	}
+
+	url, ok := instance.Info.URLs[index][subIndex]
+	if !ok || !Circuits.Allow(url) {
+		return "", "", "", false
+	}
+	return index, subIndex, url, true
+}
+
+// sourceOrder returns the M3U indexes in the order they should be tried:
+// the local playlist first, then the best measured quality, then by free
+// concurrency slots. The prefer query parameter takes precedence over the
+// preferred source of the channel, which takes precedence over the local
+// playlist.
+func (instance *StreamInstance) sourceOrder(pin store.ChannelPin) []string {
+	m3uIndexes := slices.Clone(utils.GetM3UIndexes())
+	// Custom channels are streamed from their own source, alongside the
+	// sources listing the same title.
+	if _, ok := instance.Info.URLs[store.CustomSource]; ok {
+		m3uIndexes = append(m3uIndexes, store.CustomSource)
+	}
+
+	sort.Slice(m3uIndexes, func(i, j int) bool {
+		return instance.Cm.ConcurrencyPriorityValue(m3uIndexes[i]) > instance.Cm.ConcurrencyPriorityValue(m3uIndexes[j])
+	})
+	m3uIndexes = orderByQuality(instance.Info.Title, m3uIndexes)
+	// The local playlist is managed by the user and takes precedence.
+	if _, ok := instance.Info.URLs[store.LocalSource]; ok {
+		m3uIndexes = append([]string{store.LocalSource}, m3uIndexes...)
+	}
+
+	if instance.Source != "" {
+		if slices.Contains(m3uIndexes, instance.Source) && pin.IsSourceAllowed(instance.Source) {
+			return []string{instance.Source}
+		}
+		return []string{}
+	}
+
+	prefer := instance.Prefer
+	if prefer == "" {
+		prefer = pin.PreferredSource
+	}
+
+	switch {
+	case prefer == "backup" && len(m3uIndexes) > 1:
+		m3uIndexes = append(m3uIndexes[1:], m3uIndexes[0])
+	case slices.Contains(m3uIndexes, prefer):
+		m3uIndexes = slices.DeleteFunc(m3uIndexes, func(index string) bool {
+			return index == prefer
+		})
+		m3uIndexes = append([]string{prefer}, m3uIndexes...)
+	}
+
+	return m3uIndexes
 }
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ResolveM3U8Line rewrites a relative URI line of an M3U8 playlist into an
+// absolute one using base. Tags and comments are returned unchanged and blank
+// lines return an empty string. If the URI cannot be parsed, the line is
+// returned as-is along with the error.
+func ResolveM3U8Line(base *url.URL, line string) (string, error) {
+	if strings.HasPrefix(line, "#") {
+		return line, nil
+	}
+
+	if strings.TrimSpace(line) == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(line)
+	if err != nil {
+		return line, err
+	}
+
+	if !u.IsAbs() {
+		u = base.ResolveReference(u)
+	}
+
+	return u.String(), nil
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+)
+
+const (
+	// preresolvedProbeTTL is how long a source entry found reachable by
+	// PreresolveChannels is tried first for its channel.
+	preresolvedProbeTTL = 10 * time.Minute
+	// preresolveTimeout bounds each HEAD request of PreresolveChannels.
+	preresolveTimeout = 10 * time.Second
+)
+
+// PreresolveChannels resolves and probes the source entries of the channels
+// with the given titles with a HEAD request, and caches the first reachable
+// one of each channel, so opening them right after a sync or restart does
+// not go through failing sources first. With QUALITY_PROBE, the streams of
+// all source entries are sampled instead and the best one is cached.
+func PreresolveChannels(ctx context.Context, titles []string) {
+	for _, title := range titles {
+		if ctx.Err() != nil {
+			return
+		}
+
+		stream, ok := store.GetStreamByTitle(title)
+		if !ok {
+			continue
+		}
+
+		if index, subIndex, ok := preresolveChannel(ctx, stream); ok {
+			cacheProbe(title, index, subIndex, preresolvedProbeTTL)
+			utils.SafeLogf("Pre-resolved %s on M3U_%s|%s\n", title, index, subIndex)
+		} else {
+			utils.SafeLogf("No reachable source found while pre-resolving %s\n", title)
+		}
+	}
+}
+
+// preresolveChannel returns the source entry of stream with the best quality,
+// or else the first one answering a HEAD request, in the order the load
+// balancer tries them.
+func preresolveChannel(ctx context.Context, stream store.StreamInfo) (string, string, bool) {
+	if qualityProbeEnabled() {
+		if index, subIndex, ok := probeChannelQuality(ctx, stream); ok {
+			return index, subIndex, true
+		}
+	}
+
+	pin := store.GetChannelPin(stream.Title)
+
+	m3uIndexes := orderByQuality(stream.Title, utils.GetM3UIndexes())
+	if slices.Contains(m3uIndexes, pin.PreferredSource) {
+		m3uIndexes = slices.DeleteFunc(m3uIndexes, func(index string) bool {
+			return index == pin.PreferredSource
+		})
+		m3uIndexes = append([]string{pin.PreferredSource}, m3uIndexes...)
+	}
+
+	for _, index := range m3uIndexes {
+		if !pin.IsSourceAllowed(index) || store.IsSourceDisabled(index) {
+			continue
+		}
+
+		subIndexes := make([]string, 0, len(stream.URLs[index]))
+		for subIndex := range stream.URLs[index] {
+			subIndexes = append(subIndexes, subIndex)
+		}
+		sort.Strings(subIndexes)
+
+		for _, subIndex := range subIndexes {
+			url := upstreamURL(index, stream.URLs[index][subIndex], nil)
+			probeCtx, cancel := context.WithTimeout(ctx, preresolveTimeout)
+			requested := time.Now()
+			resp, err := utils.SourceHttpRequestContext(probeCtx, index, http.MethodHead, url, stream.URLHeaders(index, subIndex))
+			cancel()
+			if err != nil {
+				Sources.recordRequest(index, 0, 0, err)
+				continue
+			}
+			resp.Body.Close()
+			Sources.recordRequest(index, resp.StatusCode, time.Since(requested), nil)
+
+			// Providers not supporting HEAD still answered.
+			if resp.StatusCode < http.StatusBadRequest ||
+				resp.StatusCode == http.StatusMethodNotAllowed ||
+				resp.StatusCode == http.StatusNotImplemented {
+				return index, subIndex, true
+			}
+		}
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"m3u-stream-merger/utils"
+)
+
+// sourceProbeMode returns how a source is checked before streaming from it:
+// "direct" streams from the response of the first GET, "head" sends a HEAD
+// request first for providers where a failed GET would still count against
+// their connection limit.
+func sourceProbeMode(m3uIndex string) string {
+	mode := os.Getenv(fmt.Sprintf("M3U_PROBE_MODE_%s", m3uIndex))
+	if strings.TrimSpace(mode) == "" {
+		mode = os.Getenv("PROBE_MODE")
+	}
+
+	if strings.ToLower(strings.TrimSpace(mode)) == "head" {
+		return "head"
+	}
+	return "direct"
+}
+
+// fetchSource requests a source entry of the stream. The returned response is
+// the one to stream from; no further request is made for it.
+func (instance *StreamInstance) fetchSource(method string, m3uIndex string, subIndex string, url string) (resp *http.Response, err error) {
+	attempt := UpstreamAttempt{Source: m3uIndex + "|" + subIndex}
+	if instance.trace != nil {
+		defer func() {
+			if err != nil {
+				attempt.Error = utils.RedactURLs(err.Error())
+			}
+			instance.trace(attempt)
+		}()
+	}
+
+	headers := instance.Info.URLHeaders(m3uIndex, subIndex)
+	for key, values := range instance.Header {
+		if _, ok := headers[key]; !ok {
+			headers[key] = values
+		}
+	}
+	url = upstreamURL(m3uIndex, url, instance.Query)
+	ctx := utils.WithUserAgentSession(context.Background(), instance.client)
+
+	// HLS media playlists that stopped advancing are served from the last
+	// version for a while, to spare rate-limited providers.
+	if method == http.MethodGet {
+		if resp, ok := cachedHLSPlaylist(url); ok {
+			return resp, nil
+		}
+	}
+
+	if err := injectRequestFault(instance.Info.Title, url); err != nil {
+		return nil, err
+	}
+
+	// The HEAD probe is skipped for the source entry the channel was opened
+	// from moments ago.
+	if method == http.MethodGet && sourceProbeMode(m3uIndex) == "head" && !probeCached(instance.Info.Title, m3uIndex, subIndex) {
+		requested := time.Now()
+		resp, err := utils.SourceHttpRequestContext(ctx, m3uIndex, http.MethodHead, url, headers)
+		attempt.ProbeMs = time.Since(requested).Milliseconds()
+		if err != nil {
+			Sources.recordRequest(m3uIndex, 0, 0, err)
+			return nil, err
+		}
+		resp.Body.Close()
+		Sources.recordRequest(m3uIndex, resp.StatusCode, time.Since(requested), nil)
+
+		// Providers not supporting HEAD are probed with the GET itself.
+		if resp.StatusCode >= http.StatusBadRequest &&
+			resp.StatusCode != http.StatusMethodNotAllowed &&
+			resp.StatusCode != http.StatusNotImplemented {
+			return nil, fmt.Errorf("HEAD probe returned %s", resp.Status)
+		}
+	}
+
+	if method == http.MethodGet {
+		conditionalHLSHeaders(url, headers)
+	}
+
+	requested := time.Now()
+	resp, err = utils.SourceHttpRequestWithBody(ctx, m3uIndex, method, url, headers, instance.Body)
+	attempt.TTFBMs = time.Since(requested).Milliseconds()
+	if err != nil {
+		Sources.recordRequest(m3uIndex, 0, 0, err)
+		return nil, err
+	}
+	attempt.Status = resp.StatusCode
+	Sources.recordRequest(m3uIndex, resp.StatusCode, time.Since(requested), nil)
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		if cached, ok := revalidatedHLSPlaylist(url); ok {
+			return cached, nil
+		}
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	if method == http.MethodGet && utils.EOFIsExpected(resp) {
+		return storeHLSPlaylist(url, resp)
+	}
+
+	injectResetFault(instance.Info.Title, resp)
+
+	return resp, nil
+}
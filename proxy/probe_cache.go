@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeResult is the source entry a channel was last opened from, trusted
+// until expires.
+type probeResult struct {
+	m3uIndex string
+	subIndex string
+	expires  time.Time
+}
+
+var probeResults = struct {
+	sync.Mutex
+	results map[string]probeResult
+}{results: make(map[string]probeResult)}
+
+// probeCacheTTL returns how long a source entry successfully opened for a
+// channel is trusted without probing it again (PROBE_CACHE_TTL, 0 to
+// disable).
+func probeCacheTTL() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("PROBE_CACHE_TTL")))
+	if err != nil || seconds < 0 {
+		seconds = 10
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cachedProbe returns the source entry the channel title was opened from
+// within the TTL.
+func cachedProbe(title string) (string, string, bool) {
+	probeResults.Lock()
+	defer probeResults.Unlock()
+
+	result, ok := probeResults.results[title]
+	if !ok || time.Now().After(result.expires) {
+		return "", "", false
+	}
+	return result.m3uIndex, result.subIndex, true
+}
+
+// probeCached reports whether the source entry is the one the channel title
+// was opened from within the TTL.
+func probeCached(title string, m3uIndex string, subIndex string) bool {
+	index, sub, ok := cachedProbe(title)
+	return ok && index == m3uIndex && sub == subIndex
+}
+
+// storeProbe records that the channel title was opened from the source entry.
+func storeProbe(title string, m3uIndex string, subIndex string) {
+	if ttl := probeCacheTTL(); ttl > 0 {
+		cacheProbe(title, m3uIndex, subIndex, ttl)
+	}
+}
+
+// cacheProbe trusts the source entry of the channel title for ttl, or
+// longer if it already was.
+func cacheProbe(title string, m3uIndex string, subIndex string, ttl time.Duration) {
+	probeResults.Lock()
+	defer probeResults.Unlock()
+
+	now := time.Now()
+	for k, result := range probeResults.results {
+		if now.After(result.expires) {
+			delete(probeResults.results, k)
+		}
+	}
+
+	expires := now.Add(ttl)
+	if result, ok := probeResults.results[title]; ok && result.m3uIndex == m3uIndex && result.subIndex == subIndex && result.expires.After(expires) {
+		expires = result.expires
+	}
+	probeResults.results[title] = probeResult{m3uIndex: m3uIndex, subIndex: subIndex, expires: expires}
+}
+
+// forgetProbe drops the cached result of the channel title if it is the
+// source entry that failed.
+func forgetProbe(title string, m3uIndex string, subIndex string) {
+	probeResults.Lock()
+	defer probeResults.Unlock()
+
+	if result, ok := probeResults.results[title]; ok && result.m3uIndex == m3uIndex && result.subIndex == subIndex {
+		delete(probeResults.results, title)
+	}
+}
@@ -3,6 +3,8 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"m3u-stream-merger/utils"
 	"net/http"
@@ -13,76 +15,122 @@ import (
 	"time"
 )
 
-func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string, subIndex string, resp *http.Response, r *http.Request, w http.ResponseWriter, statusChan chan int) {
+func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string, subIndex string, resp *http.Response, r *http.Request, w http.ResponseWriter, statusChan chan StreamStatus) {
 	debug := os.Getenv("DEBUG") == "true"
 
+	// Registered first so it runs last, once the deferred cleanups below
+	// released the concurrency slot, buffers and tee of the stream. A panic
+	// in this goroutine would otherwise take the whole process down.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			utils.LogPanic(r.Context(), "stream "+instance.Info.Title, recovered)
+			select {
+			case statusChan <- newStreamStatus(StatusPanic, fmt.Errorf("panic: %v", recovered)):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
 	bufferMbInt, err := strconv.Atoi(os.Getenv("BUFFER_MB"))
 	if err != nil || bufferMbInt < 0 {
 		bufferMbInt = 0
 	}
-	buffer := make([]byte, 1024)
-	if bufferMbInt > 0 {
-		buffer = make([]byte, bufferMbInt*1024*1024)
+
+	// The answers to other methods, e.g. to a POST for the session setup of
+	// a player, are not playlists and are passed on as they are.
+	if r.Method != http.MethodGet {
+		_, err := io.Copy(w, resp.Body)
+		if err != nil {
+			utils.SafeLogf("Failed to copy %s response: %v\n", r.Method, err)
+		}
+		statusChan <- newStreamStatus(StatusM3U8Parsed, err)
+		return
 	}
 
-	if r.Method != http.MethodGet || utils.EOFIsExpected(resp) {
+	if utils.EOFIsExpected(resp) {
 		scanner := bufio.NewScanner(resp.Body)
 		base, err := url.Parse(resp.Request.URL.String())
 		if err != nil {
 			utils.SafeLogf("Invalid base URL for M3U8 stream: %v", err)
-			statusChan <- 4
+			statusChan <- newStreamStatus(StatusM3U8Parsed, err)
 			return
 		}
 
+		var lines []string
 		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "#") {
-				_, err := w.Write([]byte(line + "\n"))
-				if err != nil {
-					utils.SafeLogf("Failed to write line to response: %v", err)
-					statusChan <- 4
-					return
-				}
-			} else if strings.TrimSpace(line) != "" {
-				u, err := url.Parse(line)
-				if err != nil {
-					utils.SafeLogf("Failed to parse M3U8 URL in line: %v", err)
-					_, err := w.Write([]byte(line + "\n"))
-					if err != nil {
-						utils.SafeLogf("Failed to write line to response: %v", err)
-						statusChan <- 4
-						return
-					}
-					continue
-				}
+			line, err := ResolveM3U8Line(base, scanner.Text())
+			if err != nil {
+				utils.SafeLogf("Failed to parse M3U8 URL in line: %v", err)
+			}
+			if line == "" {
+				continue
+			}
+			lines = append(lines, line)
+		}
 
-				if !u.IsAbs() {
-					u = base.ResolveReference(u)
-				}
+		key := utils.GenerateFingerprint(r) + "|" + instance.Info.Title
+		lines = continuousHLSPlaylist(key, m3uIndex+"|"+subIndex, lines)
 
-				_, err = w.Write([]byte(u.String() + "\n"))
-				if err != nil {
-					utils.SafeLogf("Failed to write URL to response: %v", err)
-					statusChan <- 4
-					return
-				}
+		for _, line := range lines {
+			_, err = w.Write([]byte(line + "\n"))
+			if err != nil {
+				utils.SafeLogf("Failed to write line to response: %v", err)
+				statusChan <- newStreamStatus(StatusM3U8Parsed, err)
+				return
 			}
 		}
 
-		statusChan <- 4
+		statusChan <- newStreamStatus(StatusM3U8Parsed, nil)
 		return
 	}
 
-	instance.Cm.UpdateConcurrency(m3uIndex, true)
+	instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, true)
 	defer func() {
 		if debug {
 			utils.SafeLogf("[DEBUG] Defer executed for stream: %s\n", r.RemoteAddr)
 		}
-		instance.Cm.UpdateConcurrency(m3uIndex, false)
+		instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, false)
 	}()
 
+	buffer := getBuffer(1024)
+	if bufferMbInt > 0 {
+		if budgeted, ok := Buffers.getBuffer(bufferMbInt * 1024 * 1024); ok {
+			putBuffer(buffer)
+			buffer = budgeted
+			defer Buffers.releaseBuffer(budgeted)
+		} else {
+			utils.SafeLogf("Buffer memory cap reached (BUFFER_MAX_TOTAL_MB). Streaming without buffer: %s\n", r.RemoteAddr)
+		}
+	}
+
+	// The metrics of the stream are kept across its sources.
+	if instance.metrics == nil {
+		instance.metrics = newStreamMetrics()
+	}
+	tee := startStreamTee(instance.Info.Title, instance.Info.Group, m3uIndex+"|"+subIndex, r.RemoteAddr, len(buffer), instance.metrics)
+	defer tee.stop()
 	defer func() {
-		buffer = nil
+		metrics := instance.metrics.snapshot()
+		utils.SafeLogf("Stream metrics of %s from M3U_%s|%s: %.0f kbps, %d stalls, %d zero reads (longest streak %d), %d failovers\n",
+			r.RemoteAddr, m3uIndex, subIndex, metrics.BitrateKbps, metrics.Stalls, metrics.ZeroReads, metrics.MaxZeroReadStreak, metrics.Failovers)
+	}()
+
+	// Only the start of the stream is held back, not the switch to another
+	// source while the client is already playing.
+	delay := time.Duration(0)
+	if !instance.streaming {
+		delay = startupDelay(m3uIndex)
+		instance.streaming = true
+	}
+	cw := withTSAlignment(withStartupDelay(withWriteDeadline(newClientWriter(w), w), delay))
+
+	readPending := false
+	defer func() {
+		// An in-flight read may still write into the buffer after we return,
+		// so it can only be recycled if no read is pending.
+		if !readPending {
+			putBuffer(buffer)
+		}
 	}()
 
 	timeoutSecond := 3
@@ -95,10 +143,50 @@ func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string
 		timeoutDuration = time.Minute
 	}
 
+	// A read blocking for longer than STREAM_IDLE_TIMEOUT is handled like a
+	// read error. Disabled by default as some streams have quiet periods.
+	// Until the first data arrives, STREAM_INITIAL_DATA_TIMEOUT applies
+	// instead as providers may take a while to start a stream.
+	idleTimeout := time.Duration(0)
+	resetIdleTimer := func() {}
+	if ts, err := strconv.Atoi(os.Getenv("STREAM_IDLE_TIMEOUT")); err == nil && ts > 0 {
+		idleTimeout = time.Duration(ts) * time.Second
+	}
+
+	initialDataTimeout := idleTimeout
+	if ts, err := strconv.Atoi(os.Getenv("STREAM_INITIAL_DATA_TIMEOUT")); err == nil && ts > 0 {
+		initialDataTimeout = time.Duration(ts) * time.Second
+	}
+
+	receivedData := false
+	received := int64(0)
+	currentIdleTimeout := func() time.Duration {
+		if receivedData {
+			return idleTimeout
+		}
+		return initialDataTimeout
+	}
+
+	var idleTimer <-chan time.Time
+	if initialDataTimeout > 0 {
+		timer := time.NewTimer(initialDataTimeout)
+		defer timer.Stop()
+		idleTimer = timer.C
+		resetIdleTimer = func() {
+			if timeout := currentIdleTimeout(); timeout > 0 {
+				timer.Reset(timeout)
+			} else {
+				timer.Stop()
+			}
+		}
+	}
+
+	throughput := newThroughputMonitor()
+
 	timeStarted := time.Now()
 	lastErr := timeStarted
 
-	returnStatus := 0
+	returnStatus := newStreamStatus(StatusUpstreamError, fmt.Errorf("no data received within %d seconds", timeoutSecond))
 
 	// Backoff settings
 	initialBackoff := 200 * time.Millisecond
@@ -109,7 +197,7 @@ func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(currentBackoff):
+		case <-time.After(jitter(currentBackoff)):
 			currentBackoff *= 2
 			if currentBackoff > maxBackoff {
 				currentBackoff = maxBackoff
@@ -117,67 +205,156 @@ func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string
 		}
 	}
 
+	// While the upstream is quiet, nothing is written that would fail on a
+	// dead client, e.g. behind a reverse proxy not forwarding disconnects.
+	// The connection is probed with an empty flush instead, so a dead client
+	// frees its upstream slot without waiting for the next data.
+	var probeTicker <-chan time.Time
+	probeInterval := clientProbeInterval()
+	if probeInterval > 0 {
+		ticker := time.NewTicker(probeInterval)
+		defer ticker.Stop()
+		probeTicker = ticker.C
+	}
+	rc := http.NewResponseController(w)
+	lastWrite := time.Now()
+
 	readChan := make(chan struct {
 		n   int
 		err error
 	}, 1)
 
 	for {
-		go func() {
-			n, err := resp.Body.Read(buffer)
-			readChan <- struct {
-				n   int
-				err error
-			}{n, err}
-		}()
+		// A probe of the client leaves the pending read running.
+		reading := !readPending
+		if reading {
+			readPending = true
+			go func(buffer []byte) {
+				n, err := resp.Body.Read(buffer)
+				readChan <- struct {
+					n   int
+					err error
+				}{n, err}
+			}(buffer)
+		}
 
+		// Only checked when a read is started, a probe of the client while
+		// the read is pending says nothing about the upstream.
 		elapsed := time.Since(timeStarted)
-		if timeoutSecond > 0 && elapsed >= timeoutDuration {
+		if reading && timeoutSecond > 0 && elapsed >= timeoutDuration {
 			utils.SafeLogf("Timeout reached while trying to stream: %s\n", r.RemoteAddr)
 			statusChan <- returnStatus
 			return
 		}
 
+		if reading {
+			resetIdleTimer()
+		}
+
 		select {
 		case <-ctx.Done():
 			utils.SafeLogf("Context canceled for stream: %s\n", r.RemoteAddr)
 			_ = resp.Body.Close()
 			return
+		case <-probeTicker:
+			if time.Since(lastWrite) < probeInterval {
+				continue
+			}
+			if err := probeClient(rc); err != nil {
+				utils.SafeLogf("Client connection is gone, disconnecting: %s (%v)\n", r.RemoteAddr, err)
+				_ = resp.Body.Close()
+				statusChan <- newStreamStatus(StatusClientClosed, err)
+				return
+			}
+		case <-idleTimer:
+			instance.metrics.stall()
+			utils.SafeLogf("No data received for %s, considering stream down: %s\n", currentIdleTimeout(), r.RemoteAddr)
+			// Closing the body unblocks the pending read.
+			_ = resp.Body.Close()
+			statusChan <- newStreamStatus(StatusUpstreamError, fmt.Errorf("no data received for %s", currentIdleTimeout()))
+			return
 		case result := <-readChan:
+			readPending = false
+			if result.err != nil {
+				// Data returned along with the error is still part of the
+				// stream.
+				if result.n > 0 {
+					received += int64(result.n)
+					Sources.addBytes(m3uIndex, result.n)
+					tee.publish(buffer[:result.n])
+					if err := cw.WriteChunk(buffer[:result.n], false); err != nil {
+						utils.SafeLogf("Error writing to response: %s\n", err.Error())
+						statusChan <- clientWriteStatus(err)
+						return
+					}
+				}
+
+				if err := cw.Flush(); err != nil {
+					utils.SafeLogf("Error writing to response: %s\n", err.Error())
+					statusChan <- clientWriteStatus(err)
+					return
+				}
+			}
+
 			switch {
+			case result.err == io.EOF && resp.ContentLength > 0 && received == resp.ContentLength:
+				utils.SafeLogf("Stream completed: %s\n", r.RemoteAddr)
+				statusChan <- newStreamStatus(StatusCompleted, nil)
+				return
 			case result.err == io.EOF:
 				lastErr = time.Now()
 				if utils.EOFIsExpected(resp) || timeoutSecond == 0 {
 					utils.SafeLogf("Stream ended (expected EOF reached): %s\n", r.RemoteAddr)
-					statusChan <- 2
+					statusChan <- newStreamStatus(StatusEOF, nil)
 					return
 				}
 
 				utils.SafeLogf("Stream ended (unexpected EOF reached): %s\n", r.RemoteAddr)
-				returnStatus = 2
+				returnStatus = newStreamStatus(StatusEOF, io.ErrUnexpectedEOF)
 
 				utils.SafeLogf("Retrying same stream until timeout (%d seconds) is reached...\n", timeoutSecond)
+				instance.metrics.stall()
+				tee.setRetrying()
 				contextSleep(ctx)
 			case result.err != nil:
 				lastErr = time.Now()
+				instance.metrics.stall()
 				utils.SafeLogf("Error reading stream: %s\n", result.err.Error())
-				returnStatus = 1
+				returnStatus = newStreamStatus(StatusUpstreamError, result.err)
 				if timeoutSecond == 0 {
-					statusChan <- 1
+					statusChan <- returnStatus
 					return
 				}
 
 				utils.SafeLogf("Retrying same stream until timeout (%d seconds) is reached...\n", timeoutSecond)
+				tee.setRetrying()
 				contextSleep(ctx)
 			case result.err == nil:
-				if _, err := w.Write(buffer[:result.n]); err != nil {
+				if err := cw.WriteChunk(buffer[:result.n], result.n == len(buffer)); err != nil {
 					utils.SafeLogf("Error writing to response: %s\n", err.Error())
-					statusChan <- 0
+					statusChan <- clientWriteStatus(err)
 					return
 				}
+				if result.n > 0 {
+					lastWrite = time.Now()
+				}
 
-				if flusher, ok := w.(http.Flusher); ok {
-					flusher.Flush()
+				if result.n == 0 {
+					instance.metrics.zeroRead()
+				}
+				if result.n > 0 {
+					receivedData = true
+					received += int64(result.n)
+					Sources.addBytes(m3uIndex, result.n)
+					tee.publish(buffer[:result.n])
+				}
+
+				if kbps, low := throughput.add(result.n); low {
+					instance.metrics.stall()
+					utils.SafeLogf("Upstream throughput dropped to %.0f kbps, considering stream down: %s\n", kbps, r.RemoteAddr)
+					_ = resp.Body.Close()
+					statusChan <- newStreamStatus(StatusUpstreamError, fmt.Errorf("throughput dropped to %.0f kbps", kbps))
+					return
 				}
 
 				// check if never errored or last error was at least a second ago
@@ -191,3 +368,30 @@ func (instance *StreamInstance) ProxyStream(ctx context.Context, m3uIndex string
 		}
 	}
 }
+
+// clientWriteStatus returns the status of a failed write to the client.
+func clientWriteStatus(err error) StreamStatus {
+	if errors.Is(err, errClientStalled) {
+		return newStreamStatus(StatusClientStalled, err)
+	}
+	return newStreamStatus(StatusClientClosed, err)
+}
+
+// clientProbeInterval returns how often the connection of a client is probed
+// while no data is sent to it (CLIENT_PROBE_INTERVAL). 0 disables probing.
+func clientProbeInterval() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CLIENT_PROBE_INTERVAL")))
+	if err != nil || seconds < 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// probeClient flushes the connection to the client without writing data,
+// which fails if the connection broke since the last write.
+func probeClient(rc *http.ResponseController) error {
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
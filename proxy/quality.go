@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+
+	"github.com/goccy/go-json"
+)
+
+// maxQualitySample bounds the stream data kept to find the resolution.
+const maxQualitySample = 16 * 1024 * 1024
+
+// qualityProbeEnabled reports whether PreresolveChannels samples the stream
+// of every source entry to measure its quality (QUALITY_PROBE).
+func qualityProbeEnabled() bool {
+	return strings.TrimSpace(os.Getenv("QUALITY_PROBE")) == "true"
+}
+
+// qualityProbeDuration returns how long the stream of each source entry is
+// sampled (QUALITY_PROBE_SECONDS).
+func qualityProbeDuration() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("QUALITY_PROBE_SECONDS")))
+	if err != nil || seconds <= 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func ffprobePath() string {
+	if path := strings.TrimSpace(os.Getenv("FFPROBE_PATH")); path != "" {
+		return path
+	}
+	return "ffprobe"
+}
+
+// probeChannelQuality samples the stream of every source entry of the
+// channel the load balancer may use and records their quality. The best
+// reachable one under QUALITY_POLICY is returned. Sources at their
+// concurrency limit are skipped, the samples count as open streams while
+// they are read.
+func probeChannelQuality(ctx context.Context, stream store.StreamInfo) (string, string, bool) {
+	pin := store.GetChannelPin(stream.Title)
+	policy := store.QualityPolicy()
+
+	open := make(map[string]int)
+	for _, openStream := range OpenStreams() {
+		open[openStream.M3UIndex]++
+	}
+
+	var bestIndex, bestSubIndex string
+	var best store.SourceQuality
+	found := false
+	for _, index := range utils.GetM3UIndexes() {
+		if !pin.IsSourceAllowed(index) || store.IsSourceDisabled(index) {
+			continue
+		}
+		if open[index] >= store.MaxConcurrency(index) {
+			utils.SafeLogf("Skipping quality probe of M3U_%s for %s: concurrency limit reached\n", index, stream.Title)
+			continue
+		}
+
+		subIndexes := make([]string, 0, len(stream.URLs[index]))
+		for subIndex := range stream.URLs[index] {
+			subIndexes = append(subIndexes, subIndex)
+		}
+		sort.Strings(subIndexes)
+
+		for _, subIndex := range subIndexes {
+			if ctx.Err() != nil {
+				return "", "", false
+			}
+
+			quality, err := sampleQuality(ctx, stream, index, subIndex)
+			if err != nil {
+				utils.SafeLogf("Quality probe of %s on M3U_%s|%s failed: %s\n", stream.Title, index, subIndex, utils.RedactURLs(err.Error()))
+				continue
+			}
+			if err := store.RecordSourceQuality(stream.Title, index, subIndex, quality); err != nil {
+				utils.SafeLogf("Error saving the quality of %s: %v\n", stream.Title, err)
+			}
+			utils.SafeLogf("Quality of %s on M3U_%s|%s: %dx%d, %d kbps\n", stream.Title, index, subIndex, quality.Width, quality.Height, quality.BitrateKbps)
+
+			if !found || quality.Better(best, policy) {
+				bestIndex, bestSubIndex, best, found = index, subIndex, quality, true
+			}
+		}
+	}
+
+	return bestIndex, bestSubIndex, found
+}
+
+// sampleQuality reads the stream of a source entry for
+// QUALITY_PROBE_SECONDS, measuring its bitrate, and asks ffprobe for its
+// resolution if it is available.
+func sampleQuality(ctx context.Context, stream store.StreamInfo, index string, subIndex string) (store.SourceQuality, error) {
+	quality := store.SourceQuality{ProbedAt: time.Now()}
+
+	sampleCtx, cancel := context.WithTimeout(ctx, qualityProbeDuration())
+	defer cancel()
+
+	url := upstreamURL(index, stream.URLs[index][subIndex], nil)
+	headers := stream.URLHeaders(index, subIndex)
+	resp, err := utils.SourceHttpRequestContext(sampleCtx, index, http.MethodGet, url, headers)
+	if err != nil {
+		return quality, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return quality, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	defer registerBackgroundStream(store.OpenStream{M3UIndex: index, Group: stream.Group})()
+
+	ffprobe, lookErr := exec.LookPath(ffprobePath())
+
+	if utils.EOFIsExpected(resp) {
+		// HLS playlists are read by ffprobe itself as it has to fetch the
+		// segments, the bitrate is the one it reports.
+		resp.Body.Close()
+		if lookErr != nil {
+			return quality, fmt.Errorf("ffprobe is required for HLS streams: %v", lookErr)
+		}
+		var args []string
+		var header strings.Builder
+		for name, values := range headers {
+			for _, value := range values {
+				header.WriteString(name + ": " + value + "\r\n")
+			}
+		}
+		if header.Len() > 0 {
+			args = append(args, "-headers", header.String())
+		}
+		args = append(args, "-i", resp.Request.URL.String())
+		return runFFprobe(ctx, ffprobe, args, nil, quality)
+	}
+
+	// The body is closed once the duration is over to unblock a pending
+	// read of a stalled upstream.
+	stop := context.AfterFunc(sampleCtx, func() {
+		resp.Body.Close()
+	})
+	defer stop()
+
+	var sample bytes.Buffer
+	started := time.Now()
+	n, _ := io.Copy(&sample, io.LimitReader(resp.Body, maxQualitySample))
+	elapsed := time.Since(started).Seconds()
+	if n == 0 {
+		return quality, fmt.Errorf("no data received")
+	}
+	if elapsed > 0 {
+		quality.BitrateKbps = int(float64(n*8) / 1000 / elapsed)
+	}
+
+	if lookErr != nil {
+		return quality, nil
+	}
+	measured := quality.BitrateKbps
+	quality, err = runFFprobe(ctx, ffprobe, []string{"-i", "pipe:0"}, &sample, quality)
+	if err != nil {
+		utils.SafeLogf("ffprobe could not read the sample of %s on M3U_%s|%s: %v\n", stream.Title, index, subIndex, err)
+	}
+	// The measured bitrate is more reliable than the one of a short sample.
+	quality.BitrateKbps = measured
+	return quality, nil
+}
+
+// runFFprobe sets the resolution and bitrate ffprobe reports for the first
+// video stream of the input.
+func runFFprobe(ctx context.Context, ffprobe string, inputArgs []string, input io.Reader, quality store.SourceQuality) (store.SourceQuality, error) {
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, inputArgs...)
+	args = append(args, "-select_streams", "v:0", "-show_entries", "stream=width,height,bit_rate:format=bit_rate", "-of", "json")
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout())
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffprobe, args...)
+	cmd.Stdin = input
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return quality, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return quality, err
+	}
+
+	var result struct {
+		Streams []struct {
+			Width   int    `json:"width"`
+			Height  int    `json:"height"`
+			BitRate string `json:"bit_rate"`
+		} `json:"streams"`
+		Format struct {
+			BitRate string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return quality, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+	if len(result.Streams) == 0 {
+		return quality, fmt.Errorf("no video stream found")
+	}
+
+	quality.Width, quality.Height = result.Streams[0].Width, result.Streams[0].Height
+	for _, bitRate := range []string{result.Streams[0].BitRate, result.Format.BitRate} {
+		if bps, err := strconv.Atoi(bitRate); err == nil && bps > 0 {
+			quality.BitrateKbps = bps / 1000
+			break
+		}
+	}
+	return quality, nil
+}
+
+// orderByQuality returns a copy of m3uIndexes with the sources with a
+// measured quality for the channel ahead of the others, best first under
+// QUALITY_POLICY. The order of sources of the same quality is kept.
+func orderByQuality(title string, m3uIndexes []string) []string {
+	m3uIndexes = slices.Clone(m3uIndexes)
+
+	policy := store.QualityPolicy()
+	if policy == "off" {
+		return m3uIndexes
+	}
+
+	qualities := store.GetChannelQuality(title)
+	if len(qualities) == 0 {
+		return m3uIndexes
+	}
+
+	best := make(map[string]store.SourceQuality)
+	for key, quality := range qualities {
+		index, _, _ := strings.Cut(key, "|")
+		if current, ok := best[index]; !ok || quality.Better(current, policy) {
+			best[index] = quality
+		}
+	}
+
+	sort.SliceStable(m3uIndexes, func(i, j int) bool {
+		a, aOk := best[m3uIndexes[i]]
+		b, bOk := best[m3uIndexes[j]]
+		if aOk != bOk {
+			return aOk
+		}
+		return aOk && a.Better(b, policy)
+	})
+	return m3uIndexes
+}
+
+// ForgetChannelQuality drops the qualities recorded for the channel and the
+// source entry pre-resolved for it, e.g. after a provider upgraded a stream.
+func ForgetChannelQuality(title string) error {
+	probeResults.Lock()
+	delete(probeResults.results, title)
+	probeResults.Unlock()
+
+	return store.ForgetChannelQuality(title)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var queryPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// forwardedQueryParams returns the client query parameters passed on to the
+// upstream URLs of a source.
+func forwardedQueryParams(m3uIndex string) []string {
+	names := os.Getenv(fmt.Sprintf("M3U_FORWARD_QUERY_PARAMS_%s", m3uIndex))
+	if strings.TrimSpace(names) == "" {
+		names = os.Getenv("FORWARD_QUERY_PARAMS")
+	}
+
+	params := []string{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			params = append(params, name)
+		}
+	}
+	return params
+}
+
+// upstreamURL adds the query parameters configured for the source, and the
+// forwarded ones of the client request, to a stream URL. Parameters already
+// in the URL are replaced.
+func upstreamURL(m3uIndex string, streamUrl string, clientQuery url.Values) string {
+	template := strings.TrimSpace(os.Getenv(fmt.Sprintf("M3U_QUERY_PARAMS_%s", m3uIndex)))
+	forwarded := forwardedQueryParams(m3uIndex)
+	if template == "" && len(forwarded) == 0 {
+		return streamUrl
+	}
+
+	u, err := url.Parse(streamUrl)
+	if err != nil {
+		return streamUrl
+	}
+	query := u.Query()
+
+	for _, name := range forwarded {
+		if values, ok := clientQuery[name]; ok {
+			query[name] = values
+		}
+	}
+
+	if template != "" {
+		params, err := url.ParseQuery(template)
+		if err != nil {
+			return streamUrl
+		}
+
+		for name, values := range params {
+			query.Del(name)
+			for _, value := range values {
+				// A parameter referencing a client parameter that was not
+				// sent is left out.
+				resolved, ok := resolveQueryTemplate(value, clientQuery)
+				if ok {
+					query.Add(name, resolved)
+				}
+			}
+		}
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// resolveQueryTemplate replaces the {name} placeholders of value with the
+// client query parameters of the same name.
+func resolveQueryTemplate(value string, clientQuery url.Values) (string, bool) {
+	ok := true
+	resolved := queryPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		if !clientQuery.Has(name) {
+			ok = false
+			return ""
+		}
+		return clientQuery.Get(name)
+	})
+	return resolved, ok
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// defaultResponseHeaders are the upstream response headers forwarded to the
+// client unless UPSTREAM_RESPONSE_HEADERS is set.
+var defaultResponseHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Disposition",
+	"Content-Language",
+	"Accept-Ranges",
+	"Content-Range",
+	"Cache-Control",
+	"Expires",
+	"Last-Modified",
+	"ETag",
+}
+
+// blockedResponseHeaders are never forwarded: the length changes when
+// playlists are rewritten or streams fail over, hop-by-hop headers only apply
+// to the connection to the upstream and CORS is set by the proxy's own policy.
+var blockedResponseHeaders = []string{
+	"Content-Length",
+	"Access-Control-*",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func headerPatterns(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if strings.TrimSpace(value) == "" {
+		return fallback
+	}
+
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// matchHeader reports whether the header name matches one of the patterns,
+// which may use * wildcards (e.g. X-Provider-*).
+func matchHeader(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if matched, err := path.Match(strings.ToLower(pattern), name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyResponseHeaders copies the upstream response headers allowed by
+// UPSTREAM_RESPONSE_HEADERS and not denied by UPSTREAM_RESPONSE_HEADERS_DENY
+// to the client response.
+func CopyResponseHeaders(dst http.Header, src http.Header) {
+	allow := headerPatterns("UPSTREAM_RESPONSE_HEADERS", defaultResponseHeaders)
+	deny := headerPatterns("UPSTREAM_RESPONSE_HEADERS_DENY", nil)
+
+	for name, values := range src {
+		if matchHeader(blockedResponseHeaders, name) ||
+			!matchHeader(allow, name) ||
+			matchHeader(deny, name) {
+			continue
+		}
+
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
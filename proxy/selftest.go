@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+)
+
+// UpstreamAttempt is an upstream request of the load balancer during a
+// self-test, with its timings in milliseconds. The data fields are only set
+// for the upstream the data was read from.
+type UpstreamAttempt struct {
+	Source string `json:"source"`
+	// ProbeMs is the duration of the HEAD probe, TTFBMs the time until the
+	// response headers of the request to stream from.
+	ProbeMs int64  `json:"probe_ms,omitempty"`
+	TTFBMs  int64  `json:"ttfb_ms"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	FirstByteMs    int64   `json:"first_byte_ms,omitempty"`
+	Bytes          int64   `json:"bytes,omitempty"`
+	ThroughputKbps float64 `json:"throughput_kbps,omitempty"`
+}
+
+// SelfTestReport is the result of a self-test of a channel.
+type SelfTestReport struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// Source is the source the data was read from.
+	Source     string            `json:"source,omitempty"`
+	Playlist   bool              `json:"playlist"`
+	DurationMs int64             `json:"duration_ms"`
+	Attempts   []UpstreamAttempt `json:"attempts"`
+}
+
+// SelfTest runs the load balancer like for a client of the channel and
+// reads the stream for the given duration into a null sink, reporting the
+// timings of every upstream tried. The stream counts against the concurrency
+// limit of its source while it is read.
+func (instance *StreamInstance) SelfTest(ctx context.Context, session *store.Session, duration time.Duration) SelfTestReport {
+	started := time.Now()
+	report := SelfTestReport{Channel: instance.Info.Title, Attempts: []UpstreamAttempt{}}
+	defer func() {
+		report.DurationMs = time.Since(started).Milliseconds()
+	}()
+
+	instance.trace = func(attempt UpstreamAttempt) {
+		report.Attempts = append(report.Attempts, attempt)
+	}
+	resp, _, m3uIndex, subIndex, err := instance.LoadBalancer(ctx, session, http.MethodGet)
+	instance.trace = nil
+	if err != nil {
+		report.Error = utils.RedactURLs(err.Error())
+		return report
+	}
+	defer resp.Body.Close()
+
+	report.Source = m3uIndex + "|" + subIndex
+	report.Playlist = utils.EOFIsExpected(resp)
+
+	instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, true)
+	defer instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, false)
+	defer registerBackgroundStream(store.OpenStream{M3UIndex: m3uIndex, Group: instance.Info.Group})()
+
+	// The body is closed once the duration is over to unblock a pending
+	// read of a stalled upstream.
+	readCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	stop := context.AfterFunc(readCtx, func() {
+		resp.Body.Close()
+	})
+	defer stop()
+
+	attempt := &report.Attempts[len(report.Attempts)-1]
+	readStarted := time.Now()
+	var firstByte time.Time
+	buffer := getBuffer(32 * 1024)
+	defer putBuffer(buffer)
+	for {
+		n, err := resp.Body.Read(buffer)
+		if n > 0 {
+			if firstByte.IsZero() {
+				firstByte = time.Now()
+				attempt.FirstByteMs = firstByte.Sub(readStarted).Milliseconds()
+			}
+			attempt.Bytes += int64(n)
+		}
+		if err != nil {
+			switch {
+			case readCtx.Err() != nil:
+			case err == io.EOF && report.Playlist:
+			case err == io.EOF:
+				report.Error = "upstream ended the stream"
+			default:
+				report.Error = utils.RedactURLs(err.Error())
+			}
+			break
+		}
+	}
+
+	if !firstByte.IsZero() {
+		if elapsed := time.Since(firstByte).Seconds(); elapsed > 0 {
+			attempt.ThroughputKbps = float64(attempt.Bytes*8) / 1000 / elapsed
+		}
+	}
+	if attempt.Bytes == 0 && report.Error == "" {
+		report.Error = "no data received"
+	}
+	report.OK = report.Error == ""
+	return report
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+)
+
+// maxSnapshotInput bounds the stream data fed to ffmpeg for a snapshot.
+const maxSnapshotInput = 32 * 1024 * 1024
+
+// ErrFFmpegUnavailable is returned by Snapshot if ffmpeg cannot be found.
+var ErrFFmpegUnavailable = errors.New("ffmpeg is not available")
+
+// ErrNoPicture is returned by Snapshot if no frame could be decoded from the
+// stream, e.g. for radio channels or streams without picture.
+var ErrNoPicture = errors.New("no frame could be decoded from the stream")
+
+func ffmpegPath() string {
+	if path := strings.TrimSpace(os.Getenv("FFMPEG_PATH")); path != "" {
+		return path
+	}
+	return "ffmpeg"
+}
+
+// snapshotTimeout returns how long a snapshot may take, from opening the
+// stream to the decoded frame (SNAPSHOT_TIMEOUT).
+func snapshotTimeout() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SNAPSHOT_TIMEOUT")))
+	if err != nil || seconds <= 0 {
+		seconds = 15
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Snapshot returns the first video frame ffmpeg decodes from the stream as
+// JPEG. A running stream of the channel is tapped, otherwise the stream is
+// opened through the load balancer and counts against the concurrency limit
+// of its source until the frame is extracted.
+func (instance *StreamInstance) Snapshot(ctx context.Context, session *store.Session) ([]byte, error) {
+	ffmpeg, err := exec.LookPath(ffmpegPath())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFmpegUnavailable, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout())
+	defer cancel()
+
+	if tap, ok := TapStream(instance.Info.Title); ok {
+		defer tap.Close()
+		return runSnapshot(ctx, ffmpeg, []string{"-i", "pipe:0"}, io.LimitReader(tap, maxSnapshotInput))
+	}
+
+	resp, _, m3uIndex, subIndex, err := instance.LoadBalancer(ctx, session, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, true)
+	defer instance.Cm.UpdateStreamConcurrency(m3uIndex, instance.Info.Group, false)
+	defer registerBackgroundStream(store.OpenStream{M3UIndex: m3uIndex, Group: instance.Info.Group})()
+
+	var args []string
+	var input io.Reader
+	if utils.EOFIsExpected(resp) {
+		// HLS playlists are read by ffmpeg itself as it has to fetch the
+		// segments.
+		var headers strings.Builder
+		for name, values := range instance.Info.URLHeaders(m3uIndex, subIndex) {
+			for _, value := range values {
+				headers.WriteString(name + ": " + value + "\r\n")
+			}
+		}
+		if headers.Len() > 0 {
+			args = append(args, "-headers", headers.String())
+		}
+		args = append(args, "-i", resp.Request.URL.String())
+		resp.Body.Close()
+	} else {
+		args = append(args, "-i", "pipe:0")
+		input = io.LimitReader(resp.Body, maxSnapshotInput)
+	}
+	return runSnapshot(ctx, ffmpeg, args, input)
+}
+
+// runSnapshot runs ffmpeg with the input arguments, reading input if not nil,
+// and returns the first frame it decodes.
+func runSnapshot(ctx context.Context, ffmpeg string, inputArgs []string, input io.Reader) ([]byte, error) {
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, inputArgs...)
+	args = append(args, "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "-q:v", "3", "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	cmd.Stdin = input
+	// The copy of the input may block on a stalled stream after ffmpeg
+	// exited.
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if stdout.Len() > 0 {
+		// ffmpeg stops reading once it has the frame, which may fail the
+		// copy of the remaining input.
+		return stdout.Bytes(), nil
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoPicture, ctx.Err())
+	}
+	if err != nil && stderr.Len() > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoPicture, strings.TrimSpace(stderr.String()))
+	}
+	return nil, ErrNoPicture
+}
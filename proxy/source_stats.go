@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+)
+
+// SourceStatsRegistry counts the upstream requests and the data streamed per
+// M3U source, to compare providers.
+type SourceStatsRegistry struct {
+	mu      sync.Mutex
+	sources map[string]*sourceCounters
+}
+
+type sourceCounters struct {
+	mu        sync.Mutex
+	successes int64
+	failures  int64
+	// outcomes counts the requests by HTTP status code, or by error class
+	// for requests without response.
+	outcomes  map[string]int64
+	ttfbTotal time.Duration
+
+	bytes atomic.Int64
+}
+
+// SourceStats are the statistics of a source. ExclusiveStreams is the number
+// of channels of the playlist only available on the source.
+type SourceStats struct {
+	Source           string           `json:"source"`
+	Disabled         bool             `json:"disabled"`
+	Successes        int64            `json:"successes"`
+	Failures         int64            `json:"failures"`
+	Outcomes         map[string]int64 `json:"outcomes"`
+	AvgTTFBMillis    float64          `json:"avg_ttfb_ms"`
+	BytesServed      int64            `json:"bytes_served"`
+	ExclusiveStreams int              `json:"exclusive_streams"`
+}
+
+// Sources holds the statistics of the M3U sources.
+var Sources = &SourceStatsRegistry{sources: make(map[string]*sourceCounters)}
+
+func (s *SourceStatsRegistry) counters(m3uIndex string) *sourceCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.sources[m3uIndex]
+	if !ok {
+		c = &sourceCounters{outcomes: make(map[string]int64)}
+		s.sources[m3uIndex] = c
+	}
+	return c
+}
+
+// addBytes counts bytes streamed from the source to a client.
+func (s *SourceStatsRegistry) addBytes(m3uIndex string, n int) {
+	s.counters(m3uIndex).bytes.Add(int64(n))
+}
+
+// recordRequest counts an upstream request of the source that got a
+// response with the given status code after ttfb, or failed with err.
+func (s *SourceStatsRegistry) recordRequest(m3uIndex string, statusCode int, ttfb time.Duration, err error) {
+	c := s.counters(m3uIndex)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.failures++
+		c.outcomes[classifyRequestError(err)]++
+		return
+	}
+
+	c.outcomes[strconv.Itoa(statusCode)]++
+	if statusCode >= 400 {
+		c.failures++
+		return
+	}
+	c.successes++
+	c.ttfbTotal += ttfb
+}
+
+// Stats returns the counters of every configured source.
+func (s *SourceStatsRegistry) Stats() []SourceStats {
+	exclusive := make(map[string]int)
+	channels, err := store.QueryChannels(store.ChannelQuery{})
+	if err != nil {
+		utils.SafeLogf("Error reading channels: %v\n", err)
+	}
+	for _, channel := range channels {
+		if len(channel.Sources) == 1 {
+			exclusive[channel.Sources[0]]++
+		}
+	}
+
+	indexes := slices.Clone(utils.GetM3UIndexes())
+	sort.Slice(indexes, func(i, j int) bool {
+		a, errA := strconv.Atoi(indexes[i])
+		b, errB := strconv.Atoi(indexes[j])
+		if errA != nil || errB != nil {
+			return indexes[i] < indexes[j]
+		}
+		return a < b
+	})
+
+	stats := make([]SourceStats, 0, len(indexes))
+	for _, index := range indexes {
+		c := s.counters(index)
+
+		c.mu.Lock()
+		stat := SourceStats{
+			Source:           index,
+			Disabled:         store.IsSourceDisabled(index),
+			Successes:        c.successes,
+			Failures:         c.failures,
+			Outcomes:         make(map[string]int64, len(c.outcomes)),
+			BytesServed:      c.bytes.Load(),
+			ExclusiveStreams: exclusive[index],
+		}
+		for k, v := range c.outcomes {
+			stat.Outcomes[k] = v
+		}
+		if c.successes > 0 {
+			stat.AvgTTFBMillis = float64(c.ttfbTotal.Milliseconds()) / float64(c.successes)
+		}
+		c.mu.Unlock()
+
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// classifyRequestError returns the class of an upstream request error.
+func classifyRequestError(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var headerErr tls.RecordHeaderError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.As(err, &certErr) || errors.As(err, &headerErr):
+		return "tls"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "error"
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// streamMetricsWindow is the number of seconds the bitrate of a stream is
+// averaged over.
+const streamMetricsWindow = 10
+
+// StreamMetrics are the health counters of the data written to the client of
+// a stream, kept across failovers, to debug streams dropping with data
+// instead of the logs. Stalls are the times the upstream stopped sending
+// data (read errors, unexpected EOFs, idle timeouts and too low throughput),
+// zero reads the reads returning no data and no error.
+type StreamMetrics struct {
+	BitrateKbps       float64 `json:"bitrate_kbps"`
+	Stalls            int     `json:"stalls"`
+	ZeroReads         int     `json:"zero_reads"`
+	ZeroReadStreak    int     `json:"zero_read_streak"`
+	MaxZeroReadStreak int     `json:"max_zero_read_streak"`
+	Failovers         int     `json:"failovers"`
+}
+
+// streamMetrics records the StreamMetrics of the stream of a client.
+type streamMetrics struct {
+	mu      sync.Mutex
+	started time.Time
+	// bytes holds the bytes received per second of the last seconds, by
+	// unix time modulo the window.
+	bytes   [streamMetricsWindow]int64
+	seconds [streamMetricsWindow]int64
+	source  string
+	metrics StreamMetrics
+}
+
+func newStreamMetrics() *streamMetrics {
+	return &streamMetrics{started: time.Now()}
+}
+
+// startSource records that the stream is now sent from the source entry
+// (m3uIndex|subIndex), a failover if it was sent from another one.
+func (m *streamMetrics) startSource(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.source != "" && m.source != source {
+		m.metrics.Failovers++
+	}
+	m.source = source
+}
+
+func (m *streamMetrics) addBytes(n int) {
+	now := time.Now().Unix()
+	bucket := now % streamMetricsWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.seconds[bucket] != now {
+		m.seconds[bucket] = now
+		m.bytes[bucket] = 0
+	}
+	m.bytes[bucket] += int64(n)
+	m.metrics.ZeroReadStreak = 0
+}
+
+func (m *streamMetrics) zeroRead() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metrics.ZeroReads++
+	m.metrics.ZeroReadStreak++
+	m.metrics.MaxZeroReadStreak = max(m.metrics.MaxZeroReadStreak, m.metrics.ZeroReadStreak)
+}
+
+func (m *streamMetrics) stall() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.metrics.Stalls++
+}
+
+// snapshot returns the metrics with the bitrate of the last seconds.
+func (m *streamMetrics) snapshot() StreamMetrics {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bytes int64
+	for i, second := range m.seconds {
+		if now.Unix()-second < streamMetricsWindow {
+			bytes += m.bytes[i]
+		}
+	}
+	// A stream younger than the window is averaged over its lifetime.
+	window := min(now.Sub(m.started).Seconds(), streamMetricsWindow)
+	window = max(window, 1)
+
+	metrics := m.metrics
+	metrics.BitrateKbps = float64(bytes) * 8 / 1000 / window
+	return metrics
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// StreamStatusCode tells why proxying a stream from an upstream ended.
+type StreamStatusCode int
+
+const (
+	// StatusClientClosed is returned when the client cannot be written to
+	// anymore, which is handled as the client closing the stream.
+	StatusClientClosed StreamStatusCode = 0
+	// StatusUpstreamError is returned on read errors, stalls and too slow
+	// upstreams. The stream fails over to another source.
+	StatusUpstreamError StreamStatusCode = 1
+	// StatusEOF is returned when the upstream ended the response. Playlists
+	// are done, other streams fail over to another source.
+	StatusEOF StreamStatusCode = 2
+	// StatusCompleted is returned when the upstream sent the whole body it
+	// announced with its Content-Length, e.g. a VOD file.
+	StatusCompleted StreamStatusCode = 3
+	// StatusM3U8Parsed is returned once a playlist has been rewritten and
+	// sent to the client, or the response to a non-GET request copied.
+	StatusM3U8Parsed StreamStatusCode = 4
+	// StatusClientStalled is returned when the client did not accept data
+	// within CLIENT_WRITE_TIMEOUT.
+	StatusClientStalled StreamStatusCode = 5
+	// StatusNoSource and StatusConcurrencyLimited are returned when the load
+	// balancer found no source to stream from.
+	StatusNoSource           StreamStatusCode = 6
+	StatusConcurrencyLimited StreamStatusCode = 7
+	// StatusPanic is returned when proxying panicked. The panic has been
+	// logged and the resources of the stream released.
+	StatusPanic StreamStatusCode = 8
+)
+
+// Log severities of the stream statuses.
+const (
+	SeverityDebug = "debug"
+	SeverityInfo  = "info"
+	SeverityError = "error"
+)
+
+type streamStatusInfo struct {
+	name string
+	// httpStatus is the response status if nothing has been sent yet.
+	httpStatus int
+	severity   string
+	// retry reports whether another source is tried.
+	retry bool
+}
+
+var streamStatuses = map[StreamStatusCode]streamStatusInfo{
+	StatusClientClosed:       {"client closed", http.StatusOK, SeverityInfo, false},
+	StatusUpstreamError:      {"upstream error", http.StatusBadGateway, SeverityError, true},
+	StatusEOF:                {"end of stream", http.StatusBadGateway, SeverityInfo, true},
+	StatusCompleted:          {"stream completed", http.StatusOK, SeverityInfo, false},
+	StatusM3U8Parsed:         {"playlist sent", http.StatusOK, SeverityDebug, false},
+	StatusClientStalled:      {"client stalled", http.StatusOK, SeverityInfo, false},
+	StatusNoSource:           {"no source available", http.StatusBadGateway, SeverityError, false},
+	StatusConcurrencyLimited: {"concurrency limit reached", http.StatusServiceUnavailable, SeverityError, false},
+	StatusPanic:              {"internal error", http.StatusInternalServerError, SeverityError, false},
+}
+
+// StreamStatus is how proxying a stream ended, with the error causing it if
+// any.
+type StreamStatus struct {
+	Code StreamStatusCode
+	Err  error
+}
+
+func newStreamStatus(code StreamStatusCode, err error) StreamStatus {
+	return StreamStatus{Code: code, Err: err}
+}
+
+func (s StreamStatus) info() streamStatusInfo {
+	info, ok := streamStatuses[s.Code]
+	if !ok {
+		return streamStatusInfo{fmt.Sprintf("status %d", s.Code), http.StatusInternalServerError, SeverityError, false}
+	}
+	return info
+}
+
+func (s StreamStatus) Error() string {
+	if s.Err == nil {
+		return s.info().name
+	}
+	return fmt.Sprintf("%s: %v", s.info().name, s.Err)
+}
+
+func (s StreamStatus) Unwrap() error {
+	return s.Err
+}
+
+// HTTPStatus returns the response status for the client if the stream ended
+// before anything was sent.
+func (s StreamStatus) HTTPStatus() int {
+	return s.info().httpStatus
+}
+
+// Severity returns the log severity of the status.
+func (s StreamStatus) Severity() string {
+	return s.info().severity
+}
+
+// Retryable reports whether the stream should fail over to another source.
+func (s StreamStatus) Retryable() bool {
+	return s.info().retry
+}
+
+// LoadBalancerStatus returns the status of a load balancer error.
+func LoadBalancerStatus(err error) StreamStatus {
+	if errors.Is(err, ErrConcurrencyExhausted) {
+		return newStreamStatus(StatusConcurrencyLimited, err)
+	}
+	return newStreamStatus(StatusNoSource, err)
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamTapChunks is the number of chunks a tap can fall behind before the
+// data is dropped for it.
+const streamTapChunks = 64
+
+// streamTee fans the data of a running stream out to taps, so other consumers
+// (e.g. snapshots) can read a channel without opening another provider
+// connection. The client of the stream never waits for the taps: a tap not
+// keeping up misses data instead.
+type streamTee struct {
+	id          int64
+	title       string
+	group       string
+	source      string
+	client      string
+	bufferBytes int
+	started     time.Time
+	metrics     *streamMetrics
+
+	bytes    atomic.Int64
+	lastData atomic.Int64
+
+	mu       sync.Mutex
+	taps     map[*StreamTap]struct{}
+	closed   bool
+	retrying bool
+}
+
+// RunningStream describes a stream being proxied to a client, for debugging
+// leaks and stuck streams.
+type RunningStream struct {
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Source      string    `json:"source"`
+	Client      string    `json:"client"`
+	State       string    `json:"state"`
+	BufferBytes int       `json:"buffer_bytes"`
+	BytesServed int64     `json:"bytes_served"`
+	Taps        int       `json:"taps"`
+	StartedAt   time.Time `json:"started_at"`
+	IdleSeconds float64   `json:"idle_seconds"`
+	// Metrics are kept across the failovers of the stream, unlike the
+	// other values which are about the current source.
+	Metrics StreamMetrics `json:"metrics"`
+}
+
+// StreamTap reads the data of a running stream from the moment it was
+// attached. Read returns io.EOF once the stream ends.
+type StreamTap struct {
+	tee     *streamTee
+	chunks  chan []byte
+	pending []byte
+}
+
+var runningStreams = struct {
+	sync.Mutex
+	lastID int64
+	tees   map[string][]*streamTee
+}{tees: make(map[string][]*streamTee)}
+
+// startStreamTee registers a stream of the channel title of group from source
+// (m3uIndex|subIndex) to client that can be tapped until it is stopped. The
+// data published is recorded in metrics.
+func startStreamTee(title string, group string, source string, client string, bufferBytes int, metrics *streamMetrics) *streamTee {
+	metrics.startSource(source)
+
+	tee := &streamTee{
+		title:       title,
+		group:       group,
+		source:      source,
+		client:      client,
+		bufferBytes: bufferBytes,
+		started:     time.Now(),
+		metrics:     metrics,
+		taps:        make(map[*StreamTap]struct{}),
+	}
+	tee.lastData.Store(tee.started.UnixNano())
+
+	runningStreams.Lock()
+	runningStreams.lastID++
+	tee.id = runningStreams.lastID
+	runningStreams.tees[title] = append(runningStreams.tees[title], tee)
+	runningStreams.Unlock()
+
+	return tee
+}
+
+// RunningStreams lists the streams being proxied, oldest first.
+func RunningStreams() []RunningStream {
+	runningStreams.Lock()
+	tees := make([]*streamTee, 0)
+	for _, t := range runningStreams.tees {
+		tees = append(tees, t...)
+	}
+	runningStreams.Unlock()
+
+	sort.Slice(tees, func(i, j int) bool {
+		return tees[i].id < tees[j].id
+	})
+
+	streams := make([]RunningStream, 0, len(tees))
+	for _, tee := range tees {
+		tee.mu.Lock()
+		state := "streaming"
+		if tee.retrying {
+			state = "retrying"
+		}
+		taps := len(tee.taps)
+		tee.mu.Unlock()
+
+		streams = append(streams, RunningStream{
+			ID:          tee.id,
+			Title:       tee.title,
+			Source:      tee.source,
+			Client:      tee.client,
+			State:       state,
+			BufferBytes: tee.bufferBytes,
+			BytesServed: tee.bytes.Load(),
+			Taps:        taps,
+			StartedAt:   tee.started,
+			IdleSeconds: time.Since(time.Unix(0, tee.lastData.Load())).Seconds(),
+			Metrics:     tee.metrics.snapshot(),
+		})
+	}
+	return streams
+}
+
+// TapStream attaches to a running stream of the channel title. The tap has to
+// be closed.
+func TapStream(title string) (*StreamTap, bool) {
+	runningStreams.Lock()
+	tees := runningStreams.tees[title]
+	if len(tees) == 0 {
+		runningStreams.Unlock()
+		return nil, false
+	}
+	// The most recently started stream is the least likely to end soon.
+	tee := tees[len(tees)-1]
+	runningStreams.Unlock()
+
+	tap := &StreamTap{tee: tee, chunks: make(chan []byte, streamTapChunks)}
+
+	tee.mu.Lock()
+	defer tee.mu.Unlock()
+	if tee.closed {
+		return nil, false
+	}
+	tee.taps[tap] = struct{}{}
+
+	return tap, true
+}
+
+// publish hands a copy of p to every tap with room for it.
+func (tee *streamTee) publish(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	tee.bytes.Add(int64(len(p)))
+	tee.lastData.Store(time.Now().UnixNano())
+	tee.metrics.addBytes(len(p))
+
+	tee.mu.Lock()
+	defer tee.mu.Unlock()
+
+	tee.retrying = false
+	if len(tee.taps) == 0 {
+		return
+	}
+
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	for tap := range tee.taps {
+		select {
+		case tap.chunks <- chunk:
+		default:
+		}
+	}
+}
+
+// setRetrying marks the stream as retrying the upstream after a read error,
+// until data arrives again.
+func (tee *streamTee) setRetrying() {
+	tee.mu.Lock()
+	tee.retrying = true
+	tee.mu.Unlock()
+}
+
+// stop unregisters the stream and ends its taps.
+func (tee *streamTee) stop() {
+	runningStreams.Lock()
+	tees := runningStreams.tees[tee.title]
+	for i, t := range tees {
+		if t == tee {
+			tees = append(tees[:i], tees[i+1:]...)
+			break
+		}
+	}
+	if len(tees) == 0 {
+		delete(runningStreams.tees, tee.title)
+	} else {
+		runningStreams.tees[tee.title] = tees
+	}
+	runningStreams.Unlock()
+
+	tee.mu.Lock()
+	defer tee.mu.Unlock()
+
+	tee.closed = true
+	for tap := range tee.taps {
+		close(tap.chunks)
+		delete(tee.taps, tap)
+	}
+}
+
+func (tap *StreamTap) Read(p []byte) (int, error) {
+	if len(tap.pending) == 0 {
+		chunk, ok := <-tap.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		tap.pending = chunk
+	}
+
+	n := copy(p, tap.pending)
+	tap.pending = tap.pending[n:]
+	return n, nil
+}
+
+// Close detaches the tap from the stream, ending its reads.
+func (tap *StreamTap) Close() error {
+	tap.tee.mu.Lock()
+	defer tap.tee.mu.Unlock()
+
+	if _, ok := tap.tee.taps[tap]; ok {
+		delete(tap.tee.taps, tap)
+		close(tap.chunks)
+	}
+	return nil
+}
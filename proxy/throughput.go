@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// throughputMonitor detects upstreams that still send data, but too slowly to
+// play the stream (e.g. a throttled provider), so the stream can fail over
+// like on a read error.
+type throughputMonitor struct {
+	minBytesPerSecond float64
+	window            time.Duration
+	windowStart       time.Time
+	windowBytes       int64
+}
+
+// newThroughputMonitor returns a monitor following STREAM_MIN_KBPS and
+// STREAM_LOW_THROUGHPUT_WINDOW, or nil if it is disabled.
+func newThroughputMonitor() *throughputMonitor {
+	minKbps, err := strconv.Atoi(strings.TrimSpace(os.Getenv("STREAM_MIN_KBPS")))
+	if err != nil || minKbps <= 0 {
+		return nil
+	}
+
+	windowSeconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("STREAM_LOW_THROUGHPUT_WINDOW")))
+	if err != nil || windowSeconds <= 0 {
+		windowSeconds = 10
+	}
+
+	return &throughputMonitor{
+		minBytesPerSecond: float64(minKbps) * 1000 / 8,
+		window:            time.Duration(windowSeconds) * time.Second,
+		windowStart:       time.Now(),
+	}
+}
+
+// add records n bytes read from the upstream and reports whether the
+// throughput of the last full window was below the minimum.
+func (m *throughputMonitor) add(n int) (float64, bool) {
+	if m == nil {
+		return 0, false
+	}
+
+	m.windowBytes += int64(n)
+	elapsed := time.Since(m.windowStart)
+	if elapsed < m.window {
+		return 0, false
+	}
+
+	rate := float64(m.windowBytes) / elapsed.Seconds()
+	m.windowStart = time.Now()
+	m.windowBytes = 0
+
+	return rate * 8 / 1000, rate < m.minBytesPerSecond
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThroughputMonitor(t *testing.T) {
+	t.Setenv("STREAM_LOW_THROUGHPUT_WINDOW", "10")
+
+	t.Setenv("STREAM_MIN_KBPS", "")
+	if m := newThroughputMonitor(); m != nil {
+		t.Fatalf("Expected the monitor to be disabled by default, got %+v", m)
+	}
+	var disabled *throughputMonitor
+	if _, low := disabled.add(0); low {
+		t.Error("Expected a disabled monitor to never report a low throughput")
+	}
+
+	// 800 kbps is 100000 bytes per second, 1000000 bytes per window.
+	t.Setenv("STREAM_MIN_KBPS", "800")
+
+	// The bytes are added during the window, the last add after elapsed.
+	tests := []struct {
+		name    string
+		bytes   []int
+		elapsed time.Duration
+		low     bool
+		checked bool
+	}{
+		{"window not over", []int{2000000}, 5 * time.Second, false, false},
+		{"below the minimum", []int{100000, 200000}, 10 * time.Second, true, true},
+		{"above the minimum", []int{600000, 500000}, 10 * time.Second, false, true},
+		{"no data", []int{0}, 10 * time.Second, true, true},
+		{"slow over a longer window", []int{1000000, 500000}, 20 * time.Second, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newThroughputMonitor()
+			if m == nil {
+				t.Fatal("Expected the monitor to be enabled")
+			}
+			for _, n := range tt.bytes[:len(tt.bytes)-1] {
+				if _, low := m.add(n); low {
+					t.Fatal("Expected no verdict before the end of the window")
+				}
+			}
+			m.windowStart = time.Now().Add(-tt.elapsed)
+
+			kbps, low := m.add(tt.bytes[len(tt.bytes)-1])
+			if low != tt.low {
+				t.Errorf("Expected low=%v, got low=%v at %.0f kbps", tt.low, low, kbps)
+			}
+
+			// A full window is accounted once and starts the next one.
+			if windowReset := m.windowBytes == 0 && time.Since(m.windowStart) < time.Second; windowReset != tt.checked {
+				t.Errorf("Expected the window to be reset=%v, got %d bytes since %v", tt.checked, m.windowBytes, m.windowStart)
+			}
+		})
+	}
+
+	t.Run("rate of the window", func(t *testing.T) {
+		m := newThroughputMonitor()
+		m.windowStart = time.Now().Add(-10 * time.Second)
+		kbps, _ := m.add(250000)
+		if kbps < 195 || kbps > 200 {
+			t.Errorf("Expected about 200 kbps, got %.1f", kbps)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// TranscodeProfile returns the ffmpeg output arguments of a transcode
+// profile. Besides the built-in "audio" (the audio only, re-encoded at
+// AUDIO_ONLY_BITRATE) and "720p" profiles, profiles are defined with
+// TRANSCODE_PROFILE_<NAME>, which may also override the built-in ones.
+func TranscodeProfile(name string) ([]string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return nil, false
+	}
+
+	if value := strings.TrimSpace(os.Getenv("TRANSCODE_PROFILE_" + strings.ToUpper(name))); value != "" {
+		return strings.Fields(value), true
+	}
+
+	switch name {
+	case "audio":
+		bitrate := strings.TrimSpace(os.Getenv("AUDIO_ONLY_BITRATE"))
+		if bitrate == "" {
+			bitrate = "96k"
+		}
+		return []string{"-map", "0:a", "-c:a", "aac", "-b:a", bitrate, "-f", "mpegts"}, true
+	case "720p":
+		return []string{
+			"-map", "0:v:0", "-map", "0:a?", "-vf", "scale=-2:'min(720,ih)'",
+			"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-c:a", "aac", "-f", "mpegts",
+		}, true
+	}
+	return nil, false
+}
+
+// transcodeContentTypes are the content types of the output formats of
+// ffmpeg (-f).
+var transcodeContentTypes = map[string]string{
+	"mpegts":   "video/mp2t",
+	"matroska": "video/x-matroska",
+	"webm":     "video/webm",
+	"adts":     "audio/aac",
+	"mp3":      "audio/mpeg",
+	"ogg":      "audio/ogg",
+}
+
+// TranscodeContentType returns the content type of the output of the given
+// ffmpeg output arguments.
+func TranscodeContentType(outputArgs []string) string {
+	for i := 0; i+1 < len(outputArgs); i++ {
+		if outputArgs[i] != "-f" {
+			continue
+		}
+		if contentType, ok := transcodeContentTypes[outputArgs[i+1]]; ok {
+			return contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// TranscodeWriter is an http.ResponseWriter piping the data written to it
+// through ffmpeg before it is sent to the client. As it outlives failovers,
+// the streams of every source go through the same ffmpeg process.
+type TranscodeWriter struct {
+	w      http.ResponseWriter
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	cancel context.CancelFunc
+
+	// done is closed once the output of ffmpeg is sent, outErr is the
+	// client write error that ended it early.
+	done   chan struct{}
+	outErr error
+}
+
+// NewTranscodeWriter starts ffmpeg with the given output arguments, writing
+// its output to w. The writer has to be closed.
+func NewTranscodeWriter(ctx context.Context, w http.ResponseWriter, outputArgs []string) (*TranscodeWriter, error) {
+	ffmpeg, err := exec.LookPath(ffmpegPath())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFFmpegUnavailable, err)
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-probesize", "1000000", "-i", "pipe:0"}
+	args = append(args, outputArgs...)
+	args = append(args, "pipe:1")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	tw := &TranscodeWriter{
+		w:      w,
+		cmd:    cmd,
+		stdin:  stdin,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go tw.sendOutput(stdout)
+
+	return tw, nil
+}
+
+func (tw *TranscodeWriter) sendOutput(stdout io.Reader) {
+	defer close(tw.done)
+
+	cw := withWriteDeadline(newClientWriter(tw.w), tw.w)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := stdout.Read(buffer)
+		if n > 0 {
+			if err := cw.WriteChunk(buffer[:n], n == len(buffer)); err != nil {
+				tw.outErr = err
+				// Stops ffmpeg so the writes of the stream fail too.
+				tw.cancel()
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (tw *TranscodeWriter) Header() http.Header {
+	return tw.w.Header()
+}
+
+func (tw *TranscodeWriter) WriteHeader(statusCode int) {
+	tw.w.WriteHeader(statusCode)
+}
+
+// Write feeds p to ffmpeg. Once the client stopped accepting the output,
+// the client write error is returned.
+func (tw *TranscodeWriter) Write(p []byte) (int, error) {
+	n, err := tw.stdin.Write(p)
+	if err != nil {
+		select {
+		case <-tw.done:
+			if tw.outErr != nil {
+				return n, tw.outErr
+			}
+		default:
+		}
+	}
+	return n, err
+}
+
+// Close ends the input of ffmpeg and waits until its remaining output is
+// sent.
+func (tw *TranscodeWriter) Close() error {
+	defer tw.cancel()
+
+	_ = tw.stdin.Close()
+	<-tw.done
+	return tw.cmd.Wait()
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// The cached playlist holds proxy URLs relative to the root (e.g. /p/...) so
+// it does not depend on the host it is served on. The base URL of each
+// request is inserted while serving it.
+
+var catchupSourceRef = []byte(`catchup-source="/`)
+
+// baseURLRef returns where the base URL has to be inserted in a line of the
+// cached playlist: stream URL lines and the catchup-source attribute.
+func baseURLRef(line []byte) (int, bool) {
+	if bytes.HasPrefix(line, []byte("/")) {
+		return 0, true
+	}
+
+	if bytes.HasPrefix(line, []byte("#EXTINF:")) {
+		if i := bytes.Index(line, catchupSourceRef); i >= 0 {
+			return i + len(catchupSourceRef) - 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// countBaseURLRefs returns the number of lines of content the base URL gets
+// inserted into.
+func countBaseURLRefs(content []byte) int64 {
+	var refs int64
+	for len(content) > 0 {
+		var line []byte
+		line, content, _ = bytes.Cut(content, []byte("\n"))
+		if _, ok := baseURLRef(line); ok {
+			refs++
+		}
+	}
+	return refs
+}
+
+// ResolvedSize returns the size of the playlist once baseURL is inserted.
+func (p *CachedPlaylist) ResolvedSize(baseURL string) (int64, bool) {
+	if p.Index == nil {
+		return 0, false
+	}
+	return p.Size + p.Index.BaseURLRefs*int64(len(baseURL)), true
+}
+
+// ResolveBaseURL returns a reader over the cached playlist content of r with
+// baseURL inserted into the relative proxy URLs.
+func ResolveBaseURL(r io.Reader, baseURL string) io.Reader {
+	return &baseURLReader{
+		src:     bufio.NewReaderSize(r, 64*1024),
+		baseURL: []byte(baseURL),
+	}
+}
+
+type baseURLReader struct {
+	src     *bufio.Reader
+	baseURL []byte
+	line    []byte
+	pending []byte
+	err     error
+}
+
+func (r *baseURLReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.readLine()
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readLine reads the next line into pending, with the base URL inserted if
+// needed. The buffers are reused across lines.
+func (r *baseURLReader) readLine() {
+	r.line = r.line[:0]
+	for {
+		chunk, err := r.src.ReadSlice('\n')
+		r.line = append(r.line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		r.err = err
+		break
+	}
+
+	at, ok := baseURLRef(r.line)
+	if !ok {
+		r.pending = r.line
+		return
+	}
+
+	// The resolved line is built behind the read line in the same buffer.
+	resolved := len(r.line)
+	r.line = append(r.line, r.line[:at]...)
+	r.line = append(r.line, r.baseURL...)
+	r.line = append(r.line, r.line[at:resolved]...)
+	r.pending = r.line[resolved:]
+}
@@ -1,11 +1,14 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"m3u-stream-merger/utils"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -28,56 +31,120 @@ func RevalidatingGetM3U(r *http.Request, force bool) string {
 		utils.SafeLogln("[DEBUG] Revalidating M3U cache")
 	}
 
-	if _, err := os.Stat(cacheFilePath); err != nil || force {
+	playlist, err := getPlaylistStorage().Open()
+	if err != nil || force {
 		if debug && !force {
 			utils.SafeLogln("[DEBUG] Existing cache not found, generating content")
 		}
+		if err == nil {
+			playlist.Close()
+		}
+
+		// Not bound to the request as the playlist is shared by all clients.
+		_ = RegenerateM3U(context.Background())
 
-		return generateM3UContent(r)
+		playlist, err = getPlaylistStorage().Open()
+		if err != nil {
+			utils.SafeLogf("Error opening playlist: %v\n", err)
+			return "#EXTM3U\n"
+		}
 	}
+	defer playlist.Close()
+
+	return readCachedPlaylist(playlist, utils.DetermineBaseURL(r))
+}
+
+// countingWriter counts the bytes written to w, giving the offsets of the
+// playlist index.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	return readCacheFromFile()
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
-func generateM3UContent(r *http.Request) string {
+// RegenerateM3U syncs the channels and writes the playlist to the playlist
+// storage. The stored playlist is kept if ctx is done before it is complete.
+// If only the sync fails, the playlist is written from the previous sync.
+func RegenerateM3U(ctx context.Context) error {
 	debug := isDebugMode()
 	if debug {
 		utils.SafeLogln("[DEBUG] Regenerating M3U cache in the background")
 	}
 
-	baseURL := utils.DetermineBaseURL(r)
-	if debug {
-		utils.SafeLogf("[DEBUG] Base URL set to %s\n", baseURL)
-	}
-
-	var content strings.Builder
-
 	M3uCache.Lock()
 	defer M3uCache.Unlock()
+	defer TrackSyncProgress()()
 
-	streams := GetStreams()
-
-	content.WriteString("#EXTM3U\n")
-
-	for _, stream := range streams {
-		if len(stream.URLs) == 0 {
-			continue
+	syncErr := syncChannels(ctx)
+	if syncErr != nil {
+		utils.SafeLogf("Error syncing channels: %v\n", syncErr)
+		if ctx.Err() != nil {
+			return syncErr
 		}
-
-		if debug {
-			utils.SafeLogf("[DEBUG] Processing stream title: %s\n", stream.Title)
-		}
-
-		content.WriteString(formatStreamEntry(baseURL, stream))
 	}
+	setSyncPhase(SyncPhaseWriting)
 
-	if err := writeCacheToFile(content.String()); err != nil {
+	if err := writePlaylist(ctx); err != nil {
 		utils.SafeLogf("[DEBUG] Error writing cache to file: %v\n", err)
+		return errors.Join(syncErr, err)
 	}
 
 	utils.SafeLogln("Background process: Finished building M3U content.")
 
-	return content.String()
+	return syncErr
+}
+
+// writePlaylist writes the playlist of the stored channels to the playlist
+// storage.
+func writePlaylist(ctx context.Context) error {
+	debug := isDebugMode()
+
+	err := getPlaylistStorage().Save(func(w io.Writer) (*PlaylistIndex, error) {
+		content := &countingWriter{w: w}
+
+		if _, err := io.WriteString(content, "#EXTM3U\n"); err != nil {
+			return nil, err
+		}
+
+		index := newPlaylistIndex(content.n)
+		err := forEachChannel(func(stream StreamInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Channels only available from sources in maintenance mode
+			// are left out until one of them is enabled again.
+			if len(stream.URLs) == 0 || !hasEnabledSource(stream) {
+				return nil
+			}
+
+			if debug {
+				utils.SafeLogf("[DEBUG] Processing stream title: %s\n", stream.Title)
+			}
+
+			// The base URL is inserted when serving the playlist.
+			entry := []byte(formatStreamEntry("", stream, ""))
+			index.BaseURLRefs += countBaseURLRefs(entry)
+
+			start := content.n
+			_, err := content.Write(entry)
+			index.add(stream.Group, start, content.n)
+			return err
+		})
+
+		index.Size = content.n
+		return index, err
+	})
+	if err != nil {
+		return err
+	}
+	saveShortIDs()
+
+	return nil
 }
 
 func ClearCache() {
@@ -89,18 +156,18 @@ func ClearCache() {
 	if debug {
 		utils.SafeLogln("[DEBUG] Clearing memory and disk M3U cache.")
 	}
-	if err := os.Remove(cacheFilePath); err != nil && debug {
+	if err := getPlaylistStorage().Clear(); err != nil && debug {
 		utils.SafeLogf("[DEBUG] Cache file deletion failed: %v\n", err)
 	}
-	if err := os.RemoveAll(streamsDirPath); err != nil && debug {
-		utils.SafeLogf("[DEBUG] Stream files deletion failed: %v\n", err)
+	if err := clearChannels(); err != nil && debug {
+		utils.SafeLogf("[DEBUG] Channel database clearing failed: %v\n", err)
 	}
 }
 
-func readCacheFromFile() string {
+func readCachedPlaylist(playlist *CachedPlaylist, baseURL string) string {
 	debug := isDebugMode()
 
-	data, err := os.ReadFile(cacheFilePath)
+	data, err := io.ReadAll(ResolveBaseURL(playlist.Reader(), baseURL))
 	if err != nil {
 		if debug {
 			utils.SafeLogf("[DEBUG] Cache file reading failed: %v\n", err)
@@ -112,44 +179,83 @@ func readCacheFromFile() string {
 	return string(data)
 }
 
-func writeCacheToFile(content string) error {
-	err := os.MkdirAll(filepath.Dir(cacheFilePath), os.ModePerm)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(cacheFilePath+".new", []byte(content), 0644)
-	if err != nil {
-		return err
-	}
+// formatStreamEntry returns the playlist entry of the stream. query is added
+// to its proxy URLs if not empty. Streams with a direct URL (see
+// directStreamURL) bypass the proxy.
+func formatStreamEntry(baseURL string, stream StreamInfo, query string) string {
+	return formatTitledStreamEntry(baseURL, stream, stream.Title, query)
+}
 
-	_ = os.Remove(cacheFilePath)
+// attrEscaper escapes the characters readAttrValue unescapes in quoted values.
+var attrEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
 
-	err = os.Rename(cacheFilePath+".new", cacheFilePath)
-	if err != nil {
-		return err
-	}
-	return nil
+// formatAttr formats an #EXTINF attribute, escaping its value so it is parsed
+// back verbatim.
+func formatAttr(key string, value string) string {
+	return key + `="` + attrEscaper.Replace(value) + `"`
 }
 
-func formatStreamEntry(baseURL string, stream StreamInfo) string {
+// formatTitledStreamEntry is formatStreamEntry listing the stream as title,
+// e.g. "News HD" for the HD variant of News.
+func formatTitledStreamEntry(baseURL string, stream StreamInfo, title string, query string) string {
 	var entry strings.Builder
 
 	extInfTags := []string{"#EXTINF:-1"}
 	if stream.TvgID != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-id=\"%s\"", stream.TvgID))
+		extInfTags = append(extInfTags, formatAttr("tvg-id", stream.TvgID))
 	}
 	if stream.TvgChNo != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-chno=\"%s\"", stream.TvgChNo))
+		extInfTags = append(extInfTags, formatAttr("tvg-chno", stream.TvgChNo))
 	}
 	if stream.LogoURL != "" {
-		extInfTags = append(extInfTags, fmt.Sprintf("tvg-logo=\"%s\"", stream.LogoURL))
+		extInfTags = append(extInfTags, formatAttr("tvg-logo", stream.LogoURL))
 	}
-	extInfTags = append(extInfTags, fmt.Sprintf("tvg-name=\"%s\"", stream.Title))
-	extInfTags = append(extInfTags, fmt.Sprintf("group-title=\"%s\"", stream.Group))
+	extInfTags = append(extInfTags, formatAttr("tvg-name", stream.Title))
+	extInfTags = append(extInfTags, formatAttr("group-title", stream.Group))
 
-	entry.WriteString(fmt.Sprintf("%s,%s\n", strings.Join(extInfTags, " "), stream.Title))
-	entry.WriteString(GenerateStreamURL(baseURL, stream))
+	attributes := make(map[string]string, len(stream.Attributes))
+	for key, value := range stream.Attributes {
+		attributes[key] = value
+	}
+	directURL, direct := directStreamURL(stream)
+
+	if stream.HasCatchup() && !direct {
+		// Catchup requests go through the proxy which expands the template
+		// of the selected source entry.
+		attributes["catchup"] = "default"
+		attributes["catchup-source"] = fmt.Sprintf("%s/c/%s?utc={utc}&duration={duration}", baseURL, streamID(stream))
+		if query != "" {
+			attributes["catchup-source"] += "&" + query
+		}
+	}
+
+	attrKeys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		attrKeys = append(attrKeys, key)
+	}
+	sort.Strings(attrKeys)
+	for _, key := range attrKeys {
+		extInfTags = append(extInfTags, formatAttr(key, attributes[key]))
+	}
+
+	entry.WriteString(fmt.Sprintf("%s,%s\n", strings.Join(extInfTags, " "), title))
+	if stream.ExtGrp != "" {
+		entry.WriteString(fmt.Sprintf("%s%s\n", extGrpPrefix, stream.ExtGrp))
+	}
+	for _, prop := range stream.KodiProps {
+		entry.WriteString(fmt.Sprintf("%s%s\n", kodiPropPrefix, prop))
+	}
+	for _, opt := range stream.VLCOpts {
+		entry.WriteString(fmt.Sprintf("%s%s\n", vlcOptPrefix, opt))
+	}
+	switch {
+	case direct:
+		entry.WriteString(directURL)
+	case query != "":
+		entry.WriteString(GenerateStreamURL(baseURL, stream) + "?" + query)
+	default:
+		entry.WriteString(GenerateStreamURL(baseURL, stream))
+	}
 	entry.WriteString("\n")
 
 	return entry.String()
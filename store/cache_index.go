@@ -0,0 +1,207 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// PlaylistIndex holds the byte ranges of the entries of every group in the
+// cached playlist so a subset can be served without parsing it.
+type PlaylistIndex struct {
+	Size      int64                 `json:"size"`
+	HeaderEnd int64                 `json:"header_end"`
+	Groups    map[string][][2]int64 `json:"groups"`
+
+	// Entries holds the offset of every entry in playlist order, each one
+	// ending where the next one starts, and GroupEntries the positions in
+	// Entries of the entries of every group, so pages can be served.
+	Entries      []int64          `json:"entries"`
+	GroupEntries map[string][]int `json:"group_entries"`
+
+	// BaseURLRefs is the number of lines the base URL is inserted into when
+	// serving the playlist.
+	BaseURLRefs int64 `json:"base_url_refs"`
+}
+
+func newPlaylistIndex(headerEnd int64) *PlaylistIndex {
+	return &PlaylistIndex{
+		HeaderEnd:    headerEnd,
+		Groups:       make(map[string][][2]int64),
+		Entries:      make([]int64, 0),
+		GroupEntries: make(map[string][]int),
+	}
+}
+
+func (index *PlaylistIndex) add(group string, start int64, end int64) {
+	index.GroupEntries[group] = append(index.GroupEntries[group], len(index.Entries))
+	index.Entries = append(index.Entries, start)
+
+	ranges := index.Groups[group]
+	if n := len(ranges); n > 0 && ranges[n-1][1] == start {
+		ranges[n-1][1] = end
+		return
+	}
+	index.Groups[group] = append(ranges, [2]int64{start, end})
+}
+
+// CachedPlaylist is an open handle on the cached playlist. The content stays
+// readable even if the cache is regenerated in the meantime.
+type CachedPlaylist struct {
+	Content io.ReaderAt
+	ModTime time.Time
+	Size    int64
+
+	// Index is nil if the playlist has no index matching its content.
+	Index  *PlaylistIndex
+	Closer io.Closer
+}
+
+// OpenCachedM3U opens the cached playlist, generating it first if it does not
+// exist yet. Proxy URLs of the playlist are relative, see ResolveBaseURL.
+func OpenCachedM3U() (*CachedPlaylist, error) {
+	storage := getPlaylistStorage()
+
+	playlist, err := storage.Open()
+	if err == nil {
+		return playlist, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_ = RegenerateM3U(context.Background())
+
+	return storage.Open()
+}
+
+// HasCachedM3U reports whether the playlist has been generated, i.e. whether
+// OpenCachedM3U returns it without generating it first.
+func HasCachedM3U() bool {
+	playlist, err := getPlaylistStorage().Open()
+	if err != nil {
+		return false
+	}
+	playlist.Close()
+	return true
+}
+
+func (p *CachedPlaylist) Close() error {
+	if p.Closer == nil {
+		return nil
+	}
+	return p.Closer.Close()
+}
+
+// Reader returns a reader over the whole playlist.
+func (p *CachedPlaylist) Reader() io.Reader {
+	// Files are returned as-is so the server can use sendfile.
+	if file, ok := p.Content.(*os.File); ok {
+		return file
+	}
+	return io.NewSectionReader(p.Content, 0, p.Size)
+}
+
+// ETag identifies the generated playlist content.
+func (p *CachedPlaylist) ETag() string {
+	return fmt.Sprintf("\"%x-%x\"", p.ModTime.UnixNano(), p.Size)
+}
+
+// GroupReader returns a reader over the playlist header and the entries of
+// the given groups, in playlist order.
+func (p *CachedPlaylist) GroupReader(groups []string) (io.Reader, error) {
+	if p.Index == nil {
+		return nil, fmt.Errorf("playlist index is missing or outdated")
+	}
+
+	var ranges [][2]int64
+	for _, group := range groups {
+		ranges = append(ranges, p.Index.Groups[group]...)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i][0] < ranges[j][0]
+	})
+
+	readers := []io.Reader{io.NewSectionReader(p.Content, 0, p.Index.HeaderEnd)}
+	for _, r := range ranges {
+		readers = append(readers, io.NewSectionReader(p.Content, r[0], r[1]-r[0]))
+	}
+
+	return io.MultiReader(readers...), nil
+}
+
+// PageReader returns a reader over the playlist header and limit entries of
+// the given groups (of all groups if none is given) from offset, in playlist
+// order, along with the total number of entries of the groups. A limit of 0
+// returns all entries from offset.
+func (p *CachedPlaylist) PageReader(groups []string, offset int, limit int) (io.Reader, int, error) {
+	// Indexes written before pages were supported have no entries.
+	if p.Index == nil || (p.Index.Entries == nil && len(p.Index.Groups) > 0) {
+		return nil, 0, fmt.Errorf("playlist index is missing or outdated")
+	}
+
+	var positions []int
+	if len(groups) == 0 {
+		positions = make([]int, len(p.Index.Entries))
+		for i := range positions {
+			positions[i] = i
+		}
+	} else {
+		for _, group := range slices.Compact(slices.Sorted(slices.Values(groups))) {
+			positions = append(positions, p.Index.GroupEntries[group]...)
+		}
+		sort.Ints(positions)
+	}
+
+	total := len(positions)
+	positions = positions[min(offset, total):]
+	if limit > 0 && len(positions) > limit {
+		positions = positions[:limit]
+	}
+
+	readers := []io.Reader{io.NewSectionReader(p.Content, 0, p.Index.HeaderEnd)}
+	for i := 0; i < len(positions); {
+		// Consecutive entries are read at once.
+		j := i + 1
+		for j < len(positions) && positions[j] == positions[j-1]+1 {
+			j++
+		}
+
+		start, end := p.Index.Entries[positions[i]], p.Index.Size
+		if last := positions[j-1]; last+1 < len(p.Index.Entries) {
+			end = p.Index.Entries[last+1]
+		}
+		readers = append(readers, io.NewSectionReader(p.Content, start, end-start))
+		i = j
+	}
+
+	return io.MultiReader(readers...), total, nil
+}
+
+// PlaylistGroup is a group of the cached playlist with its number of
+// channels.
+type PlaylistGroup struct {
+	Name     string `json:"name"`
+	Channels int    `json:"channels"`
+}
+
+// Groups returns the groups of the playlist in playlist order.
+func (p *CachedPlaylist) Groups() ([]PlaylistGroup, error) {
+	if p.Index == nil || (p.Index.Entries == nil && len(p.Index.Groups) > 0) {
+		return nil, fmt.Errorf("playlist index is missing or outdated")
+	}
+
+	groups := make([]PlaylistGroup, 0, len(p.Index.GroupEntries))
+	for name, positions := range p.Index.GroupEntries {
+		groups = append(groups, PlaylistGroup{Name: name, Channels: len(positions)})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return p.Index.GroupEntries[groups[i].Name][0] < p.Index.GroupEntries[groups[j].Name][0]
+	})
+	return groups, nil
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// catchupAttributes are kept per source entry since the catchup template
+// usually embeds the provider credentials of that entry.
+var catchupAttributes = []string{"catchup", "catchup-source"}
+
+// URLOpt returns the value of an option of the given source entry.
+func (s StreamInfo) URLOpt(m3uIndex string, subIndex string, key string) (string, bool) {
+	for _, opt := range s.URLOpts[m3uIndex+"|"+subIndex] {
+		optKey, value, ok := strings.Cut(opt, "=")
+		if ok && strings.EqualFold(strings.TrimSpace(optKey), key) {
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// HasCatchup reports whether at least one source entry supports catchup.
+func (s StreamInfo) HasCatchup() bool {
+	for m3uIndex, innerMap := range s.URLs {
+		for subIndex := range innerMap {
+			if _, ok := s.CatchupURL(m3uIndex, subIndex, time.Now(), time.Hour); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CatchupURL builds the archive URL of a source entry for the program
+// starting at start. Supported catchup modes are default, append and
+// shift/timeshift.
+func (s StreamInfo) CatchupURL(m3uIndex string, subIndex string, start time.Time, duration time.Duration) (string, bool) {
+	streamUrl, ok := s.URLs[m3uIndex][subIndex]
+	if !ok {
+		return "", false
+	}
+
+	mode, hasMode := s.URLOpt(m3uIndex, subIndex, "catchup")
+	source, hasSource := s.URLOpt(m3uIndex, subIndex, "catchup-source")
+	if !hasMode && !hasSource {
+		return "", false
+	}
+
+	switch strings.ToLower(mode) {
+	case "", "default":
+		if source == "" {
+			return "", false
+		}
+		return expandCatchupTemplate(source, start, duration), true
+	case "append":
+		return streamUrl + expandCatchupTemplate(source, start, duration), true
+	case "shift", "timeshift":
+		separator := "?"
+		if strings.Contains(streamUrl, "?") {
+			separator = "&"
+		}
+		return streamUrl + separator + expandCatchupTemplate("utc={utc}&lutc={lutc}", start, duration), true
+	default:
+		return "", false
+	}
+}
+
+func expandCatchupTemplate(template string, start time.Time, duration time.Duration) string {
+	now := time.Now()
+	end := start.Add(duration)
+	local := start.Local()
+
+	values := map[string]string{
+		"utc":       strconv.FormatInt(start.Unix(), 10),
+		"start":     strconv.FormatInt(start.Unix(), 10),
+		"lutc":      strconv.FormatInt(now.Unix(), 10),
+		"now":       strconv.FormatInt(now.Unix(), 10),
+		"timestamp": strconv.FormatInt(now.Unix(), 10),
+		"utcend":    strconv.FormatInt(end.Unix(), 10),
+		"end":       strconv.FormatInt(end.Unix(), 10),
+		"duration":  strconv.FormatInt(int64(duration.Seconds()), 10),
+		"offset":    strconv.FormatInt(int64(now.Sub(start).Seconds()), 10),
+		"Y":         fmt.Sprintf("%04d", local.Year()),
+		"m":         fmt.Sprintf("%02d", int(local.Month())),
+		"d":         fmt.Sprintf("%02d", local.Day()),
+		"H":         fmt.Sprintf("%02d", local.Hour()),
+		"M":         fmt.Sprintf("%02d", local.Minute()),
+		"S":         fmt.Sprintf("%02d", local.Second()),
+	}
+
+	replacements := make([]string, 0, len(values)*4)
+	for key, value := range values {
+		replacements = append(replacements, "${"+key+"}", value, "{"+key+"}", value)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template)
+}
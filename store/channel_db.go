@@ -0,0 +1,675 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"m3u-stream-merger/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	bolt "go.etcd.io/bbolt"
+)
+
+const channelDBPath = "/m3u-proxy/data/channels.db"
+
+// legacyStreamsDirPath held one index file per stream entry before the
+// channel database.
+const legacyStreamsDirPath = "/m3u-proxy/data/streams"
+
+// channelBatchSize is the number of channels written per transaction, which
+// bounds the memory used by a sync regardless of the playlist sizes.
+const channelBatchSize = 1000
+
+var (
+	// Every sync is written to a new generation bucket which replaces the
+	// current one once complete, so readers never see a partial sync.
+	metaBucket           = []byte("meta")
+	currentGenerationKey = []byte("current")
+	generationPrefix     = []byte("gen-")
+
+	channelsBucket = []byte("channels")
+	// orderBucket maps the sort key of each channel to its title, so
+	// iterating it yields the channels in playlist order.
+	orderBucket = []byte("order")
+
+	// Index buckets map "value\x00title" keys to nothing, values are lower
+	// cased.
+	tvgIDIndexBucket  = []byte("idx_tvg_id")
+	groupIndexBucket  = []byte("idx_group")
+	sourceIndexBucket = []byte("idx_source")
+
+	channelBuckets = [][]byte{channelsBucket, orderBucket, tvgIDIndexBucket, groupIndexBucket, sourceIndexBucket}
+)
+
+var channelDB = struct {
+	sync.Mutex
+	db *bolt.DB
+}{}
+
+// channelSyncMu serializes syncs of the channel database.
+var channelSyncMu sync.Mutex
+
+// channelRecord is the stored form of a StreamInfo. Unlike the JSON encoding
+// of StreamInfo used for slugs, it holds every field.
+type channelRecord struct {
+	SortKey     []byte                       `json:"sort_key,omitempty"`
+	Title       string                       `json:"title"`
+	TvgID       string                       `json:"tvg_id,omitempty"`
+	TvgChNo     string                       `json:"tvg_ch,omitempty"`
+	LogoURL     string                       `json:"logo,omitempty"`
+	Group       string                       `json:"group,omitempty"`
+	URLs        map[string]map[string]string `json:"urls,omitempty"`
+	Attributes  map[string]string            `json:"attributes,omitempty"`
+	ExtGrp      string                       `json:"ext_grp,omitempty"`
+	VLCOpts     []string                     `json:"vlc_opts,omitempty"`
+	KodiProps   []string                     `json:"kodi_props,omitempty"`
+	URLOpts     map[string][]string          `json:"url_opts,omitempty"`
+	EntryTitles map[string]string            `json:"entry_titles,omitempty"`
+}
+
+func newChannelRecord(sortKey []byte, stream StreamInfo) channelRecord {
+	return channelRecord{
+		SortKey:     sortKey,
+		Title:       stream.Title,
+		TvgID:       stream.TvgID,
+		TvgChNo:     stream.TvgChNo,
+		LogoURL:     stream.LogoURL,
+		Group:       stream.Group,
+		URLs:        stream.URLs,
+		Attributes:  stream.Attributes,
+		ExtGrp:      stream.ExtGrp,
+		VLCOpts:     stream.VLCOpts,
+		KodiProps:   stream.KodiProps,
+		URLOpts:     stream.URLOpts,
+		EntryTitles: stream.EntryTitles,
+	}
+}
+
+// encodeChannelRecord returns the stored form of a record, encrypted if the
+// artifacts are encrypted.
+func encodeChannelRecord(record channelRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return sealRecord(data)
+}
+
+func decodeChannelRecord(data []byte, record *channelRecord) error {
+	data, err := openRecord(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, record)
+}
+
+func (c channelRecord) streamInfo() StreamInfo {
+	return StreamInfo{
+		Title:       c.Title,
+		TvgID:       c.TvgID,
+		TvgChNo:     c.TvgChNo,
+		LogoURL:     c.LogoURL,
+		Group:       c.Group,
+		URLs:        c.URLs,
+		Attributes:  c.Attributes,
+		ExtGrp:      c.ExtGrp,
+		VLCOpts:     c.VLCOpts,
+		KodiProps:   c.KodiProps,
+		URLOpts:     c.URLOpts,
+		EntryTitles: c.EntryTitles,
+	}
+}
+
+func openChannelDB() (*bolt.DB, error) {
+	channelDB.Lock()
+	defer channelDB.Unlock()
+
+	if channelDB.db != nil {
+		return channelDB.db, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(channelDBPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(channelDBPath, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	// Commits are not synced to disk one by one, the database is synced once
+	// a sync is complete. It only holds data derived from the sources, so a
+	// database left corrupted by a power loss is rebuilt by the next sync.
+	db.NoSync = true
+
+	_ = os.RemoveAll(legacyStreamsDirPath)
+
+	channelDB.db = db
+	return db, nil
+}
+
+func indexKey(value string, title string) []byte {
+	return []byte(strings.ToLower(value) + "\x00" + title)
+}
+
+// currentGeneration returns the bucket of the last complete sync, or nil if
+// there is none.
+func currentGeneration(tx *bolt.Tx) *bolt.Bucket {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return nil
+	}
+
+	name := meta.Get(currentGenerationKey)
+	if name == nil {
+		return nil
+	}
+
+	return tx.Bucket(name)
+}
+
+// channelWriter writes a sync to a new generation of the channel database.
+type channelWriter struct {
+	db   *bolt.DB
+	name []byte
+}
+
+func newChannelWriter() (*channelWriter, error) {
+	db, err := openChannelDB()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &channelWriter{
+		db:   db,
+		name: []byte(fmt.Sprintf("%s%d", generationPrefix, time.Now().UnixNano())),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		generation, err := tx.CreateBucket(w.name)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range channelBuckets {
+			if _, err := generation.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// merge stores a batch of parsed streams, merging each of them with the
+// already stored stream of the same title. Batches flushed concurrently by
+// different sources are committed together.
+func (w *channelWriter) merge(batch map[string]StreamInfo) error {
+	return w.db.Batch(func(tx *bolt.Tx) error {
+		channels := tx.Bucket(w.name).Bucket(channelsBucket)
+
+		for title, stream := range batch {
+			if data := channels.Get([]byte(title)); data != nil {
+				var record channelRecord
+				if err := decodeChannelRecord(data, &record); err != nil {
+					return err
+				}
+
+				existing := record.streamInfo()
+				mergeStreamInfo(&existing, stream)
+				stream = existing
+			}
+
+			data, err := encodeChannelRecord(newChannelRecord(nil, stream))
+			if err != nil {
+				return err
+			}
+			if err := channels.Put([]byte(title), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// finish sorts and indexes the merged streams, then replaces the current
+// generation with the new one unless ctx is done first.
+func (w *channelWriter) finish(ctx context.Context) error {
+	sortKeys := getSortKeys()
+
+	// The channels are processed in batches, each resuming after the last
+	// title of the previous one.
+	var last []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var prepared []preparedChannel
+
+		err := w.db.Update(func(tx *bolt.Tx) error {
+			generation := tx.Bucket(w.name)
+			channels := generation.Bucket(channelsBucket)
+
+			c := channels.Cursor()
+			k, v := c.First()
+			if last != nil {
+				k, v = c.Seek(last)
+				if bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+
+			values := make([][]byte, 0, channelBatchSize)
+			for ; k != nil && len(values) < channelBatchSize; k, v = c.Next() {
+				values = append(values, v)
+			}
+
+			// Values are only valid until the bucket is modified, so the
+			// whole batch is decoded before writing.
+			var err error
+			prepared, err = prepareChannels(values, sortKeys)
+			if err != nil {
+				return err
+			}
+
+			for _, channel := range prepared {
+				stream := channel.stream
+
+				title := []byte(stream.Title)
+				if err := channels.Put(title, channel.data); err != nil {
+					return err
+				}
+				if err := generation.Bucket(orderBucket).Put(channel.sortKey, title); err != nil {
+					return err
+				}
+
+				if stream.TvgID != "" {
+					if err := generation.Bucket(tvgIDIndexBucket).Put(indexKey(stream.TvgID, stream.Title), nil); err != nil {
+						return err
+					}
+				}
+				if err := generation.Bucket(groupIndexBucket).Put(indexKey(stream.Group, stream.Title), nil); err != nil {
+					return err
+				}
+				for m3uIndex := range stream.URLs {
+					if err := generation.Bucket(sourceIndexBucket).Put(indexKey(m3uIndex, stream.Title), nil); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(prepared) == 0 {
+			break
+		}
+
+		last = []byte(prepared[len(prepared)-1].stream.Title)
+	}
+
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(currentGenerationKey, w.name); err != nil {
+			return err
+		}
+
+		// Also removes the generations of syncs that were interrupted.
+		return deleteGenerations(tx, w.name)
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.db.Sync()
+}
+
+// preparedChannel is a merged channel ready to be written sorted and indexed.
+type preparedChannel struct {
+	stream  StreamInfo
+	sortKey []byte
+	data    []byte
+}
+
+// prepareChannels decodes, dedupes and encodes merged channels with a worker
+// per CPU.
+func prepareChannels(values [][]byte, sortKeys []string) ([]preparedChannel, error) {
+	prepared := make([]preparedChannel, len(values))
+	errs := make([]error, len(values))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				prepared[j], errs[j] = prepareChannel(values[j], sortKeys)
+			}
+		}()
+	}
+
+	for j := range values {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	return prepared, errors.Join(errs...)
+}
+
+func prepareChannel(value []byte, sortKeys []string) (preparedChannel, error) {
+	var record channelRecord
+	if err := decodeChannelRecord(value, &record); err != nil {
+		return preparedChannel{}, err
+	}
+
+	stream := record.streamInfo()
+
+	sortKey := streamSortKey(stream, sortKeys)
+	data, err := encodeChannelRecord(newChannelRecord(sortKey, stream))
+	if err != nil {
+		return preparedChannel{}, err
+	}
+
+	return preparedChannel{stream: stream, sortKey: sortKey, data: data}, nil
+}
+
+// discard removes the generation of a failed sync.
+func (w *channelWriter) discard() error {
+	return w.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(w.name)
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// deleteGenerations removes every generation except keep.
+func deleteGenerations(tx *bolt.Tx, keep []byte) error {
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasPrefix(name, generationPrefix) && !bytes.Equal(name, keep) {
+			names = append(names, bytes.Clone(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearChannels removes the stored channels.
+func clearChannels() error {
+	db, err := openChannelDB()
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucket); meta != nil {
+			if err := meta.Delete(currentGenerationKey); err != nil {
+				return err
+			}
+		}
+		return deleteGenerations(tx, nil)
+	})
+	if err == nil {
+		currentStreamIndex.Store(nil)
+	}
+	return err
+}
+
+func getChannelRecord(generation *bolt.Bucket, title []byte) (*channelRecord, error) {
+	data := generation.Bucket(channelsBucket).Get(title)
+	if data == nil {
+		return nil, nil
+	}
+
+	var record channelRecord
+	if err := decodeChannelRecord(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// forEachChannel calls fn with every channel of the last sync in playlist
+// order, without loading them all into memory.
+func forEachChannel(fn func(stream StreamInfo) error) error {
+	db, err := openChannelDB()
+	if err != nil {
+		return err
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		generation := currentGeneration(tx)
+		if generation == nil {
+			return nil
+		}
+
+		return generation.Bucket(orderBucket).ForEach(func(_, title []byte) error {
+			record, err := getChannelRecord(generation, title)
+			if err != nil || record == nil {
+				return err
+			}
+			return fn(record.streamInfo())
+		})
+	})
+}
+
+// lookupChannel returns the stored channel with the given title.
+func lookupChannel(title string) (*StreamInfo, bool) {
+	debug := isDebugMode()
+
+	db, err := openChannelDB()
+	if err != nil {
+		if debug {
+			utils.SafeLogf("[DEBUG] Error opening channel database: %v\n", err)
+		}
+		return nil, false
+	}
+
+	var stream *StreamInfo
+	err = db.View(func(tx *bolt.Tx) error {
+		generation := currentGeneration(tx)
+		if generation == nil {
+			return nil
+		}
+
+		record, err := getChannelRecord(generation, []byte(title))
+		if record != nil {
+			info := record.streamInfo()
+			stream = &info
+		}
+		return err
+	})
+	if err != nil && debug {
+		utils.SafeLogf("[DEBUG] Error reading channel %s: %v\n", title, err)
+	}
+
+	return stream, stream != nil
+}
+
+// ChannelQuery selects channels of the channel database. Empty fields match
+// every channel. The title has to match exactly, the other values are
+// compared case-insensitively.
+type ChannelQuery struct {
+	Title  string
+	TvgID  string
+	Group  string
+	Source string
+	Offset int
+	Limit  int
+}
+
+// Channel is a channel of the generated playlist, without its source URLs.
+// Variants are its quality variants with QUALITY_VARIANTS, best first.
+type Channel struct {
+	Title    string   `json:"title"`
+	TvgID    string   `json:"tvg_id"`
+	TvgChNo  string   `json:"tvg_ch"`
+	LogoURL  string   `json:"logo"`
+	Group    string   `json:"group"`
+	Sources  []string `json:"sources"`
+	Variants []string `json:"variants,omitempty"`
+}
+
+func (c channelRecord) channel() Channel {
+	sources := make([]string, 0, len(c.URLs))
+	for m3uIndex := range c.URLs {
+		sources = append(sources, m3uIndex)
+	}
+	sort.Strings(sources)
+
+	return Channel{
+		Title:    c.Title,
+		TvgID:    c.TvgID,
+		TvgChNo:  c.TvgChNo,
+		LogoURL:  c.LogoURL,
+		Group:    c.Group,
+		Sources:  sources,
+		Variants: StreamVariants(c.streamInfo()),
+	}
+}
+
+func (q ChannelQuery) matches(record *channelRecord) bool {
+	if q.Title != "" && record.Title != q.Title {
+		return false
+	}
+	if q.TvgID != "" && !strings.EqualFold(record.TvgID, q.TvgID) {
+		return false
+	}
+	if q.Group != "" && !strings.EqualFold(record.Group, q.Group) {
+		return false
+	}
+	if q.Source != "" {
+		if _, ok := record.URLs[q.Source]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryChannels returns the channels matching the query in playlist order.
+func QueryChannels(query ChannelQuery) ([]Channel, error) {
+	db, err := openChannelDB()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*channelRecord, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		generation := currentGeneration(tx)
+		if generation == nil {
+			return nil
+		}
+
+		collect := func(title []byte) error {
+			record, err := getChannelRecord(generation, title)
+			if err != nil || record == nil {
+				return err
+			}
+			if query.matches(record) {
+				records = append(records, record)
+			}
+			return nil
+		}
+
+		// The most selective index is used, the other fields are checked on
+		// the records.
+		var index []byte
+		var value string
+		switch {
+		case query.TvgID != "":
+			index, value = tvgIDIndexBucket, query.TvgID
+		case query.Source != "":
+			index, value = sourceIndexBucket, query.Source
+		case query.Group != "":
+			index, value = groupIndexBucket, query.Group
+		}
+
+		switch {
+		case query.Title != "" && index == nil:
+			return collect([]byte(query.Title))
+		case index != nil:
+			bucket := generation.Bucket(index)
+
+			prefix := []byte(strings.ToLower(value) + "\x00")
+			c := bucket.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if err := collect(k[len(prefix):]); err != nil {
+					return err
+				}
+			}
+		default:
+			return generation.Bucket(orderBucket).ForEach(func(_, title []byte) error {
+				return collect(title)
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i].SortKey, records[j].SortKey) < 0
+	})
+
+	if query.Offset > 0 {
+		records = records[min(query.Offset, len(records)):]
+	}
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+
+	channels := make([]Channel, 0, len(records))
+	for _, record := range records {
+		channels = append(channels, record.channel())
+	}
+	return channels, nil
+}
+
+// ChannelCount returns the number of channels of the last sync.
+func ChannelCount() (int, error) {
+	db, err := openChannelDB()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		if generation := currentGeneration(tx); generation != nil {
+			count = generation.Bucket(channelsBucket).Stats().KeyN
+		}
+		return nil
+	})
+	return count, err
+}
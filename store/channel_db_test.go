@@ -0,0 +1,339 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// emptyChannelDB starts the test from a channel database without channels.
+func emptyChannelDB(t *testing.T) {
+	t.Helper()
+
+	if err := clearChannels(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = clearChannels() })
+}
+
+// writeChannels stores the batches as a complete sync.
+func writeChannels(t *testing.T, batches ...map[string]StreamInfo) {
+	t.Helper()
+
+	w, err := newChannelWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range batches {
+		if err := w.merge(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func channelTitles(t *testing.T) []string {
+	t.Helper()
+
+	titles := []string{}
+	err := forEachChannel(func(stream StreamInfo) error {
+		titles = append(titles, stream.Title)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return titles
+}
+
+func generationCount(t *testing.T) int {
+	t.Helper()
+
+	db, err := openChannelDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, generationPrefix) {
+				count++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestChannelGenerations(t *testing.T) {
+	emptyChannelDB(t)
+
+	writeChannels(t, map[string]StreamInfo{
+		"News": {Title: "News", URLs: map[string]map[string]string{"1": {"0": "http://one.invalid/1.ts"}}},
+	})
+
+	// The channels of a sync in progress are not visible.
+	w, err := newChannelWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.merge(map[string]StreamInfo{
+		"Kids": {Title: "Kids", URLs: map[string]map[string]string{"1": {"0": "http://one.invalid/2.ts"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if titles := channelTitles(t); !slices.Equal(titles, []string{"News"}) {
+		t.Fatalf("Expected the channels of the last sync during the next one, got %v", titles)
+	}
+	if _, ok := lookupChannel("Kids"); ok {
+		t.Fatal("Expected the channel of the unfinished sync not to be found")
+	}
+
+	// A failed sync is discarded and keeps the current generation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.finish(ctx); err == nil {
+		t.Fatal("Expected the cancelled sync to fail")
+	}
+	if err := w.discard(); err != nil {
+		t.Fatal(err)
+	}
+	if titles := channelTitles(t); !slices.Equal(titles, []string{"News"}) {
+		t.Errorf("Expected the channels of the last sync after a failed one, got %v", titles)
+	}
+	if n := generationCount(t); n != 1 {
+		t.Errorf("Expected the failed generation to be removed, got %d generations", n)
+	}
+
+	// A complete sync replaces the channels and the generations of the
+	// interrupted ones.
+	if _, err := newChannelWriter(); err != nil {
+		t.Fatal(err)
+	}
+	writeChannels(t, map[string]StreamInfo{
+		"Kids": {Title: "Kids", URLs: map[string]map[string]string{"1": {"0": "http://one.invalid/2.ts"}}},
+	})
+	if titles := channelTitles(t); !slices.Equal(titles, []string{"Kids"}) {
+		t.Errorf("Expected the channels of the new sync, got %v", titles)
+	}
+	if n := generationCount(t); n != 1 {
+		t.Errorf("Expected a single generation left, got %d", n)
+	}
+	if count, err := ChannelCount(); err != nil || count != 1 {
+		t.Errorf("Expected a single channel, got %d (%v)", count, err)
+	}
+}
+
+func TestChannelMerge(t *testing.T) {
+	emptyChannelDB(t)
+
+	w, err := newChannelWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sources flush their batches concurrently.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m3uIndex := fmt.Sprint(i + 1)
+			errs[i] = w.merge(map[string]StreamInfo{
+				"News": {
+					Title:     "News",
+					URLs:      map[string]map[string]string{m3uIndex: {"0": "http://" + m3uIndex + ".invalid/news.ts"}},
+					VLCOpts:   []string{"http-user-agent=Player"},
+					KodiProps: []string{"inputstream=" + m3uIndex},
+				},
+				"Source " + m3uIndex: {Title: "Source " + m3uIndex, URLs: map[string]map[string]string{m3uIndex: {"0": "http://" + m3uIndex + ".invalid/own.ts"}}},
+			})
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A later batch adds entries and keeps the attributes already set.
+	err = w.merge(map[string]StreamInfo{
+		"News": {
+			Title:      "News",
+			URLs:       map[string]map[string]string{"1": {"1": "http://1.invalid/news-sd.ts"}},
+			Attributes: map[string]string{"tvg-logo": "second"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.merge(map[string]StreamInfo{
+		"News": {Title: "News", Attributes: map[string]string{"tvg-logo": "third", "x-extra": "third"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.finish(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	news, ok := lookupChannel("News")
+	if !ok {
+		t.Fatal("Expected the merged channel")
+	}
+	wantURLs := map[string]map[string]string{
+		"1": {"0": "http://1.invalid/news.ts", "1": "http://1.invalid/news-sd.ts"},
+		"2": {"0": "http://2.invalid/news.ts"},
+		"3": {"0": "http://3.invalid/news.ts"},
+	}
+	if !reflect.DeepEqual(news.URLs, wantURLs) {
+		t.Errorf("Expected the entries of every source, got %v", news.URLs)
+	}
+	if want := map[string]string{"tvg-logo": "second", "x-extra": "third"}; !reflect.DeepEqual(news.Attributes, want) {
+		t.Errorf("Expected the first attributes to be kept, got %v", news.Attributes)
+	}
+	if !slices.Equal(news.VLCOpts, []string{"http-user-agent=Player"}) || len(news.KodiProps) != 3 {
+		t.Errorf("Expected the unique options of every source, got %v and %v", news.VLCOpts, news.KodiProps)
+	}
+
+	if titles := channelTitles(t); !slices.Equal(titles, []string{"News", "Source 1", "Source 2", "Source 3"}) {
+		t.Errorf("Expected every channel once, got %v", titles)
+	}
+
+	// The indexes see the merged sources.
+	channels, err := QueryChannels(ChannelQuery{Source: "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || channels[0].Title != "News" || channels[1].Title != "Source 3" {
+		t.Errorf("Expected News and Source 3 from the third source, got %+v", channels)
+	}
+}
+
+func TestChannelSortOrder(t *testing.T) {
+	emptyChannelDB(t)
+
+	t.Setenv("GROUP_ORDER", "Sports,News")
+	groupConfigOnce = sync.Once{}
+	t.Cleanup(func() {
+		groupRules = nil
+		groupConfigOnce = sync.Once{}
+	})
+
+	streams := []StreamInfo{
+		{Title: "News 10", TvgChNo: "4", Group: "News", TvgID: "a"},
+		{Title: "Kids", TvgChNo: "4", Group: "Kids", TvgID: "a"},
+		{Title: "Sports 2", TvgChNo: "10", Group: "Sports", TvgID: "c"},
+		{Title: "News 2", TvgChNo: "20", Group: "News", TvgID: "c"},
+		{Title: "Sports 10", TvgChNo: "3", Group: "Sports", TvgID: "b"},
+		{Title: "Films 02", TvgChNo: "1", Group: "Films", TvgID: "b"},
+		{Title: "Films 1", TvgChNo: "02", Group: "Films", TvgID: "a"},
+		{Title: "news", TvgChNo: "4", Group: "News", TvgID: "a"},
+		{Title: "Ünicode", Group: "Kids"},
+	}
+
+	// The order of the in-memory sort the channel database replaced.
+	sortStreams := func(s []StreamInfo) {
+		keys := getSortKeys()
+		sort.Slice(s, func(i, j int) bool {
+			if rankI, rankJ := groupRank(s[i].Group), groupRank(s[j].Group); rankI != rankJ {
+				return rankI < rankJ
+			}
+			for _, key := range keys {
+				if cmp := naturalCompare(getSortKey(s[i], key), getSortKey(s[j], key)); cmp != 0 {
+					return cmp < 0
+				}
+			}
+			return false
+		})
+	}
+
+	for _, sortingKey := range []string{"", "tvg-chno", "group-title,tvg-id", "tvg-id,tvg-chno"} {
+		t.Run(sortingKey, func(t *testing.T) {
+			t.Setenv("SORTING_KEY", sortingKey)
+
+			batch := make(map[string]StreamInfo)
+			for i, stream := range streams {
+				stream.URLs = map[string]map[string]string{"1": {"0": fmt.Sprintf("http://one.invalid/%d.ts", i)}}
+				batch[stream.Title] = stream
+			}
+			writeChannels(t, batch)
+
+			sorted := slices.Clone(streams)
+			sortStreams(sorted)
+			want := make([]string, 0, len(sorted))
+			for _, stream := range sorted {
+				want = append(want, stream.Title)
+			}
+
+			if titles := channelTitles(t); !slices.Equal(titles, want) {
+				t.Errorf("SORTING_KEY=%q stored %v, want %v", sortingKey, titles, want)
+			}
+		})
+	}
+}
+
+func TestLookupChannelAfterRestart(t *testing.T) {
+	emptyChannelDB(t)
+
+	news := StreamInfo{
+		Title:       "News",
+		TvgID:       "news",
+		TvgChNo:     "1",
+		LogoURL:     "http://logo.invalid/news.png",
+		Group:       "News",
+		URLs:        map[string]map[string]string{"1": {"0": "http://one.invalid/news.ts"}, "2": {"0": "http://two.invalid/news.ts"}},
+		Attributes:  map[string]string{"x-extra": "value"},
+		ExtGrp:      "News",
+		VLCOpts:     []string{"http-user-agent=Player"},
+		KodiProps:   []string{"inputstream=inputstream.adaptive"},
+		URLOpts:     map[string][]string{"http://one.invalid/news.ts": {"http-referrer=http://one.invalid"}},
+		EntryTitles: map[string]string{"2|0": "News HD"},
+	}
+	writeChannels(t, map[string]StreamInfo{"News": news})
+
+	// Closing the database stands in for a restart of the proxy.
+	channelDB.Lock()
+	if err := channelDB.db.Close(); err != nil {
+		channelDB.Unlock()
+		t.Fatal(err)
+	}
+	channelDB.db = nil
+	channelDB.Unlock()
+	currentStreamIndex.Store(nil)
+
+	stream, ok := lookupChannel("News")
+	if !ok {
+		t.Fatal("Expected the channel of the last sync after a restart")
+	}
+	if !reflect.DeepEqual(*stream, news) {
+		t.Errorf("Expected the stored channel\n%+v\ngot\n%+v", news, *stream)
+	}
+	if _, ok := lookupChannel("Kids"); ok {
+		t.Error("Expected an unknown title not to be found")
+	}
+
+	// The lookup index is rebuilt from the stored channels.
+	if err := buildStreamIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if indexed, ok := lookupStreamByTitle("News"); !ok || !reflect.DeepEqual(indexed.URLs, news.URLs) {
+		t.Errorf("Expected News in the rebuilt index, got %+v", indexed)
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const channelStatsFilePath = "/m3u-proxy/data/channel_stats.json"
+
+const (
+	// channelOpenDedupWindow is how long repeated opens of a channel by the
+	// same client (HLS playlist refreshes, reconnects) count as one.
+	channelOpenDedupWindow = 5 * time.Minute
+	// channelStatsSaveInterval is how often the open counts are persisted.
+	channelStatsSaveInterval = time.Minute
+)
+
+var channelStats = struct {
+	sync.Mutex
+	loaded  bool
+	opens   map[string]int64
+	clients map[string]time.Time
+	savedAt time.Time
+}{clients: make(map[string]time.Time)}
+
+func loadChannelStats() {
+	debug := isDebugMode()
+
+	if channelStats.loaded {
+		return
+	}
+	channelStats.loaded = true
+
+	if err := readJSONFile(channelStatsFilePath, &channelStats.opens); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading channel stats: %v\n", err)
+		}
+	}
+	if channelStats.opens == nil {
+		channelStats.opens = make(map[string]int64)
+	}
+}
+
+// RecordChannelOpen counts a client opening the channel title. client
+// identifies the client, e.g. by its fingerprint.
+func RecordChannelOpen(title string, client string) {
+	channelStats.Lock()
+	defer channelStats.Unlock()
+
+	loadChannelStats()
+
+	now := time.Now()
+	if last, ok := channelStats.clients[client]; ok && now.Sub(last) < channelOpenDedupWindow {
+		channelStats.clients[client] = now
+		return
+	}
+	channelStats.clients[client] = now
+	channelStats.opens[title]++
+
+	if now.Sub(channelStats.savedAt) < channelStatsSaveInterval {
+		return
+	}
+	channelStats.savedAt = now
+
+	for k, last := range channelStats.clients {
+		if now.Sub(last) >= channelOpenDedupWindow {
+			delete(channelStats.clients, k)
+		}
+	}
+
+	if err := writeJSONFile(channelStatsFilePath, channelStats.opens); err != nil {
+		utils.SafeLogf("Error saving channel stats: %v\n", err)
+	}
+}
+
+// PopularChannels returns the titles of the n most opened channels, most
+// opened first.
+func PopularChannels(n int) []string {
+	channelStats.Lock()
+	defer channelStats.Unlock()
+
+	loadChannelStats()
+
+	titles := make([]string, 0, len(channelStats.opens))
+	for title := range channelStats.opens {
+		titles = append(titles, title)
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		a, b := channelStats.opens[titles[i]], channelStats.opens[titles[j]]
+		if a != b {
+			return a > b
+		}
+		return titles[i] < titles[j]
+	})
+
+	if len(titles) > n {
+		titles = titles[:n]
+	}
+	return titles
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"m3u-stream-merger/utils"
+	"os"
+	"sync"
+)
+
+const slugOwnersFilePath = "/m3u-proxy/data/slugs.json"
+
+// SlugCollision is a channel that had the same title as another channel of
+// the same source with a different tvg-id and got renamed to keep both.
+type SlugCollision struct {
+	Source        string `json:"source"`
+	Title         string `json:"title"`
+	TvgID         string `json:"tvg_id"`
+	OwnerTvgID    string `json:"owner_tvg_id"`
+	ResolvedTitle string `json:"resolved_title"`
+}
+
+// slugStore persists which tvg-id owns a title within a source ("idx|title")
+// so the same channel keeps the plain title, and therefore the same slug,
+// across syncs regardless of the playlist order.
+var slugStore = struct {
+	sync.Mutex
+	loaded     bool
+	dirty      bool
+	owners     map[string]string
+	collisions map[string]SlugCollision
+}{owners: make(map[string]string), collisions: make(map[string]SlugCollision)}
+
+func loadSlugOwners() {
+	debug := isDebugMode()
+
+	if slugStore.loaded {
+		return
+	}
+	slugStore.loaded = true
+
+	if err := readJSONFile(slugOwnersFilePath, &slugStore.owners); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading slug owners: %v\n", err)
+		}
+	}
+	if slugStore.owners == nil {
+		slugStore.owners = make(map[string]string)
+	}
+}
+
+// resolveSlugCollision appends the tvg-id to the title of a stream colliding
+// with a different channel of the same source. Entries without a tvg-id, or
+// with the tvg-id of the owner, are merged as usual.
+func resolveSlugCollision(m3uIndex string, stream *StreamInfo) {
+	if stream.TvgID == "" {
+		return
+	}
+
+	slugStore.Lock()
+	defer slugStore.Unlock()
+
+	loadSlugOwners()
+
+	key := m3uIndex + "|" + stream.Title
+	owner, ok := slugStore.owners[key]
+	if !ok {
+		slugStore.owners[key] = stream.TvgID
+		slugStore.dirty = true
+		return
+	}
+	if owner == stream.TvgID {
+		return
+	}
+
+	collision := SlugCollision{
+		Source:        m3uIndex,
+		Title:         stream.Title,
+		TvgID:         stream.TvgID,
+		OwnerTvgID:    owner,
+		ResolvedTitle: fmt.Sprintf("%s (%s)", stream.Title, stream.TvgID),
+	}
+
+	collisionKey := key + "|" + stream.TvgID
+	if _, reported := slugStore.collisions[collisionKey]; !reported {
+		utils.SafeLogf("Channel title collision in M3U_URL_%s: %q (tvg-id %s) renamed to %q as %q already belongs to tvg-id %s\n",
+			m3uIndex, stream.Title, stream.TvgID, collision.ResolvedTitle, stream.Title, owner)
+		slugStore.collisions[collisionKey] = collision
+	}
+
+	stream.Title = collision.ResolvedTitle
+}
+
+// resetSlugCollisions clears the collisions reported by the previous sync.
+func resetSlugCollisions() {
+	slugStore.Lock()
+	defer slugStore.Unlock()
+
+	slugStore.collisions = make(map[string]SlugCollision)
+}
+
+func saveSlugOwners() {
+	slugStore.Lock()
+	defer slugStore.Unlock()
+
+	if !slugStore.dirty {
+		return
+	}
+
+	if err := writeJSONFile(slugOwnersFilePath, slugStore.owners); err != nil {
+		utils.SafeLogf("Error saving slug owners: %v\n", err)
+		return
+	}
+	slugStore.dirty = false
+}
+
+// GetSlugCollisions returns the title collisions resolved during the last
+// sync.
+func GetSlugCollisions() []SlugCollision {
+	slugStore.Lock()
+	defer slugStore.Unlock()
+
+	collisions := make([]SlugCollision, 0, len(slugStore.collisions))
+	for _, collision := range slugStore.collisions {
+		collisions = append(collisions, collision)
+	}
+	return collisions
+}
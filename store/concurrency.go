@@ -1,76 +1,247 @@
-package store
-
-import (
-	"fmt"
-	"m3u-stream-merger/utils"
-	"os"
-	"strconv"
-	"sync"
-)
-
-type ConcurrencyManager struct {
-	mu    sync.Mutex
-	count map[string]int
-}
-
-func NewConcurrencyManager() *ConcurrencyManager {
-	return &ConcurrencyManager{count: make(map[string]int)}
-}
-
-func (cm *ConcurrencyManager) Increment(m3uIndex string) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	cm.count[m3uIndex]++
-}
-
-func (cm *ConcurrencyManager) Decrement(m3uIndex string) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	if cm.count[m3uIndex] > 0 {
-		cm.count[m3uIndex]--
-	}
-}
-
-func (cm *ConcurrencyManager) GetCount(m3uIndex string) int {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	return cm.count[m3uIndex]
-}
-
-func (cm *ConcurrencyManager) ConcurrencyPriorityValue(m3uIndex string) int {
-	maxConcurrency, err := strconv.Atoi(os.Getenv(fmt.Sprintf("M3U_MAX_CONCURRENCY_%s", m3uIndex)))
-	if err != nil {
-		maxConcurrency = 1
-	}
-
-	count := cm.GetCount(m3uIndex)
-
-	return maxConcurrency - count
-}
-
-func (cm *ConcurrencyManager) CheckConcurrency(m3uIndex string) bool {
-	maxConcurrency, err := strconv.Atoi(os.Getenv(fmt.Sprintf("M3U_MAX_CONCURRENCY_%s", m3uIndex)))
-	if err != nil {
-		maxConcurrency = 1
-	}
-
-	count := cm.GetCount(m3uIndex)
-
-	utils.SafeLogf("Current number of connections for M3U_%s: %d", m3uIndex, count)
-	return count >= maxConcurrency
-}
-
-func (cm *ConcurrencyManager) UpdateConcurrency(m3uIndex string, incr bool) {
-	if incr {
-		cm.Increment(m3uIndex)
-	} else {
-		cm.Decrement(m3uIndex)
-	}
-
-	count := cm.GetCount(m3uIndex)
-
-	utils.SafeLogf("Current number of connections for M3U_%s: %d", m3uIndex, count)
-}
+package store
+
+import (
+	"fmt"
+	"m3u-stream-merger/utils"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ConcurrencyManager struct {
+	mu    sync.Mutex
+	count map[string]int
+	// drifted are the counts that differed from the open streams on the
+	// last reconciliation.
+	drifted map[string]bool
+}
+
+// OpenStream is a stream holding a concurrency slot of a source.
+type OpenStream struct {
+	M3UIndex string
+	Group    string
+}
+
+func NewConcurrencyManager() *ConcurrencyManager {
+	return &ConcurrencyManager{count: make(map[string]int)}
+}
+
+func (cm *ConcurrencyManager) Increment(m3uIndex string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.count[m3uIndex]++
+}
+
+func (cm *ConcurrencyManager) Decrement(m3uIndex string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.count[m3uIndex] > 0 {
+		cm.count[m3uIndex]--
+	}
+}
+
+func (cm *ConcurrencyManager) GetCount(m3uIndex string) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.count[m3uIndex]
+}
+
+// MaxConcurrency returns the max concurrency of the source, from
+// M3U_MAX_CONCURRENCY_X or else M3U_MAX_CONCURRENCY_DEFAULT.
+func MaxConcurrency(m3uIndex string) int {
+	maxConcurrency, err := strconv.Atoi(os.Getenv(fmt.Sprintf("M3U_MAX_CONCURRENCY_%s", m3uIndex)))
+	if err != nil {
+		maxConcurrency, err = strconv.Atoi(os.Getenv("M3U_MAX_CONCURRENCY_DEFAULT"))
+	}
+	if err != nil {
+		maxConcurrency = 1
+	}
+	return maxConcurrency
+}
+
+// groupConcurrencyLimit returns the max concurrency per source of the
+// streams of the group, from the first GROUP_MAX_CONCURRENCY_X rule
+// (`regex=>limit`) matching it.
+func groupConcurrencyLimit(group string) (int, bool) {
+	keys := []string{}
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		if suffix, ok := strings.CutPrefix(key, "GROUP_MAX_CONCURRENCY_"); ok {
+			if _, err := strconv.Atoi(suffix); err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return naturalCompare(keys[i], keys[j]) < 0
+	})
+
+	for _, key := range keys {
+		rule := os.Getenv(key)
+		match, limit, ok := strings.Cut(rule, "=>")
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile(strings.TrimSpace(match))
+		if err != nil || !re.MatchString(group) {
+			continue
+		}
+		if limit, err := strconv.Atoi(strings.TrimSpace(limit)); err == nil {
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+// groupCountKey is the key of the count of streams of a group on a source.
+func groupCountKey(m3uIndex string, group string) string {
+	return m3uIndex + "\x00" + group
+}
+
+func (cm *ConcurrencyManager) ConcurrencyPriorityValue(m3uIndex string) int {
+	count := cm.GetCount(m3uIndex)
+
+	return MaxConcurrency(m3uIndex) - count
+}
+
+// CheckStreamConcurrency reports whether the source has reached its
+// concurrency limit, or the limit of the group of the channel on it.
+func (cm *ConcurrencyManager) CheckStreamConcurrency(m3uIndex string, group string) bool {
+	if cm.CheckConcurrency(m3uIndex) {
+		return true
+	}
+
+	limit, ok := groupConcurrencyLimit(group)
+	if !ok {
+		return false
+	}
+	return cm.GetCount(groupCountKey(m3uIndex, group)) >= limit
+}
+
+// UpdateStreamConcurrency counts a stream of a channel of the group opened
+// from the source, or closed if incr is false.
+func (cm *ConcurrencyManager) UpdateStreamConcurrency(m3uIndex string, group string, incr bool) {
+	if incr {
+		cm.Increment(groupCountKey(m3uIndex, group))
+	} else {
+		cm.Decrement(groupCountKey(m3uIndex, group))
+	}
+	cm.UpdateConcurrency(m3uIndex, incr)
+}
+
+func (cm *ConcurrencyManager) CheckConcurrency(m3uIndex string) bool {
+	maxConcurrency := MaxConcurrency(m3uIndex)
+
+	count := cm.GetCount(m3uIndex)
+
+	utils.SafeLogf("Current number of connections for M3U_%s: %d", m3uIndex, count)
+	return count >= maxConcurrency
+}
+
+// openStreamCounts returns the counts matching the open streams.
+func openStreamCounts(open []OpenStream) map[string]int {
+	counts := make(map[string]int)
+	for _, stream := range open {
+		counts[stream.M3UIndex]++
+		counts[groupCountKey(stream.M3UIndex, stream.Group)]++
+	}
+	return counts
+}
+
+// Reconcile corrects the counts that drifted from the streams actually open,
+// e.g. after a crashed stream skipped its decrement and would block the slot
+// for good. Only counts that also differed on the previous reconciliation are
+// corrected, as the others may be of streams being opened or closed. It
+// returns the corrected sources.
+func (cm *ConcurrencyManager) Reconcile(open []OpenStream) []string {
+	actual := openStreamCounts(open)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	keys := make(map[string]bool, len(cm.count)+len(actual))
+	for key := range cm.count {
+		keys[key] = true
+	}
+	for key := range actual {
+		keys[key] = true
+	}
+
+	drifted := make(map[string]bool)
+	corrected := []string{}
+	for key := range keys {
+		if cm.count[key] == actual[key] {
+			continue
+		}
+		if !cm.drifted[key] {
+			drifted[key] = true
+			continue
+		}
+
+		m3uIndex, group, isGroup := strings.Cut(key, "\x00")
+		if isGroup {
+			utils.SafeLogf("Corrected concurrency count of group %s on M3U_%s from %d to %d\n", group, m3uIndex, cm.count[key], actual[key])
+		} else {
+			utils.SafeLogf("Corrected concurrency count of M3U_%s from %d to %d\n", m3uIndex, cm.count[key], actual[key])
+			corrected = append(corrected, m3uIndex)
+		}
+		cm.setCount(key, actual[key])
+	}
+	cm.drifted = drifted
+
+	sort.Strings(corrected)
+	return corrected
+}
+
+// Reset sets the count of the source, and of its groups, to the streams
+// actually open from it. It returns the new count of the source.
+func (cm *ConcurrencyManager) Reset(m3uIndex string, open []OpenStream) int {
+	actual := openStreamCounts(open)
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	for key := range cm.count {
+		if index, _, _ := strings.Cut(key, "\x00"); index == m3uIndex {
+			cm.setCount(key, actual[key])
+		}
+	}
+	for key, count := range actual {
+		if index, _, _ := strings.Cut(key, "\x00"); index == m3uIndex {
+			cm.setCount(key, count)
+		}
+	}
+	for key := range cm.drifted {
+		if index, _, _ := strings.Cut(key, "\x00"); index == m3uIndex {
+			delete(cm.drifted, key)
+		}
+	}
+
+	return cm.count[m3uIndex]
+}
+
+func (cm *ConcurrencyManager) setCount(key string, count int) {
+	if count == 0 {
+		delete(cm.count, key)
+		return
+	}
+	cm.count[key] = count
+}
+
+func (cm *ConcurrencyManager) UpdateConcurrency(m3uIndex string, incr bool) {
+	if incr {
+		cm.Increment(m3uIndex)
+	} else {
+		cm.Decrement(m3uIndex)
+	}
+
+	count := cm.GetCount(m3uIndex)
+
+	utils.SafeLogf("Current number of connections for M3U_%s: %d", m3uIndex, count)
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"sort"
+	"sync"
+)
+
+const customChannelsFilePath = "/m3u-proxy/data/custom_channels.json"
+
+// CustomSource is the M3U index of the channels injected through the API. It
+// is not one of the M3U_URL_X sources, but its settings (e.g.
+// M3U_MAX_CONCURRENCY_CUSTOM) are read the same way.
+const CustomSource = "CUSTOM"
+
+// CustomChannel is a channel injected through the API, e.g. a local camera
+// or a test stream, added to the playlist on every sync.
+type CustomChannel struct {
+	Title   string `json:"title"`
+	Group   string `json:"group,omitempty"`
+	URL     string `json:"url"`
+	LogoURL string `json:"logo,omitempty"`
+}
+
+var customChannelStore = struct {
+	sync.RWMutex
+	loaded bool
+	// The channels by title.
+	channels map[string]CustomChannel
+}{channels: make(map[string]CustomChannel)}
+
+func loadCustomChannels() {
+	debug := isDebugMode()
+
+	customChannelStore.Lock()
+	defer customChannelStore.Unlock()
+
+	if customChannelStore.loaded {
+		return
+	}
+	customChannelStore.loaded = true
+
+	if err := readJSONFile(customChannelsFilePath, &customChannelStore.channels); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading custom channels: %v\n", err)
+		}
+	}
+	if customChannelStore.channels == nil {
+		customChannelStore.channels = make(map[string]CustomChannel)
+	}
+}
+
+// AddCustomChannel persists the channel, replacing the custom channel of the
+// same title. It is added to the playlist from the next sync on.
+func AddCustomChannel(channel CustomChannel) error {
+	loadCustomChannels()
+
+	customChannelStore.Lock()
+	defer customChannelStore.Unlock()
+
+	customChannelStore.channels[channel.Title] = channel
+
+	return writeJSONFile(customChannelsFilePath, customChannelStore.channels)
+}
+
+// RemoveCustomChannel drops the custom channel with the given title. It
+// reports whether there was one.
+func RemoveCustomChannel(title string) (bool, error) {
+	loadCustomChannels()
+
+	customChannelStore.Lock()
+	defer customChannelStore.Unlock()
+
+	if _, ok := customChannelStore.channels[title]; !ok {
+		return false, nil
+	}
+	delete(customChannelStore.channels, title)
+
+	return true, writeJSONFile(customChannelsFilePath, customChannelStore.channels)
+}
+
+// GetCustomChannels returns the custom channels by title.
+func GetCustomChannels() []CustomChannel {
+	loadCustomChannels()
+
+	customChannelStore.RLock()
+	defer customChannelStore.RUnlock()
+
+	channels := make([]CustomChannel, 0, len(customChannelStore.channels))
+	for _, channel := range customChannelStore.channels {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Title < channels[j].Title
+	})
+	return channels
+}
+
+// customChannelBatch returns the custom channels as streams of CustomSource,
+// to be merged with the channels of the sources of the same title.
+func customChannelBatch() map[string]StreamInfo {
+	batch := make(map[string]StreamInfo)
+	for _, channel := range GetCustomChannels() {
+		batch[channel.Title] = StreamInfo{
+			Title:   channel.Title,
+			Group:   channel.Group,
+			LogoURL: channel.LogoURL,
+			URLs: map[string]map[string]string{
+				CustomSource: {"0": channel.URL},
+			},
+		}
+	}
+	return batch
+}
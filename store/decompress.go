@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+var errPlaylistTooLarge = errors.New("playlist exceeds M3U_MAX_SIZE_MB")
+
+// decodedBody returns a reader that decompresses the playlist body on the fly
+// if it is gzip or zstd compressed, either through Content-Encoding or as a
+// compressed file (e.g. playlist.m3u.gz).
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	body := bufio.NewReader(resp.Body)
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+
+	magic, _ := body.Peek(len(zstdMagic))
+
+	switch {
+	case encoding == "gzip" || encoding == "x-gzip" || bytes.HasPrefix(magic, gzipMagic):
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading gzip playlist: %v", err)
+		}
+		return reader, nil
+	case encoding == "zstd" || bytes.HasPrefix(magic, zstdMagic):
+		reader, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading zstd playlist: %v", err)
+		}
+		return reader.IOReadCloser(), nil
+	default:
+		return io.NopCloser(body), nil
+	}
+}
+
+// copyWithLimit copies src to dst, failing once more than M3U_MAX_SIZE_MB of
+// decompressed data is read.
+func copyWithLimit(dst io.Writer, src io.Reader) error {
+	maxMb, err := strconv.ParseInt(os.Getenv("M3U_MAX_SIZE_MB"), 10, 64)
+	if err != nil || maxMb <= 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	maxBytes := maxMb * 1024 * 1024
+	n, err := io.Copy(dst, io.LimitReader(src, maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > maxBytes {
+		return errPlaylistTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package store
+
+import "sort"
+
+// SameURLEntries returns the source entries ("index|subIndex") of the stream
+// listing the same URL as the given one, itself included, e.g. sources
+// reselling the same provider. When one of them fails, the load balancer
+// skips the others instead of trying the same dead URL again. They are kept
+// in the stream as the entries of their own source, for ?source=, pins and
+// the concurrency of each source.
+func SameURLEntries(stream StreamInfo, m3uIndex string, subIndex string) []string {
+	url, ok := stream.URLs[m3uIndex][subIndex]
+	if !ok {
+		return []string{m3uIndex + "|" + subIndex}
+	}
+
+	var entries []string
+	for index, innerMap := range stream.URLs {
+		for sub, entryURL := range innerMap {
+			if entryURL == url {
+				entries = append(entries, index+"|"+sub)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return naturalCompare(entries[i], entries[j]) < 0
+	})
+
+	return entries
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSameURLEntries(t *testing.T) {
+	stream := StreamInfo{
+		Title: "Live",
+		URLs: map[string]map[string]string{
+			"1":  {"0": "http://a/live/1.ts", "1": "http://a/live/1-sd.ts"},
+			"2":  {"0": "http://b/live/1.ts"},
+			"10": {"0": "http://a/live/1.ts"},
+			"3":  {"0": "http://a/live/1.ts", "1": "http://a/live/1-sd.ts"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		m3uIndex string
+		subIndex string
+		want     []string
+	}{
+		{"shared across sources", "1", "0", []string{"1|0", "3|0", "10|0"}},
+		{"from a later source", "10", "0", []string{"1|0", "3|0", "10|0"}},
+		{"other sub-index", "3", "1", []string{"1|1", "3|1"}},
+		{"unique", "2", "0", []string{"2|0"}},
+		{"unknown entry", "4", "0", []string{"4|0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameURLEntries(stream, tt.m3uIndex, tt.subIndex); !slices.Equal(got, tt.want) {
+				t.Errorf("SameURLEntries(%s|%s) = %v, want %v", tt.m3uIndex, tt.subIndex, got, tt.want)
+			}
+		})
+	}
+
+	// The entries are left in the stream.
+	if len(stream.URLs["3"]) != 2 || len(stream.URLs["10"]) != 1 {
+		t.Errorf("Expected the duplicate entries to be kept, got %v", stream.URLs)
+	}
+}
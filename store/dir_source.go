@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalDirPrefix marks an M3U_URL_X pointing to a directory of playlists.
+const LocalDirPrefix = "dir://"
+
+// IsLocalDirSource reports whether the given source URL is a dir:// source.
+func IsLocalDirSource(m3uURL string) bool {
+	return strings.HasPrefix(m3uURL, LocalDirPrefix)
+}
+
+// LocalDirPath returns the directory path of a dir:// source.
+func LocalDirPath(m3uURL string) string {
+	return strings.TrimPrefix(m3uURL, LocalDirPrefix)
+}
+
+// IsPlaylistFile reports whether the file is picked up by a dir:// source.
+func IsPlaylistFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".m3u" || ext == ".m3u8"
+}
+
+// mergeM3UDirectory writes every playlist in dir, in name order, into a
+// single M3U file at outPath.
+func mergeM3UDirectory(ctx context.Context, dir string, outPath string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Error reading directory: %v", err)
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && IsPlaylistFile(entry.Name()) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("Error creating file: %v", err)
+	}
+	defer outFile.Close()
+
+	out, err := newArtifactWriter(outFile)
+	if err != nil {
+		return fmt.Errorf("Error writing to file: %v", err)
+	}
+
+	if _, err := io.WriteString(out, "#EXTM3U\n"); err != nil {
+		return fmt.Errorf("Error writing to file: %v", err)
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := appendPlaylist(out, file); err != nil {
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Error writing to file: %v", err)
+	}
+	return nil
+}
+
+func appendPlaylist(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if err := copyWithLimit(w, file); err != nil {
+		return fmt.Errorf("Error writing %s: %v", path, err)
+	}
+
+	// Files without a trailing newline would otherwise merge their last line
+	// with the first line of the next file.
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// directStreamURL returns the original upstream URL written to the playlist
+// for the stream instead of a proxy URL, with PLAYLIST_URL_MODE=direct
+// (limited to the groups of DIRECT_URL_GROUPS if set). The URL of the first
+// enabled source is used, by source then QUALITY_ORDER (see SubIndexOrder).
+func directStreamURL(stream StreamInfo) (string, bool) {
+	if strings.ToLower(strings.TrimSpace(os.Getenv("PLAYLIST_URL_MODE"))) != "direct" {
+		return "", false
+	}
+
+	if groups := strings.TrimSpace(os.Getenv("DIRECT_URL_GROUPS")); groups != "" {
+		matched := false
+		for _, group := range strings.Split(groups, ",") {
+			if strings.TrimSpace(group) == stream.Group {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+
+	indexes := make([]string, 0, len(stream.URLs))
+	for m3uIndex := range stream.URLs {
+		if !IsSourceDisabled(m3uIndex) {
+			indexes = append(indexes, m3uIndex)
+		}
+	}
+	if len(indexes) == 0 {
+		return "", false
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return naturalCompare(indexes[i], indexes[j]) < 0
+	})
+
+	subIndexes := SubIndexOrder(stream, indexes[0])
+	if len(subIndexes) == 0 {
+		return "", false
+	}
+
+	return stream.URLs[indexes[0]][subIndexes[0]], true
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	extGrpPrefix   = "#EXTGRP:"
+	vlcOptPrefix   = "#EXTVLCOPT:"
+	kodiPropPrefix = "#KODIPROP:"
+)
+
+// isStreamDirective reports whether the line is a per-entry directive that
+// should be kept with the next stream entry.
+func isStreamDirective(line string) bool {
+	return strings.HasPrefix(line, extGrpPrefix) ||
+		strings.HasPrefix(line, vlcOptPrefix) ||
+		strings.HasPrefix(line, kodiPropPrefix)
+}
+
+func applyDirectives(stream *StreamInfo, directives []string) {
+	for _, directive := range directives {
+		switch {
+		case strings.HasPrefix(directive, extGrpPrefix):
+			stream.ExtGrp = strings.TrimSpace(strings.TrimPrefix(directive, extGrpPrefix))
+			if stream.Group == "" {
+				stream.Group = stream.ExtGrp
+			}
+		case strings.HasPrefix(directive, vlcOptPrefix):
+			stream.VLCOpts = appendUnique(stream.VLCOpts, strings.TrimSpace(strings.TrimPrefix(directive, vlcOptPrefix)))
+		case strings.HasPrefix(directive, kodiPropPrefix):
+			stream.KodiProps = appendUnique(stream.KodiProps, strings.TrimSpace(strings.TrimPrefix(directive, kodiPropPrefix)))
+		}
+	}
+}
+
+func appendUnique(dst []string, values ...string) []string {
+	for _, value := range values {
+		if value != "" && !slices.Contains(dst, value) {
+			dst = append(dst, value)
+		}
+	}
+	return dst
+}
+
+// URLHeaders returns the request headers set through #EXTVLCOPT for the given
+// source entry.
+func (s StreamInfo) URLHeaders(m3uIndex string, subIndex string) http.Header {
+	headers := http.Header{}
+	for _, opt := range s.URLOpts[m3uIndex+"|"+subIndex] {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "http-user-agent":
+			headers.Set("User-Agent", strings.TrimSpace(value))
+		case "http-referrer", "http-referer":
+			headers.Set("Referer", strings.TrimSpace(value))
+		}
+	}
+	return headers
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -10,7 +11,7 @@ import (
 	"m3u-stream-merger/utils"
 )
 
-func DownloadM3USource(m3uIndex string) (err error) {
+func DownloadM3USource(ctx context.Context, m3uIndex string) (err error) {
 	debug := os.Getenv("DEBUG") == "true"
 	m3uURL := os.Getenv(fmt.Sprintf("M3U_URL_%s", m3uIndex))
 
@@ -49,12 +50,40 @@ func DownloadM3USource(m3uIndex string) (err error) {
 		return nil
 	}
 
+	// Handle local directories
+	if IsLocalDirSource(m3uURL) {
+		localDir := LocalDirPath(m3uURL)
+		if debug {
+			utils.SafeLogf("[DEBUG] Local M3U directory detected: %s\n", localDir)
+		}
+
+		err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("Error creating directories for final path: %v", err)
+		}
+
+		err = mergeM3UDirectory(ctx, localDir, tmpPath)
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+
+		_ = os.Remove(finalPath)
+		_ = os.Rename(tmpPath, finalPath)
+
+		if debug {
+			utils.SafeLogf("[DEBUG] M3U files in %s merged to %s\n", localDir, finalPath)
+		}
+
+		return nil
+	}
+
 	// Handle remote URLs
 	if debug {
 		utils.SafeLogf("[DEBUG] Remote M3U URL detected: %s\n", m3uURL)
 	}
 
-	resp, err := utils.CustomHttpRequest("GET", m3uURL)
+	resp, err := utils.SourceHttpRequestContext(ctx, m3uIndex, "GET", m3uURL, nil)
 	if err != nil {
 		return fmt.Errorf("HTTP GET error: %v", err)
 	}
@@ -69,6 +98,12 @@ func DownloadM3USource(m3uIndex string) (err error) {
 		return fmt.Errorf("Error creating directories for final path: %v", err)
 	}
 
+	body, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
 	// Write response body to finalPath
 	outFile, err := os.Create(tmpPath)
 	if err != nil {
@@ -76,8 +111,18 @@ func DownloadM3USource(m3uIndex string) (err error) {
 	}
 	defer outFile.Close()
 
-	_, err = io.Copy(outFile, resp.Body)
+	out, err := newArtifactWriter(outFile)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Error writing to file: %v", err)
+	}
+
+	err = copyWithLimit(out, body)
+	if err == nil {
+		err = out.Close()
+	}
 	if err != nil {
+		_ = os.Remove(tmpPath)
 		return fmt.Errorf("Error writing to file: %v", err)
 	}
 
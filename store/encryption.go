@@ -0,0 +1,320 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Encrypted artifacts start with encryptedMagic. Files are followed by a
+// random nonce prefix and the content sealed in chunks of encryptedChunkSize,
+// so they can still be streamed and read at any offset. Channel records are
+// followed by a random nonce and the sealed record.
+const (
+	encryptedMagic     = "M3UPENC1"
+	encryptedChunkSize = 64 * 1024
+	noncePrefixSize    = 8
+)
+
+// errArtifactKey is returned when an encrypted artifact cannot be decrypted.
+var errArtifactKey = errors.New("encrypted artifact cannot be decrypted, check DATA_ENCRYPTION_KEY")
+
+var artifactCipherCache = struct {
+	sync.Mutex
+	config string
+	aead   cipher.AEAD
+}{}
+
+// artifactCipher returns the cipher the artifacts holding provider URLs (the
+// downloaded source playlists, the generated playlist and the channel
+// database records) are encrypted with, derived from DATA_ENCRYPTION_KEY or
+// the content of the file at DATA_ENCRYPTION_KEY_FILE. It is nil if the
+// artifacts are stored in clear.
+func artifactCipher() (cipher.AEAD, error) {
+	passphrase := os.Getenv("DATA_ENCRYPTION_KEY")
+	path := strings.TrimSpace(os.Getenv("DATA_ENCRYPTION_KEY_FILE"))
+	config := passphrase + "\x00" + path
+
+	artifactCipherCache.Lock()
+	defer artifactCipherCache.Unlock()
+
+	if artifactCipherCache.config == config && artifactCipherCache.aead != nil {
+		return artifactCipherCache.aead, nil
+	}
+
+	if passphrase == "" && path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading DATA_ENCRYPTION_KEY_FILE: %v", err)
+		}
+		passphrase = strings.TrimRight(string(content), "\r\n")
+	}
+	if passphrase == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	artifactCipherCache.config = config
+	artifactCipherCache.aead = aead
+	return aead, nil
+}
+
+// chunkNonce returns the nonce of a chunk of an encrypted file. The final
+// chunk is sealed with different additional data, so truncated files are
+// detected.
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(index))
+	return nonce
+}
+
+func chunkAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// artifactWriter encrypts the content written to it in chunks.
+type artifactWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  int64
+	chunk  []byte
+	sealed []byte
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newArtifactWriter returns a writer encrypting the content written to it
+// into w if the artifacts are encrypted. It has to be closed to write the
+// end of the content, which does not close w.
+func newArtifactWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := artifactCipher()
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &artifactWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		chunk:  make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (a *artifactWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Full chunks are only sealed once more content follows, as the
+		// last chunk is sealed as final.
+		if len(a.chunk) == encryptedChunkSize {
+			if err := a.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(a.chunk[len(a.chunk):encryptedChunkSize], p)
+		a.chunk = a.chunk[:len(a.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (a *artifactWriter) seal(final bool) error {
+	a.sealed = a.aead.Seal(a.sealed[:0], chunkNonce(a.prefix, a.index), a.chunk, chunkAdditionalData(final))
+	a.index++
+	a.chunk = a.chunk[:0]
+	_, err := a.w.Write(a.sealed)
+	return err
+}
+
+func (a *artifactWriter) Close() error {
+	return a.seal(true)
+}
+
+// encryptedArtifact reads the decrypted content of an encrypted file.
+type encryptedArtifact struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	chunks int64
+	size   int64
+
+	mu     sync.Mutex
+	cached int64
+	plain  []byte
+	sealed []byte
+}
+
+// openArtifact returns the content of file and its size, decrypted if it is
+// an encrypted artifact. Files stored in clear, e.g. before the encryption
+// was enabled, are returned as-is.
+func openArtifact(file *os.File) (io.ReaderAt, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header := make([]byte, len(encryptedMagic)+noncePrefixSize)
+	if n, _ := file.ReadAt(header, 0); n < len(header) || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return file, info.Size(), nil
+	}
+
+	aead, err := artifactCipher()
+	if err != nil {
+		return nil, 0, err
+	}
+	if aead == nil {
+		return nil, 0, errArtifactKey
+	}
+
+	sealedChunkSize := int64(encryptedChunkSize + aead.Overhead())
+	body := info.Size() - int64(len(header))
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || body-(chunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		return nil, 0, fmt.Errorf("encrypted artifact %s is truncated", file.Name())
+	}
+
+	size := body - chunks*int64(aead.Overhead())
+	return &encryptedArtifact{
+		r:      file,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		chunks: chunks,
+		size:   size,
+		cached: -1,
+	}, size, nil
+}
+
+func (a *encryptedArtifact) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= a.size {
+			return n, io.EOF
+		}
+
+		index := off / encryptedChunkSize
+		plain, err := a.chunk(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plain[off-index*encryptedChunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// chunk returns the decrypted chunk at index, keeping the last one for the
+// sequential reads of the chunk.
+func (a *encryptedArtifact) chunk(index int64) ([]byte, error) {
+	if index == a.cached {
+		return a.plain, nil
+	}
+
+	sealedChunkSize := int64(encryptedChunkSize + a.aead.Overhead())
+	offset := int64(len(encryptedMagic)+noncePrefixSize) + index*sealedChunkSize
+	size := sealedChunkSize
+	if index == a.chunks-1 {
+		size = a.size - index*encryptedChunkSize + int64(a.aead.Overhead())
+	}
+
+	if int64(cap(a.sealed)) < size {
+		a.sealed = make([]byte, sealedChunkSize)
+	}
+	a.sealed = a.sealed[:size]
+	if _, err := a.r.ReadAt(a.sealed, offset); err != nil {
+		return nil, err
+	}
+
+	plain, err := a.aead.Open(a.plain[:0], chunkNonce(a.prefix, index), a.sealed, chunkAdditionalData(index == a.chunks-1))
+	if err != nil {
+		a.cached = -1
+		return nil, errArtifactKey
+	}
+	a.plain = plain
+	a.cached = index
+	return plain, nil
+}
+
+// sealRecord encrypts a channel record if the artifacts are encrypted.
+func sealRecord(data []byte) ([]byte, error) {
+	aead, err := artifactCipher()
+	if err != nil || aead == nil {
+		return data, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte(encryptedMagic), nonce...)
+	return aead.Seal(sealed, nonce, data, nil), nil
+}
+
+// openRecord returns the decrypted channel record, or data if it is stored in
+// clear.
+func openRecord(data []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(data, []byte(encryptedMagic))
+	if !ok {
+		return data, nil
+	}
+
+	aead, err := artifactCipher()
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil || len(sealed) < aead.NonceSize() {
+		return nil, errArtifactKey
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errArtifactKey
+	}
+	return plain, nil
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"net/url"
+	"strings"
+)
+
+type ExtInfAttr struct {
+	Key   string
+	Value string
+}
+
+// ExtInf is a tokenized #EXTINF line.
+type ExtInf struct {
+	Duration   string
+	Attributes []ExtInfAttr
+	Title      string
+
+	// titled is set if the line has the comma before the title.
+	titled bool
+}
+
+// Get returns the value of the first attribute matching key (case
+// insensitive).
+func (e ExtInf) Get(key string) string {
+	for _, attr := range e.Attributes {
+		if strings.EqualFold(attr.Key, key) {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// ParseExtInf tokenizes an #EXTINF line. Attribute values may be double or
+// single quoted (with backslash escapes), unquoted, and may contain commas.
+// The title is everything after the first comma outside of an attribute.
+func ParseExtInf(line string) ExtInf {
+	var result ExtInf
+
+	s := strings.TrimPrefix(strings.TrimSpace(line), "#EXTINF:")
+	i := 0
+
+	for i < len(s) && !isSpace(s[i]) && s[i] != ',' {
+		i++
+	}
+	result.Duration = s[:i]
+
+	for i < len(s) {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		if s[i] == ',' {
+			result.Title = strings.TrimSpace(s[i+1:])
+			result.titled = true
+			break
+		}
+
+		start := i
+		for i < len(s) && isAttrKeyChar(s[i]) {
+			i++
+		}
+		key := s[start:i]
+
+		if key == "" || i >= len(s) || s[i] != '=' {
+			// Not an attribute, skip the stray token.
+			if i == start {
+				i++
+			}
+			for i < len(s) && !isSpace(s[i]) && s[i] != ',' {
+				i++
+			}
+			continue
+		}
+		i++
+
+		var value string
+		value, i = readAttrValue(s, i)
+		result.Attributes = append(result.Attributes, ExtInfAttr{Key: key, Value: strings.TrimSpace(value)})
+	}
+
+	return result
+}
+
+// ContinuesExtInf reports whether line carries on the #EXTINF line, as
+// written by generators wrapping the attributes over several lines: the
+// #EXTINF line has no title yet and line starts with an attribute or the
+// comma before the title.
+func ContinuesExtInf(extInfLine, line string) bool {
+	i := 0
+	for i < len(line) && isAttrKeyChar(line[i]) {
+		i++
+	}
+	isAttr := i > 0 && i < len(line) && line[i] == '='
+	if !isAttr && !strings.HasPrefix(line, ",") {
+		return false
+	}
+	return !ParseExtInf(extInfLine).titled
+}
+
+func readAttrValue(s string, i int) (string, int) {
+	if i >= len(s) {
+		return "", i
+	}
+
+	quote := s[i]
+	if quote != '"' && quote != '\'' {
+		start := i
+		for i < len(s) && !isSpace(s[i]) && s[i] != ',' {
+			i++
+		}
+		return s[start:i], i
+	}
+	i++
+
+	var value strings.Builder
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == quote || s[i+1] == '\\'):
+			value.WriteByte(s[i+1])
+			i += 2
+		case c == quote:
+			return value.String(), i + 1
+		default:
+			value.WriteByte(c)
+			i++
+		}
+	}
+
+	// Unterminated quote, take the rest of the line as the value.
+	return value.String(), i
+}
+
+// unescapeAttr decodes URI-encoded attribute values (e.g. "Fox%20News"). The
+// value is returned as-is if it is not valid percent-encoding.
+func unescapeAttr(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+
+	decoded, err := url.PathUnescape(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isAttrKeyChar(c byte) bool {
+	return c == '-' || c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
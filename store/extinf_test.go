@@ -0,0 +1,50 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtInfRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"escaped quote", `#EXTINF:-1 tvg-id="news" group-title="News" x-desc="The \"Daily\" Show",Daily`},
+		{"escaped backslash", `#EXTINF:-1 group-title="C:\\TV\\" x-path="a\\b",Paths`},
+		{"quote in group and name", `#EXTINF:-1 tvg-name="Say \"Hi\"" group-title="\"Quoted\" Group",Say "Hi"`},
+		{"single quotes", `#EXTINF:-1 group-title='Kids' x-note='a "b" c',Single`},
+	}
+
+	parse := func(line string) StreamInfo {
+		return parseLine(line, nil, "http://provider.invalid/live/1.ts", "1", make(map[string]int))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed := parse(tt.line)
+
+			formatted := formatStreamEntry("http://example.com", parsed, "")
+			extInf, _, _ := strings.Cut(formatted, "\n")
+			reparsed := parse(extInf)
+
+			if reparsed.Title != parsed.Title || reparsed.Group != parsed.Group || reparsed.TvgID != parsed.TvgID {
+				t.Errorf("Expected %q, %q and %q back from %s, got %q, %q and %q",
+					parsed.Title, parsed.Group, parsed.TvgID, extInf, reparsed.Title, reparsed.Group, reparsed.TvgID)
+			}
+			if !reflect.DeepEqual(reparsed.Attributes, parsed.Attributes) {
+				t.Errorf("Expected the attributes %v back from %s, got %v", parsed.Attributes, extInf, reparsed.Attributes)
+			}
+		})
+	}
+
+	// The values are passed through verbatim.
+	parsed := parse(`#EXTINF:-1 group-title="News" x-desc="The \"Daily\" Show",Daily`)
+	if got := parsed.Attributes["x-desc"]; got != `The "Daily" Show` {
+		t.Errorf("Expected the unescaped value, got %q", got)
+	}
+	if entry := formatStreamEntry("http://example.com", parsed, ""); !strings.Contains(entry, `x-desc="The \"Daily\" Show"`) {
+		t.Errorf("Expected the quotes to be escaped, got %s", entry)
+	}
+}
@@ -0,0 +1,271 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FilterExpr is a compiled FILTER_EXPR, e.g.
+//
+//	group =~ "Sports" && title !~ "PPV" || tvg-id == "cnn.us"
+//
+// Operators are ==, !=, =~ (regex match) and !~ (regex mismatch), combined
+// with !, && and || (in decreasing precedence) and parentheses.
+type FilterExpr interface {
+	Match(stream StreamInfo) bool
+}
+
+type filterOr struct{ left, right FilterExpr }
+type filterAnd struct{ left, right FilterExpr }
+type filterNot struct{ expr FilterExpr }
+
+type filterCompare struct {
+	field  string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+func (e filterOr) Match(stream StreamInfo) bool {
+	return e.left.Match(stream) || e.right.Match(stream)
+}
+
+func (e filterAnd) Match(stream StreamInfo) bool {
+	return e.left.Match(stream) && e.right.Match(stream)
+}
+
+func (e filterNot) Match(stream StreamInfo) bool {
+	return !e.expr.Match(stream)
+}
+
+func (e filterCompare) Match(stream StreamInfo) bool {
+	value := filterField(stream, e.field)
+
+	switch e.op {
+	case "==":
+		return value == e.value
+	case "!=":
+		return value != e.value
+	case "=~":
+		return e.regexp.MatchString(value)
+	default:
+		return !e.regexp.MatchString(value)
+	}
+}
+
+func filterField(stream StreamInfo, field string) string {
+	switch strings.ToLower(field) {
+	case "title", "tvg-name":
+		return stream.Title
+	case "group", "group-title":
+		return stream.Group
+	case "tvg-id":
+		return stream.TvgID
+	case "tvg-chno", "channel-number":
+		return stream.TvgChNo
+	case "logo", "tvg-logo":
+		return stream.LogoURL
+	default:
+		return stream.Attributes[field]
+	}
+}
+
+type filterToken struct {
+	kind  string // "ident", "string", "op", "(", ")" or "eof"
+	value string
+	pos   int
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// ParseFilterExpr compiles a filter expression.
+func ParseFilterExpr(input string) (FilterExpr, error) {
+	tokens, err := tokenizeFilterExpr(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != "eof" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (FilterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == "op" && p.peek().value == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (FilterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == "op" && p.peek().value == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (FilterExpr, error) {
+	tok := p.peek()
+
+	switch {
+	case tok.kind == "op" && tok.value == "!":
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{expr}, nil
+	case tok.kind == "(":
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != ")" {
+			return nil, fmt.Errorf("expected ) at position %d", closing.pos)
+		}
+		return expr, nil
+	case tok.kind == "ident":
+		return p.parseCompare()
+	case tok.kind == "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.value, tok.pos)
+	}
+}
+
+func (p *filterParser) parseCompare() (FilterExpr, error) {
+	field := p.next()
+
+	op := p.next()
+	if op.kind != "op" || (op.value != "==" && op.value != "!=" && op.value != "=~" && op.value != "!~") {
+		return nil, fmt.Errorf("expected ==, !=, =~ or !~ after %q at position %d", field.value, op.pos)
+	}
+
+	value := p.next()
+	if value.kind != "string" && value.kind != "ident" {
+		return nil, fmt.Errorf("expected a value after %q at position %d", op.value, value.pos)
+	}
+
+	compare := filterCompare{field: field.value, op: op.value, value: value.value}
+	if op.value == "=~" || op.value == "!~" {
+		re, err := regexp.Compile(value.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", value.value, err)
+		}
+		compare.regexp = re
+	}
+
+	return compare, nil
+}
+
+func tokenizeFilterExpr(input string) ([]filterToken, error) {
+	var tokens []filterToken
+
+	i := 0
+	for i < len(input) {
+		c := input[i]
+
+		switch {
+		case isSpace(c) || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{kind: string(c), value: string(c), pos: i})
+			i++
+		case c == '"' || c == '\'':
+			value, end, ok := readFilterString(input, i)
+			if !ok {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{kind: "string", value: value, pos: i})
+			i = end
+		case strings.HasPrefix(input[i:], "&&"), strings.HasPrefix(input[i:], "||"),
+			strings.HasPrefix(input[i:], "=="), strings.HasPrefix(input[i:], "!="),
+			strings.HasPrefix(input[i:], "=~"), strings.HasPrefix(input[i:], "!~"):
+			tokens = append(tokens, filterToken{kind: "op", value: input[i : i+2], pos: i})
+			i += 2
+		case c == '!':
+			tokens = append(tokens, filterToken{kind: "op", value: "!", pos: i})
+			i++
+		case isAttrKeyChar(c) || c == '.':
+			start := i
+			for i < len(input) && (isAttrKeyChar(input[i]) || input[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: "ident", value: input[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+
+	return append(tokens, filterToken{kind: "eof", pos: len(input)}), nil
+}
+
+// readFilterString reads a quoted string starting at i, where \" (or \')
+// and \\ are escapes. Other backslashes are kept as-is for regexes.
+func readFilterString(s string, i int) (string, int, bool) {
+	quote := s[i]
+	i++
+
+	var value strings.Builder
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == quote || s[i+1] == '\\'):
+			value.WriteByte(s[i+1])
+			i += 2
+		case c == quote:
+			return value.String(), i + 1, true
+		default:
+			value.WriteByte(c)
+			i++
+		}
+	}
+
+	return "", i, false
+}
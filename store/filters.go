@@ -2,15 +2,25 @@ package store
 
 import (
 	"m3u-stream-merger/utils"
+	"os"
 	"regexp"
+	"strings"
 )
 
 var includeFilters [][]string
 var excludeFilters [][]string
+var filterExpr FilterExpr
 var filtersInitialized bool
 
 func checkFilter(stream StreamInfo) bool {
 	if !filtersInitialized {
+		if exprString := strings.TrimSpace(os.Getenv("FILTER_EXPR")); exprString != "" {
+			expr, err := ParseFilterExpr(exprString)
+			if err != nil {
+				utils.SafeLogf("Invalid FILTER_EXPR, ignoring it: %v\n", err)
+			}
+			filterExpr = expr
+		}
 		excludeFilters = [][]string{
 			utils.GetFilters("EXCLUDE_GROUPS"),
 			utils.GetFilters("EXCLUDE_TITLE"),
@@ -22,6 +32,12 @@ func checkFilter(stream StreamInfo) bool {
 		filtersInitialized = true
 	}
 
+	// FILTER_EXPR has to match first, the INCLUDE/EXCLUDE lists are applied
+	// on top of it.
+	if filterExpr != nil && !filterExpr.Match(stream) {
+		return false
+	}
+
 	if allFiltersEmpty(append(excludeFilters, includeFilters...)...) {
 		return true
 	}
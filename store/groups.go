@@ -0,0 +1,74 @@
+package store
+
+import (
+	"m3u-stream-merger/utils"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type groupRule struct {
+	pattern *regexp.Regexp
+	group   string
+}
+
+var (
+	groupRules      []groupRule
+	groupOrder      map[string]int
+	groupConfigOnce sync.Once
+)
+
+func loadGroupConfig() {
+	groupConfigOnce.Do(func() {
+		for _, rule := range utils.GetFilters("GROUP_MAP") {
+			match, group, ok := strings.Cut(rule, "=>")
+			if !ok {
+				utils.SafeLogf("Invalid group mapping rule (expected `regex=>group`): %s\n", rule)
+				continue
+			}
+
+			re, err := regexp.Compile(strings.TrimSpace(match))
+			if err != nil {
+				utils.SafeLogf("Error compiling group mapping regex: %v\n", err)
+				continue
+			}
+
+			groupRules = append(groupRules, groupRule{pattern: re, group: strings.TrimSpace(group)})
+		}
+
+		groupOrder = make(map[string]int)
+		for _, group := range strings.Split(os.Getenv("GROUP_ORDER"), ",") {
+			group = strings.TrimSpace(group)
+			if _, exists := groupOrder[group]; group != "" && !exists {
+				groupOrder[group] = len(groupOrder)
+			}
+		}
+	})
+}
+
+// remapGroup renames the group using the first matching GROUP_MAP_X rule.
+// Several upstream groups can be merged by mapping them to the same name.
+func remapGroup(group string) string {
+	loadGroupConfig()
+
+	for _, rule := range groupRules {
+		if rule.pattern.MatchString(group) {
+			return rule.group
+		}
+	}
+
+	return group
+}
+
+// groupRank returns the position of the group in GROUP_ORDER. Groups not
+// listed are ranked after all listed ones.
+func groupRank(group string) int {
+	loadGroupConfig()
+
+	if rank, ok := groupOrder[group]; ok {
+		return rank
+	}
+
+	return len(groupOrder)
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The kinds of streams, as classified by StreamMediaType.
+const (
+	MediaLive   = "live"
+	MediaMovie  = "movie"
+	MediaSeries = "series"
+)
+
+var (
+	// episodePatterns match "Show S01E02", "Show - S01 E02" and "Show 1x02"
+	// titles, capturing the show name, season and episode.
+	episodePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)^(.*?)[\s._-]*\bS(\d{1,3})[\s._-]*E(\d{1,4})\b`),
+		regexp.MustCompile(`(?i)^(.*?)[\s._-]*\b(\d{1,2})x(\d{1,4})\b`),
+	}
+	seriesGroupPattern = regexp.MustCompile(`(?i)\b(series|tv shows?)\b`)
+	movieGroupPattern  = regexp.MustCompile(`(?i)\b(vod|movies?|films?)\b`)
+)
+
+// StreamMediaType guesses whether a stream is a live channel, a movie or an
+// episode of a series: from the Xtream Codes URL layout of its sources
+// (/movie/... and /series/...), then from an episode number in its title,
+// then from the naming of its group.
+func StreamMediaType(stream StreamInfo) string {
+	for _, innerMap := range stream.URLs {
+		for _, streamUrl := range innerMap {
+			lower := strings.ToLower(streamUrl)
+			switch {
+			case strings.Contains(lower, "/movie/"):
+				return MediaMovie
+			case strings.Contains(lower, "/series/"):
+				return MediaSeries
+			}
+		}
+	}
+
+	if _, _, _, ok := parseEpisode(stream.Title); ok {
+		return MediaSeries
+	}
+
+	switch {
+	case seriesGroupPattern.MatchString(stream.Group):
+		return MediaSeries
+	case movieGroupPattern.MatchString(stream.Group):
+		return MediaMovie
+	}
+	return MediaLive
+}
+
+// parseEpisode returns the show name, season and episode of an episode
+// title.
+func parseEpisode(title string) (string, int, int, bool) {
+	for _, pattern := range episodePatterns {
+		match := pattern.FindStringSubmatch(title)
+		if match == nil {
+			continue
+		}
+		season, _ := strconv.Atoi(match[2])
+		episode, _ := strconv.Atoi(match[3])
+		return strings.Trim(match[1], " -_.|:"), season, episode, true
+	}
+	return "", 0, 0, false
+}
+
+// seriesID returns the ID of the series with the given name in the API.
+func seriesID(name string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(name)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// LibraryItem is a movie or a series of the VOD library.
+type LibraryItem struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Group   string `json:"group"`
+	LogoURL string `json:"logo"`
+	// URL is the stream URL of a movie. ID is the stream ID (as in the URL)
+	// of a movie, or the ID of a series to list its episodes with.
+	URL      string `json:"url,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Seasons  int    `json:"seasons,omitempty"`
+	Episodes int    `json:"episodes,omitempty"`
+}
+
+// Episode is an episode of a series of the VOD library. Episodes whose
+// title has no episode number have season and episode 0.
+type Episode struct {
+	ID      string `json:"id"`
+	Season  int    `json:"season"`
+	Episode int    `json:"episode"`
+	Title   string `json:"title"`
+	LogoURL string `json:"logo"`
+	URL     string `json:"url"`
+}
+
+// LibraryQuery selects items of the VOD library. Empty fields match every
+// item. The type is "movie" or "series", the group is compared
+// case-insensitively and the title is searched for case-insensitively.
+type LibraryQuery struct {
+	Type   string
+	Group  string
+	Title  string
+	Offset int
+	Limit  int
+}
+
+func (q LibraryQuery) matches(item LibraryItem) bool {
+	if q.Type != "" && item.Type != q.Type {
+		return false
+	}
+	if q.Group != "" && !strings.EqualFold(item.Group, q.Group) {
+		return false
+	}
+	if q.Title != "" && !strings.Contains(strings.ToLower(item.Title), strings.ToLower(q.Title)) {
+		return false
+	}
+	return true
+}
+
+// seriesEntry is a series being gathered from the channels of the last sync.
+type seriesEntry struct {
+	item     LibraryItem
+	seasons  map[int]bool
+	episodes []Episode
+}
+
+// readLibrary gathers the movies and series of the last sync in playlist
+// order, a series being placed where its first episode is.
+func readLibrary(baseURL string) ([]LibraryItem, map[string]*seriesEntry, error) {
+	var order []LibraryItem
+	series := make(map[string]*seriesEntry)
+
+	err := forEachChannel(func(stream StreamInfo) error {
+		switch StreamMediaType(stream) {
+		case MediaMovie:
+			order = append(order, LibraryItem{
+				Type:    MediaMovie,
+				Title:   stream.Title,
+				Group:   stream.Group,
+				LogoURL: stream.LogoURL,
+				URL:     GenerateStreamURL(baseURL, stream),
+				ID:      streamID(stream),
+			})
+		case MediaSeries:
+			name, season, number, ok := parseEpisode(stream.Title)
+			if !ok || name == "" {
+				name = stream.Title
+			}
+
+			id := seriesID(name)
+			entry, ok := series[id]
+			if !ok {
+				entry = &seriesEntry{
+					item:    LibraryItem{Type: MediaSeries, Title: name, Group: stream.Group, LogoURL: stream.LogoURL, ID: id},
+					seasons: make(map[int]bool),
+				}
+				series[id] = entry
+				order = append(order, LibraryItem{Type: MediaSeries, ID: id})
+			}
+			if entry.item.LogoURL == "" {
+				entry.item.LogoURL = stream.LogoURL
+			}
+
+			entry.seasons[season] = true
+			entry.episodes = append(entry.episodes, Episode{
+				ID:      streamID(stream),
+				Season:  season,
+				Episode: number,
+				Title:   stream.Title,
+				LogoURL: stream.LogoURL,
+				URL:     GenerateStreamURL(baseURL, stream),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, item := range order {
+		if item.Type != MediaSeries {
+			continue
+		}
+		entry := series[item.ID]
+		entry.item.Seasons, entry.item.Episodes = len(entry.seasons), len(entry.episodes)
+		order[i] = entry.item
+	}
+	return order, series, nil
+}
+
+// QueryLibrary returns the movies and series of the last sync matching the
+// query, with their stream URLs under baseURL.
+func QueryLibrary(query LibraryQuery, baseURL string) ([]LibraryItem, error) {
+	order, _, err := readLibrary(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]LibraryItem, 0)
+	for _, item := range order {
+		if query.matches(item) {
+			items = append(items, item)
+		}
+	}
+
+	if query.Offset > 0 {
+		items = items[min(query.Offset, len(items)):]
+	}
+	if query.Limit > 0 && len(items) > query.Limit {
+		items = items[:query.Limit]
+	}
+	return items, nil
+}
+
+// SeriesEpisodes returns the episodes of the series with the given ID, by
+// season and episode number, with their stream URLs under baseURL.
+func SeriesEpisodes(id string, baseURL string) ([]Episode, bool, error) {
+	_, series, err := readLibrary(baseURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry, ok := series[id]
+	if !ok {
+		return nil, false, nil
+	}
+
+	episodes := entry.episodes
+	sort.SliceStable(episodes, func(i, j int) bool {
+		if episodes[i].Season != episodes[j].Season {
+			return episodes[i].Season < episodes[j].Season
+		}
+		return episodes[i].Episode < episodes[j].Episode
+	})
+	return episodes, true, nil
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const lineupFilePath = "/m3u-proxy/data/lineup.json"
+
+// LineupChannel is the identity of a channel in the DVR lineup. It is
+// assigned the first time a title is seen and persisted, so DVR software
+// caching the lineup keeps working across syncs and restarts.
+type LineupChannel struct {
+	ID     string `json:"id"`
+	Number int    `json:"number"`
+}
+
+type LineupEntry struct {
+	Channel LineupChannel
+	Stream  StreamInfo
+}
+
+var lineupStore = struct {
+	sync.Mutex
+	loaded   bool
+	channels map[string]LineupChannel
+}{channels: make(map[string]LineupChannel)}
+
+func loadLineup() {
+	debug := isDebugMode()
+
+	if lineupStore.loaded {
+		return
+	}
+	lineupStore.loaded = true
+
+	if err := readJSONFile(lineupFilePath, &lineupStore.channels); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading lineup: %v\n", err)
+		}
+	}
+	if lineupStore.channels == nil {
+		lineupStore.channels = make(map[string]LineupChannel)
+	}
+}
+
+// GetLineup returns the streams with their persisted lineup identity, sorted
+// by channel number. Streams seen for the first time get the tvg-chno and
+// tvg-id of the playlist if those are still free.
+func GetLineup(streams []StreamInfo) []LineupEntry {
+	lineupStore.Lock()
+	defer lineupStore.Unlock()
+
+	loadLineup()
+
+	usedIDs := make(map[string]bool, len(lineupStore.channels))
+	usedNumbers := make(map[int]bool, len(lineupStore.channels))
+	maxNumber := 0
+	for _, channel := range lineupStore.channels {
+		usedIDs[channel.ID] = true
+		usedNumbers[channel.Number] = true
+		maxNumber = max(maxNumber, channel.Number)
+	}
+
+	changed := false
+	entries := make([]LineupEntry, 0, len(streams))
+	for _, stream := range streams {
+		channel, ok := lineupStore.channels[stream.Title]
+		if !ok {
+			number, err := strconv.Atoi(strings.TrimSpace(stream.TvgChNo))
+			if err != nil || number <= 0 || usedNumbers[number] {
+				number = maxNumber + 1
+			}
+			maxNumber = max(maxNumber, number)
+
+			id := stream.TvgID
+			if id == "" {
+				id = stream.Title
+			}
+			if usedIDs[id] {
+				id = fmt.Sprintf("%s-%d", id, number)
+			}
+
+			channel = LineupChannel{ID: id, Number: number}
+			lineupStore.channels[stream.Title] = channel
+			usedIDs[id] = true
+			usedNumbers[number] = true
+			changed = true
+		}
+
+		entries = append(entries, LineupEntry{Channel: channel, Stream: stream})
+	}
+
+	if changed {
+		if err := writeJSONFile(lineupFilePath, lineupStore.channels); err != nil {
+			utils.SafeLogf("Error saving lineup: %v\n", err)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Channel.Number < entries[j].Channel.Number
+	})
+
+	return entries
+}
+
+// storedLineup returns the lineup of the channels of the last sync. DVR
+// software polls the lineup, so it is read from the channel database instead
+// of syncing.
+func storedLineup() []LineupEntry {
+	var streams []StreamInfo
+	err := forEachChannel(func(stream StreamInfo) error {
+		streams = append(streams, stream)
+		return nil
+	})
+	if err != nil {
+		utils.SafeLogf("Error reading channels: %v\n", err)
+	}
+
+	return GetLineup(streams)
+}
+
+// GenerateLineupM3U generates a playlist using the lineup IDs and numbers as
+// tvg-id and tvg-chno, matching the channels of GenerateXMLTV.
+func GenerateLineupM3U(baseURL string) string {
+	var content strings.Builder
+
+	content.WriteString(fmt.Sprintf("#EXTM3U url-tvg=\"%s/xmltv.xml\"\n", baseURL))
+	for _, entry := range storedLineup() {
+		if len(entry.Stream.URLs) == 0 {
+			continue
+		}
+
+		stream := entry.Stream
+		stream.TvgID = entry.Channel.ID
+		stream.TvgChNo = strconv.Itoa(entry.Channel.Number)
+		content.WriteString(formatStreamEntry(baseURL, stream, ""))
+	}
+
+	saveShortIDs()
+
+	return content.String()
+}
+
+type xmltvIcon struct {
+	Src string `xml:"src,attr"`
+}
+
+type xmltvChannel struct {
+	ID           string     `xml:"id,attr"`
+	DisplayNames []string   `xml:"display-name"`
+	Icon         *xmltvIcon `xml:"icon,omitempty"`
+}
+
+type xmltvDocument struct {
+	XMLName       xml.Name       `xml:"tv"`
+	GeneratorName string         `xml:"generator-info-name,attr"`
+	Channels      []xmltvChannel `xml:"channel"`
+}
+
+// GenerateXMLTV writes an XMLTV document listing the lineup channels.
+func GenerateXMLTV(w io.Writer) error {
+	doc := xmltvDocument{GeneratorName: "m3u-stream-merger-proxy"}
+	for _, entry := range storedLineup() {
+		if len(entry.Stream.URLs) == 0 {
+			continue
+		}
+
+		channel := xmltvChannel{
+			ID:           entry.Channel.ID,
+			DisplayNames: []string{entry.Stream.Title, strconv.Itoa(entry.Channel.Number)},
+		}
+		if entry.Stream.LogoURL != "" {
+			channel.Icon = &xmltvIcon{Src: entry.Stream.LogoURL}
+		}
+		doc.Channels = append(doc.Channels, channel)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// emptyLineup starts the test from a lineup without channels.
+func emptyLineup(t *testing.T) {
+	t.Helper()
+
+	reset := func() {
+		_ = os.Remove(lineupFilePath)
+		lineupStore.Lock()
+		lineupStore.loaded = false
+		lineupStore.channels = nil
+		lineupStore.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func lineupChannels(entries []LineupEntry) map[string]LineupChannel {
+	channels := make(map[string]LineupChannel, len(entries))
+	for _, entry := range entries {
+		channels[entry.Stream.Title] = entry.Channel
+	}
+	return channels
+}
+
+func TestGetLineup(t *testing.T) {
+	emptyLineup(t)
+
+	entries := GetLineup([]StreamInfo{
+		{Title: "News", TvgID: "news", TvgChNo: "5"},
+		{Title: "News 2", TvgID: "news", TvgChNo: "5"},
+		{Title: "Kids", TvgID: "kids"},
+		{Title: "Sports", TvgChNo: "2"},
+		{Title: "Films", TvgID: "News", TvgChNo: "-1"},
+		{Title: "Music", TvgID: "music", TvgChNo: " 3 "},
+	})
+
+	want := map[string]LineupChannel{
+		// The tvg-chno and tvg-id of the playlist if still free.
+		"News":   {ID: "news", Number: 5},
+		"Sports": {ID: "Sports", Number: 2},
+		"Music":  {ID: "music", Number: 3},
+		// Taken or invalid numbers follow the highest one, taken IDs get the
+		// number as suffix.
+		"News 2": {ID: "news-6", Number: 6},
+		"Kids":   {ID: "kids", Number: 7},
+		"Films":  {ID: "News", Number: 8},
+	}
+	got := lineupChannels(entries)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d channels, got %v", len(want), got)
+	}
+	for title, channel := range want {
+		if got[title] != channel {
+			t.Errorf("Expected %s to be %+v, got %+v", title, channel, got[title])
+		}
+	}
+
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].Channel.Number >= entries[i].Channel.Number {
+			t.Fatalf("Expected the lineup sorted by number, got %+v", entries)
+		}
+	}
+}
+
+func TestLineupPersistence(t *testing.T) {
+	emptyLineup(t)
+
+	first := lineupChannels(GetLineup([]StreamInfo{
+		{Title: "News", TvgID: "news", TvgChNo: "1"},
+		{Title: "Kids", TvgID: "kids", TvgChNo: "2"},
+	}))
+
+	// A restart reads the lineup back from its file.
+	lineupStore.Lock()
+	lineupStore.loaded = false
+	lineupStore.channels = nil
+	lineupStore.Unlock()
+
+	// The identity is kept even if the playlist changes it, and new channels
+	// don't take the numbers of channels gone from the playlist.
+	entries := GetLineup([]StreamInfo{
+		{Title: "Kids", TvgID: "kids.new", TvgChNo: "10"},
+		{Title: "Sports", TvgID: "sports", TvgChNo: "1"},
+	})
+	got := lineupChannels(entries)
+	if got["Kids"] != first["Kids"] {
+		t.Errorf("Expected Kids to keep %+v, got %+v", first["Kids"], got["Kids"])
+	}
+	if sports := got["Sports"]; sports != (LineupChannel{ID: "sports", Number: 3}) {
+		t.Errorf("Expected Sports to get the next free number, got %+v", sports)
+	}
+
+	if again := lineupChannels(GetLineup([]StreamInfo{{Title: "News"}})); again["News"] != first["News"] {
+		t.Errorf("Expected News to get its number back, got %+v", again["News"])
+	}
+}
+
+func TestStoredLineup(t *testing.T) {
+	emptyLineup(t)
+	setupSources(t, "#EXTM3U\n"+
+		"#EXTINF:-1 tvg-id=\"news\" tvg-chno=\"4\" tvg-logo=\"http://logo.invalid/news.png\" group-title=\"News\",News\nhttp://provider.invalid/live/1.ts\n")
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new version of the source, which is not synced yet.
+	source := strings.TrimPrefix(os.Getenv("M3U_URL_1"), "file://")
+	if err := os.WriteFile(source, []byte("#EXTM3U\n#EXTINF:-1 group-title=\"Kids\",Kids\nhttp://provider.invalid/live/2.ts\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	playlist := GenerateLineupM3U("http://example.com")
+	if !strings.Contains(playlist, `tvg-id="news" tvg-chno="4"`) || !strings.Contains(playlist, "http://example.com/p/") {
+		t.Errorf("Expected News with its lineup identity, got\n%s", playlist)
+	}
+	if strings.Contains(playlist, "Kids") {
+		t.Errorf("Expected the lineup not to sync the channels, got\n%s", playlist)
+	}
+
+	var xmltv bytes.Buffer
+	if err := GenerateXMLTV(&xmltv); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<channel id="news">`, "<display-name>News</display-name>", "<display-name>4</display-name>", `<icon src="http://logo.invalid/news.png">`} {
+		if !strings.Contains(xmltv.String(), want) {
+			t.Errorf("Expected %s in the XMLTV document, got\n%s", want, xmltv.String())
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// LocalPlaylistPath is the playlist managed through the API and served at
+// /local.m3u. It can also be edited by hand, it is read again on every sync.
+const LocalPlaylistPath = "/m3u-proxy/data/local.m3u"
+
+// LocalSource is the M3U index of the channels of the local playlist, an
+// implicit source tried before the M3U_URL_X sources.
+const LocalSource = "LOCAL"
+
+// LocalEntry is an entry of the local playlist.
+type LocalEntry struct {
+	Title   string `json:"title"`
+	Group   string `json:"group,omitempty"`
+	URL     string `json:"url"`
+	LogoURL string `json:"logo,omitempty"`
+	TvgID   string `json:"tvg_id,omitempty"`
+}
+
+// localPlaylistMu serializes the changes to the local playlist.
+var localPlaylistMu sync.Mutex
+
+func (e LocalEntry) format() string {
+	var entry strings.Builder
+
+	entry.WriteString("#EXTINF:-1")
+	if e.TvgID != "" {
+		entry.WriteString(" " + formatAttr("tvg-id", e.TvgID))
+	}
+	if e.LogoURL != "" {
+		entry.WriteString(" " + formatAttr("tvg-logo", e.LogoURL))
+	}
+	entry.WriteString(" " + formatAttr("tvg-name", e.Title))
+	if e.Group != "" {
+		entry.WriteString(" " + formatAttr("group-title", e.Group))
+	}
+	fmt.Fprintf(&entry, ",%s\n%s\n", e.Title, e.URL)
+
+	return entry.String()
+}
+
+// sourceFilePath returns the path of the playlist of the source.
+func sourceFilePath(m3uIndex string) string {
+	if m3uIndex == LocalSource {
+		return LocalPlaylistPath
+	}
+	return utils.GetM3UFilePathByIndex(m3uIndex)
+}
+
+// syncedIndexes returns the M3U indexes of the sources synced: the
+// M3U_URL_X sources and the local playlist if there is one.
+func syncedIndexes() []string {
+	indexes := utils.GetM3UIndexes()
+	if _, err := os.Stat(LocalPlaylistPath); err == nil {
+		indexes = append(slices.Clone(indexes), LocalSource)
+	}
+	return indexes
+}
+
+// readLocalPlaylist returns the content of the local playlist, an empty
+// playlist if there is none yet.
+func readLocalPlaylist() ([]byte, error) {
+	content, err := os.ReadFile(LocalPlaylistPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []byte("#EXTM3U\n"), nil
+	}
+	return content, err
+}
+
+// writeLocalPlaylist atomically replaces the local playlist, so syncs never
+// read a partial one.
+func writeLocalPlaylist(content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(LocalPlaylistPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(LocalPlaylistPath+".new", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(LocalPlaylistPath+".new", LocalPlaylistPath)
+}
+
+// AddLocalEntry appends the entry to the local playlist. An entry with the
+// title of an existing one becomes another stream of the channel. It is
+// added to the playlist from the next sync on.
+func AddLocalEntry(entry LocalEntry) error {
+	localPlaylistMu.Lock()
+	defer localPlaylistMu.Unlock()
+
+	content, err := readLocalPlaylist()
+	if err != nil {
+		return err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+
+	return writeLocalPlaylist(append(content, entry.format()...))
+}
+
+// RemoveLocalEntries drops the entries of the channel with the given title
+// from the local playlist, with their directives. Other lines, e.g.
+// comments, are kept as they are. It returns the number of entries removed.
+func RemoveLocalEntries(title string) (int, error) {
+	localPlaylistMu.Lock()
+	defer localPlaylistMu.Unlock()
+
+	content, err := readLocalPlaylist()
+	if err != nil {
+		return 0, err
+	}
+
+	var result bytes.Buffer
+	var block []string
+	extInf := ""
+	removed := 0
+
+	reader := bufio.NewReader(bytes.NewReader(content))
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			trimmed := strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(trimmed, "#EXTINF:"):
+				block = append(block, line)
+				extInf = trimmed
+			case len(block) > 0 && (trimmed == "" || strings.HasPrefix(trimmed, "#")):
+				block = append(block, line)
+			case isStreamDirective(trimmed):
+				block = append(block, line)
+			case extInf != "" && ContinuesExtInf(extInf, trimmed):
+				block = append(block, line)
+				extInf += " " + trimmed
+			case extInf != "":
+				// The URL line ends the entry.
+				if extInfTitle(extInf) == title {
+					removed++
+				} else {
+					result.WriteString(strings.Join(block, "") + line)
+				}
+				block, extInf = nil, ""
+			default:
+				result.WriteString(strings.Join(block, "") + line)
+				block = nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	result.WriteString(strings.Join(block, ""))
+
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeLocalPlaylist(result.Bytes())
+}
+
+// extInfTitle returns the title of the channel of an #EXTINF line, as
+// parsed by the syncs.
+func extInfTitle(line string) string {
+	extInf := ParseExtInf(line)
+	if extInf.Title != "" {
+		return utils.TvgNameParser(extInf.Title)
+	}
+	return utils.TvgNameParser(unescapeAttr(extInf.Get("tvg-name")))
+}
@@ -0,0 +1,55 @@
+package store
+
+import "sync/atomic"
+
+// streamIndex maps the slugs and titles of the channels of the current
+// generation of the channel database to their streams so stream requests
+// don't have to query the channel database.
+type streamIndex struct {
+	bySlug  map[string]*StreamInfo
+	byTitle map[string]*StreamInfo
+}
+
+var currentStreamIndex atomic.Pointer[streamIndex]
+
+// buildStreamIndex replaces the lookup index with the channels of the current
+// generation of the channel database. It is called once a generation is
+// switched to, so the index is swapped along with it.
+func buildStreamIndex() error {
+	index := &streamIndex{
+		bySlug:  make(map[string]*StreamInfo),
+		byTitle: make(map[string]*StreamInfo),
+	}
+
+	err := forEachChannel(func(stream StreamInfo) error {
+		index.bySlug[EncodeSlug(stream)] = &stream
+		index.byTitle[stream.Title] = &stream
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	currentStreamIndex.Store(index)
+	return nil
+}
+
+func lookupStreamBySlug(slug string) (*StreamInfo, bool) {
+	index := currentStreamIndex.Load()
+	if index == nil {
+		return nil, false
+	}
+
+	stream, ok := index.bySlug[slug]
+	return stream, ok
+}
+
+func lookupStreamByTitle(title string) (*StreamInfo, bool) {
+	index := currentStreamIndex.Load()
+	if index == nil {
+		return nil, false
+	}
+
+	stream, ok := index.byTitle[title]
+	return stream, ok
+}
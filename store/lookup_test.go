@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"m3u-stream-merger/utils"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupSources configures the playlists as the local M3U sources 1, 2, ...
+// and downloads them, starting from an empty channel database.
+func setupSources(t *testing.T, playlists ...string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for i, playlist := range playlists {
+		path := filepath.Join(dir, fmt.Sprintf("source%d.m3u", i+1))
+		if err := os.WriteFile(path, []byte(playlist), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(fmt.Sprintf("M3U_URL_%d", i+1), "file://"+path)
+	}
+	// Also drops the source indexes cached by the previous tests.
+	utils.LoadSourceEnv()
+	t.Cleanup(func() { utils.LoadSourceEnv() })
+
+	ClearCache()
+	t.Cleanup(ClearCache)
+
+	for i := range playlists {
+		if err := DownloadM3USource(context.Background(), fmt.Sprint(i+1)); err != nil {
+			t.Fatalf("Downloader returned error: %v", err)
+		}
+	}
+}
+
+func TestStreamIndexAfterRevalidation(t *testing.T) {
+	setupSources(t, "#EXTM3U\n"+
+		"#EXTINF:-1 tvg-id=\"news\" group-title=\"News\",News\nhttp://provider.invalid/live/1.ts\n"+
+		"#EXTINF:-1 tvg-id=\"kids\" group-title=\"Kids\",Kids\nhttp://provider.invalid/live/2.ts\n")
+
+	if index := currentStreamIndex.Load(); index != nil && len(index.byTitle) > 0 {
+		t.Fatalf("Expected an empty index before the sync, got %d channels", len(index.byTitle))
+	}
+
+	// The playlist path syncs through RegenerateM3U, not GetStreams.
+	RevalidatingGetM3U(httptest.NewRequest("GET", "/playlist.m3u", nil), true)
+
+	stream, ok := lookupStreamByTitle("News")
+	if !ok {
+		t.Fatal("Expected News in the lookup index after the sync")
+	}
+	slug := EncodeSlug(*stream)
+	if _, ok := lookupStreamBySlug(slug); !ok {
+		t.Fatal("Expected the slug of News in the lookup index")
+	}
+
+	resolved, err := GetStreamBySlug(slug)
+	if err != nil || resolved.Title != "News" || resolved.URLs["1"]["0"] != "http://provider.invalid/live/1.ts" {
+		t.Errorf("Expected the slug to resolve to News, got %+v (%v)", resolved, err)
+	}
+
+	// The index is replaced by the next sync.
+	setupSources(t, "#EXTM3U\n#EXTINF:-1 tvg-id=\"kids\" group-title=\"Kids\",Kids\nhttp://provider.invalid/live/2.ts\n")
+	if _, ok := lookupStreamByTitle("News"); ok {
+		t.Error("Expected the index to be cleared with the channels")
+	}
+	RevalidatingGetM3U(httptest.NewRequest("GET", "/playlist.m3u", nil), true)
+	if _, ok := lookupStreamByTitle("Kids"); !ok {
+		t.Error("Expected Kids in the index of the new sync")
+	}
+	if _, ok := lookupStreamBySlug(slug); ok {
+		t.Error("Expected News to be dropped from the index of the new sync")
+	}
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/utils"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const mappingFilePath = "/m3u-proxy/data/mapping.json"
+
+var mappingCsvHeader = []string{"title", "merge_into", "tvg_id", "tvg_ch", "logo", "group", "sources"}
+
+// ChannelMapping overrides the attributes of the channels parsed with its
+// title. Sources lists the sources of a channel on export only, it is
+// ignored on import.
+type ChannelMapping struct {
+	Title     string   `json:"title"`
+	MergeInto string   `json:"merge_into,omitempty"`
+	TvgID     string   `json:"tvg_id,omitempty"`
+	TvgChNo   string   `json:"tvg_ch,omitempty"`
+	LogoURL   string   `json:"logo,omitempty"`
+	Group     string   `json:"group,omitempty"`
+	Sources   []string `json:"sources,omitempty"`
+}
+
+var mappingStore = struct {
+	sync.RWMutex
+	loaded   bool
+	mappings map[string]ChannelMapping
+}{mappings: make(map[string]ChannelMapping)}
+
+func loadChannelMappings() {
+	debug := isDebugMode()
+
+	mappingStore.Lock()
+	defer mappingStore.Unlock()
+
+	if mappingStore.loaded {
+		return
+	}
+	mappingStore.loaded = true
+
+	var mappings []ChannelMapping
+	if err := readJSONFile(mappingFilePath, &mappings); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading channel mapping: %v\n", err)
+		}
+		return
+	}
+
+	for _, mapping := range mappings {
+		mappingStore.mappings[mapping.Title] = mapping
+	}
+}
+
+// applyChannelMapping overrides the parsed attributes of a stream with the
+// ones from the imported mapping. It must run before the stream gets indexed
+// as the title is used as the merge key.
+func applyChannelMapping(stream *StreamInfo) {
+	loadChannelMappings()
+
+	mappingStore.RLock()
+	mapping, ok := mappingStore.mappings[stream.Title]
+	mappingStore.RUnlock()
+	if !ok {
+		return
+	}
+
+	if mapping.MergeInto != "" {
+		stream.Title = mapping.MergeInto
+	}
+	if mapping.TvgID != "" {
+		stream.TvgID = mapping.TvgID
+	}
+	if mapping.TvgChNo != "" {
+		stream.TvgChNo = mapping.TvgChNo
+	}
+	if mapping.LogoURL != "" {
+		stream.LogoURL = mapping.LogoURL
+	}
+	if mapping.Group != "" {
+		stream.Group = mapping.Group
+	}
+}
+
+// ExportChannelMappings returns a mapping entry for every channel of the last
+// sync, followed by the imported entries merging a title into another one, as
+// the channels only have the title they were merged into. Importing the
+// export gives the same channels.
+func ExportChannelMappings() ([]ChannelMapping, error) {
+	mappings := make([]ChannelMapping, 0)
+	titles := make(map[string]bool)
+	err := forEachChannel(func(stream StreamInfo) error {
+		titles[stream.Title] = true
+
+		sources := make([]string, 0, len(stream.URLs))
+		for _, m3uIndex := range utils.GetM3UIndexes() {
+			if len(stream.URLs[m3uIndex]) > 0 {
+				sources = append(sources, m3uIndex)
+			}
+		}
+
+		mappings = append(mappings, ChannelMapping{
+			Title:   stream.Title,
+			TvgID:   stream.TvgID,
+			TvgChNo: stream.TvgChNo,
+			LogoURL: stream.LogoURL,
+			Group:   stream.Group,
+			Sources: sources,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loadChannelMappings()
+
+	mappingStore.RLock()
+	merges := make([]ChannelMapping, 0)
+	for title, mapping := range mappingStore.mappings {
+		if mapping.MergeInto != "" && !titles[title] {
+			merges = append(merges, mapping)
+		}
+	}
+	mappingStore.RUnlock()
+
+	sort.Slice(merges, func(i, j int) bool {
+		return naturalCompare(merges[i].Title, merges[j].Title) < 0
+	})
+
+	return append(mappings, merges...), nil
+}
+
+func WriteChannelMappingsCSV(w io.Writer, mappings []ChannelMapping) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(mappingCsvHeader); err != nil {
+		return err
+	}
+
+	for _, mapping := range mappings {
+		record := []string{
+			mapping.Title,
+			mapping.MergeInto,
+			mapping.TvgID,
+			mapping.TvgChNo,
+			mapping.LogoURL,
+			mapping.Group,
+			strings.Join(mapping.Sources, ";"),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func ReadChannelMappingsCSV(r io.Reader) ([]ChannelMapping, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(mappingCsvHeader)
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV: %v", err)
+	}
+
+	mappings := make([]ChannelMapping, 0, len(records))
+	for i, record := range records {
+		if i == 0 && record[0] == mappingCsvHeader[0] {
+			continue
+		}
+
+		// The sources column of the export is ignored.
+		mappings = append(mappings, ChannelMapping{
+			Title:     record[0],
+			MergeInto: record[1],
+			TvgID:     record[2],
+			TvgChNo:   record[3],
+			LogoURL:   record[4],
+			Group:     record[5],
+		})
+	}
+
+	return mappings, nil
+}
+
+// ImportChannelMappings replaces the persisted mapping. Changes take effect
+// on the next sync.
+func ImportChannelMappings(mappings []ChannelMapping) error {
+	for i, mapping := range mappings {
+		if strings.TrimSpace(mapping.Title) == "" {
+			return fmt.Errorf("mapping entry %d has no title", i)
+		}
+		mappings[i].Sources = nil
+	}
+
+	mappingStore.Lock()
+	defer mappingStore.Unlock()
+
+	if err := writeJSONFile(mappingFilePath, mappings); err != nil {
+		return err
+	}
+
+	mappingStore.mappings = make(map[string]ChannelMapping, len(mappings))
+	for _, mapping := range mappings {
+		mappingStore.mappings[mapping.Title] = mapping
+	}
+	mappingStore.loaded = true
+
+	return nil
+}
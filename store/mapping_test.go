@@ -0,0 +1,88 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+// storedChannels returns the channels of the last sync by title.
+func storedChannels(t *testing.T) map[string]StreamInfo {
+	t.Helper()
+
+	channels := make(map[string]StreamInfo)
+	err := forEachChannel(func(stream StreamInfo) error {
+		channels[stream.Title] = stream
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return channels
+}
+
+func TestChannelMappingRoundTrip(t *testing.T) {
+	setupSources(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 tvg-id=\"news\" group-title=\"News\",News\nhttp://one.invalid/live/1.ts\n"+
+			"#EXTINF:-1 tvg-id=\"news-hd\" group-title=\"News\",News Full\nhttp://one.invalid/live/2.ts\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 tvg-id=\"kids\" group-title=\"Kids\",Kids\nhttp://two.invalid/live/1.ts\n")
+	t.Cleanup(func() { _ = ImportChannelMappings([]ChannelMapping{}) })
+
+	err := ImportChannelMappings([]ChannelMapping{
+		{Title: "News Full", MergeInto: "News", TvgID: "news"},
+		{Title: "Kids", TvgID: "kids.mapped", Group: "Family", Sources: []string{"1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	channels := storedChannels(t)
+	if len(channels) != 2 || len(channels["News"].URLs["1"]) != 2 {
+		t.Fatalf("Expected News Full to be merged into News, got %v", channels)
+	}
+	if kids := channels["Kids"]; kids.TvgID != "kids.mapped" || kids.Group != "Family" || len(kids.URLs["2"]) != 1 {
+		t.Fatalf("Expected the attributes of Kids to be overridden and its sources kept, got %+v", kids)
+	}
+
+	exported, err := ExportChannelMappings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChannelMapping{
+		{Title: "Kids", TvgID: "kids.mapped", Group: "Family", Sources: []string{"2"}},
+		{Title: "News", TvgID: "news", Group: "News", Sources: []string{"1"}},
+		{Title: "News Full", MergeInto: "News", TvgID: "news"},
+	}
+	if !reflect.DeepEqual(exported, want) {
+		t.Fatalf("Expected the export\n%+v\ngot\n%+v", want, exported)
+	}
+
+	// Through the CSV format, which also carries the sources.
+	var csv bytes.Buffer
+	if err := WriteChannelMappingsCSV(&csv, exported); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ReadChannelMappingsCSV(&csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportChannelMappings(imported); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if again := storedChannels(t); !reflect.DeepEqual(again, channels) {
+		t.Errorf("Expected the same channels after importing the export, got\n%+v\nwant\n%+v", again, channels)
+	}
+	if again, _ := ExportChannelMappings(); !reflect.DeepEqual(again, exported) {
+		t.Errorf("Expected the same export after importing it, got\n%+v\nwant\n%+v", again, exported)
+	}
+}
@@ -3,22 +3,21 @@ package store
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
-	"errors"
+	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
-	"path/filepath"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"m3u-stream-merger/utils"
 
 	"github.com/edsrzf/mmap-go"
 )
 
-const streamsDirPath = "/m3u-proxy/data/streams"
-
 func ParseStreamInfoBySlug(slug string) (*StreamInfo, error) {
 	debug := os.Getenv("DEBUG") == "true"
 
@@ -27,54 +26,94 @@ func ParseStreamInfoBySlug(slug string) (*StreamInfo, error) {
 		return nil, err
 	}
 
-	initInfo.URLs = make(map[string]map[string]string)
+	// Slugs generated with different attributes (e.g. /lineup.m3u) are not in
+	// the slug index but can still be resolved by title.
+	stream, ok := lookupStreamByTitle(initInfo.Title)
+	if !ok {
+		// The channel database survives restarts, unlike the lookup index.
+		stream, ok = lookupChannel(initInfo.Title)
+	}
+	if !ok {
+		if debug {
+			utils.SafeLogf("[DEBUG] Channel not found: %s\n", initInfo.Title)
+		}
+		initInfo.URLs = make(map[string]map[string]string)
+		return initInfo, nil
+	}
 
-	indexes := utils.GetM3UIndexes()
+	initInfo.URLs = stream.URLs
+	initInfo.URLOpts = stream.URLOpts
 
-	for _, m3uIndex := range indexes {
-		safeTitle := base64.StdEncoding.EncodeToString([]byte(initInfo.Title))
+	return initInfo, nil
+}
 
-		fileName := fmt.Sprintf("%s_%s*", safeTitle, m3uIndex)
-		globPattern := filepath.Join(streamsDirPath, "*", fileName)
+// ParseStats counts the entries of a source found by its last parse, and the
+// lines that were left out: skipped lines are #EXTINF lines without URL and
+// URLs without #EXTINF, invalid lines are URLs that can't be parsed.
+type ParseStats struct {
+	Entries int `json:"entries"`
+	Skipped int `json:"skipped_lines"`
+	Invalid int `json:"invalid_lines"`
+}
 
-		fileMatches, err := filepath.Glob(globPattern)
-		if err != nil {
-			if debug {
-				utils.SafeLogf("Error finding files for pattern %s: %v", globPattern, err)
-			}
-			continue
-		}
+var parseStats = struct {
+	sync.Mutex
+	sources map[string]ParseStats
+}{sources: make(map[string]ParseStats)}
 
-		if _, exists := initInfo.URLs[m3uIndex]; !exists {
-			initInfo.URLs[m3uIndex] = make(map[string]string)
-		}
+// GetParseStats returns the stats of the last parse of the given sources.
+func GetParseStats(m3uIndexes []string) map[string]ParseStats {
+	parseStats.Lock()
+	defer parseStats.Unlock()
 
-		for _, fileMatch := range fileMatches {
-			fileNameSplit := strings.Split(filepath.Base(fileMatch), "|")
-			if len(fileNameSplit) != 2 {
-				continue
-			}
-
-			urlEncoded, err := os.ReadFile(fileMatch)
-			if err != nil {
-				continue
-			}
+	stats := make(map[string]ParseStats, len(m3uIndexes))
+	for _, m3uIndex := range m3uIndexes {
+		if sourceStats, ok := parseStats.sources[m3uIndex]; ok {
+			stats[m3uIndex] = sourceStats
+		}
+	}
+	return stats
+}
 
-			url, err := base64.StdEncoding.DecodeString(string(urlEncoded))
-			if err != nil {
-				continue
-			}
+// scanPlaylistLines is bufio.ScanLines also ending lines on a lone CR, as
+// written by some old tools.
+func scanPlaylistLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
 
-			initInfo.URLs[m3uIndex][fileNameSplit[1]] = strings.TrimSpace(string(url))
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		switch {
+		case data[i] == '\n':
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			return i + 1, data[:i], nil
 		}
+		// A CR at the end of the data may be followed by a LF.
+		return 0, nil, nil
 	}
 
-	return initInfo, nil
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
 }
 
-func M3UScanner(m3uIndex string, sessionId string, fn func(streamInfo StreamInfo)) error {
+// cleanStreamURL encodes the spaces of a URL line, which some providers
+// leave in their URLs. It returns false if the URL can't be parsed.
+func cleanStreamURL(line string) (string, bool) {
+	streamURL := strings.ReplaceAll(line, " ", "%20")
+	parsed, err := url.Parse(streamURL)
+	return streamURL, err == nil && parsed.Scheme != ""
+}
+
+// M3UScanner calls fn with every stream of the source passing the filters.
+// It stops with the error of ctx once ctx is done.
+func M3UScanner(ctx context.Context, m3uIndex string, fn func(streamInfo StreamInfo)) error {
 	utils.SafeLogf("Parsing M3U #%s...\n", m3uIndex)
-	filePath := utils.GetM3UFilePathByIndex(m3uIndex)
+	filePath := sourceFilePath(m3uIndex)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -82,39 +121,99 @@ func M3UScanner(m3uIndex string, sessionId string, fn func(streamInfo StreamInfo
 	}
 	defer file.Close()
 
-	mappedFile, err := mmap.Map(file, mmap.RDONLY, 0)
+	artifact, size, err := openArtifact(file)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = mappedFile.Unmap()
-	}()
 
-	scanner := bufio.NewScanner(bytes.NewReader(mappedFile))
+	var content io.Reader
+	if _, ok := artifact.(*os.File); ok {
+		mappedFile, err := mmap.Map(file, mmap.RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = mappedFile.Unmap()
+		}()
+		content = bytes.NewReader(mappedFile)
+	} else {
+		// Encrypted playlists are decrypted while they are scanned.
+		content = io.NewSectionReader(artifact, 0, size)
+	}
+
+	scanner := bufio.NewScanner(content)
+	// Some providers have very long #EXTINF lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(scanPlaylistLines)
+	var stats ParseStats
 	var currentLine string
+	var directives []string
+	// Number of entries per title, giving each entry of a title its own
+	// sub index.
+	subIndexes := make(map[string]int)
 
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Playlists merged from several files may have a BOM on any line.
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
 		if strings.HasPrefix(line, "#EXTINF:") {
+			if currentLine != "" {
+				stats.Skipped++
+			}
 			currentLine = line
-		} else if currentLine != "" && !strings.HasPrefix(line, "#") {
-			streamInfo := parseLine(sessionId, currentLine, line, m3uIndex)
+		} else if isStreamDirective(line) {
+			// Directives may come before or after the #EXTINF line
+			directives = append(directives, line)
+		} else if line == "" || strings.HasPrefix(line, "#") {
+			// Other tags, e.g. #EXT-X-SESSION-DATA, may come between the
+			// #EXTINF line and its URL.
+			continue
+		} else if currentLine == "" {
+			stats.Skipped++
+		} else if ContinuesExtInf(currentLine, line) {
+			currentLine += " " + line
+		} else {
+			streamURL, ok := cleanStreamURL(line)
+			if !ok {
+				stats.Invalid++
+				currentLine = ""
+				directives = nil
+				continue
+			}
+
+			streamInfo := parseLine(currentLine, directives, streamURL, m3uIndex, subIndexes)
 			currentLine = ""
+			directives = nil
+			stats.Entries++
 
 			if checkFilter(streamInfo) {
+				streamInfo.Group = remapGroup(streamInfo.Group)
 				fn(streamInfo)
 			}
 		}
 	}
+	if currentLine != "" {
+		stats.Skipped++
+	}
 
 	if err := scanner.Err(); err != nil {
 		return fmt.Errorf("error reading M3U file: %w", err)
 	}
 
+	parseStats.Lock()
+	parseStats.sources[m3uIndex] = stats
+	parseStats.Unlock()
+	if stats.Skipped > 0 || stats.Invalid > 0 {
+		utils.SafeLogf("M3U #%s: %d entries, %d lines skipped, %d invalid URLs\n", m3uIndex, stats.Entries, stats.Skipped, stats.Invalid)
+	}
+
 	return nil
 }
 
-func parseLine(sessionId string, line string, nextLine string, m3uIndex string) StreamInfo {
+func parseLine(line string, directives []string, nextLine string, m3uIndex string, subIndexes map[string]int) StreamInfo {
 	debug := os.Getenv("DEBUG") == "true"
 	if debug {
 		utils.SafeLogf("[DEBUG] Parsing line: %s\n", line)
@@ -126,17 +225,15 @@ func parseLine(sessionId string, line string, nextLine string, m3uIndex string)
 
 	currentStream := StreamInfo{}
 
-	lineWithoutPairs := line
+	extInf := ParseExtInf(line)
+	entryTitle := ""
 
-	// Define a regular expression to capture key-value pairs
-	regex := regexp.MustCompile(`([a-zA-Z0-9_-]+)="([^"]+)"`)
-
-	// Find all key-value pairs in the line
-	matches := regex.FindAllStringSubmatch(line, -1)
-
-	for _, match := range matches {
-		key := strings.TrimSpace(match[1])
-		value := strings.TrimSpace(match[2])
+	for _, attr := range extInf.Attributes {
+		key := attr.Key
+		value := attr.Value
+		if value == "" {
+			continue
+		}
 
 		if debug {
 			utils.SafeLogf("[DEBUG] Processing attribute: %s=%s\n", key, value)
@@ -148,59 +245,66 @@ func parseLine(sessionId string, line string, nextLine string, m3uIndex string)
 		case "tvg-chno":
 			currentStream.TvgChNo = utils.TvgChNoParser(value)
 		case "tvg-name":
-			currentStream.Title = utils.TvgNameParser(value)
+			entryTitle = unescapeAttr(value)
+			currentStream.Title = utils.TvgNameParser(entryTitle)
 		case "group-title":
-			currentStream.Group = utils.GroupTitleParser(value)
+			currentStream.Group = utils.GroupTitleParser(unescapeAttr(value))
 		case "tvg-logo":
 			currentStream.LogoURL = utils.TvgLogoParser(value)
 		default:
 			if debug {
-				utils.SafeLogf("[DEBUG] Uncaught attribute: %s=%s\n", key, value)
+				utils.SafeLogf("[DEBUG] Passing through attribute: %s=%s\n", key, value)
+			}
+			if currentStream.Attributes == nil {
+				currentStream.Attributes = make(map[string]string)
 			}
+			currentStream.Attributes[key] = value
 		}
-
-		lineWithoutPairs = strings.Replace(lineWithoutPairs, match[0], "", 1)
 	}
 
-	lineCommaSplit := strings.SplitN(lineWithoutPairs, ",", 2)
-
-	if len(lineCommaSplit) > 1 {
+	// The title after the comma takes precedence, tvg-name is the fallback.
+	if extInf.Title != "" {
 		if debug {
-			utils.SafeLogf("[DEBUG] Line comma split detected, title: %s\n", strings.TrimSpace(lineCommaSplit[1]))
+			utils.SafeLogf("[DEBUG] Line comma split detected, title: %s\n", extInf.Title)
 		}
-		currentStream.Title = utils.TvgNameParser(strings.TrimSpace(lineCommaSplit[1]))
+		entryTitle = extInf.Title
+		currentStream.Title = utils.TvgNameParser(extInf.Title)
 	}
 
-	encodedUrl := base64.StdEncoding.EncodeToString([]byte(cleanUrl))
+	// The quality variants of a channel, e.g. "News HD" and "News SD", are
+	// merged into one channel, the variant of each entry is kept in its
+	// entry title.
+	if qualityVariantsEnabled() {
+		currentStream.Title, _ = splitQualityVariant(currentStream.Title)
+	}
 
-	sessionDirPath := filepath.Join(streamsDirPath, sessionId)
+	applyDirectives(&currentStream, directives)
 
-	err := os.MkdirAll(sessionDirPath, os.ModePerm)
-	if err != nil {
-		utils.SafeLogf("[DEBUG] Error creating stream cache folder: %s -> %v\n", sessionDirPath, err)
-	}
+	applyChannelMapping(&currentStream)
 
-	for i := 0; true; i++ {
-		fileName := fmt.Sprintf("%s_%s|%d", base64.StdEncoding.EncodeToString([]byte(currentStream.Title)), m3uIndex, i)
-		filePath := filepath.Join(sessionDirPath, fileName)
+	resolveSlugCollision(m3uIndex, &currentStream)
 
-		if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
-			err = os.WriteFile(filePath, []byte(encodedUrl), 0644)
-			if err != nil {
-				utils.SafeLogf("[DEBUG] Error indexing stream: %s (#%s) -> %v\n", currentStream.Title, m3uIndex, err)
-			}
+	entryOpts := slices.Clone(currentStream.VLCOpts)
+	for _, key := range catchupAttributes {
+		if value, ok := currentStream.Attributes[key]; ok {
+			entryOpts = append(entryOpts, key+"="+value)
+		}
+	}
 
-			// Initialize maps if not already initialized
-			if currentStream.URLs == nil {
-				currentStream.URLs = make(map[string]map[string]string)
-			}
-			if currentStream.URLs[m3uIndex] == nil {
-				currentStream.URLs[m3uIndex] = make(map[string]string)
-			}
+	subIndex := strconv.Itoa(subIndexes[currentStream.Title])
+	subIndexes[currentStream.Title]++
 
-			// Add the URL to the map
-			currentStream.URLs[m3uIndex][strconv.Itoa(i)] = cleanUrl
-			break
+	currentStream.URLs = map[string]map[string]string{
+		m3uIndex: {subIndex: cleanUrl},
+	}
+	if len(entryOpts) > 0 {
+		currentStream.URLOpts = map[string][]string{
+			m3uIndex + "|" + subIndex: entryOpts,
+		}
+	}
+	if entryTitle != "" && entryTitle != currentStream.Title {
+		currentStream.EntryTitles = map[string]string{
+			m3uIndex + "|" + subIndex: entryTitle,
 		}
 	}
 
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/goccy/go-json"
+)
+
+// writeJSONFile atomically replaces the file at path with the JSON encoding
+// of v.
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".new", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".new", path)
+}
+
+// readJSONFile decodes the JSON file at path into v.
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"slices"
+	"sync"
+)
+
+const pinsFilePath = "/m3u-proxy/data/pins.json"
+
+type ChannelPin struct {
+	PinnedSource    string   `json:"pinned_source,omitempty"`
+	PreferredSource string   `json:"preferred_source,omitempty"`
+	ExcludedSources []string `json:"excluded_sources,omitempty"`
+}
+
+var pinStore = struct {
+	sync.RWMutex
+	loaded bool
+	pins   map[string]ChannelPin
+}{pins: make(map[string]ChannelPin)}
+
+func loadChannelPins() {
+	debug := isDebugMode()
+
+	pinStore.Lock()
+	defer pinStore.Unlock()
+
+	if pinStore.loaded {
+		return
+	}
+	pinStore.loaded = true
+
+	if err := readJSONFile(pinsFilePath, &pinStore.pins); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading channel pins: %v\n", err)
+		}
+	}
+	if pinStore.pins == nil {
+		pinStore.pins = make(map[string]ChannelPin)
+	}
+}
+
+func updateChannelPin(title string, fn func(pin *ChannelPin)) error {
+	loadChannelPins()
+
+	pinStore.Lock()
+	defer pinStore.Unlock()
+
+	pin := pinStore.pins[title]
+	fn(&pin)
+
+	if pin.PinnedSource == "" && pin.PreferredSource == "" && len(pin.ExcludedSources) == 0 {
+		delete(pinStore.pins, title)
+	} else {
+		pinStore.pins[title] = pin
+	}
+
+	return writeJSONFile(pinsFilePath, pinStore.pins)
+}
+
+func GetChannelPin(title string) ChannelPin {
+	loadChannelPins()
+
+	pinStore.RLock()
+	defer pinStore.RUnlock()
+
+	return pinStore.pins[title]
+}
+
+// PinChannelSource forces the channel to only be streamed from m3uIndex. An
+// empty index removes the pin.
+func PinChannelSource(title string, m3uIndex string) error {
+	return updateChannelPin(title, func(pin *ChannelPin) {
+		pin.PinnedSource = m3uIndex
+	})
+}
+
+// PreferChannelSource makes the load balancer try m3uIndex first for the
+// channel, falling back to the other sources if it fails. An empty index
+// removes the preference.
+func PreferChannelSource(title string, m3uIndex string) error {
+	return updateChannelPin(title, func(pin *ChannelPin) {
+		pin.PreferredSource = m3uIndex
+	})
+}
+
+func ExcludeChannelSource(title string, m3uIndex string, exclude bool) error {
+	return updateChannelPin(title, func(pin *ChannelPin) {
+		// The pins handed out by GetChannelPin share the slice and are read
+		// without the lock, so it is never changed in place.
+		pin.ExcludedSources = slices.DeleteFunc(slices.Clone(pin.ExcludedSources), func(idx string) bool {
+			return idx == m3uIndex
+		})
+		if exclude {
+			pin.ExcludedSources = append(pin.ExcludedSources, m3uIndex)
+		}
+	})
+}
+
+// IsSourceAllowed reports whether the load balancer may use m3uIndex for the
+// given channel based on its pins and exclusions.
+func (pin ChannelPin) IsSourceAllowed(m3uIndex string) bool {
+	if pin.PinnedSource != "" && pin.PinnedSource != m3uIndex {
+		return false
+	}
+
+	return !slices.Contains(pin.ExcludedSources, m3uIndex)
+}
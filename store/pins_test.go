@@ -0,0 +1,42 @@
+package store
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExcludeChannelSource(t *testing.T) {
+	const title = "TestExcludeChannelSource"
+	reset := func() {
+		for _, m3uIndex := range []string{"1", "2", "3", "4"} {
+			_ = ExcludeChannelSource(title, m3uIndex, false)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+
+	for _, m3uIndex := range []string{"1", "2", "3"} {
+		if err := ExcludeChannelSource(title, m3uIndex, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pin := GetChannelPin(title)
+	if pin.IsSourceAllowed("2") || !pin.IsSourceAllowed("4") {
+		t.Fatalf("Expected source 2 to be excluded, got %+v", pin)
+	}
+
+	// The pin handed out before is left untouched by the changes.
+	if err := ExcludeChannelSource(title, "1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExcludeChannelSource(title, "4", true); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pin.ExcludedSources, []string{"1", "2", "3"}) {
+		t.Errorf("Expected the previous pin to keep its exclusions, got %v", pin.ExcludedSources)
+	}
+	if got := GetChannelPin(title).ExcludedSources; !slices.Equal(got, []string{"2", "3", "4"}) {
+		t.Errorf("Expected the exclusions to be updated, got %v", got)
+	}
+}
@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"m3u-stream-merger/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cacheIndexFilePath = cacheFilePath + ".index"
+
+// PlaylistStorage stores the generated playlist and its group index. The
+// backend is selected with PLAYLIST_STORAGE.
+type PlaylistStorage interface {
+	// Save replaces the stored playlist with the content written by write.
+	// The playlist is streamed so it never has to be held in memory.
+	Save(write func(w io.Writer) (*PlaylistIndex, error)) error
+	// Open returns the stored playlist, or an error wrapping os.ErrNotExist
+	// if none has been generated yet.
+	Open() (*CachedPlaylist, error)
+	Clear() error
+}
+
+var (
+	playlistStorageMu       sync.Mutex
+	playlistStorage         PlaylistStorage
+	playlistStorageBackends = map[string]func() PlaylistStorage{
+		"file": func() PlaylistStorage {
+			return &filePlaylistStorage{path: cacheFilePath, indexPath: cacheIndexFilePath}
+		},
+		"memory": func() PlaylistStorage { return &memoryPlaylistStorage{} },
+	}
+)
+
+// RegisterPlaylistStorage makes a storage backend selectable with
+// PLAYLIST_STORAGE=name. It has to be called before the first playlist is
+// generated.
+func RegisterPlaylistStorage(name string, factory func() PlaylistStorage) {
+	playlistStorageMu.Lock()
+	defer playlistStorageMu.Unlock()
+
+	playlistStorageBackends[name] = factory
+}
+
+func getPlaylistStorage() PlaylistStorage {
+	playlistStorageMu.Lock()
+	defer playlistStorageMu.Unlock()
+
+	if playlistStorage != nil {
+		return playlistStorage
+	}
+
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("PLAYLIST_STORAGE")))
+	factory, ok := playlistStorageBackends[name]
+	if !ok {
+		if name != "" {
+			utils.SafeLogf("Unknown PLAYLIST_STORAGE %q, using file storage.\n", name)
+		}
+		factory = playlistStorageBackends["file"]
+	}
+
+	playlistStorage = factory()
+	return playlistStorage
+}
+
+// filePlaylistStorage keeps the playlist on disk, allowing it to be served
+// with sendfile and to survive restarts.
+type filePlaylistStorage struct {
+	// mu keeps the playlist and its index consistent with each other while
+	// they are replaced or opened.
+	mu        sync.RWMutex
+	path      string
+	indexPath string
+}
+
+func (s *filePlaylistStorage) Save(write func(w io.Writer) (*PlaylistIndex, error)) error {
+	err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(s.path + ".new")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out, err := newArtifactWriter(file)
+	if err != nil {
+		_ = os.Remove(s.path + ".new")
+		return err
+	}
+
+	buffered := bufio.NewWriterSize(out, 64*1024)
+	index, err := write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		_ = os.Remove(s.path + ".new")
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeJSONFile(s.indexPath, index); err != nil {
+		return err
+	}
+
+	_ = os.Remove(s.path)
+
+	return os.Rename(s.path+".new", s.path)
+}
+
+func (s *filePlaylistStorage) Open() (*CachedPlaylist, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	content, size, err := openArtifact(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	playlist := &CachedPlaylist{
+		Content: content,
+		ModTime: info.ModTime(),
+		Size:    size,
+		Closer:  file,
+	}
+
+	var index PlaylistIndex
+	if err := readJSONFile(s.indexPath, &index); err == nil && index.Size == size {
+		playlist.Index = &index
+	}
+
+	return playlist, nil
+}
+
+func (s *filePlaylistStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = os.Remove(s.indexPath)
+	return os.Remove(s.path)
+}
+
+// memoryPlaylistStorage keeps the playlist in memory, for small playlists or
+// read-only filesystems. The playlist is regenerated after a restart.
+type memoryPlaylistStorage struct {
+	mu      sync.RWMutex
+	content []byte
+	index   *PlaylistIndex
+	modTime time.Time
+}
+
+func (s *memoryPlaylistStorage) Save(write func(w io.Writer) (*PlaylistIndex, error)) error {
+	var content bytes.Buffer
+	index, err := write(&content)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = content.Bytes()
+	s.index = index
+	s.modTime = time.Now()
+	return nil
+}
+
+func (s *memoryPlaylistStorage) Open() (*CachedPlaylist, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.content == nil {
+		return nil, fmt.Errorf("playlist not generated yet: %w", os.ErrNotExist)
+	}
+
+	return &CachedPlaylist{
+		Content: bytes.NewReader(s.content),
+		ModTime: s.modTime,
+		Size:    int64(len(s.content)),
+		Index:   s.index,
+	}, nil
+}
+
+func (s *memoryPlaylistStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.content = nil
+	s.index = nil
+	return nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"m3u-stream-merger/utils"
+)
+
+// probeHeadBytes is how much of a remote source is read by ProbeM3USource.
+const probeHeadBytes = 16 * 1024
+
+// ProbeM3USource checks that the source of m3uIndex is reachable and looks
+// like an M3U playlist without downloading it entirely.
+func ProbeM3USource(m3uIndex string) error {
+	m3uURL := os.Getenv(fmt.Sprintf("M3U_URL_%s", m3uIndex))
+
+	switch {
+	case strings.HasPrefix(m3uURL, "file://"):
+		file, err := os.Open(strings.TrimPrefix(m3uURL, "file://"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return checkM3UHead(file)
+	case IsLocalDirSource(m3uURL):
+		entries, err := os.ReadDir(LocalDirPath(m3uURL))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && IsPlaylistFile(entry.Name()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no .m3u/.m3u8 files found in %s", LocalDirPath(m3uURL))
+	}
+
+	resp, err := utils.SourceHttpRequest(m3uIndex, "GET", m3uURL, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return checkM3UHead(io.LimitReader(body, probeHeadBytes))
+}
+
+func checkM3UHead(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXTM3U") || strings.HasPrefix(line, "#EXTINF") {
+			return nil
+		}
+		return fmt.Errorf("content does not look like an M3U playlist (starts with %q)", truncate(line, 40))
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return err
+	}
+
+	return fmt.Errorf("playlist is empty")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const qualityFilePath = "/m3u-proxy/data/quality.json"
+
+// SourceQuality is the picture quality of a source entry of a channel,
+// measured by sampling its stream.
+type SourceQuality struct {
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	BitrateKbps int       `json:"bitrate_kbps,omitempty"`
+	ProbedAt    time.Time `json:"probed_at"`
+}
+
+var qualityStore = struct {
+	sync.RWMutex
+	loaded bool
+	// The qualities by channel title and "index|subIndex".
+	channels map[string]map[string]SourceQuality
+}{channels: make(map[string]map[string]SourceQuality)}
+
+func loadQualities() {
+	debug := isDebugMode()
+
+	qualityStore.Lock()
+	defer qualityStore.Unlock()
+
+	if qualityStore.loaded {
+		return
+	}
+	qualityStore.loaded = true
+
+	if err := readJSONFile(qualityFilePath, &qualityStore.channels); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading source qualities: %v\n", err)
+		}
+	}
+	if qualityStore.channels == nil {
+		qualityStore.channels = make(map[string]map[string]SourceQuality)
+	}
+}
+
+// RecordSourceQuality persists the quality measured for a source entry of the
+// channel.
+func RecordSourceQuality(title string, m3uIndex string, subIndex string, quality SourceQuality) error {
+	loadQualities()
+
+	qualityStore.Lock()
+	defer qualityStore.Unlock()
+
+	if qualityStore.channels[title] == nil {
+		qualityStore.channels[title] = make(map[string]SourceQuality)
+	}
+	qualityStore.channels[title][m3uIndex+"|"+subIndex] = quality
+
+	return writeJSONFile(qualityFilePath, qualityStore.channels)
+}
+
+// GetChannelQuality returns the qualities measured for the source entries of
+// the channel by "index|subIndex".
+func GetChannelQuality(title string) map[string]SourceQuality {
+	loadQualities()
+
+	qualityStore.RLock()
+	defer qualityStore.RUnlock()
+
+	qualities := make(map[string]SourceQuality, len(qualityStore.channels[title]))
+	for key, quality := range qualityStore.channels[title] {
+		qualities[key] = quality
+	}
+	return qualities
+}
+
+// QualityPolicy returns how sources with a measured quality are ranked
+// (QUALITY_POLICY): "resolution" (default) ranks by picture height, then
+// bitrate, "bitrate" by bitrate only and "off" keeps the qualities for
+// reference without changing the order of the sources.
+func QualityPolicy() string {
+	switch policy := strings.ToLower(strings.TrimSpace(os.Getenv("QUALITY_POLICY"))); policy {
+	case "bitrate", "off":
+		return policy
+	default:
+		return "resolution"
+	}
+}
+
+// Better reports whether q is of a higher quality than other under the
+// policy.
+func (q SourceQuality) Better(other SourceQuality, policy string) bool {
+	if policy == "resolution" && q.Height != other.Height {
+		return q.Height > other.Height
+	}
+	return q.BitrateKbps > other.BitrateKbps
+}
+
+// ForgetChannelQuality drops the qualities recorded for the channel.
+func ForgetChannelQuality(title string) error {
+	loadQualities()
+
+	qualityStore.Lock()
+	defer qualityStore.Unlock()
+
+	if _, ok := qualityStore.channels[title]; !ok {
+		return nil
+	}
+	delete(qualityStore.channels, title)
+
+	return writeJSONFile(qualityFilePath, qualityStore.channels)
+}
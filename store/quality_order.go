@@ -0,0 +1,84 @@
+package store
+
+import (
+	"m3u-stream-merger/utils"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// qualityOrder holds the compiled QUALITY_ORDER patterns, compiled again if
+// the variable changes.
+var qualityOrder = struct {
+	sync.Mutex
+	value    string
+	patterns []*regexp.Regexp
+}{}
+
+func qualityPatterns() []*regexp.Regexp {
+	value := os.Getenv("QUALITY_ORDER")
+
+	qualityOrder.Lock()
+	defer qualityOrder.Unlock()
+
+	if value == qualityOrder.value {
+		return qualityOrder.patterns
+	}
+
+	qualityOrder.value = value
+	qualityOrder.patterns = nil
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			utils.SafeLogf("Error compiling QUALITY_ORDER regex: %v\n", err)
+			continue
+		}
+		qualityOrder.patterns = append(qualityOrder.patterns, re)
+	}
+
+	return qualityOrder.patterns
+}
+
+// SubIndexOrder returns the entries of a source of the stream in the order
+// they should be tried: by the first QUALITY_ORDER pattern matching their
+// title or URL, e.g. HD before SD variants of the channel, then in playlist
+// order.
+func SubIndexOrder(stream StreamInfo, m3uIndex string) []string {
+	innerMap := stream.URLs[m3uIndex]
+	subIndexes := make([]string, 0, len(innerMap))
+	for subIndex := range innerMap {
+		subIndexes = append(subIndexes, subIndex)
+	}
+
+	patterns := qualityPatterns()
+	ranks := make(map[string]int, len(subIndexes))
+	for _, subIndex := range subIndexes {
+		title := stream.Title
+		if entryTitle, ok := stream.EntryTitles[m3uIndex+"|"+subIndex]; ok {
+			title = entryTitle
+		}
+
+		ranks[subIndex] = len(patterns)
+		for rank, pattern := range patterns {
+			if pattern.MatchString(title) || pattern.MatchString(innerMap[subIndex]) {
+				ranks[subIndex] = rank
+				break
+			}
+		}
+	}
+
+	sort.Slice(subIndexes, func(i, j int) bool {
+		if ranks[subIndexes[i]] != ranks[subIndexes[j]] {
+			return ranks[subIndexes[i]] < ranks[subIndexes[j]]
+		}
+		return naturalCompare(subIndexes[i], subIndexes[j]) < 0
+	})
+
+	return subIndexes
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"m3u-stream-merger/utils"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The quality variants of a channel, best first.
+var qualityVariants = []string{"4k", "fhd", "hd", "sd"}
+
+// qualityTagPattern matches the quality tag of a title, e.g. "HD" in
+// "News HD" or "(FHD)" in "US: Sports (FHD)".
+var qualityTagPattern = regexp.MustCompile(`(?i)(^|[\s\-|:(\[])(SD|HD|FHD|UHD|4K|720p|1080p|2160p)([\s\-|:)\]]|$)`)
+
+// qualityVariantsEnabled reports whether QUALITY_VARIANTS merges the quality
+// variants of a channel.
+func qualityVariantsEnabled() bool {
+	return strings.TrimSpace(os.Getenv("QUALITY_VARIANTS")) == "true"
+}
+
+// splitQualityVariant returns the title without its quality tag and the
+// variant of the tag, e.g. "News" and "hd" for "News HD". The variant is
+// empty if the title has no tag.
+func splitQualityVariant(title string) (string, string) {
+	matches := qualityTagPattern.FindAllStringSubmatchIndex(title, -1)
+	if len(matches) == 0 {
+		return title, ""
+	}
+	match := matches[len(matches)-1]
+
+	var variant string
+	switch strings.ToLower(title[match[4]:match[5]]) {
+	case "sd":
+		variant = "sd"
+	case "hd", "720p":
+		variant = "hd"
+	case "fhd", "1080p":
+		variant = "fhd"
+	default:
+		variant = "4k"
+	}
+
+	base := title[:match[4]] + title[match[5]:]
+	base = strings.Join(strings.Fields(strings.NewReplacer("()", "", "[]", "").Replace(base)), " ")
+	base = strings.Trim(base, " -|:")
+	if base == "" {
+		return title, ""
+	}
+	return base, variant
+}
+
+// entryVariant returns the quality variant of a source entry of the stream,
+// empty if it has none or QUALITY_VARIANTS is disabled.
+func entryVariant(stream StreamInfo, m3uIndex, subIndex string) string {
+	if !qualityVariantsEnabled() {
+		return ""
+	}
+
+	title, ok := stream.EntryTitles[m3uIndex+"|"+subIndex]
+	if !ok {
+		title = stream.Title
+	}
+	_, variant := splitQualityVariant(title)
+	return variant
+}
+
+// StreamVariants returns the quality variants of the stream, best first.
+func StreamVariants(stream StreamInfo) []string {
+	var variants []string
+	for m3uIndex, innerMap := range stream.URLs {
+		for subIndex := range innerMap {
+			if variant := entryVariant(stream, m3uIndex, subIndex); variant != "" && !slices.Contains(variants, variant) {
+				variants = append(variants, variant)
+			}
+		}
+	}
+
+	slices.SortFunc(variants, func(a, b string) int {
+		return slices.Index(qualityVariants, a) - slices.Index(qualityVariants, b)
+	})
+	return variants
+}
+
+// VariantURLs returns the source entries of the stream of the quality
+// variant, e.g. for ?quality=hd.
+func VariantURLs(stream StreamInfo, variant string) map[string]map[string]string {
+	variant = strings.ToLower(strings.TrimSpace(variant))
+
+	urls := make(map[string]map[string]string)
+	for m3uIndex, innerMap := range stream.URLs {
+		for subIndex, streamURL := range innerMap {
+			if entryVariant(stream, m3uIndex, subIndex) != variant {
+				continue
+			}
+			if urls[m3uIndex] == nil {
+				urls[m3uIndex] = make(map[string]string)
+			}
+			urls[m3uIndex][subIndex] = streamURL
+		}
+	}
+	return urls
+}
+
+// GenerateVariantsM3U generates a playlist listing each quality variant of
+// the channels as its own entry, e.g. "News HD" and "News SD", streamed with
+// ?quality=. Channels without variants, or with entries without a quality
+// tag, are also listed as merged entries. It can be limited to some groups.
+func GenerateVariantsM3U(baseURL string, groups []string) string {
+	var content strings.Builder
+
+	content.WriteString("#EXTM3U\n")
+	err := forEachChannel(func(stream StreamInfo) error {
+		if len(groups) > 0 && !slices.Contains(groups, stream.Group) {
+			return nil
+		}
+		if len(stream.URLs) == 0 || !hasEnabledSource(stream) {
+			return nil
+		}
+
+		variants := StreamVariants(stream)
+		if len(variants) == 0 || len(VariantURLs(stream, "")) > 0 {
+			content.WriteString(formatStreamEntry(baseURL, stream, ""))
+		}
+
+		for _, variant := range variants {
+			// The file extension and the direct URL of the entry are taken
+			// from the entries of the variant.
+			variantStream := stream
+			variantStream.URLs = VariantURLs(stream, variant)
+			title := stream.Title + " " + strings.ToUpper(variant)
+			content.WriteString(formatTitledStreamEntry(baseURL, variantStream, title, url.Values{"quality": {variant}}.Encode()))
+		}
+		return nil
+	})
+	if err != nil {
+		utils.SafeLogf("Error reading channels: %v\n", err)
+	}
+
+	saveShortIDs()
+
+	return content.String()
+}
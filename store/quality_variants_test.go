@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitQualityVariant(t *testing.T) {
+	tests := []struct {
+		title   string
+		base    string
+		variant string
+	}{
+		{"News HD", "News", "hd"},
+		{"News (FHD)", "News", "fhd"},
+		{"US: Sports [4K]", "US: Sports", "4k"},
+		{"Movies - 1080p", "Movies", "fhd"},
+		{"Movies 720p", "Movies", "hd"},
+		{"Kids UHD", "Kids", "4k"},
+		{"HD News SD", "HD News", "sd"},
+		{"News", "News", ""},
+		{"HDTV", "HDTV", ""},
+		{"HD", "HD", ""},
+	}
+
+	for _, tt := range tests {
+		base, variant := splitQualityVariant(tt.title)
+		if base != tt.base || variant != tt.variant {
+			t.Errorf("splitQualityVariant(%q) = %q, %q, want %q, %q", tt.title, base, variant, tt.base, tt.variant)
+		}
+	}
+}
+
+func TestGenerateVariantsM3U(t *testing.T) {
+	t.Setenv("QUALITY_VARIANTS", "true")
+	setupSources(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",News SD\nhttp://one.invalid/live/1.ts\n"+
+			"#EXTINF:-1 group-title=\"News\",News (HD)\nhttp://one.invalid/live/2.ts\n"+
+			"#EXTINF:-1 group-title=\"Kids\",Kids\nhttp://one.invalid/live/3.ts\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",News\nhttp://two.invalid/live/1.ts\n")
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	channels := storedChannels(t)
+	if len(channels) != 2 {
+		t.Fatalf("Expected the variants to be merged into News, got %v", channels)
+	}
+	news := channels["News"]
+	if variants := StreamVariants(news); !slices.Equal(variants, []string{"hd", "sd"}) {
+		t.Errorf("Expected the hd and sd variants, got %v", variants)
+	}
+	if found, err := QueryChannels(ChannelQuery{Title: "News"}); err != nil || len(found) != 1 || !slices.Equal(found[0].Variants, []string{"hd", "sd"}) {
+		t.Errorf("Expected the variants in the channel query, got %+v (%v)", found, err)
+	}
+	if urls := VariantURLs(news, "HD"); len(urls) != 1 || urls["1"]["1"] != "http://one.invalid/live/2.ts" {
+		t.Errorf("Expected the entry of the HD variant, got %v", urls)
+	}
+
+	entries := playlistEntries(GenerateVariantsM3U("http://example.com", nil))
+	if !strings.HasSuffix(entries["News HD"], "?quality=hd") || !strings.HasSuffix(entries["News SD"], "?quality=sd") {
+		t.Errorf("Expected an entry per variant, got %v", entries)
+	}
+	// News is also listed as merged for the entry without a quality tag, and
+	// Kids as it has no variants.
+	if len(entries) != 4 || entries["News"] == "" || entries["Kids"] == "" || strings.Contains(entries["Kids"], "quality=") {
+		t.Errorf("Expected the merged entries of News and Kids, got %v", entries)
+	}
+
+	if entries := playlistEntries(GenerateVariantsM3U("http://example.com", []string{"Kids"})); len(entries) != 1 || entries["Kids"] == "" {
+		t.Errorf("Expected only Kids, got %v", entries)
+	}
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/utils"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisConn is a minimal client of the Redis protocol (RESP), enough to read
+// the data of the versions backed by Redis without a client library.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRedis(addr string, password string, db int) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and returns its reply: a string, an int64, a []any or
+// nil. Error replies are returned as errors.
+func (c *redisConn) do(args ...string) (any, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply: %q", line)
+}
+
+// scan returns the keys matching pattern.
+func (c *redisConn) scan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply: %v", reply)
+		}
+		cursor, _ = page[0].(string)
+		batch, _ := page[1].([]any)
+		for _, key := range batch {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// hgetall returns the fields of the hash at key.
+func (c *redisConn) hgetall(key string) (map[string]string, error) {
+	reply, err := c.do("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		field, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+func (c *redisConn) get(key string) (string, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	value, _ := reply.(string)
+	return value, nil
+}
+
+// redisSourceIndex returns the M3U_URL_X index of a source index of the
+// Redis-backed versions, which numbered the sources from 0.
+func redisSourceIndex(index string) string {
+	if i, err := strconv.Atoi(index); err == nil {
+		return strconv.Itoa(i + 1)
+	}
+	return index
+}
+
+// readRedisStreams reads the channels stored by the Redis-backed versions:
+// a stream:<slug> hash with the attributes of each channel and its URLs as
+// stream:<slug>:url:<source> keys (or a stream:<slug>:urls hash by source in
+// older versions).
+func readRedisStreams(c *redisConn) (map[string]StreamInfo, error) {
+	keys, err := c.scan("stream:*")
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make(map[string]*StreamInfo)
+	stream := func(slug string) *StreamInfo {
+		if streams[slug] == nil {
+			streams[slug] = &StreamInfo{URLs: make(map[string]map[string]string)}
+		}
+		return streams[slug]
+	}
+
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, "stream:")
+
+		var err error
+		switch slug, index, isURL := strings.Cut(rest, ":url:"); {
+		case isURL:
+			var url string
+			if url, err = c.get(key); err == nil && url != "" {
+				stream(slug).URLs[redisSourceIndex(index)] = map[string]string{"0": url}
+			}
+		case strings.HasSuffix(rest, ":urls"):
+			var urls map[string]string
+			if urls, err = c.hgetall(key); err == nil {
+				for index, url := range urls {
+					stream(strings.TrimSuffix(rest, ":urls")).URLs[redisSourceIndex(index)] = map[string]string{"0": url}
+				}
+			}
+		case !strings.Contains(rest, ":"):
+			var fields map[string]string
+			if fields, err = c.hgetall(key); err == nil {
+				s := stream(rest)
+				s.Title = fields["title"]
+				s.TvgID = fields["tvg_id"]
+				s.TvgChNo = fields["tvg_chno"]
+				s.LogoURL = fields["logo_url"]
+				s.Group = fields["group_name"]
+			}
+		}
+		if err != nil {
+			utils.SafeLogf("Skipping Redis key %s: %v\n", key, err)
+		}
+	}
+
+	byTitle := make(map[string]StreamInfo, len(streams))
+	for slug, s := range streams {
+		if s.Title == "" || len(s.URLs) == 0 {
+			utils.SafeLogf("Skipping incomplete Redis channel %s\n", slug)
+			continue
+		}
+		if existing, ok := byTitle[s.Title]; ok {
+			mergeStreamInfo(&existing, *s)
+			byTitle[s.Title] = existing
+		} else {
+			byTitle[s.Title] = *s
+		}
+	}
+	return byTitle, nil
+}
+
+// MigrateRedis imports the channels of the Redis-backed versions from
+// REDIS_ADDR into the channel database and writes the playlist, so it is
+// served before the first sync completed (or if the sources are down). It
+// only runs while the channel database is empty, as the syncs replace the
+// imported channels.
+func MigrateRedis(ctx context.Context) error {
+	addr := strings.TrimSpace(os.Getenv("REDIS_ADDR"))
+	if addr == "" {
+		return nil
+	}
+
+	if count, err := ChannelCount(); err != nil || count > 0 {
+		return err
+	}
+
+	db, err := strconv.Atoi(strings.TrimSpace(os.Getenv("REDIS_DB")))
+	if err != nil {
+		db = 0
+	}
+	c, err := dialRedis(addr, os.Getenv("REDIS_PASS"), db)
+	if err != nil {
+		return fmt.Errorf("connecting to Redis at %s: %w", addr, err)
+	}
+	defer c.Close()
+
+	streams, err := readRedisStreams(c)
+	if err != nil {
+		return err
+	}
+
+	// The counters counted the connections of the previous instance, which
+	// are gone.
+	if keys, err := c.scan("m3u_*_concurrency"); err == nil && len(keys) > 0 {
+		utils.SafeLogf("Not importing %d concurrency counters from Redis, the counts start from 0\n", len(keys))
+	}
+
+	if len(streams) == 0 {
+		utils.SafeLogf("No channels found in Redis at %s\n", addr)
+		return nil
+	}
+
+	M3uCache.Lock()
+	defer M3uCache.Unlock()
+
+	channelSyncMu.Lock()
+	err = importChannels(ctx, streams)
+	channelSyncMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writePlaylist(ctx); err != nil {
+		return err
+	}
+
+	utils.SafeLogf("Migrated %d channels from Redis at %s\n", len(streams), addr)
+	return nil
+}
+
+// importChannels replaces the stored channels with streams.
+func importChannels(ctx context.Context, streams map[string]StreamInfo) error {
+	writer, err := newChannelWriter()
+	if err != nil {
+		return err
+	}
+
+	batch := make(map[string]StreamInfo)
+	for title, stream := range streams {
+		batch[title] = stream
+		if len(batch) >= channelBatchSize {
+			if err := writer.merge(batch); err != nil {
+				_ = writer.discard()
+				return err
+			}
+			batch = make(map[string]StreamInfo)
+		}
+	}
+	if err := writer.merge(batch); err != nil {
+		_ = writer.discard()
+		return err
+	}
+
+	if err := writer.finish(ctx); err != nil {
+		_ = writer.discard()
+		return err
+	}
+
+	if err := buildStreamIndex(); err != nil {
+		utils.SafeLogf("Error indexing channels: %v\n", err)
+		currentStreamIndex.Store(nil)
+	}
+	return nil
+}
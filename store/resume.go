@@ -0,0 +1,105 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumeSession is the source entry a client was streamed from, kept for a
+// while after the client disconnected so it can re-attach to it.
+type resumeSession struct {
+	title    string
+	m3uIndex string
+	subIndex string
+	active   bool
+	expires  time.Time
+}
+
+var resumeSessions = struct {
+	sync.Mutex
+	sessions map[string]*resumeSession
+}{sessions: make(map[string]*resumeSession)}
+
+// resumeWindow returns how long a client may take to re-attach to its stream
+// (STREAM_RESUME_WINDOW, 0 to disable).
+func resumeWindow() time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("STREAM_RESUME_WINDOW")))
+	if err != nil || seconds < 0 {
+		seconds = 30
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// NewResumeToken returns a new opaque session token, or an empty string if
+// session resumption is disabled.
+func NewResumeToken() string {
+	if resumeWindow() <= 0 {
+		return ""
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(token)
+}
+
+// AttachResumeToken records the source entry the stream of token is proxied
+// from.
+func AttachResumeToken(token string, title string, m3uIndex string, subIndex string) {
+	if token == "" {
+		return
+	}
+
+	resumeSessions.Lock()
+	defer resumeSessions.Unlock()
+
+	now := time.Now()
+	for k, session := range resumeSessions.sessions {
+		if !session.active && now.After(session.expires) {
+			delete(resumeSessions.sessions, k)
+		}
+	}
+
+	resumeSessions.sessions[token] = &resumeSession{
+		title:    title,
+		m3uIndex: m3uIndex,
+		subIndex: subIndex,
+		active:   true,
+	}
+}
+
+// ReleaseResumeToken starts the resume window of token once its client
+// disconnected.
+func ReleaseResumeToken(token string) {
+	resumeSessions.Lock()
+	defer resumeSessions.Unlock()
+
+	if session, ok := resumeSessions.sessions[token]; ok {
+		session.active = false
+		session.expires = time.Now().Add(resumeWindow())
+	}
+}
+
+// ResumeSource returns the source entry to re-attach a client presenting
+// token to, if it disconnected from the channel title within the resume
+// window.
+func ResumeSource(token string, title string) (string, string, bool) {
+	if token == "" {
+		return "", "", false
+	}
+
+	resumeSessions.Lock()
+	defer resumeSessions.Unlock()
+
+	session, ok := resumeSessions.sessions[token]
+	if !ok || session.title != title || (!session.active && time.Now().After(session.expires)) {
+		return "", "", false
+	}
+	return session.m3uIndex, session.subIndex, true
+}
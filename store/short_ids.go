@@ -0,0 +1,117 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"strings"
+	"sync"
+)
+
+const shortIDsFilePath = "/m3u-proxy/data/short_ids.json"
+
+// shortIDLength is the length of new short IDs, extended for titles whose
+// ID is already taken.
+const shortIDLength = 8
+
+var shortIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// shortIDStore persists the short ID of every title, so stream URLs stay the
+// same across syncs and restarts even for titles whose hash collided.
+var shortIDStore = struct {
+	sync.Mutex
+	loaded bool
+	dirty  bool
+	ids    map[string]string
+	titles map[string]string
+}{ids: make(map[string]string), titles: make(map[string]string)}
+
+// useShortIDs reports whether stream URLs use short IDs instead of slugs
+// (SHORT_STREAM_IDS), as some players truncate the long slug URLs.
+func useShortIDs() bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("SHORT_STREAM_IDS"))) == "true"
+}
+
+func loadShortIDs() {
+	debug := isDebugMode()
+
+	if shortIDStore.loaded {
+		return
+	}
+	shortIDStore.loaded = true
+
+	if err := readJSONFile(shortIDsFilePath, &shortIDStore.ids); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading short IDs: %v\n", err)
+		}
+	}
+	if shortIDStore.ids == nil {
+		shortIDStore.ids = make(map[string]string)
+	}
+	shortIDStore.titles = make(map[string]string, len(shortIDStore.ids))
+	for title, id := range shortIDStore.ids {
+		shortIDStore.titles[id] = title
+	}
+}
+
+// streamID returns the ID of the stream in its proxy URLs: its short ID with
+// SHORT_STREAM_IDS, its slug otherwise.
+func streamID(stream StreamInfo) string {
+	if !useShortIDs() {
+		return EncodeSlug(stream)
+	}
+	return shortID(stream.Title)
+}
+
+// shortID returns the short ID of the title, assigning one derived from its
+// hash the first time the title is seen.
+func shortID(title string) string {
+	shortIDStore.Lock()
+	defer shortIDStore.Unlock()
+
+	loadShortIDs()
+
+	if id, ok := shortIDStore.ids[title]; ok {
+		return id
+	}
+
+	hash := sha256.Sum256([]byte(title))
+	encoded := strings.ToLower(shortIDEncoding.EncodeToString(hash[:]))
+	id := encoded[:shortIDLength]
+	for length := shortIDLength + 1; shortIDStore.titles[id] != "" && length <= len(encoded); length++ {
+		id = encoded[:length]
+	}
+
+	shortIDStore.ids[title] = id
+	shortIDStore.titles[id] = title
+	shortIDStore.dirty = true
+	return id
+}
+
+// shortIDTitle returns the title of a short ID.
+func shortIDTitle(id string) (string, bool) {
+	shortIDStore.Lock()
+	defer shortIDStore.Unlock()
+
+	loadShortIDs()
+
+	title, ok := shortIDStore.titles[id]
+	return title, ok
+}
+
+func saveShortIDs() {
+	shortIDStore.Lock()
+	defer shortIDStore.Unlock()
+
+	if !shortIDStore.dirty {
+		return
+	}
+
+	if err := writeJSONFile(shortIDsFilePath, shortIDStore.ids); err != nil {
+		utils.SafeLogf("Error saving short IDs: %v\n", err)
+		return
+	}
+	shortIDStore.dirty = false
+}
@@ -1,13 +1,12 @@
 package store
 
 import (
-	"bytes"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"m3u-stream-merger/utils"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/goccy/go-json"
 	"github.com/klauspost/compress/zstd"
@@ -15,6 +14,23 @@ import (
 
 var debug = os.Getenv("DEBUG") == "true"
 
+// The encoder and decoder are safe for concurrent use with EncodeAll and
+// DecodeAll, which avoids allocating new ones for every slug.
+var (
+	slugEncoder, _ = zstd.NewWriter(nil)
+	slugDecoder, _ = zstd.NewReader(nil)
+)
+
+// maxDecodedSlugs bounds the decoded slug cache, which is cleared once full.
+const maxDecodedSlugs = 4096
+
+// decodedSlugs caches the decoded slugs, as players request the same
+// channels over and over.
+var decodedSlugs = struct {
+	sync.Mutex
+	streams map[string]StreamInfo
+}{streams: make(map[string]StreamInfo)}
+
 func EncodeSlug(stream StreamInfo) string {
 	jsonData, err := json.Marshal(stream)
 	if err != nil {
@@ -24,25 +40,9 @@ func EncodeSlug(stream StreamInfo) string {
 		return ""
 	}
 
-	var compressedData bytes.Buffer
-	writer, err := zstd.NewWriter(&compressedData)
-	if err != nil {
-		if debug {
-			utils.SafeLogf("[DEBUG] Error zstd compression for slug: %v\n", err)
-		}
-		return ""
-	}
-
-	_, err = writer.Write(jsonData)
-	if err != nil {
-		if debug {
-			utils.SafeLogf("[DEBUG] Error zstd compression for slug: %v\n", err)
-		}
-		return ""
-	}
-	writer.Close()
+	compressedData := slugEncoder.EncodeAll(jsonData, nil)
 
-	encodedData := base64.StdEncoding.EncodeToString(compressedData.Bytes())
+	encodedData := base64.StdEncoding.EncodeToString(compressedData)
 
 	// 62nd char of encoding
 	encodedData = strings.Replace(encodedData, "+", "-", -1)
@@ -54,7 +54,30 @@ func EncodeSlug(stream StreamInfo) string {
 	return encodedData
 }
 
-func DecodeSlug(encodedSlug string) (*StreamInfo, error) {
+func DecodeSlug(slug string) (*StreamInfo, error) {
+	decodedSlugs.Lock()
+	cached, ok := decodedSlugs.streams[slug]
+	decodedSlugs.Unlock()
+	if ok {
+		return &cached, nil
+	}
+
+	result, err := decodeSlug(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	decodedSlugs.Lock()
+	if len(decodedSlugs.streams) >= maxDecodedSlugs {
+		decodedSlugs.streams = make(map[string]StreamInfo)
+	}
+	decodedSlugs.streams[slug] = *result
+	decodedSlugs.Unlock()
+
+	return result, nil
+}
+
+func decodeSlug(encodedSlug string) (*StreamInfo, error) {
 	encodedSlug = strings.Replace(encodedSlug, "-", "+", -1)
 	encodedSlug = strings.Replace(encodedSlug, "_", "/", -1)
 
@@ -70,16 +93,10 @@ func DecodeSlug(encodedSlug string) (*StreamInfo, error) {
 		return nil, fmt.Errorf("error decoding Base64 data: %v", err)
 	}
 
-	reader, err := zstd.NewReader(bytes.NewReader(decodedData))
-	if err != nil {
-		return nil, fmt.Errorf("error reading decompressed data: %v", err)
-	}
-
-	decompressedData, err := io.ReadAll(reader)
+	decompressedData, err := slugDecoder.DecodeAll(decodedData, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error reading decompressed data: %v", err)
 	}
-	reader.Close()
 
 	var result StreamInfo
 	err = json.Unmarshal(decompressedData, &result)
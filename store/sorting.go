@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+)
+
+// getSortKeys parses SORTING_KEY as a comma-separated list of keys, e.g.
+// `group-title,tvg-chno`. The title is always used as the final tiebreaker.
+func getSortKeys() []string {
+	keys := []string{}
+	for _, key := range strings.Split(os.Getenv("SORTING_KEY"), ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return append(keys, "tvg-name")
+}
+
+func getSortKey(stream StreamInfo, key string) string {
+	switch key {
+	case "tvg-id":
+		return stream.TvgID
+	case "tvg-chno":
+		return stream.TvgChNo
+	case "group-title":
+		return stream.Group
+	default:
+		return stream.Title
+	}
+}
+
+// naturalCompare compares two strings treating runs of digits as numbers so
+// that "Channel 2" sorts before "Channel 10".
+func naturalCompare(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			startA, startB := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+
+			numA := strings.TrimLeft(a[startA:i], "0")
+			numB := strings.TrimLeft(b[startB:j], "0")
+			if len(numA) != len(numB) {
+				return len(numA) - len(numB)
+			}
+			if cmp := strings.Compare(numA, numB); cmp != 0 {
+				return cmp
+			}
+			continue
+		}
+
+		if a[i] != b[j] {
+			return int(a[i]) - int(b[j])
+		}
+		i++
+		j++
+	}
+
+	return (len(a) - i) - (len(b) - j)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// streamSortKey encodes the playlist position of a stream: comparing the keys
+// of two streams byte-wise orders them by GROUP_ORDER, then by the sort keys
+// using naturalCompare. The title is appended so that keys are unique.
+func streamSortKey(stream StreamInfo, keys []string) []byte {
+	key := binary.BigEndian.AppendUint32(nil, uint32(groupRank(stream.Group)))
+	for _, k := range keys {
+		key = appendNaturalKey(key, getSortKey(stream, k))
+		key = append(key, 0)
+	}
+
+	return append(key, stream.Title...)
+}
+
+// appendNaturalKey appends s with every run of digits replaced by a '0'
+// marker, the length of the number on two bytes and the number without
+// leading zeros. The marker compares to other characters like any digit
+// would, so the result compares byte-wise like naturalCompare.
+func appendNaturalKey(key []byte, s string) []byte {
+	for i := 0; i < len(s); {
+		if !isDigit(s[i]) {
+			key = append(key, s[i])
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+
+		num := strings.TrimLeft(s[start:i], "0")
+		key = append(key, '0')
+		key = binary.BigEndian.AppendUint16(key, uint16(len(num)))
+		key = append(key, num...)
+	}
+
+	return key
+}
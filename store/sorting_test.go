@@ -0,0 +1,84 @@
+package store
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"Channel 2", "Channel 10", -1},
+		{"Channel 10", "Channel 2", 1},
+		{"Channel 02", "Channel 2", 0},
+		{"Channel 2", "Channel 2 HD", -1},
+		{"A1B2", "A1B10", -1},
+		{"100", "99", 1},
+		{"Alpha", "Beta", -1},
+		{"Channel", "Channel 1", -1},
+		{"", "", 0},
+	}
+
+	sign := func(n int) int {
+		return min(max(n, -1), 1)
+	}
+
+	for _, tt := range tests {
+		if got := sign(naturalCompare(tt.a, tt.b)); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+
+		// The encoded keys compare byte-wise like naturalCompare.
+		if got := sign(bytes.Compare(appendNaturalKey(nil, tt.a), appendNaturalKey(nil, tt.b))); tt.want != 0 && got != tt.want {
+			t.Errorf("appendNaturalKey(%q) compared to appendNaturalKey(%q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStreamSortKey(t *testing.T) {
+	streams := []StreamInfo{
+		{Title: "Sports 10", TvgChNo: "3", Group: "Sports", TvgID: "b"},
+		{Title: "News 2", TvgChNo: "20", Group: "News", TvgID: "c"},
+		{Title: "Sports 2", TvgChNo: "1", Group: "Sports", TvgID: "a"},
+		{Title: "News 10", TvgChNo: "4", Group: "News", TvgID: "a"},
+		{Title: "Kids", TvgChNo: "4", Group: "News", TvgID: "a"},
+	}
+
+	tests := []struct {
+		sortingKey string
+		want       []string
+	}{
+		{"", []string{"Kids", "News 2", "News 10", "Sports 2", "Sports 10"}},
+		{"tvg-name", []string{"Kids", "News 2", "News 10", "Sports 2", "Sports 10"}},
+		{"tvg-chno", []string{"Sports 2", "Sports 10", "Kids", "News 10", "News 2"}},
+		{"group-title,tvg-chno", []string{"Kids", "News 10", "News 2", "Sports 2", "Sports 10"}},
+		{" Group-Title , tvg-id ", []string{"Kids", "News 10", "News 2", "Sports 2", "Sports 10"}},
+		{"tvg-id,tvg-chno", []string{"Sports 2", "Kids", "News 10", "Sports 10", "News 2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sortingKey, func(t *testing.T) {
+			t.Setenv("SORTING_KEY", tt.sortingKey)
+			keys := getSortKeys()
+			if keys[len(keys)-1] != "tvg-name" {
+				t.Errorf("Expected the title as final tiebreaker, got %v", keys)
+			}
+
+			sorted := slices.Clone(streams)
+			slices.SortFunc(sorted, func(a, b StreamInfo) int {
+				return bytes.Compare(streamSortKey(a, keys), streamSortKey(b, keys))
+			})
+
+			titles := make([]string, 0, len(sorted))
+			for _, stream := range sorted {
+				titles = append(titles, stream.Title)
+			}
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("SORTING_KEY=%q sorted %v, want %v", tt.sortingKey, titles, tt.want)
+			}
+		})
+	}
+}
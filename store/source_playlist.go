@@ -0,0 +1,61 @@
+package store
+
+import (
+	"m3u-stream-merger/utils"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// GenerateSourcesM3U generates a playlist of the channels available from the
+// given M3U sources, optionally limited to some groups. Its stream URLs only
+// balance across these sources, e.g. to test a single provider through the
+// proxy.
+func GenerateSourcesM3U(baseURL string, sources []string, groups []string) string {
+	var content strings.Builder
+
+	query := url.Values{"sources": {strings.Join(sources, ",")}}.Encode()
+
+	content.WriteString("#EXTM3U\n")
+	err := forEachChannel(func(stream StreamInfo) error {
+		if len(groups) > 0 && !slices.Contains(groups, stream.Group) {
+			return nil
+		}
+
+		urls := make(map[string]map[string]string, len(sources))
+		for _, index := range sources {
+			if innerMap, ok := stream.URLs[index]; ok && !IsSourceDisabled(index) {
+				urls[index] = innerMap
+			}
+		}
+		if len(urls) == 0 {
+			return nil
+		}
+
+		// The file extension of the stream URL is taken from the selected
+		// sources.
+		stream.URLs = urls
+		content.WriteString(formatStreamEntry(baseURL, stream, query))
+		return nil
+	})
+	if err != nil {
+		utils.SafeLogf("Error reading channels: %v\n", err)
+	}
+
+	saveShortIDs()
+
+	return content.String()
+}
+
+// ParseSources returns the M3U indexes of a comma-separated list, e.g. the
+// sources query parameter.
+func ParseSources(value string) []string {
+	sources := make([]string, 0)
+	for _, index := range strings.Split(value, ",") {
+		index = strings.TrimSpace(index)
+		if index != "" && !slices.Contains(sources, index) {
+			sources = append(sources, index)
+		}
+	}
+	return sources
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// playlistEntries returns the stream URLs of a generated playlist by title.
+func playlistEntries(playlist string) map[string]string {
+	entries := make(map[string]string)
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "#EXTINF") || i+1 >= len(lines) {
+			continue
+		}
+		_, title, _ := strings.Cut(line, ",")
+		entries[title] = lines[i+1]
+	}
+	return entries
+}
+
+func TestGenerateSourcesM3U(t *testing.T) {
+	setupSources(t,
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",News\nhttp://one.invalid/live/1.ts\n"+
+			"#EXTINF:-1 group-title=\"Kids\",Kids\nhttp://one.invalid/live/2.ts\n",
+		"#EXTM3U\n"+
+			"#EXTINF:-1 group-title=\"News\",News\nhttp://two.invalid/live/1.ts\n"+
+			"#EXTINF:-1 group-title=\"Films\",Big Movie\nhttp://two.invalid/movie/user/pass/2.mp4\n")
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		groups  []string
+		want    []string
+	}{
+		{"single source", []string{"2"}, nil, []string{"Big Movie", "News"}},
+		{"several sources", []string{"1", "2"}, nil, []string{"Big Movie", "Kids", "News"}},
+		{"groups", []string{"1", "2"}, []string{"News", "Kids"}, []string{"Kids", "News"}},
+		{"unknown source", []string{"9"}, nil, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := playlistEntries(GenerateSourcesM3U("http://example.com", tt.sources, tt.groups))
+
+			titles := make([]string, 0, len(entries))
+			for title, streamURL := range entries {
+				titles = append(titles, title)
+				if !strings.HasPrefix(streamURL, "http://example.com/p/") || !strings.HasSuffix(streamURL, "?sources="+strings.Join(tt.sources, "%2C")) {
+					t.Errorf("Expected the stream URL of %s to be restricted to the sources, got %s", title, streamURL)
+				}
+			}
+			slices.Sort(titles)
+			if !slices.Equal(titles, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, titles)
+			}
+		})
+	}
+
+	// The file extension is taken from the selected sources.
+	if streamURL := playlistEntries(GenerateSourcesM3U("http://example.com", []string{"2"}, nil))["Big Movie"]; !strings.Contains(streamURL, ".mp4?") {
+		t.Errorf("Expected the extension of the movie, got %s", streamURL)
+	}
+
+	// Disabled sources are left out.
+	t.Setenv("M3U_DISABLED_2", "true")
+	if entries := playlistEntries(GenerateSourcesM3U("http://example.com", []string{"1", "2"}, nil)); len(entries) != 2 || entries["Big Movie"] != "" {
+		t.Errorf("Expected only the channels of the first source, got %v", entries)
+	}
+}
+
+func TestParseSources(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{}},
+		{"2", []string{"2"}},
+		{" 1, 3 ,", []string{"1", "3"}},
+		{"3,1,3", []string{"3", "1"}},
+	}
+
+	for _, tt := range tests {
+		if got := ParseSources(tt.value); !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSources(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
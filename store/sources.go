@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"m3u-stream-merger/utils"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const disabledSourcesFilePath = "/m3u-proxy/data/disabled_sources.json"
+
+// ErrSourceDisabledByConfig is returned when enabling a source disabled with
+// its M3U_DISABLED_X env, which only a config change can undo.
+var ErrSourceDisabledByConfig = errors.New("source is disabled by its M3U_DISABLED env")
+
+var disabledSources = struct {
+	sync.RWMutex
+	loaded  bool
+	indexes []string
+}{}
+
+func loadDisabledSources() {
+	debug := isDebugMode()
+
+	disabledSources.Lock()
+	defer disabledSources.Unlock()
+
+	if disabledSources.loaded {
+		return
+	}
+	disabledSources.loaded = true
+
+	if err := readJSONFile(disabledSourcesFilePath, &disabledSources.indexes); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading disabled sources: %v\n", err)
+		}
+	}
+}
+
+func sourceDisabledByConfig(m3uIndex string) bool {
+	return strings.ToLower(strings.TrimSpace(os.Getenv(fmt.Sprintf("M3U_DISABLED_%s", m3uIndex)))) == "true"
+}
+
+// IsSourceDisabled reports whether the source is in maintenance mode, either
+// with its M3U_DISABLED_X env or through the API. Disabled sources are not
+// streamed from nor refreshed.
+func IsSourceDisabled(m3uIndex string) bool {
+	if sourceDisabledByConfig(m3uIndex) {
+		return true
+	}
+
+	loadDisabledSources()
+
+	disabledSources.RLock()
+	defer disabledSources.RUnlock()
+
+	return slices.Contains(disabledSources.indexes, m3uIndex)
+}
+
+// SetSourceDisabled puts the source in or out of maintenance mode. The state
+// persists across restarts.
+func SetSourceDisabled(m3uIndex string, disabled bool) error {
+	if !disabled && sourceDisabledByConfig(m3uIndex) {
+		return ErrSourceDisabledByConfig
+	}
+
+	loadDisabledSources()
+
+	disabledSources.Lock()
+	defer disabledSources.Unlock()
+
+	indexes := slices.DeleteFunc(slices.Clone(disabledSources.indexes), func(index string) bool {
+		return index == m3uIndex
+	})
+	if disabled {
+		indexes = append(indexes, m3uIndex)
+	}
+
+	if err := writeJSONFile(disabledSourcesFilePath, indexes); err != nil {
+		return err
+	}
+	disabledSources.indexes = indexes
+
+	return nil
+}
+
+// hasEnabledSource reports whether the stream can be streamed from a source
+// that is not disabled.
+func hasEnabledSource(stream StreamInfo) bool {
+	for index := range stream.URLs {
+		if !IsSourceDisabled(index) {
+			return true
+		}
+	}
+	return false
+}
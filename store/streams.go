@@ -1,19 +1,28 @@
 package store
 
 import (
-	"encoding/hex"
+	"context"
 	"fmt"
 	"m3u-stream-merger/utils"
 	"os"
-	"path/filepath"
-	"sort"
 	"sync"
-	"time"
-
-	"golang.org/x/crypto/sha3"
 )
 
 func GetStreamBySlug(slug string) (StreamInfo, error) {
+	// Short IDs are resolved first, slugs stay valid for URLs generated
+	// before SHORT_STREAM_IDS was enabled.
+	if title, ok := shortIDTitle(slug); ok {
+		stream, ok := GetStreamByTitle(title)
+		if !ok {
+			return StreamInfo{}, fmt.Errorf("channel %s not found", title)
+		}
+		return stream, nil
+	}
+
+	if stream, ok := lookupStreamBySlug(slug); ok {
+		return *stream, nil
+	}
+
 	streamInfo, err := ParseStreamInfoBySlug(slug)
 	if err != nil {
 		return StreamInfo{}, fmt.Errorf("error parsing stream info: %v", err)
@@ -22,65 +31,163 @@ func GetStreamBySlug(slug string) (StreamInfo, error) {
 	return *streamInfo, nil
 }
 
-func GetStreams() []StreamInfo {
-	var (
-		debug   = os.Getenv("DEBUG") == "true"
-		result  = make([]StreamInfo, 0) // Slice to store final results
-		streams sync.Map
-	)
+// GetStreamByTitle returns the channel with the given title.
+func GetStreamByTitle(title string) (StreamInfo, bool) {
+	if stream, ok := lookupStreamByTitle(title); ok {
+		return *stream, true
+	}
+
+	stream, ok := lookupChannel(title)
+	if !ok {
+		return StreamInfo{}, false
+	}
+	return *stream, true
+}
+
+// syncChannels parses every source into a new generation of the channel
+// database. Streams are merged and sorted by the database in batches, so
+// memory use does not grow with the size of the playlists. If ctx is done
+// before the sync completes, the current generation is kept.
+func syncChannels(ctx context.Context) error {
+	debug := os.Getenv("DEBUG") == "true"
+
+	channelSyncMu.Lock()
+	defer channelSyncMu.Unlock()
+	defer TrackSyncProgress()()
+
+	writer, err := newChannelWriter()
+	if err != nil {
+		return err
+	}
+
+	resetSlugCollisions()
 
-	sessionIdHash := sha3.Sum224([]byte(time.Now().String()))
-	sessionId := hex.EncodeToString(sessionIdHash[:])
+	indexes := syncedIndexes()
+	StartSyncPhase(SyncPhaseParsing, len(indexes))
 
 	var wg sync.WaitGroup
-	for _, m3uIndex := range utils.GetM3UIndexes() {
+	for _, m3uIndex := range indexes {
 		wg.Add(1)
 		go func(m3uIndex string) {
 			defer wg.Done()
+			defer SyncSourceDone()
+
+			batch := make(map[string]StreamInfo)
+			flush := func() {
+				if err := writer.merge(batch); err != nil {
+					utils.SafeLogf("Error saving channels of M3U #%s: %v\n", m3uIndex, err)
+				}
+				batch = make(map[string]StreamInfo)
+			}
+
+			err := M3UScanner(ctx, m3uIndex, func(streamInfo StreamInfo) {
+				syncProgress.streams.Add(1)
 
-			err := M3UScanner(m3uIndex, sessionId, func(streamInfo StreamInfo) {
 				// Check uniqueness and update if necessary
-				if existingStream, exists := streams.Load(streamInfo.Title); exists {
-					for idx, innerMap := range streamInfo.URLs {
-						if _, ok := existingStream.(StreamInfo).URLs[idx]; !ok {
-							existingStream.(StreamInfo).URLs[idx] = innerMap
-							continue
-						}
-
-						for subIdx, url := range innerMap {
-							existingStream.(StreamInfo).URLs[idx][subIdx] = url
-						}
-					}
-					streams.Store(streamInfo.Title, existingStream)
+				if existing, exists := batch[streamInfo.Title]; exists {
+					mergeStreamInfo(&existing, streamInfo)
+					batch[streamInfo.Title] = existing
 				} else {
-					streams.Store(streamInfo.Title, streamInfo)
+					batch[streamInfo.Title] = streamInfo
+				}
+
+				if len(batch) >= channelBatchSize {
+					flush()
 				}
 			})
 			if err != nil && debug {
 				utils.SafeLogf("error getting streams: %v\n", err)
 			}
+
+			flush()
 		}(m3uIndex)
 	}
 	wg.Wait()
 
-	entries, err := os.ReadDir(streamsDirPath)
-	if err == nil {
-		for _, e := range entries {
-			if e.Name() == sessionId {
-				continue
-			}
+	if batch := customChannelBatch(); len(batch) > 0 {
+		if err := writer.merge(batch); err != nil {
+			utils.SafeLogf("Error saving custom channels: %v\n", err)
+		}
+	}
+
+	saveSlugOwners()
 
-			_ = os.RemoveAll(filepath.Join(streamsDirPath, e.Name()))
+	if err := writer.finish(ctx); err != nil {
+		_ = writer.discard()
+		return err
+	}
+
+	if err := buildStreamIndex(); err != nil {
+		// The lookups fall back to the channel database.
+		utils.SafeLogf("Error indexing channels: %v\n", err)
+		currentStreamIndex.Store(nil)
+	}
+
+	return nil
+}
+
+// mergeStreamInfo adds the sources of stream to existing. Attributes already
+// set on existing are kept.
+func mergeStreamInfo(existing *StreamInfo, stream StreamInfo) {
+	for idx, innerMap := range stream.URLs {
+		if existing.URLs == nil {
+			existing.URLs = make(map[string]map[string]string)
+		}
+		if _, ok := existing.URLs[idx]; !ok {
+			existing.URLs[idx] = innerMap
+			continue
+		}
+
+		for subIdx, url := range innerMap {
+			existing.URLs[idx][subIdx] = url
 		}
 	}
 
-	streams.Range(func(key, value any) bool {
-		stream := value.(StreamInfo)
+	for key, value := range stream.Attributes {
+		if existing.Attributes == nil {
+			existing.Attributes = make(map[string]string)
+		}
+		if _, ok := existing.Attributes[key]; !ok {
+			existing.Attributes[key] = value
+		}
+	}
+
+	if existing.ExtGrp == "" {
+		existing.ExtGrp = stream.ExtGrp
+	}
+	existing.VLCOpts = appendUnique(existing.VLCOpts, stream.VLCOpts...)
+	existing.KodiProps = appendUnique(existing.KodiProps, stream.KodiProps...)
+	for key, opts := range stream.URLOpts {
+		if existing.URLOpts == nil {
+			existing.URLOpts = make(map[string][]string)
+		}
+		existing.URLOpts[key] = opts
+	}
+	for key, title := range stream.EntryTitles {
+		if existing.EntryTitles == nil {
+			existing.EntryTitles = make(map[string]string)
+		}
+		existing.EntryTitles[key] = title
+	}
+}
+
+// GetStreams syncs the channels and returns all of them in playlist order.
+// Playlist generation iterates the channel database instead, as this loads
+// every channel into memory.
+func GetStreams() []StreamInfo {
+	result := make([]StreamInfo, 0)
+
+	if err := syncChannels(context.Background()); err != nil {
+		utils.SafeLogf("Error syncing channels: %v\n", err)
+	}
+
+	err := forEachChannel(func(stream StreamInfo) error {
 		result = append(result, stream)
-		return true
+		return nil
 	})
-
-	sortStreams(result)
+	if err != nil {
+		utils.SafeLogf("Error reading channels: %v\n", err)
+	}
 
 	return result
 }
@@ -97,30 +204,11 @@ func GenerateStreamURL(baseUrl string, stream StreamInfo) string {
 
 			ext, err := utils.GetFileExtensionFromUrl(srcUrl)
 			if err != nil {
-				return fmt.Sprintf("%s/p/%s/%s", baseUrl, subPath, EncodeSlug(stream))
+				ext = ""
 			}
 
-			return fmt.Sprintf("%s/p/%s/%s%s", baseUrl, subPath, EncodeSlug(stream), ext)
+			return fmt.Sprintf("%s/p/%s/%s%s", baseUrl, subPath, streamID(stream), streamURLExtension(stream, ext))
 		}
 	}
-	return fmt.Sprintf("%s/p/stream/%s", baseUrl, EncodeSlug(stream))
-}
-
-func sortStreams(s []StreamInfo) {
-	key := os.Getenv("SORTING_KEY")
-
-	switch key {
-	case "tvg-id":
-		sort.Slice(s, func(i, j int) bool {
-			return s[i].TvgID < s[j].TvgID
-		})
-	case "tvg-chno":
-		sort.Slice(s, func(i, j int) bool {
-			return s[i].TvgChNo < s[j].TvgChNo
-		})
-	default:
-		sort.Slice(s, func(i, j int) bool {
-			return s[i].Title < s[j].Title
-		})
-	}
+	return fmt.Sprintf("%s/p/stream/%s%s", baseUrl, streamID(stream), streamURLExtension(stream, ""))
 }
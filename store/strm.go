@@ -0,0 +1,112 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"m3u-stream-merger/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	strmLiveDir   = "Live"
+	strmMoviesDir = "Movies"
+	strmSeriesDir = "Series"
+)
+
+var strmNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+	"\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
+// ExportSTRM writes a .strm file pointing at the proxy URL of every stream
+// into dir, laid out as <Live|Movies|Series>/<group>/<title>.strm for media
+// servers such as Jellyfin and Emby. Unchanged files are left untouched and
+// files of streams that no longer exist are removed. It exports the channels
+// of the last sync.
+func ExportSTRM(dir string, baseURL string) error {
+	debug := isDebugMode()
+
+	written := make(map[string]bool)
+	err := forEachChannel(func(stream StreamInfo) error {
+		if len(stream.URLs) == 0 {
+			return nil
+		}
+
+		path := filepath.Join(dir, strmCategory(stream), strmName(stream.Group), strmName(stream.Title)+".strm")
+		content := []byte(GenerateStreamURL(baseURL, stream) + "\n")
+		written[path] = true
+
+		if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return fmt.Errorf("Error creating directories for %s: %v", path, err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return fmt.Errorf("Error writing %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep the files of the streams that could not be read.
+		return err
+	}
+
+	var stale []string
+	var dirs []string
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".strm" && !written[path] {
+			stale = append(stale, path)
+		}
+		return nil
+	})
+
+	for _, path := range stale {
+		if debug {
+			utils.SafeLogf("[DEBUG] Removing stale STRM file: %s\n", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	// Remove the deepest directories first so emptied parents go as well.
+	// os.Remove fails on non-empty directories, which are kept.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, path := range dirs {
+		_ = os.Remove(path)
+	}
+
+	return nil
+}
+
+// strmCategory returns the library folder of a stream.
+func strmCategory(stream StreamInfo) string {
+	switch StreamMediaType(stream) {
+	case MediaMovie:
+		return strmMoviesDir
+	case MediaSeries:
+		return strmSeriesDir
+	}
+	return strmLiveDir
+}
+
+func strmName(name string) string {
+	name = strings.Trim(strmNameReplacer.Replace(strings.TrimSpace(name)), ". ")
+	if name == "" {
+		return "Uncategorized"
+	}
+	return name
+}
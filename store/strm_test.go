@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportSTRM(t *testing.T) {
+	setupSources(t, "#EXTM3U\n"+
+		"#EXTINF:-1 group-title=\"News\",News\nhttp://provider.invalid/live/1.ts\n"+
+		"#EXTINF:-1 group-title=\"Films\",Big Movie\nhttp://provider.invalid/movie/user/pass/2.mp4\n")
+	if err := RegenerateM3U(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new version of the source, which is not synced yet.
+	source := strings.TrimPrefix(os.Getenv("M3U_URL_1"), "file://")
+	if err := os.WriteFile(source, []byte("#EXTM3U\n#EXTINF:-1 group-title=\"News\",Kids\nhttp://provider.invalid/live/3.ts\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "Live", "Old", "Gone.strm")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("http://example.com/gone\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ExportSTRM(dir, "http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"Live/News/News.strm", "Movies/Films/Big Movie.strm"} {
+		content, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Errorf("Expected %s: %v", path, err)
+			continue
+		}
+		if !strings.HasPrefix(string(content), "http://example.com/p/") {
+			t.Errorf("Expected %s to point at the proxy, got %q", path, content)
+		}
+	}
+
+	// Only the synced channels are exported.
+	if _, err := os.Stat(filepath.Join(dir, "Live", "News", "Kids.strm")); err == nil {
+		t.Error("Expected the export not to sync the channels")
+	}
+	if _, err := os.Stat(filepath.Dir(stale)); !os.IsNotExist(err) {
+		t.Errorf("Expected the stale file and its directory to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const syncHistoryFilePath = "/m3u-proxy/data/sync_history.json"
+
+// syncHistorySize is the number of sync runs kept in the history.
+const syncHistorySize = 50
+
+const (
+	SyncCompleted = "completed"
+	SyncFailed    = "failed"
+	SyncCancelled = "cancelled"
+	SyncSkipped   = "skipped"
+)
+
+// SyncRun is a run of the updater. Channels and Parse, the entries and lines
+// left out of each source, are only set if the run rebuilt the channels
+// (CACHE_ON_SYNC).
+type SyncRun struct {
+	Start           time.Time             `json:"start"`
+	End             time.Time             `json:"end"`
+	DurationSeconds float64               `json:"duration_seconds"`
+	Sources         []string              `json:"sources"`
+	Status          string                `json:"status"`
+	Channels        int                   `json:"channels,omitempty"`
+	Parse           map[string]ParseStats `json:"parse,omitempty"`
+	Errors          []string              `json:"errors,omitempty"`
+}
+
+var syncHistory = struct {
+	sync.Mutex
+	loaded bool
+	runs   []SyncRun
+}{}
+
+func loadSyncHistory() {
+	debug := isDebugMode()
+
+	if syncHistory.loaded {
+		return
+	}
+	syncHistory.loaded = true
+
+	if err := readJSONFile(syncHistoryFilePath, &syncHistory.runs); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading sync history: %v\n", err)
+		}
+	}
+}
+
+// RecordSyncRun adds a run to the persisted sync history, dropping the
+// oldest runs beyond syncHistorySize.
+func RecordSyncRun(run SyncRun) {
+	syncHistory.Lock()
+	defer syncHistory.Unlock()
+
+	loadSyncHistory()
+
+	syncHistory.runs = append(syncHistory.runs, run)
+	if len(syncHistory.runs) > syncHistorySize {
+		syncHistory.runs = slices.Clone(syncHistory.runs[len(syncHistory.runs)-syncHistorySize:])
+	}
+
+	if err := writeJSONFile(syncHistoryFilePath, syncHistory.runs); err != nil {
+		utils.SafeLogf("Error saving sync history: %v\n", err)
+	}
+}
+
+// GetSyncHistory returns the recorded sync runs, most recent first.
+func GetSyncHistory() []SyncRun {
+	syncHistory.Lock()
+	defer syncHistory.Unlock()
+
+	loadSyncHistory()
+
+	runs := slices.Clone(syncHistory.runs)
+	slices.Reverse(runs)
+	if runs == nil {
+		runs = []SyncRun{}
+	}
+	return runs
+}
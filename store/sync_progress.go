@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The phases of a sync, in order.
+const (
+	SyncPhaseFetching = "fetching"
+	SyncPhaseParsing  = "parsing"
+	SyncPhaseWriting  = "writing"
+)
+
+// SyncProgress is the progress of the running sync. Sources are the sources
+// fetched or parsed so far in the current phase, streams the entries parsed
+// so far.
+type SyncProgress struct {
+	Phase            string    `json:"phase"`
+	SourcesDone      int       `json:"sources_done"`
+	SourcesTotal     int       `json:"sources_total"`
+	StreamsProcessed int64     `json:"streams_processed"`
+	StartedAt        time.Time `json:"started_at"`
+}
+
+var syncProgress = struct {
+	sync.Mutex
+	// active is the number of nested syncs tracked, e.g. the channel sync of
+	// a playlist regeneration of an updater run.
+	active   int
+	progress SyncProgress
+	streams  atomic.Int64
+}{}
+
+// TrackSyncProgress marks a sync as running until the returned function is
+// called. Nested calls are part of the same sync.
+func TrackSyncProgress() func() {
+	syncProgress.Lock()
+	defer syncProgress.Unlock()
+
+	if syncProgress.active == 0 {
+		syncProgress.progress = SyncProgress{StartedAt: time.Now()}
+		syncProgress.streams.Store(0)
+	}
+	syncProgress.active++
+
+	return func() {
+		syncProgress.Lock()
+		defer syncProgress.Unlock()
+		syncProgress.active--
+	}
+}
+
+// StartSyncPhase records that the running sync entered the phase, going
+// through the given number of sources.
+func StartSyncPhase(phase string, sources int) {
+	syncProgress.Lock()
+	defer syncProgress.Unlock()
+
+	syncProgress.progress.Phase = phase
+	syncProgress.progress.SourcesDone = 0
+	syncProgress.progress.SourcesTotal = sources
+	if phase == SyncPhaseParsing {
+		syncProgress.streams.Store(0)
+	}
+}
+
+// SyncSourceDone records that a source went through the current phase.
+func SyncSourceDone() {
+	syncProgress.Lock()
+	defer syncProgress.Unlock()
+
+	syncProgress.progress.SourcesDone++
+}
+
+// setSyncPhase moves the running sync to the phase, keeping its counts.
+func setSyncPhase(phase string) {
+	syncProgress.Lock()
+	defer syncProgress.Unlock()
+
+	syncProgress.progress.Phase = phase
+}
+
+// GetSyncProgress returns the progress of the running sync, false if no sync
+// is running.
+func GetSyncProgress() (SyncProgress, bool) {
+	syncProgress.Lock()
+	defer syncProgress.Unlock()
+
+	if syncProgress.active == 0 {
+		return SyncProgress{}, false
+	}
+	progress := syncProgress.progress
+	progress.StreamsProcessed = syncProgress.streams.Load()
+	return progress, true
+}
@@ -7,4 +7,23 @@ type StreamInfo struct {
 	LogoURL string                       `json:"logo"`
 	Group   string                       `json:"group"`
 	URLs    map[string]map[string]string `json:"-"`
+
+	// Attributes holds the #EXTINF attributes that are not parsed into
+	// dedicated fields (e.g. tvg-shift, catchup, timeshift) so they can be
+	// reproduced in the generated playlist.
+	Attributes map[string]string `json:"-"`
+
+	// Directives from #EXTGRP, #EXTVLCOPT and #KODIPROP lines. These are
+	// reproduced in the generated playlist.
+	ExtGrp    string   `json:"-"`
+	VLCOpts   []string `json:"-"`
+	KodiProps []string `json:"-"`
+	// URLOpts maps an "index|subIndex" key to the options of that specific
+	// source entry as key=value pairs: its #EXTVLCOPT options (e.g.
+	// http-user-agent) and catchup attributes.
+	URLOpts map[string][]string `json:"-"`
+	// EntryTitles maps an "index|subIndex" key to the title of that source
+	// entry in its playlist, if it differs from Title (e.g. "News HD" merged
+	// into "News" by TITLE_SUBSTR_FILTER).
+	EntryTitles map[string]string `json:"-"`
 }
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"os"
+	"strings"
+)
+
+// streamURLExtension returns the file extension of the proxy URL of the
+// stream, as some players select their demuxer by it. STREAM_URL_EXTENSION,
+// overridden for groups by STREAM_URL_EXTENSION_GROUPS (e.g.
+// "Movies=auto,PPV=ts"), is either "auto" for the extension of the source
+// URL (sourceExt), "none" or a fixed extension such as "ts".
+func streamURLExtension(stream StreamInfo, sourceExt string) string {
+	mode := strings.TrimSpace(os.Getenv("STREAM_URL_EXTENSION"))
+	for _, override := range strings.Split(os.Getenv("STREAM_URL_EXTENSION_GROUPS"), ",") {
+		group, groupMode, ok := strings.Cut(override, "=")
+		if ok && strings.TrimSpace(group) == stream.Group {
+			mode = strings.TrimSpace(groupMode)
+			break
+		}
+	}
+
+	switch strings.ToLower(mode) {
+	case "", "auto":
+		return sourceExt
+	case "none":
+		return ""
+	}
+	return "." + strings.TrimPrefix(mode, ".")
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"errors"
+	"m3u-stream-merger/utils"
+	"os"
+	"sync"
+	"time"
+)
+
+const vodProgressFilePath = "/m3u-proxy/data/vod_progress.json"
+
+// VODProgress is how far a user got into a movie or an episode: the byte
+// offset after the last byte served and, if known, the size of the file.
+type VODProgress struct {
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var vodProgressStore = struct {
+	sync.RWMutex
+	loaded bool
+	// The progress by user and title.
+	users map[string]map[string]VODProgress
+}{users: make(map[string]map[string]VODProgress)}
+
+func loadVODProgress() {
+	debug := isDebugMode()
+
+	vodProgressStore.Lock()
+	defer vodProgressStore.Unlock()
+
+	if vodProgressStore.loaded {
+		return
+	}
+	vodProgressStore.loaded = true
+
+	if err := readJSONFile(vodProgressFilePath, &vodProgressStore.users); err != nil {
+		if debug && !errors.Is(err, os.ErrNotExist) {
+			utils.SafeLogf("[DEBUG] Error reading VOD progress: %v\n", err)
+		}
+	}
+	if vodProgressStore.users == nil {
+		vodProgressStore.users = make(map[string]map[string]VODProgress)
+	}
+}
+
+// RecordVODProgress persists the progress of the user in the movie or
+// episode with the given title.
+func RecordVODProgress(user string, title string, progress VODProgress) error {
+	loadVODProgress()
+
+	vodProgressStore.Lock()
+	defer vodProgressStore.Unlock()
+
+	if vodProgressStore.users[user] == nil {
+		vodProgressStore.users[user] = make(map[string]VODProgress)
+	}
+	vodProgressStore.users[user][title] = progress
+
+	return writeJSONFile(vodProgressFilePath, vodProgressStore.users)
+}
+
+// GetVODProgress returns the progress of the user in the movie or episode
+// with the given title.
+func GetVODProgress(user string, title string) (VODProgress, bool) {
+	loadVODProgress()
+
+	vodProgressStore.RLock()
+	defer vodProgressStore.RUnlock()
+
+	progress, ok := vodProgressStore.users[user][title]
+	return progress, ok
+}
+
+// ForgetVODProgress drops the progress of the user in the movie or episode
+// with the given title, e.g. once it was watched to the end.
+func ForgetVODProgress(user string, title string) error {
+	loadVODProgress()
+
+	vodProgressStore.Lock()
+	defer vodProgressStore.Unlock()
+
+	if _, ok := vodProgressStore.users[user][title]; !ok {
+		return nil
+	}
+	delete(vodProgressStore.users[user], title)
+	if len(vodProgressStore.users[user]) == 0 {
+		delete(vodProgressStore.users, user)
+	}
+
+	return writeJSONFile(vodProgressFilePath, vodProgressStore.users)
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/updater"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForGoroutines fails the test if the number of goroutines does not drop
+// back to baseline.
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("Leaked goroutines: %d running, expected at most %d\n%s", runtime.NumGoroutine(), baseline, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// blockingUpstream serves the start of a playlist, then blocks until the
+// client goes away.
+func blockingUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("#EXTM3U\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func writeTestPlaylist(t *testing.T, channels int) string {
+	t.Helper()
+
+	var content strings.Builder
+	content.WriteString("#EXTM3U\n")
+	for i := 0; i < channels; i++ {
+		content.WriteString(fmt.Sprintf("#EXTINF:-1 group-title=\"Test\",Channel %d\nhttp://example.com/%d.ts\n", i, i))
+	}
+
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	if err := os.WriteFile(path, []byte(content.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDownloadCancellation(t *testing.T) {
+	upstream := blockingUpstream()
+	defer upstream.Close()
+
+	t.Setenv("M3U_URL_1", upstream.URL)
+
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- store.DownloadM3USource(ctx, "1")
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected cancelled download to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not stop after cancellation")
+	}
+
+	waitForGoroutines(t, baseline)
+}
+
+func TestScannerCancellation(t *testing.T) {
+	t.Setenv("M3U_URL_1", "file://"+writeTestPlaylist(t, 100))
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scanned := 0
+	err := store.M3UScanner(ctx, "1", func(stream store.StreamInfo) {
+		scanned++
+		if scanned == 10 {
+			cancel()
+		}
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if scanned != 10 {
+		t.Errorf("Expected scanning to stop after 10 streams, got %d", scanned)
+	}
+}
+
+func TestUpdateSourcesCancellation(t *testing.T) {
+	upstream := blockingUpstream()
+	defer upstream.Close()
+
+	t.Setenv("M3U_URL_1", upstream.URL)
+	t.Setenv("M3U_URL_2", "file://"+writeTestPlaylist(t, 10))
+
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		(&updater.Updater{}).UpdateSources(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not stop after cancellation")
+	}
+
+	waitForGoroutines(t, baseline)
+}
+
+func TestRegenerateCancellationKeepsPlaylist(t *testing.T) {
+	t.Setenv("M3U_URL_1", "file://"+writeTestPlaylist(t, 10))
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	store.RegenerateM3U(context.Background())
+	expected := readCachedPlaylist(t)
+
+	// A larger playlist whose sync gets cancelled
+	t.Setenv("M3U_URL_1", "file://"+writeTestPlaylist(t, 20))
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.RegenerateM3U(ctx)
+
+	if got := readCachedPlaylist(t); got != expected {
+		t.Errorf("Cancelled regeneration replaced the playlist:\n%s", got)
+	}
+
+	channels, err := store.QueryChannels(store.ChannelQuery{})
+	if err != nil {
+		t.Fatalf("Error querying channels: %v", err)
+	}
+	if len(channels) != 10 {
+		t.Errorf("Expected the 10 channels of the previous sync, got %d", len(channels))
+	}
+}
+
+func readCachedPlaylist(t *testing.T) string {
+	t.Helper()
+
+	playlist, err := store.OpenCachedM3U()
+	if err != nil {
+		t.Fatalf("Error opening playlist: %v", err)
+	}
+	defer playlist.Close()
+
+	content, err := io.ReadAll(playlist.Reader())
+	if err != nil {
+		t.Fatalf("Error reading playlist: %v", err)
+	}
+	return string(content)
+}
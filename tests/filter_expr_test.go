@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"m3u-stream-merger/store"
+	"testing"
+)
+
+func TestFilterExpr(t *testing.T) {
+	sports := store.StreamInfo{Title: "ESPN HD", Group: "US Sports", TvgID: "espn.us"}
+	ppv := store.StreamInfo{Title: "UFC PPV 1", Group: "US Sports", TvgID: "ufc.us"}
+	cnn := store.StreamInfo{Title: "CNN", Group: "News", TvgID: "cnn.us"}
+	movie := store.StreamInfo{Title: "Movie", Group: "VOD", Attributes: map[string]string{"tvg-type": "movie"}}
+
+	cases := []struct {
+		expr    string
+		matches []store.StreamInfo
+		rejects []store.StreamInfo
+	}{
+		{
+			// && binds tighter than ||
+			expr:    `group =~ "Sports" && title !~ "PPV" || tvg-id == "cnn.us"`,
+			matches: []store.StreamInfo{sports, cnn},
+			rejects: []store.StreamInfo{ppv, movie},
+		},
+		{
+			expr:    `tvg-id == "cnn.us" || group =~ "Sports" && title !~ "PPV"`,
+			matches: []store.StreamInfo{sports, cnn},
+			rejects: []store.StreamInfo{ppv, movie},
+		},
+		{
+			expr:    `group =~ "Sports" && (title !~ "PPV" || tvg-id == "ufc.us")`,
+			matches: []store.StreamInfo{sports, ppv},
+			rejects: []store.StreamInfo{cnn, movie},
+		},
+		{
+			// ! binds tighter than &&
+			expr:    `!group == "News" && !title =~ "^UFC"`,
+			matches: []store.StreamInfo{sports, movie},
+			rejects: []store.StreamInfo{ppv, cnn},
+		},
+		{
+			expr:    `!(group == "News" || group == "VOD")`,
+			matches: []store.StreamInfo{sports, ppv},
+			rejects: []store.StreamInfo{cnn, movie},
+		},
+		{
+			expr:    `tvg-type == 'movie'`,
+			matches: []store.StreamInfo{movie},
+			rejects: []store.StreamInfo{sports, cnn},
+		},
+		{
+			expr:    `title =~ "\d$" && group != "News"`,
+			matches: []store.StreamInfo{ppv},
+			rejects: []store.StreamInfo{sports, cnn},
+		},
+	}
+
+	for _, c := range cases {
+		expr, err := store.ParseFilterExpr(c.expr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.expr, err)
+		}
+		for _, stream := range c.matches {
+			if !expr.Match(stream) {
+				t.Errorf("%s: expected %q to match", c.expr, stream.Title)
+			}
+		}
+		for _, stream := range c.rejects {
+			if expr.Match(stream) {
+				t.Errorf("%s: expected %q not to match", c.expr, stream.Title)
+			}
+		}
+	}
+}
+
+func TestFilterExprErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`group`,
+		`group ==`,
+		`group == "News" &&`,
+		`(group == "News"`,
+		`group == "News")`,
+		`group =~ "("`,
+		`group == "unterminated`,
+		`group < "a"`,
+		`group == "a" group == "b"`,
+	}
+
+	for _, expr := range invalid {
+		if _, err := store.ParseFilterExpr(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"m3u-stream-merger/proxy"
+	"m3u-stream-merger/store"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseExtInf(t *testing.T) {
+	cases := []struct {
+		line  string
+		title string
+		attrs map[string]string
+	}{
+		{
+			line:  `#EXTINF:-1 tvg-id="cnn.us" tvg-name="CNN" group-title="News",CNN HD`,
+			title: "CNN HD",
+			attrs: map[string]string{"tvg-id": "cnn.us", "tvg-name": "CNN", "group-title": "News"},
+		},
+		{
+			line:  `#EXTINF:-1 group-title="Sports, US" tvg-name="ESPN",ESPN, Live`,
+			title: "ESPN, Live",
+			attrs: map[string]string{"group-title": "Sports, US", "tvg-name": "ESPN"},
+		},
+		{
+			line:  `#EXTINF:-1 tvg-name="He said \"hi\"" tvg-logo='http://logo/a.png',Quoted`,
+			title: "Quoted",
+			attrs: map[string]string{"tvg-name": `He said "hi"`, "tvg-logo": "http://logo/a.png"},
+		},
+		{
+			line:  `#EXTINF:-1 tvg-chno=5 tvg-name="Fox%20News",`,
+			title: "",
+			attrs: map[string]string{"tvg-chno": "5", "tvg-name": "Fox%20News"},
+		},
+		{
+			line:  `#EXTINF:-1 stray tvg-id="x" group-title="unterminated`,
+			title: "",
+			attrs: map[string]string{"tvg-id": "x", "group-title": "unterminated"},
+		},
+	}
+
+	for _, c := range cases {
+		extInf := store.ParseExtInf(c.line)
+		if extInf.Title != c.title {
+			t.Errorf("%s: expected title %q, got %q", c.line, c.title, extInf.Title)
+		}
+		for key, value := range c.attrs {
+			if got := extInf.Get(key); got != value {
+				t.Errorf("%s: expected %s=%q, got %q", c.line, key, value, got)
+			}
+		}
+	}
+}
+
+func TestM3UScannerLineHandling(t *testing.T) {
+	content := "\ufeff#EXTM3U\r\n" +
+		"#EXTINF:-1,CRLF\r\nhttp://example.com/crlf.ts\r\n" +
+		"\ufeff#EXTINF:-1,BOM\rhttp://example.com/bom.ts\r" +
+		"#EXTINF:-1,Spaces\n\nhttp://example.com/my stream.ts\n" +
+		"#EXTINF:-1,Dropped\n" +
+		"#EXTINF:-1,Invalid\n://no-scheme\n" +
+		"http://example.com/orphan.ts\n" +
+		"#EXTINF:-1,Trailing\n"
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("M3U_URL_1", "file://"+path)
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	urls := make(map[string]string)
+	err := store.M3UScanner(context.Background(), "1", func(stream store.StreamInfo) {
+		for _, innerMap := range stream.URLs {
+			for _, streamURL := range innerMap {
+				urls[stream.Title] = streamURL
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Scanner returned error: %v", err)
+	}
+
+	expected := map[string]string{
+		"CRLF":   "http://example.com/crlf.ts",
+		"BOM":    "http://example.com/bom.ts",
+		"Spaces": "http://example.com/my%20stream.ts",
+	}
+	if len(urls) != len(expected) {
+		t.Errorf("Expected %d streams, got %v", len(expected), urls)
+	}
+	for title, streamURL := range expected {
+		if urls[title] != streamURL {
+			t.Errorf("Expected %s for %s, got %q", streamURL, title, urls[title])
+		}
+	}
+
+	stats := store.GetParseStats([]string{"1"})["1"]
+	if stats != (store.ParseStats{Entries: 3, Skipped: 3, Invalid: 1}) {
+		t.Errorf("Unexpected parse stats: %+v", stats)
+	}
+}
+
+func TestM3UScannerInterleavedLines(t *testing.T) {
+	content := "#EXTM3U\n" +
+		"#EXT-X-SESSION-DATA:DATA-ID=\"com.example.title\",VALUE=\"Example\"\n" +
+		"#EXTINF:-1 tvg-id=\"wrapped.us\"\n" +
+		"  tvg-logo=\"http://example.com/logo.png\"\n" +
+		"  group-title=\"News\",Wrapped\n" +
+		"#EXT-X-SESSION-KEY:METHOD=NONE\n" +
+		"# a comment\n" +
+		"http://example.com/wrapped.ts\n" +
+		"#EXTINF:-1 group-title=\"Sports\",Interleaved\n" +
+		"#EXTVLCOPT:http-user-agent=Test\n" +
+		"#EXT-X-SESSION-DATA:DATA-ID=\"x\"\n" +
+		"http://example.com/interleaved.ts\n"
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("M3U_URL_1", "file://"+path)
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	streams := make(map[string]store.StreamInfo)
+	err := store.M3UScanner(context.Background(), "1", func(stream store.StreamInfo) {
+		streams[stream.Title] = stream
+	})
+	if err != nil {
+		t.Fatalf("Scanner returned error: %v", err)
+	}
+
+	wrapped, ok := streams["Wrapped"]
+	if !ok || wrapped.TvgID != "wrapped.us" || wrapped.LogoURL != "http://example.com/logo.png" || wrapped.Group != "News" {
+		t.Errorf("Expected the wrapped #EXTINF attributes to be joined, got %+v", wrapped)
+	}
+	interleaved, ok := streams["Interleaved"]
+	if !ok || interleaved.Group != "Sports" || len(interleaved.VLCOpts) != 1 {
+		t.Errorf("Expected the interleaved entry with its directive, got %+v", interleaved)
+	}
+
+	stats := store.GetParseStats([]string{"1"})["1"]
+	if stats != (store.ParseStats{Entries: 2}) {
+		t.Errorf("Unexpected parse stats: %+v", stats)
+	}
+}
+
+func FuzzParseExtInf(f *testing.F) {
+	f.Add(`#EXTINF:-1 tvg-id="cnn.us" tvg-name="CNN" group-title="News",CNN HD`)
+	f.Add(`#EXTINF:-1 group-title="Sports, US",ESPN, Live`)
+	f.Add(`#EXTINF:-1 tvg-name="a \"b\" \\",c`)
+	f.Add(`#EXTINF:0 a='b' c=d ,`)
+	f.Add(`#EXTINF:`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		extInf := store.ParseExtInf(line)
+
+		if extInf.Title != strings.TrimSpace(extInf.Title) {
+			t.Errorf("title not trimmed: %q", extInf.Title)
+		}
+		for _, attr := range extInf.Attributes {
+			if attr.Key == "" || strings.ContainsAny(attr.Key, " \t,=\"'") {
+				t.Errorf("invalid attribute key: %q", attr.Key)
+			}
+		}
+	})
+}
+
+func FuzzExtInfRoundTrip(f *testing.F) {
+	f.Add("News", "CNN HD")
+	f.Add(`Sports, "US"`, "ESPN, Live")
+	f.Add(`back\slash`, "")
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	f.Fuzz(func(t *testing.T, group string, title string) {
+		if !utf8.ValidString(group) || !utf8.ValidString(title) || strings.ContainsAny(group+title, "\r\n") {
+			t.Skip()
+		}
+
+		line := fmt.Sprintf(`#EXTINF:-1 group-title="%s",%s`, escaper.Replace(group), title)
+		extInf := store.ParseExtInf(line)
+
+		if got := extInf.Get("group-title"); got != strings.TrimSpace(group) {
+			t.Errorf("group-title mismatch: expected %q, got %q", strings.TrimSpace(group), got)
+		}
+		if extInf.Title != strings.TrimSpace(title) {
+			t.Errorf("title mismatch: expected %q, got %q", strings.TrimSpace(title), extInf.Title)
+		}
+	})
+}
+
+func FuzzResolveM3U8Line(f *testing.F) {
+	f.Add("#EXTINF:2.000,")
+	f.Add("seg1.ts")
+	f.Add("../other/seg2.ts?token=abc")
+	f.Add("https://cdn.example.com/seg3.ts")
+	f.Add("   ")
+
+	base, _ := url.Parse("http://provider.example.com/live/channel/index.m3u8")
+
+	f.Fuzz(func(t *testing.T, line string) {
+		result, err := proxy.ResolveM3U8Line(base, line)
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+			if result != line {
+				t.Errorf("tag line modified: %q -> %q", line, result)
+			}
+		case strings.TrimSpace(line) == "":
+			if result != "" {
+				t.Errorf("blank line not dropped: %q", result)
+			}
+		case err != nil:
+			if result != line {
+				t.Errorf("unparseable line modified: %q -> %q", line, result)
+			}
+		default:
+			u, err := url.Parse(result)
+			if err != nil {
+				t.Fatalf("resolved line is not a valid URL: %q (%v)", result, err)
+			}
+			if !u.IsAbs() {
+				t.Errorf("resolved line is not absolute: %q", result)
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"log"
 	"m3u-stream-merger/handlers"
@@ -17,7 +18,7 @@ func TestStreamHandler(t *testing.T) {
 	os.Setenv("M3U_URL_1", "https://gist.githubusercontent.com/sonroyaalmerol/de1c90e8681af040924da5d15c7f530d/raw/06844df09e69ea278060252ca5aa8d767eb4543d/test-m3u.m3u")
 	os.Setenv("INCLUDE_GROUPS_1", "movies")
 
-	err := store.DownloadM3USource("1")
+	err := store.DownloadM3USource(context.Background(), "1")
 	if err != nil {
 		t.Errorf("Downloader returned error: %v", err)
 	}
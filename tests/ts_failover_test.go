@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"m3u-stream-merger/handlers"
+	"m3u-stream-merger/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const tsPacketSize = 188
+
+// Elementary streams of the synthetic channel: one video and two audio
+// tracks, announced by the PAT and PMT.
+var (
+	tsPATPid    uint16 = 0x0000
+	tsPMTPid    uint16 = 0x1000
+	tsVideoPid  uint16 = 0x0100
+	tsAudioPids        = []uint16{0x0101, 0x0102}
+)
+
+// tsPacket returns a 188 byte TS packet of pid whose payload is filled with
+// marker, to tell the sources apart in the output.
+func tsPacket(pid uint16, cc byte, marker byte) []byte {
+	packet := make([]byte, tsPacketSize)
+	packet[0] = 0x47
+	packet[1] = byte(pid>>8) & 0x1f
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | (cc & 0x0f)
+	for i := 4; i < tsPacketSize; i++ {
+		packet[i] = marker
+	}
+	return packet
+}
+
+// multiAudioTS returns a TS stream starting with a PAT and PMT, followed by
+// interleaved video and audio packets.
+func multiAudioTS(packets int, marker byte) []byte {
+	var ts []byte
+	ts = append(ts, tsPacket(tsPATPid, 0, marker)...)
+	ts = append(ts, tsPacket(tsPMTPid, 0, marker)...)
+
+	pids := append([]uint16{tsVideoPid}, tsAudioPids...)
+	for i := 0; i < packets; i++ {
+		ts = append(ts, tsPacket(pids[i%len(pids)], byte(i/len(pids)), marker)...)
+	}
+	return ts
+}
+
+// tsUpstream serves content in chunks of chunkSize bytes, flushing after
+// each, and then closes the connection after writing the first cut bytes of
+// an extra packet.
+func tsUpstream(content []byte, chunkSize int, cut int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.WriteHeader(http.StatusOK)
+
+		for start := 0; start < len(content); start += chunkSize {
+			end := min(start+chunkSize, len(content))
+			if _, err := w.Write(content[start:end]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+
+		if cut > 0 {
+			_, _ = w.Write(tsPacket(tsVideoPid, 0, 0xff)[:cut])
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func writeSourcePlaylist(t *testing.T, url string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "playlist.m3u")
+	content := fmt.Sprintf("#EXTM3U\n#EXTINF:-1 group-title=\"Test\",Multi Audio\n%s/stream.ts\n", url)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// tsPackets splits the output into packets, failing the test if it is not
+// made of whole packets starting with the sync byte.
+func tsPackets(t *testing.T, output []byte) [][]byte {
+	t.Helper()
+
+	if len(output)%tsPacketSize != 0 {
+		t.Fatalf("Output of %d bytes is not made of whole TS packets", len(output))
+	}
+
+	var packets [][]byte
+	for start := 0; start < len(output); start += tsPacketSize {
+		packet := output[start : start+tsPacketSize]
+		if packet[0] != 0x47 {
+			t.Fatalf("Lost TS sync at byte %d", start)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+func tsPid(packet []byte) uint16 {
+	return uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+}
+
+func streamChannel(t *testing.T) []byte {
+	t.Helper()
+
+	streams := store.GetStreams()
+	if len(streams) != 1 {
+		t.Fatalf("Expected 1 channel, got %d", len(streams))
+	}
+
+	req := httptest.NewRequest("GET", store.GenerateStreamURL("", streams[0]), nil)
+	w := httptest.NewRecorder()
+	handlers.StreamHandler(w, req, store.NewConcurrencyManager())
+
+	output, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatalf("Error reading stream: %v", err)
+	}
+	return output
+}
+
+func TestMultiAudioTSPassthrough(t *testing.T) {
+	content := multiAudioTS(300, 0x01)
+
+	// Chunks not aligned to packets, as delivered by most providers
+	upstream := tsUpstream(content, 1000, 0)
+	defer upstream.Close()
+
+	t.Setenv("M3U_URL_1", "file://"+writeSourcePlaylist(t, upstream.URL))
+	t.Setenv("M3U_URL_2", "file://"+writeSourcePlaylist(t, upstream.URL))
+	t.Setenv("STREAM_TIMEOUT", "0")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("MAX_RETRIES", "1")
+	store.ClearSessionStore()
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+	if err := store.DownloadM3USource(context.Background(), "2"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	output := streamChannel(t)
+	if len(output) < len(content) || string(output[:len(content)]) != string(content) {
+		t.Fatalf("Expected the stream to start with the %d bytes of the upstream unchanged, got %d bytes", len(content), len(output))
+	}
+
+	pids := make(map[uint16]int)
+	for _, packet := range tsPackets(t, output) {
+		pids[tsPid(packet)]++
+	}
+	for _, pid := range append([]uint16{tsPATPid, tsPMTPid, tsVideoPid}, tsAudioPids...) {
+		if pids[pid] == 0 {
+			t.Errorf("PID 0x%04x missing from the output", pid)
+		}
+	}
+}
+
+func TestMultiAudioTSFailover(t *testing.T) {
+	// Both sources end mid-packet, the stream fails over from one to the
+	// other.
+	first := tsUpstream(multiAudioTS(90, 0x01), 1000, 100)
+	defer first.Close()
+	second := tsUpstream(multiAudioTS(90, 0x02), 777, 50)
+	defer second.Close()
+
+	t.Setenv("M3U_URL_1", "file://"+writeSourcePlaylist(t, first.URL))
+	t.Setenv("M3U_URL_2", "file://"+writeSourcePlaylist(t, second.URL))
+	t.Setenv("STREAM_TIMEOUT", "0")
+	t.Setenv("STREAM_RECONNECT_ATTEMPTS", "0")
+	t.Setenv("MAX_RETRIES", "1")
+	store.ClearSessionStore()
+
+	if err := store.DownloadM3USource(context.Background(), "1"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+	if err := store.DownloadM3USource(context.Background(), "2"); err != nil {
+		t.Fatalf("Downloader returned error: %v", err)
+	}
+
+	packets := tsPackets(t, streamChannel(t))
+
+	// Every elementary stream of both sources has to make it to the client.
+	pids := make(map[byte]map[uint16]int)
+	for _, packet := range packets {
+		marker := packet[tsPacketSize-1]
+		if marker == 0xff {
+			t.Fatal("Partial packet of a failed source was sent")
+		}
+		if pids[marker] == nil {
+			pids[marker] = make(map[uint16]int)
+		}
+		pids[marker][tsPid(packet)]++
+	}
+
+	for _, marker := range []byte{0x01, 0x02} {
+		for _, pid := range append([]uint16{tsPATPid, tsPMTPid, tsVideoPid}, tsAudioPids...) {
+			if pids[marker][pid] == 0 {
+				t.Errorf("PID 0x%04x of source %d missing from the output", pid, marker)
+			}
+		}
+		for _, pid := range tsAudioPids {
+			if pids[marker][pid] != 30 {
+				t.Errorf("Expected 30 packets of audio PID 0x%04x from source %d, got %d", pid, marker, pids[marker][pid])
+			}
+		}
+	}
+}
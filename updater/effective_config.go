@@ -0,0 +1,193 @@
+package updater
+
+import (
+	"fmt"
+	"m3u-stream-merger/store"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// redactedValue replaces the values of secrets in the effective configuration.
+const redactedValue = "<redacted>"
+
+// ConfigSetting is the effective value of an env, which is its default if
+// the env is not set.
+type ConfigSetting struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Default string `json:"default,omitempty"`
+	Set     bool   `json:"set"`
+}
+
+// SourceConfig is the effective configuration of an M3U source.
+type SourceConfig struct {
+	Index          string          `json:"index"`
+	URL            string          `json:"url"`
+	MaxConcurrency int             `json:"max_concurrency"`
+	Disabled       bool            `json:"disabled"`
+	Overrides      []ConfigSetting `json:"overrides"`
+}
+
+type EffectiveConfig struct {
+	Settings []ConfigSetting `json:"settings"`
+	Sources  []SourceConfig  `json:"sources"`
+}
+
+// configDefaults lists the global envs with the default applied when they are
+// not set. Empty defaults mean the feature is disabled.
+var configDefaults = []struct {
+	key      string
+	fallback string
+}{
+	{"PORT", "8080"}, {"LISTEN_ADDR", ""}, {"TZ", "Etc/UTC"}, {"PATH_PREFIX", ""},
+	{"PUBLIC_URL", ""}, {"BASE_URL", ""}, {"TRUSTED_PROXIES", ""}, {"USER_AGENT", "IPTV Smarters/1.0.3 (iPad; iOS 16.6.1; Scale/2.00)"}, {"USER_AGENT_POOL", ""},
+	{"SYNC_CRON", "0 0 * * *"}, {"SYNC_ON_BOOT", "true"}, {"SYNC_OVERLAP_POLICY", "queue"},
+	{"CACHE_ON_SYNC", "false"}, {"CLEAR_ON_BOOT", "false"}, {"PLAYLIST_STORAGE", "file"},
+	{"REDIS_ADDR", ""}, {"REDIS_PASS", ""}, {"REDIS_DB", "0"},
+	{"DATA_ENCRYPTION_KEY", ""}, {"DATA_ENCRYPTION_KEY_FILE", ""}, {"STRM_EXPORT_DIR", ""},
+	{"M3U_MAX_CONCURRENCY_DEFAULT", "1"}, {"CONCURRENCY_RECONCILE_INTERVAL", "60"}, {"M3U_MAX_SIZE_MB", "0"},
+	{"IP_PREFERENCE", "auto"}, {"TLS_CA_BUNDLE", ""},
+	{"MAX_RETRIES", "5"}, {"RETRY_WAIT", "0"}, {"PROBE_MODE", "direct"}, {"PROBE_CACHE_TTL", "10"},
+	{"PRERESOLVE_TOP_CHANNELS", "0"}, {"FORWARD_QUERY_PARAMS", ""},
+	{"QUALITY_PROBE", "false"}, {"QUALITY_PROBE_SECONDS", "5"}, {"QUALITY_POLICY", "resolution"}, {"FFPROBE_PATH", "ffprobe"},
+	{"QUALITY_ORDER", ""}, {"QUALITY_VARIANTS", "false"},
+	{"CIRCUIT_BREAKER_THRESHOLD", "5"}, {"CIRCUIT_BREAKER_COOLDOWN", "30"},
+	{"STREAM_TIMEOUT", "3"}, {"STREAM_RECONNECT_ATTEMPTS", "1"}, {"STREAM_FAILURE_MODE", "close"},
+	{"OFFLINE_SLATE_PATH", ""}, {"STREAM_RESUME_WINDOW", "30"}, {"STREAM_IDLE_TIMEOUT", "0"},
+	{"STREAM_INITIAL_DATA_TIMEOUT", ""}, {"STREAM_MIN_KBPS", "0"}, {"STREAM_LOW_THROUGHPUT_WINDOW", "10"},
+	{"CLIENT_WRITE_TIMEOUT", "30"}, {"CLIENT_PROBE_INTERVAL", "5"}, {"CLIENT_KEEPALIVE_INTERVAL", "15"}, {"UPSTREAM_DIAL_TIMEOUT", "30"}, {"UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "10"},
+	{"UPSTREAM_RESPONSE_HEADER_TIMEOUT", "0"}, {"HLS_POLL_BACKOFF", "true"},
+	{"UPSTREAM_RESPONSE_HEADERS", ""}, {"UPSTREAM_RESPONSE_HEADERS_DENY", ""},
+	{"STARTUP_BUFFER_SECONDS", "0"}, {"BUFFER_MB", "0"}, {"BUFFER_POOL_MAX_MB", "4"},
+	{"CLIENT_WRITE_BATCH_KB", "0"}, {"BUFFER_MAX_TOTAL_MB", "0"},
+	{"SORTING_KEY", "tvg-name"}, {"TITLE_SUBSTR_FILTER", ""}, {"GROUP_ORDER", ""},
+	{"STREAM_URL_EXTENSION", "auto"}, {"STREAM_URL_EXTENSION_GROUPS", ""}, {"LEGACY_STREAM_PATHS", "redirect"},
+	{"SHORT_STREAM_IDS", "false"}, {"PLAYLIST_URL_MODE", "proxy"}, {"DIRECT_URL_GROUPS", ""},
+	{"CORS_ALLOWED_ORIGINS", "*"}, {"CORS_ALLOWED_METHODS", "GET, HEAD, OPTIONS"}, {"CORS_ALLOWED_HEADERS", ""},
+	{"STREAM_ALLOWED_REFERERS", ""}, {"PLAYLIST_RATE_LIMIT", ""}, {"PLAYLIST_RATE_BURST", ""},
+	{"PLAYLIST_RATE_LIMIT_EXEMPT", ""}, {"ADMIN_TOKEN", ""}, {"API_ALLOWED_STREAM_HOSTS", ""},
+	{"FFMPEG_PATH", "ffmpeg"}, {"SNAPSHOT_TIMEOUT", "15"}, {"AUDIO_ONLY_BITRATE", "96k"},
+	{"DEBUG", "false"}, {"SAFE_LOGS", "false"},
+	{"CHAOS_CHANNELS", ""}, {"CHAOS_LATENCY_MS", "0"}, {"CHAOS_FAILURE_RATE", "0"}, {"CHAOS_RESET_AFTER_SECONDS", "0"},
+}
+
+// numberedEnvPrefixes are the envs set once per rule or profile, listed as
+// they are set.
+var numberedEnvPrefixes = []string{
+	"FILTER_EXPR", "INCLUDE_GROUPS", "EXCLUDE_GROUPS", "INCLUDE_TITLE", "EXCLUDE_TITLE",
+	"GROUP_MAX_CONCURRENCY_", "TRANSCODE_PROFILE_",
+}
+
+// isSecretEnv reports whether the value of the env is left out of the
+// effective configuration.
+func isSecretEnv(key string) bool {
+	if strings.HasSuffix(key, "_FILE") {
+		return false
+	}
+	if key == "DATA_ENCRYPTION_KEY" || strings.HasPrefix(key, "M3U_QUERY_PARAMS_") {
+		return true
+	}
+	for _, secret := range []string{"TOKEN", "PASS", "SECRET"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL keeps the scheme and host of a source URL, which usually holds
+// the credentials of the account in its path or query. Local files are kept
+// as-is.
+func redactURL(value string) string {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || u.Host == "" {
+		if strings.HasPrefix(value, "file://") || strings.HasPrefix(value, "dir://") {
+			return value
+		}
+		return redactedValue
+	}
+
+	redacted := u.Scheme + "://" + u.Hostname()
+	if u.Port() != "" {
+		redacted += ":" + u.Port()
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		redacted += "/" + redactedValue
+	}
+	return redacted
+}
+
+func redactEnv(key string, value string) string {
+	switch {
+	case value == "":
+		return ""
+	case strings.Contains(key, "URL") && key != "PLAYLIST_URL_MODE":
+		return redactURL(value)
+	case isSecretEnv(key):
+		return redactedValue
+	}
+	return value
+}
+
+func configSetting(key string, fallback string) ConfigSetting {
+	value, set := os.LookupEnv(key)
+	if !set {
+		value = fallback
+	}
+	return ConfigSetting{Key: key, Value: redactEnv(key, value), Default: fallback, Set: set}
+}
+
+// GetEffectiveConfig returns the configuration the proxy runs with: every
+// global env with its default applied, the rules and profiles that are set
+// and the settings of every source. Secrets and the credentials in source
+// URLs are redacted, so it can be shared in bug reports.
+func GetEffectiveConfig() EffectiveConfig {
+	config := EffectiveConfig{Settings: []ConfigSetting{}, Sources: []SourceConfig{}}
+
+	for _, env := range configDefaults {
+		config.Settings = append(config.Settings, configSetting(env.key, env.fallback))
+	}
+
+	var numbered []string
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		for _, prefix := range numberedEnvPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				numbered = append(numbered, key)
+				break
+			}
+		}
+	}
+	sort.Strings(numbered)
+	for _, key := range numbered {
+		config.Settings = append(config.Settings, configSetting(key, ""))
+	}
+
+	for _, idx := range sortedM3UIndexes() {
+		source := SourceConfig{
+			Index:          idx,
+			URL:            redactURL(os.Getenv(fmt.Sprintf("M3U_URL_%s", idx))),
+			MaxConcurrency: store.MaxConcurrency(idx),
+			Disabled:       store.IsSourceDisabled(idx),
+			Overrides:      []ConfigSetting{},
+		}
+
+		var overrides []string
+		for _, env := range os.Environ() {
+			key, _, _ := strings.Cut(env, "=")
+			if strings.HasPrefix(key, "M3U_") && strings.HasSuffix(key, "_"+idx) && key != "M3U_URL_"+idx {
+				overrides = append(overrides, key)
+			}
+		}
+		sort.Strings(overrides)
+		for _, key := range overrides {
+			source.Overrides = append(source.Overrides, configSetting(key, ""))
+		}
+
+		config.Sources = append(config.Sources, source)
+	}
+
+	return config
+}
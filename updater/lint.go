@@ -0,0 +1,85 @@
+package updater
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"m3u-stream-merger/store"
+	"net/url"
+	"strings"
+)
+
+// LintPlaylist parses an M3U playlist like the syncs do and reports the
+// entries that would be dropped or merged unexpectedly, by line. It returns
+// the number of entries found.
+func LintPlaylist(r io.Reader) (int, []ConfigIssue) {
+	var issues []ConfigIssue
+	addIssue := func(severity string, line int, format string, args ...any) {
+		issues = append(issues, ConfigIssue{Severity: severity, Key: fmt.Sprintf("line %d", line), Message: fmt.Sprintf(format, args...)})
+	}
+
+	scanner := bufio.NewScanner(r)
+	// Same limit as the parser of the syncs.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	entries := 0
+	lineNumber := 0
+	extInfLine := 0
+	extInf := ""
+	first := true
+	urls := make(map[string]int)
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+		if first && !strings.HasPrefix(line, "#EXTM3U") {
+			addIssue(SeverityWarning, lineNumber, "missing #EXTM3U header")
+		}
+		first = false
+
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if extInfLine != 0 {
+				addIssue(SeverityError, extInfLine, "#EXTINF has no URL, the entry is dropped")
+			}
+			extInfLine = lineNumber
+			extInf = line
+		case strings.HasPrefix(line, "#"):
+		case extInfLine != 0 && store.ContinuesExtInf(extInf, line):
+			extInf += " " + line
+		default:
+			if extInfLine == 0 {
+				addIssue(SeverityWarning, lineNumber, "URL without #EXTINF, it is ignored")
+				continue
+			}
+			if parsed := store.ParseExtInf(extInf); parsed.Title == "" && parsed.Get("tvg-name") == "" {
+				addIssue(SeverityError, extInfLine, "entry has no title (after the comma or as tvg-name)")
+			}
+			extInfLine = 0
+			entries++
+
+			if streamURL, err := url.Parse(line); err != nil || streamURL.Scheme == "" || streamURL.Host == "" {
+				addIssue(SeverityError, lineNumber, "invalid URL")
+			} else if first, ok := urls[line]; ok {
+				addIssue(SeverityWarning, lineNumber, "URL already listed on line %d", first)
+			} else {
+				urls[line] = lineNumber
+			}
+		}
+	}
+
+	if extInfLine != 0 {
+		addIssue(SeverityError, extInfLine, "#EXTINF has no URL, the entry is dropped")
+	}
+	if err := scanner.Err(); err != nil {
+		addIssue(SeverityError, lineNumber+1, "error reading playlist: %v", err)
+	}
+	if entries == 0 {
+		addIssue(SeverityError, lineNumber, "no entries found")
+	}
+
+	return entries, issues
+}
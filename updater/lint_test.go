@@ -0,0 +1,50 @@
+package updater
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLintPlaylist(t *testing.T) {
+	playlist := strings.Join([]string{
+		"#EXTINF:-1 group-title=\"Live\",Live",
+		"http://provider/live/1.ts",
+		"#EXTINF:-1 tvg-id=\"untitled\"",
+		"http://provider/live/2.ts",
+		"http://provider/live/3.ts",
+		"#EXTINF:-1,Relative",
+		"live/4.ts",
+		"#EXTINF:-1,Copy",
+		"http://provider/live/1.ts",
+		"#EXTINF:-1,Missing",
+		"",
+	}, "\n")
+
+	entries, issues := LintPlaylist(strings.NewReader(playlist))
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.String())
+	}
+	expected := []string{
+		"[WARNING] line 1: missing #EXTM3U header",
+		"[ERROR] line 3: entry has no title (after the comma or as tvg-name)",
+		"[WARNING] line 5: URL without #EXTINF, it is ignored",
+		"[ERROR] line 7: invalid URL",
+		"[WARNING] line 9: URL already listed on line 2",
+		"[ERROR] line 10: #EXTINF has no URL, the entry is dropped",
+	}
+	if entries != 4 || !slices.Equal(got, expected) {
+		t.Errorf("Expected 4 entries with the issues %q, got %d with %q", expected, entries, got)
+	}
+
+	entries, issues = LintPlaylist(strings.NewReader("#EXTM3U\n#EXTINF:-1,Live\nhttp://provider/live/1.ts\n"))
+	if entries != 1 || len(issues) > 0 {
+		t.Errorf("Expected a valid playlist, got %d entries with %v", entries, issues)
+	}
+
+	entries, issues = LintPlaylist(strings.NewReader("#EXTM3U\n#EXTINF:-1 tvg-id=\"live\"\n  group-title=\"Live\",Live\n#EXT-X-SESSION-DATA:DATA-ID=\"x\"\nhttp://provider/live/1.ts\n"))
+	if entries != 1 || len(issues) > 0 {
+		t.Errorf("Expected a wrapped #EXTINF line to be valid, got %d entries with %v", entries, issues)
+	}
+}
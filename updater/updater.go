@@ -2,11 +2,18 @@ package updater
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"m3u-stream-merger/proxy"
 	"m3u-stream-merger/store"
 	"m3u-stream-merger/utils"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/robfig/cron/v3"
 )
@@ -15,6 +22,9 @@ type Updater struct {
 	sync.Mutex
 	ctx  context.Context
 	Cron *cron.Cron
+
+	// queued is set while a sync waits for the running one.
+	queued atomic.Bool
 }
 
 func Initialize(ctx context.Context) (*Updater, error) {
@@ -28,6 +38,12 @@ func Initialize(ctx context.Context) (*Updater, error) {
 		store.ClearCache()
 	}
 
+	// The channels of the Redis-backed versions are served until the first
+	// sync completed.
+	if err := store.MigrateRedis(ctx); err != nil {
+		utils.SafeLogf("Error migrating channels from Redis: %v\n", err)
+	}
+
 	cronSched := os.Getenv("SYNC_CRON")
 	if len(strings.TrimSpace(cronSched)) == 0 {
 		utils.SafeLogln("SYNC_CRON not initialized. Defaulting to 0 0 * * * (12am every day).")
@@ -48,6 +64,11 @@ func Initialize(ctx context.Context) (*Updater, error) {
 	}
 	c.Start()
 
+	go func() {
+		<-ctx.Done()
+		c.Stop()
+	}()
+
 	syncOnBoot := os.Getenv("SYNC_ON_BOOT")
 	if len(strings.TrimSpace(syncOnBoot)) == 0 {
 		syncOnBoot = "true"
@@ -61,54 +82,201 @@ func Initialize(ctx context.Context) (*Updater, error) {
 
 	updateInstance.Cron = c
 
+	updateInstance.WatchLocalDirs(ctx)
+
 	return updateInstance, nil
 }
 
 func (instance *Updater) UpdateSources(ctx context.Context) {
+	instance.runSync(ctx, utils.GetM3UIndexes())
+}
+
+// UpdateSource re-fetches a single source without touching the others.
+func (instance *Updater) UpdateSource(ctx context.Context, idx string) {
+	instance.runSync(ctx, []string{idx})
+}
+
+// acquire takes the run lock following SYNC_OVERLAP_POLICY. With "queue" (the
+// default) a sync waits for the running one, with at most one sync waiting.
+// With "skip" it gives up right away.
+func (instance *Updater) acquire() bool {
+	if instance.TryLock() {
+		return true
+	}
+
+	if strings.ToLower(strings.TrimSpace(os.Getenv("SYNC_OVERLAP_POLICY"))) == "skip" {
+		return false
+	}
+
+	// The waiting sync fetches every source again, further ones are
+	// redundant.
+	if !instance.queued.CompareAndSwap(false, true) {
+		return false
+	}
+	instance.Lock()
+	instance.queued.Store(false)
+
+	return true
+}
+
+// SyncOnce fetches every source and refreshes the store without scheduling
+// further syncs, e.g. for the sync command.
+func SyncOnce(ctx context.Context) store.SyncRun {
+	instance := &Updater{ctx: ctx}
+	return instance.runSync(ctx, utils.GetM3UIndexes())
+}
+
+// runSync fetches the given sources and refreshes the store, recording the
+// run in the sync history. The run is returned as recorded.
+func (instance *Updater) runSync(ctx context.Context, indexes []string) (run store.SyncRun) {
 	debug := os.Getenv("DEBUG") == "true"
 
+	run = store.SyncRun{
+		Start:   time.Now(),
+		Sources: indexes,
+		Status:  store.SyncCompleted,
+	}
+	var runErrs []string
+	var errsMu sync.Mutex
+	addErr := func(err error) {
+		errsMu.Lock()
+		runErrs = append(runErrs, err.Error())
+		errsMu.Unlock()
+	}
+
+	defer func() {
+		run.End = time.Now()
+		run.DurationSeconds = run.End.Sub(run.Start).Seconds()
+		run.Errors = runErrs
+		if run.Status == store.SyncCompleted && len(runErrs) > 0 {
+			run.Status = store.SyncFailed
+		}
+		store.RecordSyncRun(run)
+	}()
+
 	// Ensure only one job is running at a time
-	instance.Lock()
+	if !instance.acquire() {
+		utils.SafeLogln("Background process: A sync is already running, skipping this one.")
+		run.Status = store.SyncSkipped
+		return
+	}
 	defer instance.Unlock()
+	defer store.TrackSyncProgress()()
+
+	// A queued sync starts once it gets the lock.
+	run.Start = time.Now()
+
+	// Sources in maintenance mode keep their last fetched playlist.
+	indexes = slices.DeleteFunc(slices.Clone(indexes), func(idx string) bool {
+		if store.IsSourceDisabled(idx) {
+			utils.SafeLogf("Background process: Skipping M3U_URL_%s: source is disabled\n", idx)
+			return true
+		}
+		return false
+	})
+	run.Sources = indexes
 
 	select {
 	case <-ctx.Done():
+		run.Status = store.SyncCancelled
 		return
 	default:
 		utils.SafeLogln("Background process: Checking M3U_URLs...")
+		store.StartSyncPhase(store.SyncPhaseFetching, len(indexes))
 		var wg sync.WaitGroup
 
-		indexes := utils.GetM3UIndexes()
 		for _, idx := range indexes {
 			utils.SafeLogf("Background process: Fetching M3U_URL_%s...\n", idx)
 			wg.Add(1)
 			// Start the goroutine for periodic updates
 			go func(idx string) {
 				defer wg.Done()
-				err := store.DownloadM3USource(idx)
-				if err != nil && debug {
-					utils.SafeLogf("Background process: Error fetching M3U_URL_%s: %v\n", idx, err)
+				defer store.SyncSourceDone()
+				err := store.DownloadM3USource(ctx, idx)
+				if err != nil {
+					if debug {
+						utils.SafeLogf("Background process: Error fetching M3U_URL_%s: %v\n", idx, err)
+					}
+					addErr(fmt.Errorf("M3U_URL_%s: %v", idx, err))
 				}
 			}(idx)
 		}
 		wg.Wait()
 
+		if ctx.Err() != nil {
+			utils.SafeLogln("Background process: M3U fetching cancelled.")
+			run.Status = store.SyncCancelled
+			return
+		}
+
 		utils.SafeLogf("Background process: M3U fetching complete.\n")
 
-		store.ClearSessionStore()
+		channels, err := refreshStore(ctx)
+		if err != nil {
+			addErr(err)
+		}
+		if ctx.Err() != nil {
+			run.Status = store.SyncCancelled
+			run.Channels = channels
+			return
+		}
+		run.Channels = channels
+		if channels > 0 {
+			run.Parse = store.GetParseStats(indexes)
+		}
+
+		// The most watched channels are opened right after a sync or
+		// restart, their sources are probed ahead of time.
+		if top, err := strconv.Atoi(strings.TrimSpace(os.Getenv("PRERESOLVE_TOP_CHANNELS"))); err == nil && top > 0 {
+			utils.SafeLogf("Background process: Pre-resolving the %d most watched channels...\n", top)
+			proxy.PreresolveChannels(ctx, store.PopularChannels(top))
+		}
+	}
+
+	return
+}
+
+// refreshStore applies the fetched sources. The number of channels is
+// returned if they were rebuilt.
+func refreshStore(ctx context.Context) (int, error) {
+	var errs []error
+
+	store.ClearSessionStore()
+
+	cacheOnSync := os.Getenv("CACHE_ON_SYNC")
+	if len(strings.TrimSpace(cacheOnSync)) == 0 {
+		cacheOnSync = "false"
+	}
+
+	channels := 0
 
-		cacheOnSync := os.Getenv("CACHE_ON_SYNC")
-		if len(strings.TrimSpace(cacheOnSync)) == 0 {
-			cacheOnSync = "false"
+	utils.SafeLogln("Background process: Updated M3U store.")
+	if cacheOnSync == "true" {
+		utils.SafeLogln("CACHE_ON_SYNC enabled. Building cache.")
+		if err := store.RegenerateM3U(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("building cache: %v", err))
 		}
 
-		utils.SafeLogln("Background process: Updated M3U store.")
-		if cacheOnSync == "true" {
-			if _, ok := os.LookupEnv("BASE_URL"); !ok {
-				utils.SafeLogln("BASE_URL is required for CACHE_ON_SYNC to work.")
-			}
-			utils.SafeLogln("CACHE_ON_SYNC enabled. Building cache.")
-			_ = store.RevalidatingGetM3U(nil, true)
+		count, err := store.ChannelCount()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("counting channels: %v", err))
 		}
+		channels = count
 	}
+
+	if strmDir := os.Getenv("STRM_EXPORT_DIR"); strings.TrimSpace(strmDir) != "" {
+		baseURL := utils.DetermineBaseURL(nil)
+		if baseURL == "" {
+			utils.SafeLogln("PUBLIC_URL or BASE_URL is required for STRM_EXPORT_DIR to work.")
+			return channels, errors.Join(errs...)
+		}
+
+		utils.SafeLogf("STRM_EXPORT_DIR enabled. Exporting STRM files to %s.\n", strmDir)
+		if err := store.ExportSTRM(strmDir, baseURL); err != nil {
+			utils.SafeLogf("Error exporting STRM files: %v\n", err)
+			errs = append(errs, fmt.Errorf("exporting STRM files: %v", err))
+		}
+	}
+
+	return channels, errors.Join(errs...)
 }
@@ -0,0 +1,321 @@
+package updater
+
+import (
+	"fmt"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+type ConfigIssue struct {
+	Severity string `json:"severity"`
+	Key      string `json:"key"`
+	Message  string `json:"message"`
+}
+
+func (issue ConfigIssue) String() string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(issue.Severity), issue.Key, issue.Message)
+}
+
+// sortedM3UIndexes returns the indexes of the configured sources in numeric
+// order.
+func sortedM3UIndexes() []string {
+	indexes := append([]string(nil), utils.GetM3UIndexes()...)
+	sort.Slice(indexes, func(i, j int) bool {
+		a, errA := strconv.Atoi(indexes[i])
+		b, errB := strconv.Atoi(indexes[j])
+		if errA != nil || errB != nil {
+			return indexes[i] < indexes[j]
+		}
+		return a < b
+	})
+	return indexes
+}
+
+// HasConfigErrors reports whether any of the issues prevents the proxy from
+// working.
+func HasConfigErrors(issues []ConfigIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	integerEnvs = []string{
+		"BUFFER_MB", "STREAM_TIMEOUT", "MAX_RETRIES", "M3U_MAX_SIZE_MB",
+		"BUFFER_MAX_TOTAL_MB", "BUFFER_POOL_MAX_MB", "CLIENT_WRITE_BATCH_KB",
+		"STREAM_IDLE_TIMEOUT", "STREAM_RECONNECT_ATTEMPTS", "STREAM_INITIAL_DATA_TIMEOUT",
+		"UPSTREAM_DIAL_TIMEOUT", "UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "UPSTREAM_RESPONSE_HEADER_TIMEOUT",
+		"CIRCUIT_BREAKER_THRESHOLD", "CIRCUIT_BREAKER_COOLDOWN",
+		"STREAM_MIN_KBPS", "STREAM_LOW_THROUGHPUT_WINDOW", "CLIENT_WRITE_TIMEOUT",
+		"CHAOS_LATENCY_MS", "CHAOS_RESET_AFTER_SECONDS", "STREAM_RESUME_WINDOW", "PROBE_CACHE_TTL",
+		"PRERESOLVE_TOP_CHANNELS", "SNAPSHOT_TIMEOUT", "PLAYLIST_RATE_BURST", "M3U_MAX_CONCURRENCY_DEFAULT",
+		"CONCURRENCY_RECONCILE_INTERVAL", "CLIENT_PROBE_INTERVAL", "CLIENT_KEEPALIVE_INTERVAL",
+		"QUALITY_PROBE_SECONDS",
+	}
+	booleanEnvs = []string{
+		"DEBUG", "SYNC_ON_BOOT", "CLEAR_ON_BOOT", "CACHE_ON_SYNC", "HLS_POLL_BACKOFF", "SHORT_STREAM_IDS",
+		"QUALITY_PROBE",
+	}
+	regexEnvs = []string{
+		"INCLUDE_GROUPS", "EXCLUDE_GROUPS", "INCLUDE_TITLE", "EXCLUDE_TITLE",
+	}
+)
+
+// ValidateConfig checks the environment configuration and, if probeSources
+// is set, fetches the head of every M3U source. The URLs in the messages are
+// redacted, as source URLs usually hold credentials.
+func ValidateConfig(probeSources bool) []ConfigIssue {
+	var issues []ConfigIssue
+	addIssue := func(severity string, key string, format string, args ...any) {
+		message := utils.RedactURLs(fmt.Sprintf(format, args...))
+		issues = append(issues, ConfigIssue{Severity: severity, Key: key, Message: message})
+	}
+
+	indexes := sortedM3UIndexes()
+
+	if len(indexes) == 0 {
+		addIssue(SeverityError, "M3U_URL_1", "no M3U source configured")
+	}
+
+	numbered := make(map[int]bool)
+	for _, idx := range indexes {
+		key := "M3U_URL_" + idx
+		number, err := strconv.Atoi(idx)
+		if err != nil || number <= 0 {
+			addIssue(SeverityWarning, key, "source index should be a positive integer")
+		} else {
+			numbered[number] = true
+		}
+
+		m3uURL := strings.TrimSpace(os.Getenv(key))
+		switch {
+		case m3uURL == "":
+			addIssue(SeverityError, key, "URL is empty")
+			continue
+		case strings.HasPrefix(m3uURL, "file://"):
+			if _, err := os.Stat(strings.TrimPrefix(m3uURL, "file://")); err != nil {
+				addIssue(SeverityError, key, "local file is not accessible: %v", err)
+				continue
+			}
+		case store.IsLocalDirSource(m3uURL):
+			if info, err := os.Stat(store.LocalDirPath(m3uURL)); err != nil || !info.IsDir() {
+				addIssue(SeverityError, key, "local directory is not accessible")
+				continue
+			}
+		default:
+			u, err := url.Parse(m3uURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				addIssue(SeverityError, key, "not a valid http(s)://, file:// or dir:// URL")
+				continue
+			}
+		}
+
+		if value, ok := os.LookupEnv("M3U_MAX_CONCURRENCY_" + idx); ok {
+			if concurrency, err := strconv.Atoi(strings.TrimSpace(value)); err != nil || concurrency < 0 {
+				addIssue(SeverityError, "M3U_MAX_CONCURRENCY_"+idx, "%q is not a non-negative integer", value)
+			}
+		}
+
+		if value := strings.TrimSpace(os.Getenv("M3U_QUERY_PARAMS_" + idx)); value != "" {
+			if _, err := url.ParseQuery(value); err != nil {
+				addIssue(SeverityError, "M3U_QUERY_PARAMS_"+idx, "not a valid query string")
+			}
+		}
+
+		if probeSources {
+			if err := store.ProbeM3USource(idx); err != nil {
+				addIssue(SeverityError, key, "source check failed: %v", err)
+			}
+		}
+	}
+
+	for number := 1; number <= len(numbered); number++ {
+		if !numbered[number] {
+			addIssue(SeverityWarning, fmt.Sprintf("M3U_URL_%d", number), "missing; source indexes are not continuous")
+			break
+		}
+	}
+
+	for _, env := range os.Environ() {
+		key, _, _ := strings.Cut(env, "=")
+		if idx, ok := strings.CutPrefix(key, "M3U_MAX_CONCURRENCY_"); ok && idx != "DEFAULT" {
+			if _, exists := os.LookupEnv("M3U_URL_" + idx); !exists {
+				addIssue(SeverityWarning, key, "no matching M3U_URL_%s", idx)
+			}
+		}
+	}
+
+	if cronSched := strings.TrimSpace(os.Getenv("SYNC_CRON")); cronSched != "" {
+		if _, err := cron.ParseStandard(cronSched); err != nil {
+			addIssue(SeverityError, "SYNC_CRON", "invalid cron expression: %v", err)
+		}
+	}
+
+	for _, baseEnv := range regexEnvs {
+		for _, filter := range utils.GetFilters(baseEnv) {
+			if _, err := regexp.Compile(filter); err != nil {
+				addIssue(SeverityError, baseEnv+"_X", "invalid regex %q: %v", filter, err)
+			}
+		}
+	}
+
+	for _, pattern := range strings.Split(os.Getenv("QUALITY_ORDER"), ",") {
+		if _, err := regexp.Compile(strings.TrimSpace(pattern)); err != nil {
+			addIssue(SeverityError, "QUALITY_ORDER", "invalid regex %q: %v", pattern, err)
+		}
+	}
+
+	if exprString := strings.TrimSpace(os.Getenv("FILTER_EXPR")); exprString != "" {
+		if _, err := store.ParseFilterExpr(exprString); err != nil {
+			addIssue(SeverityError, "FILTER_EXPR", "%v", err)
+		}
+	}
+
+	for _, rule := range utils.GetFilters("GROUP_MAP") {
+		match, _, ok := strings.Cut(rule, "=>")
+		if !ok {
+			addIssue(SeverityError, "GROUP_MAP_X", "rule %q is not in the regex=>group format", rule)
+			continue
+		}
+		if _, err := regexp.Compile(strings.TrimSpace(match)); err != nil {
+			addIssue(SeverityError, "GROUP_MAP_X", "invalid regex %q: %v", match, err)
+		}
+	}
+
+	for _, rule := range utils.GetFilters("GROUP_MAX_CONCURRENCY") {
+		match, limit, ok := strings.Cut(rule, "=>")
+		if !ok {
+			addIssue(SeverityError, "GROUP_MAX_CONCURRENCY_X", "rule %q is not in the regex=>limit format", rule)
+			continue
+		}
+		if _, err := regexp.Compile(strings.TrimSpace(match)); err != nil {
+			addIssue(SeverityError, "GROUP_MAX_CONCURRENCY_X", "invalid regex %q: %v", match, err)
+		}
+		if _, err := strconv.Atoi(strings.TrimSpace(limit)); err != nil {
+			addIssue(SeverityError, "GROUP_MAX_CONCURRENCY_X", "limit %q is not an integer", limit)
+		}
+	}
+
+	for _, key := range integerEnvs {
+		if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
+			if _, err := strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				addIssue(SeverityError, key, "%q is not an integer", value)
+			}
+		}
+	}
+
+	for _, key := range booleanEnvs {
+		if value, ok := os.LookupEnv(key); ok && strings.TrimSpace(value) != "" {
+			if value != "true" && value != "false" {
+				addIssue(SeverityWarning, key, "%q is treated as false, expected true/false", value)
+			}
+		}
+	}
+
+	if value := strings.TrimSpace(os.Getenv("CHAOS_FAILURE_RATE")); value != "" {
+		if rate, err := strconv.ParseFloat(value, 64); err != nil || rate < 0 || rate > 1 {
+			addIssue(SeverityError, "CHAOS_FAILURE_RATE", "%q is not a number between 0 and 1", value)
+		}
+	}
+
+	if value := strings.TrimSpace(os.Getenv("CHAOS_CHANNELS")); value != "" {
+		addIssue(SeverityWarning, "CHAOS_CHANNELS", "fault injection is enabled for %q", value)
+	}
+
+	if mode := strings.ToLower(strings.TrimSpace(os.Getenv("PLAYLIST_URL_MODE"))); mode != "" && mode != "proxy" && mode != "direct" {
+		addIssue(SeverityWarning, "PLAYLIST_URL_MODE", "%q is treated as proxy, expected proxy/direct", mode)
+	}
+
+	for _, override := range strings.Split(os.Getenv("STREAM_URL_EXTENSION_GROUPS"), ",") {
+		if override = strings.TrimSpace(override); override != "" && !strings.Contains(override, "=") {
+			addIssue(SeverityError, "STREAM_URL_EXTENSION_GROUPS", "%q is not in the group=extension format", override)
+		}
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("LEGACY_STREAM_PATHS"))); mode {
+	case "", "redirect", "rewrite", "off", "false":
+	default:
+		addIssue(SeverityWarning, "LEGACY_STREAM_PATHS", "%q is treated as redirect, expected redirect/rewrite/off", mode)
+	}
+
+	for _, mode := range strings.Split(os.Getenv("STREAM_FAILURE_MODE"), ",") {
+		switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+		case "", "close", "padding", "slate", "endlist":
+		default:
+			addIssue(SeverityWarning, "STREAM_FAILURE_MODE", "%q is ignored, expected close/padding/slate/endlist", mode)
+		}
+	}
+	switch policy := strings.ToLower(strings.TrimSpace(os.Getenv("QUALITY_POLICY"))); policy {
+	case "", "resolution", "bitrate", "off":
+	default:
+		addIssue(SeverityWarning, "QUALITY_POLICY", "%q is treated as resolution, expected resolution/bitrate/off", policy)
+	}
+	if os.Getenv("QUALITY_PROBE") == "true" {
+		if top, _ := strconv.Atoi(strings.TrimSpace(os.Getenv("PRERESOLVE_TOP_CHANNELS"))); top <= 0 {
+			addIssue(SeverityWarning, "QUALITY_PROBE", "has no effect without PRERESOLVE_TOP_CHANNELS")
+		}
+	}
+	if value := strings.TrimSpace(os.Getenv("PLAYLIST_RATE_LIMIT")); value != "" {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			addIssue(SeverityError, "PLAYLIST_RATE_LIMIT", "%q is not a number", value)
+		}
+	}
+	for _, key := range []string{"PLAYLIST_RATE_LIMIT_EXEMPT", "TRUSTED_PROXIES"} {
+		for _, value := range strings.Split(os.Getenv(key), ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+				addIssue(SeverityWarning, key, "%q is not an IP or CIDR range", value)
+			}
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("DATA_ENCRYPTION_KEY_FILE")); path != "" && os.Getenv("DATA_ENCRYPTION_KEY") == "" {
+		if _, err := os.ReadFile(path); err != nil {
+			addIssue(SeverityError, "DATA_ENCRYPTION_KEY_FILE", "%v", err)
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("OFFLINE_SLATE_PATH")); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			addIssue(SeverityWarning, "OFFLINE_SLATE_PATH", "%v", err)
+		}
+	}
+
+	if _, err := utils.ListenAddr(); err != nil {
+		addIssue(SeverityError, "LISTEN_ADDR", "%v", err)
+	}
+
+	for _, key := range []string{"PUBLIC_URL", "BASE_URL"} {
+		if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+			if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+				addIssue(SeverityError, key, "%q is not an absolute URL", value)
+			}
+		}
+	}
+
+	if tz := os.Getenv("TZ"); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			addIssue(SeverityWarning, "TZ", "unknown time zone: %v", err)
+		}
+	}
+
+	return issues
+}
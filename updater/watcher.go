@@ -0,0 +1,77 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"m3u-stream-merger/store"
+	"m3u-stream-merger/utils"
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce groups bursts of file events (e.g. an export script writing
+// several playlists) into a single resync.
+const watchDebounce = 2 * time.Second
+
+// WatchLocalDirs starts a watcher for every dir:// source which resyncs that
+// source whenever a playlist in its directory changes.
+func (instance *Updater) WatchLocalDirs(ctx context.Context) {
+	for _, idx := range utils.GetM3UIndexes() {
+		m3uURL := os.Getenv(fmt.Sprintf("M3U_URL_%s", idx))
+		if !store.IsLocalDirSource(m3uURL) {
+			continue
+		}
+
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			utils.SafeLogf("Error creating watcher for M3U_URL_%s: %v\n", idx, err)
+			continue
+		}
+
+		dir := store.LocalDirPath(m3uURL)
+		if err := watcher.Add(dir); err != nil {
+			utils.SafeLogf("Error watching %s for M3U_URL_%s: %v\n", dir, idx, err)
+			watcher.Close()
+			continue
+		}
+
+		utils.SafeLogf("Watching %s for changes to M3U_URL_%s.\n", dir, idx)
+		go instance.watchLocalDir(ctx, watcher, idx)
+	}
+}
+
+func (instance *Updater) watchLocalDir(ctx context.Context, watcher *fsnotify.Watcher, idx string) {
+	debug := os.Getenv("DEBUG") == "true"
+	defer watcher.Close()
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !store.IsPlaylistFile(event.Name) || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if debug {
+				utils.SafeLogf("[DEBUG] Playlist change detected for M3U_URL_%s: %s\n", idx, event)
+			}
+			timer.Reset(watchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			utils.SafeLogf("Error watching M3U_URL_%s: %v\n", idx, err)
+		case <-timer.C:
+			instance.UpdateSource(ctx, idx)
+		}
+	}
+}
@@ -22,13 +22,26 @@ func GetEnv(env string) string {
 	}
 }
 
-var m3uIndexes []string
-var m3uIndexesInitialized bool
+var (
+	m3uIndexes            []string
+	m3uIndexesInitialized bool
+	m3uIndexesMutex       sync.RWMutex
+)
 
 func GetM3UIndexes() []string {
+	m3uIndexesMutex.RLock()
 	if m3uIndexesInitialized {
+		defer m3uIndexesMutex.RUnlock()
 		return m3uIndexes
 	}
+	m3uIndexesMutex.RUnlock()
+
+	m3uIndexesMutex.Lock()
+	defer m3uIndexesMutex.Unlock()
+	if m3uIndexesInitialized {
+		return m3uIndexes
+	}
+
 	m3uIndexes = []string{}
 	for _, env := range os.Environ() {
 		pair := strings.SplitN(env, "=", 2)
@@ -41,6 +54,13 @@ func GetM3UIndexes() []string {
 	return m3uIndexes
 }
 
+// resetM3UIndexes makes the next GetM3UIndexes read the sources again.
+func resetM3UIndexes() {
+	m3uIndexesMutex.Lock()
+	defer m3uIndexesMutex.Unlock()
+	m3uIndexesInitialized = false
+}
+
 var (
 	filters            = make(map[string][]string)
 	filtersInitialized = make(map[string]bool)
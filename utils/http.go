@@ -1,17 +1,51 @@
 package utils
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
 )
 
 func CustomHttpRequest(method string, url string) (*http.Response, error) {
+	return CustomHttpRequestWithHeaders(method, url, nil)
+}
+
+// CustomHttpRequestWithHeaders sends the request with additional headers.
+// A User-Agent in headers overrides the USER_AGENT env and pools.
+func CustomHttpRequestWithHeaders(method string, url string, headers http.Header) (*http.Response, error) {
+	return SourceHttpRequest("", method, url, headers)
+}
+
+// SourceHttpRequest sends a request to an M3U source using the TLS and IP
+// family settings of that source.
+func SourceHttpRequest(m3uIndex string, method string, url string, headers http.Header) (*http.Response, error) {
+	return SourceHttpRequestContext(context.Background(), m3uIndex, method, url, headers)
+}
+
+// SourceHttpRequestContext is SourceHttpRequest aborting the request, and
+// reads of the response body, once ctx is done.
+func SourceHttpRequestContext(ctx context.Context, m3uIndex string, method string, url string, headers http.Header) (*http.Response, error) {
+	return SourceHttpRequestWithBody(ctx, m3uIndex, method, url, headers, nil)
+}
+
+// SourceHttpRequestWithBody is SourceHttpRequestContext sending body with the
+// request, e.g. for a POST of a player passed on to the source.
+func SourceHttpRequestWithBody(ctx context.Context, m3uIndex string, method string, url string, headers http.Header, body []byte) (*http.Response, error) {
 	userAgent := GetEnv("USER_AGENT")
+	if ua := sourceUserAgent(ctx, m3uIndex); ua != "" {
+		userAgent = ua
+	}
+	if ua := headers.Get("User-Agent"); ua != "" {
+		userAgent = ua
+	}
 
 	// Create a new HTTP client with a custom User-Agent header
 	client := &http.Client{
+		Transport: SourceTransport(m3uIndex),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// Follow redirects while preserving the custom User-Agent header
 			req.Header.Set("User-Agent", userAgent)
@@ -19,11 +53,19 @@ func CustomHttpRequest(method string, url string) (*http.Response, error) {
 		},
 	}
 
-	req, err := http.NewRequest(method, url, nil)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
 	if err != nil {
 		return nil, err
 	}
 
+	for k, v := range headers {
+		req.Header[k] = v
+	}
 	req.Header.Set("User-Agent", userAgent)
 
 	resp, err := client.Do(req)
@@ -34,18 +76,71 @@ func CustomHttpRequest(method string, url string) (*http.Response, error) {
 	return resp, nil
 }
 
+// PathPrefix returns the normalized PATH_PREFIX (e.g. "/iptv") or an empty
+// string if the proxy is served from the root.
+func PathPrefix() string {
+	prefix := strings.Trim(strings.TrimSpace(os.Getenv("PATH_PREFIX")), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
 func DetermineBaseURL(r *http.Request) string {
+	if customBase, ok := os.LookupEnv("PUBLIC_URL"); ok && strings.TrimSpace(customBase) != "" {
+		return strings.TrimSuffix(strings.TrimSpace(customBase), "/")
+	}
+
 	if customBase, ok := os.LookupEnv("BASE_URL"); ok {
 		return strings.TrimSuffix(customBase, "/")
 	}
 
 	if r != nil {
-		if r.TLS == nil {
-			return fmt.Sprintf("http://%s", r.Host)
-		} else {
-			return fmt.Sprintf("https://%s", r.Host)
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
 		}
+		host := r.Host
+		prefix := PathPrefix()
+
+		if FromTrustedProxy(r) {
+			if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+				scheme = strings.ToLower(proto)
+			}
+			if forwardedHost := firstHeaderValue(r, "X-Forwarded-Host"); forwardedHost != "" {
+				host = forwardedHost
+			}
+			if forwardedPrefix := firstHeaderValue(r, "X-Forwarded-Prefix"); forwardedPrefix != "" {
+				prefix = "/" + strings.Trim(forwardedPrefix, "/")
+			}
+		}
+
+		return fmt.Sprintf("%s://%s%s", scheme, host, strings.TrimSuffix(prefix, "/"))
 	}
 
 	return ""
 }
+
+// firstHeaderValue returns the first value of a possibly comma-separated
+// header set by a chain of reverse proxies.
+func firstHeaderValue(r *http.Request, key string) string {
+	value, _, _ := strings.Cut(r.Header.Get(key), ",")
+	return strings.TrimSpace(value)
+}
+
+// StripPathPrefix serves the handler under PATH_PREFIX. Requests without the
+// prefix are still served for reverse proxies that strip it.
+func StripPathPrefix(h http.Handler) http.Handler {
+	prefix := PathPrefix()
+	if prefix == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.StripPrefix(prefix, h).ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
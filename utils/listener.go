@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListenFD is the first file descriptor passed by systemd socket
+// activation.
+const systemdListenFD = 3
+
+// ListenAddr returns the address the server listens on: LISTEN_ADDR, which
+// may leave out the port (e.g. "127.0.0.1"), with PORT (default 8080).
+func ListenAddr() (string, error) {
+	port := strings.TrimSpace(os.Getenv("PORT"))
+	if port == "" {
+		port = "8080"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("PORT %q is not a valid port number", port)
+	}
+
+	addr := strings.TrimSpace(os.Getenv("LISTEN_ADDR"))
+	if addr == "" {
+		return ":" + port, nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr, nil
+	}
+	// A host or IP without port, IPv6 addresses may be in brackets.
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if strings.ContainsAny(host, "[]/ ") {
+		return "", fmt.Errorf("LISTEN_ADDR %q is not a valid host or host:port address", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// keepAliveListener sets the TCP keep-alive probes of the accepted
+// connections, so the connection of a client gone without closing it (e.g.
+// a TV losing power) breaks after three unanswered probes.
+type keepAliveListener struct {
+	net.Listener
+	config net.KeepAliveConfig
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetKeepAliveConfig(l.config)
+	}
+	return conn, err
+}
+
+// withClientKeepAlive probes idle client connections every
+// CLIENT_KEEPALIVE_INTERVAL seconds (15 by default, 0 disables the probes).
+func withClientKeepAlive(listener net.Listener) net.Listener {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CLIENT_KEEPALIVE_INTERVAL")))
+	if err != nil || seconds < 0 {
+		seconds = 15
+	}
+
+	config := net.KeepAliveConfig{Enable: seconds > 0}
+	if seconds > 0 {
+		interval := time.Duration(seconds) * time.Second
+		config.Idle, config.Interval, config.Count = interval, interval, 3
+	}
+	return keepAliveListener{Listener: listener, config: config}
+}
+
+// Listen returns the listener of the server: the socket passed by systemd
+// socket activation (LISTEN_FDS) if any, a new listener on ListenAddr
+// otherwise. The returned description is for logging.
+func Listen() (net.Listener, string, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		if fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err == nil && fds > 0 {
+			file := os.NewFile(systemdListenFD, "systemd-socket")
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				return nil, "", fmt.Errorf("Error using the socket passed by systemd: %v", err)
+			}
+			return withClientKeepAlive(listener), "systemd socket " + listener.Addr().String(), nil
+		}
+	}
+
+	addr, err := ListenAddr()
+	if err != nil {
+		return nil, "", err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error listening on %s: %v", addr, err)
+	}
+	return withClientKeepAlive(listener), listener.Addr().String(), nil
+}
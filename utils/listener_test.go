@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		port, listenAddr, want string
+	}{
+		{"", "", ":8080"},
+		{"9000", "", ":9000"},
+		{"9000", "127.0.0.1", "127.0.0.1:9000"},
+		{"9000", "[::1]", "[::1]:9000"},
+		{"", "127.0.0.1:9100", "127.0.0.1:9100"},
+	} {
+		t.Setenv("PORT", tc.port)
+		t.Setenv("LISTEN_ADDR", tc.listenAddr)
+		if addr, err := ListenAddr(); err != nil || addr != tc.want {
+			t.Errorf("Expected %s for PORT=%q LISTEN_ADDR=%q, got %s (%v)", tc.want, tc.port, tc.listenAddr, addr, err)
+		}
+	}
+
+	t.Setenv("PORT", "http")
+	t.Setenv("LISTEN_ADDR", "")
+	if _, err := ListenAddr(); err == nil || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("Expected an error naming PORT, got %v", err)
+	}
+}
@@ -8,13 +8,22 @@ import (
 )
 
 func cleanString(text string) string {
-	urlRegex := `[a-zA-Z][a-zA-Z0-9+.-]*:\/\/[a-zA-Z0-9+%/.\-:_?&=#@+]+`
+	// Anything up to a space or a quote, as the userinfo of a URL may be
+	// masked with *** (e.g. in a *url.Error) and its query may hold any
+	// character.
+	urlRegex := `[a-zA-Z][a-zA-Z0-9+.-]*:\/\/[^\s"'<>]+`
 	re := regexp.MustCompile(urlRegex)
 
 	safeString := re.ReplaceAllString(text, "[redacted url]")
 	return safeString
 }
 
+// RedactURLs replaces the URLs in text, e.g. in errors returned to clients,
+// as source URLs usually hold credentials.
+func RedactURLs(text string) string {
+	return cleanString(text)
+}
+
 func safeLog(format string) string {
 	safeLogs := os.Getenv("SAFE_LOGS") == "true"
 	safeString := format
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// RequestID returns the correlation ID of the request of ctx, logged along
+// with the panics of its handler. It is empty outside of RecoverPanics.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the X-Request-ID of a reverse proxy in front of the
+// service, or a new ID.
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); id != "" && len(id) <= 64 && !strings.ContainsAny(id, "\r\n") {
+		return id
+	}
+
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LogPanic logs a recovered panic with its stack trace and the correlation ID
+// of the request it happened in.
+func LogPanic(ctx context.Context, where string, recovered any) {
+	SafeLogf("[ERROR] Panic in %s (request %s): %v\n%s", where, RequestID(ctx), recovered, debug.Stack())
+}
+
+// recoverWriter records whether the response has been started, so a panic
+// is only answered with an error if nothing has been sent yet.
+type recoverWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (rw *recoverWriter) WriteHeader(code int) {
+	rw.started = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recoverWriter) Write(p []byte) (int, error) {
+	rw.started = true
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recoverWriter) Flush() {
+	_ = rw.FlushError()
+}
+
+// FlushError lets http.ResponseController see the errors of flushes, e.g.
+// of clients gone without closing the connection.
+func (rw *recoverWriter) FlushError() error {
+	rw.started = true
+	return http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (rw *recoverWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// RecoverPanics assigns a correlation ID to every request, returned as
+// X-Request-ID, and recovers from the panics of its handler. They are logged
+// with their stack trace and answered with 500, or abort the response if it
+// was already started, without taking the other requests down.
+func RecoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			LogPanic(r.Context(), r.Method+" "+r.URL.Path, recovered)
+			if rw.started {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		h.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	handler := RecoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestID(r.Context()) == "" {
+			t.Error("Expected a request ID in the context")
+		}
+		if r.URL.Query().Has("started") {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		panic("boom")
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", resp.StatusCode)
+	}
+	if id := resp.Header.Get("X-Request-ID"); id != "abc123" {
+		t.Errorf("Expected the X-Request-ID of the request, got %q", id)
+	}
+
+	// A started response is aborted instead, the server keeps serving.
+	resp, err = http.Get(server.URL + "?started")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("Expected the started response to be aborted")
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Server stopped serving after a panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Error("Expected a generated X-Request-ID")
+	}
+}
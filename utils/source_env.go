@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envReference matches the ${VAR} references expanded in source variables.
+// Plain $VAR is left alone as it may be part of a provider URL.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadSourceEnv resolves the source variables (M3U_*) in the environment, so
+// credentials embedded in provider URLs don't have to be in the container
+// configuration:
+//   - M3U_URL_1_FILE=/run/secrets/provider1 sets M3U_URL_1 to the content of
+//     the file, for any M3U_* variable.
+//   - ${VAR} in M3U_* values is replaced by VAR, or by the content of the file
+//     at VAR_FILE.
+//
+// It has to be called before the configuration is read. The returned errors
+// are the variables that could not be resolved.
+func LoadSourceEnv() []error {
+	errs := []error{}
+
+	for _, env := range os.Environ() {
+		key, path, _ := strings.Cut(env, "=")
+		name, ok := strings.CutSuffix(key, "_FILE")
+		if !ok || !strings.HasPrefix(name, "M3U_") {
+			continue
+		}
+		os.Unsetenv(key)
+
+		if os.Getenv(name) != "" {
+			errs = append(errs, fmt.Errorf("%s: ignored as %s is set", key, name))
+			continue
+		}
+		value, err := readEnvFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+			continue
+		}
+		os.Setenv(name, value)
+	}
+
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(key, "M3U_") || !strings.Contains(value, "${") {
+			continue
+		}
+
+		expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			if path, ok := os.LookupEnv(name + "_FILE"); ok {
+				value, err := readEnvFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s_FILE: %v", key, name, err))
+				}
+				return value
+			}
+			errs = append(errs, fmt.Errorf("%s: %s is not set", key, name))
+			return ""
+		})
+		os.Setenv(key, expanded)
+	}
+
+	// The sources may have changed.
+	resetM3UIndexes()
+
+	return errs
+}
+
+// readEnvFile returns the content of a secrets file without the trailing
+// newline most editors add.
+func readEnvFile(path string) (string, error) {
+	content, err := os.ReadFile(strings.TrimSpace(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
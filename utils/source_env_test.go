@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSourceSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "provider1")
+	if err := os.WriteFile(secret, []byte("http://${PROVIDER_HOST}/playlist.m3u\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	host := filepath.Join(dir, "host")
+	if err := os.WriteFile(host, []byte("provider.invalid:8080"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("M3U_URL_1", "")
+	t.Setenv("M3U_URL_1_FILE", secret)
+	t.Setenv("PROVIDER_HOST_FILE", host)
+	t.Setenv("M3U_QUERY_PARAMS_1", "token=${MISSING_TOKEN}")
+	errs := LoadSourceEnv()
+
+	if got, want := os.Getenv("M3U_URL_1"), "http://provider.invalid:8080/playlist.m3u"; got != want {
+		t.Errorf("Expected M3U_URL_1 %s, got %s", want, got)
+	}
+	if _, ok := os.LookupEnv("M3U_URL_1_FILE"); ok {
+		t.Error("Expected M3U_URL_1_FILE to be removed from the environment")
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "MISSING_TOKEN") {
+		t.Errorf("Expected an error for the missing variable, got %v", errs)
+	}
+	if slices.Contains(GetM3UIndexes(), "1_FILE") {
+		t.Errorf("Expected no source for M3U_URL_1_FILE, got %v", GetM3UIndexes())
+	}
+}
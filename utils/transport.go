@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sourceTransports sync.Map
+
+	caPoolOnce sync.Once
+	caPool     *x509.CertPool
+)
+
+// customCAPool returns the system roots with the certificates of TLS_CA_BUNDLE
+// appended, or nil if no bundle is configured.
+func customCAPool() *x509.CertPool {
+	caPoolOnce.Do(func() {
+		bundlePath := strings.TrimSpace(os.Getenv("TLS_CA_BUNDLE"))
+		if bundlePath == "" {
+			return
+		}
+
+		pem, err := os.ReadFile(bundlePath)
+		if err != nil {
+			SafeLogf("Error reading TLS_CA_BUNDLE: %v\n", err)
+			return
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			SafeLogf("No valid certificates found in TLS_CA_BUNDLE: %s\n", bundlePath)
+			return
+		}
+
+		caPool = pool
+	})
+
+	return caPool
+}
+
+// SourceTransport returns the transport shared by all requests to the given
+// M3U source. An empty index returns the transport used for requests not tied
+// to a source.
+func SourceTransport(m3uIndex string) http.RoundTripper {
+	if transport, ok := sourceTransports.Load(m3uIndex); ok {
+		return transport.(http.RoundTripper)
+	}
+
+	transport, _ := sourceTransports.LoadOrStore(m3uIndex, newSourceTransport(m3uIndex))
+	return transport.(http.RoundTripper)
+}
+
+func newSourceTransport(m3uIndex string) http.RoundTripper {
+	insecure := m3uIndex != "" && os.Getenv(fmt.Sprintf("M3U_INSECURE_SKIP_VERIFY_%s", m3uIndex)) == "true"
+	pool := customCAPool()
+	ipPreference := sourceIPPreference(m3uIndex)
+	timeouts, customTimeouts := upstreamTimeouts()
+
+	if !insecure && pool == nil && ipPreference == "" && !customTimeouts {
+		return http.DefaultTransport
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   timeouts.dial,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:            pool,
+		InsecureSkipVerify: insecure,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = timeouts.tlsHandshake
+	transport.ResponseHeaderTimeout = timeouts.responseHeader
+	if ipPreference != "" {
+		transport.DialContext = preferredFamilyDialer(dialer, ipPreference)
+	}
+
+	return transport
+}
+
+type transportTimeouts struct {
+	dial           time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+}
+
+// upstreamTimeouts returns the connection timeouts of upstream requests and
+// whether any of them differs from the defaults of http.DefaultTransport.
+// These only cover establishing the connection and getting the response
+// headers; reading the stream body is bound by STREAM_IDLE_TIMEOUT.
+func upstreamTimeouts() (transportTimeouts, bool) {
+	dial, customDial := secondsEnv("UPSTREAM_DIAL_TIMEOUT", 30*time.Second)
+	tlsHandshake, customTLS := secondsEnv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	responseHeader, customHeader := secondsEnv("UPSTREAM_RESPONSE_HEADER_TIMEOUT", 0)
+
+	return transportTimeouts{
+		dial:           dial,
+		tlsHandshake:   tlsHandshake,
+		responseHeader: responseHeader,
+	}, customDial || customTLS || customHeader
+}
+
+// secondsEnv parses a duration in seconds from the env, returning fallback if
+// it is unset or invalid. 0 disables the timeout.
+func secondsEnv(key string, fallback time.Duration) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+	if err != nil || seconds < 0 {
+		return fallback, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// sourceIPPreference returns the tcp network ("tcp4" or "tcp6") to try first
+// for the source, falling back to IP_PREFERENCE. An empty string keeps the
+// default happy eyeballs dialing.
+func sourceIPPreference(m3uIndex string) string {
+	preference := ""
+	if m3uIndex != "" {
+		preference = os.Getenv(fmt.Sprintf("M3U_IP_PREFERENCE_%s", m3uIndex))
+	}
+	if strings.TrimSpace(preference) == "" {
+		preference = os.Getenv("IP_PREFERENCE")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(preference)) {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	default:
+		return ""
+	}
+}
+
+// preferredFamilyDialer dials the preferred address family first and only
+// falls back to the other one if that fails, so broken AAAA (or A) records do
+// not stall the connection.
+func preferredFamilyDialer(dialer *net.Dialer, preferred string) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	fallback := "tcp6"
+	if preferred == "tcp6" {
+		fallback = "tcp4"
+	}
+
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if network != "tcp" {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		conn, err := dialer.DialContext(ctx, preferred, addr)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+
+		return dialer.DialContext(ctx, fallback, addr)
+	}
+}
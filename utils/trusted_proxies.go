@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// remoteIP returns the address of the peer of r, without its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES, a comma-separated
+// list of the IPs and CIDR ranges of the reverse proxies in front of the
+// server.
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, trusted := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		trusted = strings.TrimSpace(trusted)
+		if _, network, err := net.ParseCIDR(trusted); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if trustedAddr := net.ParseIP(trusted); trustedAddr != nil && trustedAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromTrustedProxy reports whether r was sent by one of TRUSTED_PROXIES. Only
+// their X-Forwarded-* headers are honored, as any client can set them.
+func FromTrustedProxy(r *http.Request) bool {
+	return isTrustedProxy(remoteIP(r))
+}
+
+// ClientIP returns the address of the client of r. Behind TRUSTED_PROXIES it
+// is the last address of X-Forwarded-For not of a trusted proxy, as the
+// addresses before it were set by the client.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync"
+)
+
+type userAgentSessionKey struct{}
+
+// WithUserAgentSession returns a context whose source requests all use the
+// same User-Agent of the pool of their source, e.g. every request made for
+// the stream of a client.
+func WithUserAgentSession(ctx context.Context, session string) context.Context {
+	if session == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, userAgentSessionKey{}, session)
+}
+
+// userAgentPool returns the User-Agents requests to the source rotate
+// through, from M3U_USER_AGENT_POOL_X or else USER_AGENT_POOL, separated by
+// "|" as User-Agents contain commas.
+func userAgentPool(m3uIndex string) []string {
+	value := ""
+	if m3uIndex != "" {
+		value = os.Getenv(fmt.Sprintf("M3U_USER_AGENT_POOL_%s", m3uIndex))
+	}
+	if strings.TrimSpace(value) == "" {
+		value = os.Getenv("USER_AGENT_POOL")
+	}
+
+	var pool []string
+	for _, userAgent := range strings.Split(value, "|") {
+		if userAgent = strings.TrimSpace(userAgent); userAgent != "" {
+			pool = append(pool, userAgent)
+		}
+	}
+	return pool
+}
+
+var userAgentRotation = struct {
+	sync.Mutex
+	next map[string]int
+}{next: make(map[string]int)}
+
+// sourceUserAgent returns the User-Agent of a request to the source from its
+// pool, or an empty string without pool. Requests of a session always get
+// the same one, so a provider sees a stream keep its User-Agent across
+// probes and reconnects. The others, e.g. playlist downloads, take the next
+// one of the pool.
+func sourceUserAgent(ctx context.Context, m3uIndex string) string {
+	pool := userAgentPool(m3uIndex)
+	if len(pool) == 0 {
+		return ""
+	}
+
+	if session, ok := ctx.Value(userAgentSessionKey{}).(string); ok {
+		hash := fnv.New32a()
+		hash.Write([]byte(m3uIndex + "|" + session))
+		return pool[hash.Sum32()%uint32(len(pool))]
+	}
+
+	userAgentRotation.Lock()
+	defer userAgentRotation.Unlock()
+
+	next := userAgentRotation.next[m3uIndex] % len(pool)
+	userAgentRotation.next[m3uIndex] = next + 1
+	return pool[next]
+}